@@ -0,0 +1,111 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Added Token Injection - Insert added tokens at byte positions with zero-width spans
+
+Prompts such as fill-in-the-middle put added tokens (<|fim_prefix|>,
+<|fim_suffix|>, ...) between pieces of a file. AddedTokens.inject splits
+the text at the injection points, tokenizes every piece on its own (no
+token crosses an injection point, as when the prompt is built from
+pieces) and splices the added token IDs in. They get zero-width spans at
+their injection point:
+
+  {'id': 32, 'start_byte': 120, 'end_byte': 120, 'partial': False, 'added': '<|fim_suffix|>'}
+
+so every other token keeps its offsets into the original file and the
+stream still satisfies token_index.TokenIndex (a zero-width token overlaps
+a range only when it sits strictly inside it).
+
+Added tokens are registered per tokenizer: from the vocabulary by default,
+with explicit IDs, or added to the tokenizer with add=True.
+"""
+
+from typing import Dict, Iterable, List, Optional, Tuple
+
+from offset_map import rewritten_offset
+from token_spans import compute_token_spans, encode_source, is_char_boundary
+
+
+class AddedTokens:
+    """Registry of added tokens for one tokenizer, and their injection."""
+
+    def __init__(self, tokenizer):
+        self.tokenizer = tokenizer
+        self._ids: Dict[str, List[int]] = {}
+
+    def register(self, text: str, token_ids: Optional[Iterable[int]] = None, add: bool = False) -> List[int]:
+        """Register an added token; returns its ID(s).
+
+        Without token_ids the token must be in the vocabulary, or is added
+        to the tokenizer as a special token when add is True.
+        """
+        if token_ids is None:
+            token_id = self._vocab_id(text)
+            if token_id is None and add:
+                self.tokenizer.add_tokens([text], special_tokens=True)
+                token_id = self._vocab_id(text)
+            if token_id is None:
+                raise ValueError(f"{text!r} is not in the vocabulary; pass token_ids or add=True")
+            token_ids = [token_id]
+        self._ids[text] = list(token_ids)
+        return self._ids[text]
+
+    def _vocab_id(self, text: str) -> Optional[int]:
+        try:
+            token_id = self.tokenizer.convert_tokens_to_ids(text)
+        except Exception:
+            return None
+        unk = getattr(self.tokenizer, 'unk_token_id', None)
+        if token_id is None or (token_id == unk and text != getattr(self.tokenizer, 'unk_token', None)):
+            return None
+        return token_id
+
+    def __contains__(self, text: str) -> bool:
+        return text in self._ids
+
+    def ids(self, text: str) -> List[int]:
+        if text not in self._ids:
+            raise KeyError(f"Added token not registered: {text}")
+        return self._ids[text]
+
+    def inject(self, text: str, injections: Iterable[Tuple[int, str]],
+               byte_map: Optional[List[int]] = None) -> Dict:
+        """Tokenize text with added tokens at (byte position, token text) points.
+
+        Positions and returned offsets are file offsets when byte_map
+        (source_text) is given. Injections at the same position keep their
+        order. Returns {'ids', 'spans', 'injections'}; each injection lists
+        the indices of its tokens in the stream.
+        """
+        code_bytes = encode_source(text)
+        points = []
+        for order, (pos, token) in enumerate(injections):
+            ids = self.ids(token)
+            text_pos = rewritten_offset(byte_map, pos)
+            if not 0 <= text_pos <= len(code_bytes) or (byte_map is not None and byte_map[text_pos] != pos):
+                raise ValueError(f"Injection point {pos} is outside the text")
+            if not is_char_boundary(code_bytes, text_pos):
+                raise ValueError(f"Injection point {pos} falls inside a UTF-8 character")
+            points.append((text_pos, order, pos, token, ids))
+        points.sort()
+
+        def _file(offset: int) -> int:
+            return byte_map[offset] if byte_map is not None else offset
+
+        spans: List[Dict] = []
+        injected: List[Dict] = []
+        piece_start = 0
+        for boundary in [p[0] for p in points] + [len(code_bytes)]:
+            if boundary > piece_start:
+                piece = code_bytes[piece_start:boundary].decode('utf-8', errors='surrogateescape')
+                piece_spans, _ = compute_token_spans(self.tokenizer, piece)
+                for span in piece_spans:
+                    spans.append(dict(span, start_byte=_file(span['start_byte'] + piece_start),
+                                      end_byte=_file(span['end_byte'] + piece_start)))
+                piece_start = boundary
+            while points and points[0][0] == boundary:
+                _, _, pos, token, ids = points.pop(0)
+                injected.append({'token': token, 'start_byte': pos, 'indices': list(range(len(spans), len(spans) + len(ids)))})
+                spans.extend({'id': token_id, 'start_byte': pos, 'end_byte': pos, 'partial': False, 'added': token}
+                             for token_id in ids)
+        return {'ids': [span['id'] for span in spans], 'spans': spans, 'injections': injected}
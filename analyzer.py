@@ -5,6 +5,7 @@ Quick Multilingual Analyzer - Using existing compiled libraries
 """
 
 import os
+import sys
 import json
 import time
 import argparse
@@ -22,14 +23,19 @@ import multiprocessing
 from typing import Any
 import signal
 
+import tracing
+from position_index import COLUMN_UNITS
+from source_text import INVALID_UTF8_POLICIES, read_source
+from token_spans import UNIT_KEYS, build_byte_to_unit, build_char_to_byte, compute_token_spans, encode_source
+
 # Global worker analyzer for process pool
 WORKER_ANALYZER: Optional["QuickMultiLanguageAnalyzer"] = None
 
-def _worker_init(model_name: str, emit_utf16: bool, target_language: str):
+def _worker_init(model_name: str, emit_utf16: bool, target_language: str, offset_unit: str = 'bytes', invalid_utf8: str = 'replace', encoding: str = 'utf-8', normalize: Optional[List[str]] = None):
     global WORKER_ANALYZER
     try:
         os.environ.setdefault('TOKENIZERS_PARALLELISM', 'false')
-        WORKER_ANALYZER = QuickMultiLanguageAnalyzer(model_name=model_name, emit_utf16_offsets=emit_utf16, allowed_languages=[target_language])
+        WORKER_ANALYZER = QuickMultiLanguageAnalyzer(model_name=model_name, emit_utf16_offsets=emit_utf16, allowed_languages=[target_language], offset_unit=offset_unit, invalid_utf8=invalid_utf8, encoding=encoding, normalize=normalize)
     except Exception:
         WORKER_ANALYZER = None
 
@@ -48,10 +54,9 @@ def _worker_analyze_file(args: Tuple[str, str]) -> Optional[Dict[str, Any]]:
         timeout_secs = int(os.environ.get('ANALYZER_PER_FILE_TIMEOUT', '10'))
         signal.alarm(max(1, timeout_secs))
 
-        with open(file_path, 'r', encoding='utf-8', errors='ignore') as f:
-            code = f.read()
+        code, byte_map = read_source(file_path, WORKER_ANALYZER.invalid_utf8, WORKER_ANALYZER.encoding)
         MAX_CODE_BYTES = 1 * 1024 * 1024
-        if len(code.encode('utf-8')) > MAX_CODE_BYTES:
+        if len(encode_source(code)) > MAX_CODE_BYTES:
             signal.alarm(0) 
             signal.signal(signal.SIGALRM, old_handler)
             return None 
@@ -61,7 +66,7 @@ def _worker_analyze_file(args: Tuple[str, str]) -> Optional[Dict[str, Any]]:
             return None
         code_size = len(code)
         file_start_time = time.time()
-        score, details = WORKER_ANALYZER.calculate_rule_level_alignment(code, language)
+        score, details = WORKER_ANALYZER.calculate_rule_level_alignment(code, language, byte_map=byte_map)
         signal.alarm(0)
         signal.signal(signal.SIGALRM, old_handler)
         file_analysis_time = time.time() - file_start_time
@@ -112,10 +117,26 @@ def _worker_analyze_file(args: Tuple[str, str]) -> Optional[Dict[str, Any]]:
 class QuickMultiLanguageAnalyzer:
     """Quick Multilingual Analyzer - Using compiled libraries"""
     
-    def __init__(self, model_name: str = "gpt2", emit_utf16_offsets: bool = False, allowed_languages: Optional[List[str]] = None):
+    def __init__(self, model_name: str = "gpt2", emit_utf16_offsets: bool = False, allowed_languages: Optional[List[str]] = None, offset_unit: str = 'bytes', invalid_utf8: str = 'replace', encoding: str = 'utf-8', normalize: Optional[List[str]] = None):
         self.model_name = model_name
         self.tokenizer = AutoTokenizer.from_pretrained(model_name)
-        self.emit_utf16_offsets = emit_utf16_offsets
+        # Normalizer steps applied before tokenizing; token offsets still address the original text
+        self.normalize = list(normalize) if normalize else None
+        if self.normalize:
+            from normalizers import NormalizerChain, NormalizingEncoder
+            self.tokenizer = NormalizingEncoder(self.tokenizer, NormalizerChain.from_spec(self.normalize))
+        # Extra offset unit for token spans and rules: 'utf16' (emit_utf16_offsets) or
+        # 'codepoints' (UTF-32, matches Python str indices); byte offsets are always kept
+        if offset_unit not in COLUMN_UNITS:
+            raise ValueError(f"Unknown offset unit: {offset_unit}")
+        self.offset_unit = 'utf16' if emit_utf16_offsets and offset_unit == 'bytes' else offset_unit
+        self.emit_utf16_offsets = self.offset_unit == 'utf16'
+        # Malformed UTF-8 policy for files read from disk (see source_text.py)
+        if invalid_utf8 not in INVALID_UTF8_POLICIES:
+            raise ValueError(f"Unknown invalid UTF-8 policy: {invalid_utf8}")
+        self.invalid_utf8 = invalid_utf8
+        # Source encoding ('auto' detects UTF-16, Latin-1, GBK, ...; offsets still address the file bytes)
+        self.encoding = encoding
         self.allowed_languages = set(allowed_languages) if allowed_languages else None
         
         # Language configurations
@@ -209,13 +230,27 @@ class QuickMultiLanguageAnalyzer:
         """Get list of available languages"""
         return list(self.parsers.keys())
     
-    def calculate_rule_level_alignment(self, code: str, language: str) -> Tuple[float, Dict]:
-        """Calculate rule-level alignment score"""
+    @tracing.traced('align', kind='rules',
+                    before=lambda a: {'encoder': tracing.encoder_name(a['self'].tokenizer), 'language': a['language']},
+                    after=lambda result, a: {'bytes': len(encode_source(a['code'])), 'rules': len(result[1]),
+                                             'score': result[0]})
+    def calculate_rule_level_alignment(self, code: str, language: str, byte_map: Optional[List[int]] = None) -> Tuple[float, Dict]:
+        """Calculate rule-level alignment score
+
+        byte_map: optional mapping from byte offsets of the decoded code to
+        offsets in the original file (from source_text.decode_source); when
+        given, reported byte offsets refer to the original file.
+        """
         if language not in self.parsers:
             raise ValueError(f"Unsupported language: {language}")
         
         parser = self.parsers[language]
-        code_bytes = code.encode('utf-8')
+        code_bytes = encode_source(code)
+
+        def _orig(pos: int) -> int:
+            if byte_map is not None and 0 <= pos < len(byte_map):
+                return byte_map[pos]
+            return pos
         
         # Parse code
         tree = parser.parse(code_bytes)
@@ -240,112 +275,15 @@ class QuickMultiLanguageAnalyzer:
         rules = extract_rules(tree.root_node)
         
         # Tokenization with reliable offsets (prefer fast tokenizer offset_mapping)
-        token_boundaries = []
-        token_source = 'offset_mapping'
         try:
-            encoding = self.tokenizer(
-                code,
-                add_special_tokens=False,
-                return_offsets_mapping=True
-            )
-            offsets = encoding.get('offset_mapping')
-            if offsets is None:
-                raise ValueError('offset_mapping not available')
-
-            # Build char->byte mapping once
-            char_to_byte = [0] * (len(code) + 1)
-            bpos = 0
-            for i, ch in enumerate(code):
-                blen = len(ch.encode('utf-8'))
-                char_to_byte[i] = bpos
-                bpos += blen
-            char_to_byte[len(code)] = len(code_bytes)
-
-            # Normalize and filter offsets; exclude zero-length pairs and specials
-            norm_offsets = []
-            for pair in offsets:
-                if pair is None:
-                    continue
-                if isinstance(pair, (list, tuple)) and len(pair) == 2:
-                    s, e = pair
-                else:
-                    continue
-                if s is None or e is None:
-                    continue
-                if e <= s:
-                    continue
-                s = max(0, min(s, len(code)))
-                e = max(0, min(e, len(code)))
-                norm_offsets.append((s, e))
-
-            token_boundaries = [(char_to_byte[s], char_to_byte[e]) for (s, e) in norm_offsets]
-
-            # Final guard: ensure we have tuples of two ints within range
-            token_boundaries = [
-                (int(max(0, min(sb, len(code_bytes)))), int(max(0, min(eb, len(code_bytes)))))
-                for (sb, eb) in token_boundaries
-                if isinstance(sb, int) and isinstance(eb, int) and eb > sb
-            ]
-        except Exception:
-            # Fallback: heuristic byte-search per token id (less reliable across tokenizers)
-            try:
-                tokens = self.tokenizer.encode(code, add_special_tokens=False)
-                token_texts = [self.tokenizer.decode([token], clean_up_tokenization_spaces=False) for token in tokens]
-            except Exception as e:
-                print(f"Tokenization error: {e}")
-                return 0.0, {}
-            token_source = 'heuristic_decode'
-
-        # Build token boundaries if we fell back or need to reconstruct
-        if 'token_boundaries' not in locals():
-            token_boundaries = []
-            current_pos = 0
-            for token_text in token_texts:
-                token_bytes = token_text.encode('utf-8')
-                if token_bytes.strip():
-                    token_start = -1
-                    for i in range(current_pos, len(code_bytes) - len(token_bytes) + 1):
-                        if code_bytes[i:i+len(token_bytes)] == token_bytes:
-                            token_start = i
-                            break
-                    if token_start != -1:
-                        token_end = token_start + len(token_bytes)
-                        token_boundaries.append((token_start, token_end))
-                        current_pos = token_end
-                    else:
-                        token_boundaries.append((current_pos, min(current_pos + 1, len(code_bytes))))
-                        current_pos = min(current_pos + 1, len(code_bytes))
-                else:
-                    token_boundaries.append((current_pos, min(current_pos + 1, len(code_bytes))))
-                    current_pos = min(current_pos + 1, len(code_bytes))
-        
-        # Safety fallback: if still empty, degrade to single-byte boundaries to avoid crashes
-        if not token_boundaries:
-            token_source = 'single_byte_fallback'
-            token_boundaries = [(i, i + 1) for i in range(len(code_bytes))]
-
-        # Optionally build byte->UTF16 code unit index mapping (for emoji safety / external consumers)
-        byte_to_utf16_index = None
-        if self.emit_utf16_offsets:
-            try:
-                # Build mapping of byte positions to UTF-16 code unit indices
-                byte_to_utf16_index = [0] * (len(code_bytes) + 1)
-                byte_pos = 0
-                utf16_index = 0
-                for ch in code:
-                    encoded = ch.encode('utf-8')
-                    blen = len(encoded)
-                    # surrogate pair in UTF-16 if codepoint > 0xFFFF
-                    units = 2 if ord(ch) > 0xFFFF else 1
-                    # Fill mapping for interior bytes of this codepoint
-                    for i in range(blen):
-                        byte_to_utf16_index[byte_pos + i] = utf16_index
-                    # Boundary after this codepoint
-                    byte_to_utf16_index[byte_pos + blen] = utf16_index + units
-                    byte_pos += blen
-                    utf16_index += units
-            except Exception:
-                byte_to_utf16_index = None
+            token_spans, token_source = compute_token_spans(self.tokenizer, code, self.offset_unit)
+        except Exception as e:
+            print(f"Tokenization error: {e}")
+            return 0.0, {}
+        token_boundaries = [(span['start_byte'], span['end_byte']) for span in token_spans]
+
+        # Byte -> offset-unit index for rule boundaries (interior bytes map to their character)
+        byte_to_unit_index = build_byte_to_unit(code, self.offset_unit) if self.offset_unit != 'bytes' else None
         
         # Calculate alignment with boundary-crossing detection
         aligned_rules = 0
@@ -358,13 +296,7 @@ class QuickMultiLanguageAnalyzer:
             return None
 
         # Build char->byte and byte->char boundary maps for mid-word detection (independent of tokenizer)
-        if 'char_to_byte' not in locals():
-            char_to_byte = [0] * (len(code) + 1)
-            bpos_tmp = 0
-            for i_tmp, ch_tmp in enumerate(code):
-                char_to_byte[i_tmp] = bpos_tmp
-                bpos_tmp += len(ch_tmp.encode('utf-8'))
-            char_to_byte[len(code)] = len(code_bytes)
+        char_to_byte = build_char_to_byte(code)
         byte_to_char = {char_to_byte[i]: i for i in range(len(char_to_byte))}
 
         def _is_word_char(ch: str) -> bool:
@@ -398,7 +330,7 @@ class QuickMultiLanguageAnalyzer:
             if fully_aligned:
                 aligned_rules += 1
             
-            rule_key = f"{rule['type']}_{rule['start_byte']}_{rule['end_byte']}"
+            rule_key = f"{rule['type']}_{_orig(rule_start)}_{_orig(rule_end)}"
 
             # Only compute token context if boundary splits a word
             crossing_start_reason = None
@@ -410,13 +342,14 @@ class QuickMultiLanguageAnalyzer:
                     s_text = code_bytes[s_tb:s_te].decode('utf-8', errors='ignore')
                     token_start_context = {
                         'token_index': s_idx,
-                        'token_start': s_tb,
-                        'token_end': s_te,
-                        'token_text_preview': s_text[:50]
+                        'token_start': _orig(s_tb),
+                        'token_end': _orig(s_te),
+                        'token_text_preview': s_text[:50],
+                        'partial': token_spans[s_idx]['partial']
                     }
                 left = prev_ch_s if prev_ch_s is not None else ''
                 right = curr_ch_s if curr_ch_s is not None else ''
-                crossing_start_reason = f"rule.start_byte={rule_start} splits word between '{left}' and '{right}'"
+                crossing_start_reason = f"rule.start_byte={_orig(rule_start)} splits word between '{left}' and '{right}'"
 
             crossing_end_reason = None
             token_end_context = None
@@ -427,13 +360,14 @@ class QuickMultiLanguageAnalyzer:
                     e_text = code_bytes[e_tb:e_te].decode('utf-8', errors='ignore')
                     token_end_context = {
                         'token_index': e_idx,
-                        'token_start': e_tb,
-                        'token_end': e_te,
-                        'token_text_preview': e_text[:50]
+                        'token_start': _orig(e_tb),
+                        'token_end': _orig(e_te),
+                        'token_text_preview': e_text[:50],
+                        'partial': token_spans[e_idx]['partial']
                     }
                 left = prev_ch_e if prev_ch_e is not None else ''
                 right = curr_ch_e if curr_ch_e is not None else ''
-                crossing_end_reason = f"rule.end_byte={rule_end} splits word between '{left}' and '{right}'"
+                crossing_end_reason = f"rule.end_byte={_orig(rule_end)} splits word between '{left}' and '{right}'"
 
             if fully_aligned:
                 details_entry = {
@@ -442,8 +376,8 @@ class QuickMultiLanguageAnalyzer:
             else:
                 details_entry = {
                     'type': rule['type'],
-                    'start_byte': rule['start_byte'],
-                    'end_byte': rule['end_byte'],
+                    'start_byte': _orig(rule_start),
+                    'end_byte': _orig(rule_end),
                     'start_aligned': start_aligned,
                     'end_aligned': end_aligned,
                     'crossing_start': crossing_start,
@@ -454,16 +388,17 @@ class QuickMultiLanguageAnalyzer:
                     'token_end_context': token_end_context,
                     'fully_aligned': False,
                     'text_preview': code_bytes[rule_start:rule_end].decode('utf-8', errors='ignore')[:50],
-                    'explain_tree_sitter': f"Tree-sitter node '{rule['type']}' spans bytes [{rule_start}, {rule_end}) from node.start_byte/end_byte.",
+                    'explain_tree_sitter': f"Tree-sitter node '{rule['type']}' spans bytes [{_orig(rule_start)}, {_orig(rule_end)}) from node.start_byte/end_byte.",
                     'explain_tokenizer': f"Token boundaries derived via {token_source}; offsets mapped to UTF-8 byte positions.",
                 }
-            if byte_to_utf16_index is not None:
+            if byte_to_unit_index is not None:
                 sb = rule['start_byte']
                 eb = rule['end_byte']
-                if 0 <= sb < len(byte_to_utf16_index):
-                    details_entry['start_utf16'] = byte_to_utf16_index[sb]
-                if 0 <= eb <= len(byte_to_utf16_index):
-                    details_entry['end_utf16'] = byte_to_utf16_index[eb]
+                key = UNIT_KEYS[self.offset_unit]
+                if 0 <= sb < len(byte_to_unit_index):
+                    details_entry[f'start_{key}'] = byte_to_unit_index[sb]
+                if 0 <= eb <= len(byte_to_unit_index):
+                    details_entry[f'end_{key}'] = byte_to_unit_index[eb]
             rule_details[rule_key] = details_entry
         
         alignment_score = (aligned_rules / len(rules) * 100) if rules else 0
@@ -581,7 +516,7 @@ class QuickMultiLanguageAnalyzer:
                         max_workers=max_workers,
                         mp_context=mp_ctx,
                         initializer=_worker_init,
-                        initargs=(self.model_name, self.emit_utf16_offsets, language)
+                        initargs=(self.model_name, self.emit_utf16_offsets, language, self.offset_unit, self.invalid_utf8, self.encoding, self.normalize)
                     ) as ex:
                         os.environ['ANALYZER_PER_FILE_TIMEOUT'] = str(max(1, int(per_file_timeout)))
                         batch_iter = ex.map(_worker_analyze_file, ((str(p), language) for p in batch), chunksize=64)
@@ -598,13 +533,12 @@ class QuickMultiLanguageAnalyzer:
                     for file_path in tqdm(batch, desc=f"Analyzing {language}", unit="files"):
                         # serial process single file
                         try:
-                            with open(file_path, 'r', encoding='utf-8', errors='ignore') as f:
-                                code = f.read()
+                            code, byte_map = read_source(file_path, self.invalid_utf8, self.encoding)
                             if not code.strip():
                                 continue
                             code_size = len(code)
                             file_start_time = time.time()
-                            score, details = self.calculate_rule_level_alignment(code, language)
+                            score, details = self.calculate_rule_level_alignment(code, language, byte_map=byte_map)
                             file_analysis_time = time.time() - file_start_time
                             aligned_count = sum(1 for d in details.values() if d['fully_aligned'])
                             unaligned_rules_list = [
@@ -741,7 +675,7 @@ class QuickMultiLanguageAnalyzer:
                 max_workers=max_workers,
                 mp_context=mp_ctx,
                 initializer=_worker_init,
-                initargs=(self.model_name, self.emit_utf16_offsets, language)
+                initargs=(self.model_name, self.emit_utf16_offsets, language, self.offset_unit, self.invalid_utf8, self.encoding, self.normalize)
             ) as ex:
                 # pass timeout to workers via env
                 os.environ['ANALYZER_PER_FILE_TIMEOUT'] = str(max(1, int(per_file_timeout)))
@@ -762,13 +696,12 @@ class QuickMultiLanguageAnalyzer:
                 # serial path: best-effort timeout using monotonic time check
                 start_t = time.time()
                 try:
-                    with open(file_path, 'r', encoding='utf-8', errors='ignore') as f:
-                        code = f.read()
+                    code, byte_map = read_source(file_path, self.invalid_utf8, self.encoding)
                     if not code.strip():
                         continue
                     code_size = len(code)
                     file_start_time = time.time()
-                    score, details = self.calculate_rule_level_alignment(code, language)
+                    score, details = self.calculate_rule_level_alignment(code, language, byte_map=byte_map)
                     file_analysis_time = time.time() - file_start_time
                     aligned_count = sum(1 for d in details.values() if d['fully_aligned'])
                     unaligned_rules_list = [
@@ -1343,6 +1276,10 @@ def main():
     parser.add_argument('--models', nargs='+', help='Analyze with multiple tokenizer models (space-separated)')
     parser.add_argument('--no_progress_bar', action='store_true', help='Do not display progress bar')
     parser.add_argument('--emit_utf16', action='store_true', help='Emit UTF-16 code unit offsets alongside byte offsets for rules')
+    parser.add_argument('--invalid_utf8', choices=INVALID_UTF8_POLICIES, default='replace', help='Handling of malformed UTF-8 in source files (reported offsets always refer to the original bytes; the default used to drop invalid bytes)')
+    parser.add_argument('--encoding', default='utf-8', help="Source file encoding, or 'auto' to detect it (files are transcoded to UTF-8 for tokenization)")
+    parser.add_argument('--normalize', action='append', metavar='STEP', help='Normalizer step applied before tokenizing (repeatable, see normalizers.py); offsets still refer to the original text')
+    parser.add_argument('--emit_codepoints', action='store_true', help='Emit code point (UTF-32) offsets alongside byte offsets for tokens and rules (instead of --emit_utf16)')
     parser.add_argument('--estimate', action='store_true', help='Estimate large-scale processing time')
     parser.add_argument('--file_count', type=int, default=1000000, help='Number of files for estimation')
     parser.add_argument('--avg_file_size', type=float, default=0, help='Average file size for estimation (bytes)')
@@ -1365,7 +1302,17 @@ def main():
     parser.add_argument('--no_hf_streaming', dest='hf_streaming', action='store_false', help='Disable streaming mode')
     parser.set_defaults(hf_streaming=True)
     parser.add_argument('--hf_token', type=str, default=None, help='HuggingFace auth token (if required)')
+    parser.add_argument('--config', type=str, default=None, help='Project config file (default: nearest .tokoffset.yaml/.toml)')
+    parser.add_argument('--no_config', action='store_true', help='Ignore project config files')
     
+    from config import ConfigError, apply_config, load_project_config
+    known, _ = parser.parse_known_args()
+    try:
+        if not known.no_config:
+            apply_config(parser, load_project_config(known.config), 'analyzer')
+    except ConfigError as e:
+        print(f"✗ {e}", file=sys.stderr)
+        sys.exit(2)
     args = parser.parse_args()
     
     # If no progress bar specified, replace tqdm with no-op version
@@ -1375,7 +1322,7 @@ def main():
     
     # If estimation mode, only run once (use --model)
     if args.estimate:
-        analyzer = QuickMultiLanguageAnalyzer(model_name=args.model, emit_utf16_offsets=args.emit_utf16)
+        analyzer = QuickMultiLanguageAnalyzer(model_name=args.model, emit_utf16_offsets=args.emit_utf16, offset_unit='codepoints' if args.emit_codepoints else 'bytes', invalid_utf8=args.invalid_utf8, encoding=args.encoding, normalize=args.normalize)
         # If estimation mode, only run estimation function
         language = args.language if args.language else 'python'
         estimate_processing_time(analyzer, language, args.avg_file_size, args.file_count)
@@ -1396,7 +1343,7 @@ def main():
             print(f"Running analysis with tokenizer model: {mdl}")
             print(f"{'='*80}")
 
-            analyzer = QuickMultiLanguageAnalyzer(model_name=mdl, emit_utf16_offsets=args.emit_utf16)
+            analyzer = QuickMultiLanguageAnalyzer(model_name=mdl, emit_utf16_offsets=args.emit_utf16, offset_unit='codepoints' if args.emit_codepoints else 'bytes', invalid_utf8=args.invalid_utf8, encoding=args.encoding, normalize=args.normalize)
 
         if args.hf_dataset:
                 _ = analyzer.analyze_hf_dataset(
@@ -0,0 +1,127 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Arrow / Parquet Export - Token tables for corpus-scale analytics
+
+One row per token:
+  doc_id (string), token_index (int32), token_id (int64, null for
+  single-byte fallback spans), start (int64), end (int64), class (string,
+  lexical class from lexical.py; null when no grammar is available)
+
+start/end are UTF-8 byte offsets into the file on disk. The tables load
+directly in DuckDB (SELECT ... FROM 'tokens.parquet'), Spark or pandas.
+
+Needs the 'pyarrow' package (imported only when writing).
+"""
+
+from pathlib import Path
+from typing import Dict, Iterable, Iterator, List, Optional, Union
+
+from repo_walker import walk_repository
+from source_text import read_source
+from token_spans import compute_token_spans, encode_source
+
+EXPORT_FORMATS = ('parquet', 'arrow')
+BATCH_ROWS = 65536
+
+
+def _pyarrow():
+    try:
+        import pyarrow
+    except ImportError:
+        raise RuntimeError("Arrow/Parquet export needs the 'pyarrow' package (pip install pyarrow)")
+    return pyarrow
+
+
+def token_schema():
+    pa = _pyarrow()
+    return pa.schema([
+        ('doc_id', pa.string()),
+        ('token_index', pa.int32()),
+        ('token_id', pa.int64()),
+        ('start', pa.int64()),
+        ('end', pa.int64()),
+        ('class', pa.string()),
+    ])
+
+
+def iter_token_rows(tokenizer, paths: Iterable[Union[str, Path]], with_classes: bool = True,
+                    encoding: str = 'auto', invalid_utf8: str = 'replace',
+                    ignore_patterns=None) -> Iterator[Dict]:
+    """Yield one row dict per token of every text file under paths."""
+    from chunker import parser_for_path
+    from lexical import enrich_tokens, lexical_segments
+
+    for root in paths:
+        root = Path(root)
+        base = root if root.is_dir() else root.parent
+        for path in walk_repository(root, ignore_patterns=ignore_patterns):
+            try:
+                text, byte_map = read_source(path, invalid_utf8, encoding)
+            except (OSError, UnicodeDecodeError):
+                continue
+            spans, _ = compute_token_spans(tokenizer, text)
+            parser = parser_for_path(path) if with_classes else None
+            if parser is not None:
+                code_bytes = encode_source(text)
+                enrich_tokens(spans, code_bytes, lexical_segments(parser.parse(code_bytes)))
+            doc_id = path.relative_to(base).as_posix()
+            for index, span in enumerate(spans):
+                start, end = span['start_byte'], span['end_byte']
+                if byte_map is not None:
+                    start, end = byte_map[start], byte_map[end]
+                yield {
+                    'doc_id': doc_id,
+                    'token_index': index,
+                    'token_id': span['id'],
+                    'start': start,
+                    'end': end,
+                    'class': span.get('lexical_class'),
+                }
+
+
+def _batches(rows: Iterable[Dict], batch_rows: int) -> Iterator[Dict[str, List]]:
+    columns: Dict[str, List] = {}
+    count = 0
+    for row in rows:
+        for key, value in row.items():
+            columns.setdefault(key, []).append(value)
+        count += 1
+        if count >= batch_rows:
+            yield columns
+            columns, count = {}, 0
+    if count:
+        yield columns
+
+
+def write_token_table(rows: Iterable[Dict], output: Union[str, Path], fmt: Optional[str] = None,
+                      batch_rows: int = BATCH_ROWS, compression: str = 'zstd') -> int:
+    """Stream rows into a Parquet or Arrow IPC file; returns the row count.
+
+    fmt defaults from the file extension (.parquet, otherwise Arrow IPC).
+    """
+    pa = _pyarrow()
+    fmt = fmt or ('parquet' if str(output).endswith('.parquet') else 'arrow')
+    if fmt not in EXPORT_FORMATS:
+        raise ValueError(f"Unknown export format: {fmt}")
+    schema = token_schema()
+
+    if fmt == 'parquet':
+        import pyarrow.parquet as pq
+        writer = pq.ParquetWriter(str(output), schema, compression=compression)
+    else:
+        import pyarrow.ipc
+        sink = pa.OSFile(str(output), 'wb')
+        writer = pyarrow.ipc.new_file(sink, schema)
+
+    total = 0
+    try:
+        for columns in _batches(rows, batch_rows):
+            table = pa.Table.from_pydict(columns, schema=schema)
+            writer.write_table(table)
+            total += table.num_rows
+    finally:
+        writer.close()
+        if fmt == 'arrow':
+            sink.close()
+    return total
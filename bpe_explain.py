@@ -0,0 +1,156 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+BPE Merge Explanation - The merge tree behind every token of a text
+
+explain(tokenizer, text) tokenizes text and, for each final token, replays
+the tokenizer's BPE merges over the token's symbols: single bytes for
+byte-level BPE (GPT-2 style), characters for SentencePiece-style BPE.
+It returns a binary merge tree per token:
+
+  {'token': 'Ġparse', 'id': 12345, 'start_byte': 10, 'end_byte': 16,
+   'rank': 2071, 'step': 3,              # merge rank, order within the token
+   'children': [left, right]}            # leaves: rank/step None, no children
+
+Every node carries the byte range it covers in the text, so one can see
+which byte pairs merged, in what order, and where a CJK identifier or a
+mixed-script comment got split. Replaying per final token gives the same
+tree as the full BPE pass: merges never cross final token boundaries.
+'consistent' is False when the replay does not end in the token itself
+(added tokens, byte-fallback pieces, merges with dropout, or a
+pre-tokenizer splitting differently).
+
+The merges come from the fast tokenizer's serialized model, so this needs
+a 'tokenizers'-backed BPE tokenizer.
+"""
+
+import json
+from typing import Dict, List, Optional
+
+from token_bytes import BYTE_LEVEL_ALPHABET, is_byte_level
+from token_spans import BYTE_FALLBACK_PATTERN, compute_token_spans, encode_source
+
+
+class ExplainError(ValueError):
+    """Raised when the tokenizer's merges are not available."""
+
+
+def load_merges(tokenizer) -> Dict:
+    """Merge ranks {(left, right): rank} and vocab of a fast BPE tokenizer."""
+    backend = getattr(tokenizer, 'backend_tokenizer', None)
+    if backend is None:
+        raise ExplainError("Merge explanations need a fast (tokenizers-backed) tokenizer")
+    model = json.loads(backend.to_str()).get('model', {})
+    if model.get('type') != 'BPE':
+        raise ExplainError(f"Merge explanations need a BPE tokenizer (got {model.get('type')})")
+    ranks = {}
+    for rank, merge in enumerate(model.get('merges', [])):
+        left, right = merge.split(' ', 1) if isinstance(merge, str) else merge
+        ranks.setdefault((left, right), rank)
+    return {'ranks': ranks, 'vocab': model.get('vocab', {}), 'byte_level': is_byte_level(tokenizer)}
+
+
+def _leaves(piece: str, start: int, end: int, byte_level: bool) -> List[Dict]:
+    """Initial symbols of a token piece with the bytes each covers."""
+    if BYTE_FALLBACK_PATTERN.match(piece):
+        return [{'token': piece, 'start_byte': start, 'end_byte': end}]
+    widths = [1 if byte_level and ch in BYTE_LEVEL_ALPHABET else len(' ' if ch == '▁' else ch.encode('utf-8', 'surrogateescape'))
+              for ch in piece]
+    # A normalizer may have added symbols with no text behind them (a prefix '▁')
+    excess = sum(widths) - (end - start)
+    for i in range(len(widths)):
+        if excess <= 0:
+            break
+        taken = min(widths[i], excess)
+        widths[i] -= taken
+        excess -= taken
+    leaves = []
+    pos = start
+    for ch, width in zip(piece, widths):
+        leaves.append({'token': ch, 'start_byte': pos, 'end_byte': min(pos + width, end)})
+        pos = min(pos + width, end)
+    if leaves:
+        leaves[-1]['end_byte'] = end
+    return leaves
+
+
+def merge_tree(piece: str, start: int, end: int, merges: Dict) -> Dict:
+    """Replay the BPE merges over one token piece; returns its tree."""
+    vocab = merges['vocab']
+    symbols = _leaves(piece, start, end, merges['byte_level'])
+    for symbol in symbols:
+        symbol.update(id=vocab.get(symbol['token']), rank=None, step=None, children=[])
+    ranks = merges['ranks']
+    step = 0
+    while len(symbols) > 1:
+        best = None
+        for i in range(len(symbols) - 1):
+            rank = ranks.get((symbols[i]['token'], symbols[i + 1]['token']))
+            if rank is not None and (best is None or rank < best[0]):
+                best = (rank, i)
+        if best is None:
+            break
+        rank, i = best
+        step += 1
+        left, right = symbols[i], symbols[i + 1]
+        token = left['token'] + right['token']
+        symbols[i:i + 2] = [{'token': token, 'id': vocab.get(token), 'start_byte': left['start_byte'],
+                             'end_byte': right['end_byte'], 'rank': rank, 'step': step, 'children': [left, right]}]
+    if len(symbols) == 1:
+        return dict(symbols[0], consistent=symbols[0]['token'] == piece)
+    # The replay stopped early: keep the pieces under one unmerged root
+    return {'token': piece, 'id': vocab.get(piece), 'start_byte': start, 'end_byte': end,
+            'rank': None, 'step': None, 'children': symbols, 'consistent': False}
+
+
+def explain(tokenizer, text: str, byte_map: Optional[List[int]] = None,
+            start: int = 0, end: Optional[int] = None) -> List[Dict]:
+    """Merge trees of tokens [start, end) of text; offsets are file offsets when byte_map is given."""
+    merges = load_merges(tokenizer)
+    spans, _ = compute_token_spans(tokenizer, text)
+    code_bytes = encode_source(text)
+    results = []
+    for index in range(start, len(spans) if end is None else min(end, len(spans))):
+        span = spans[index]
+        piece = tokenizer.convert_ids_to_tokens(span['id']) if span['id'] is not None else None
+        if not isinstance(piece, str):
+            piece = code_bytes[span['start_byte']:span['end_byte']].decode('utf-8', errors='replace')
+        tree = merge_tree(piece, span['start_byte'], span['end_byte'], merges)
+        if byte_map is not None:
+            _remap(tree, byte_map)
+        results.append({'index': index, 'id': span['id'], 'piece': piece, 'partial': span['partial'],
+                        'merges': _count_merges(tree), 'consistent': tree.pop('consistent'), 'tree': tree})
+    return results
+
+
+def _remap(node: Dict, byte_map: List[int]):
+    node['start_byte'], node['end_byte'] = byte_map[node['start_byte']], byte_map[node['end_byte']]
+    for child in node['children']:
+        _remap(child, byte_map)
+
+
+def _count_merges(node: Dict) -> int:
+    return (1 if node['rank'] is not None else 0) + sum(_count_merges(child) for child in node['children'])
+
+
+def format_tree(node: Dict, prefix: str = '', last: bool = True, root: bool = True) -> List[str]:
+    """Box-drawing lines for a merge tree, one node per line."""
+    label = f"{node['token']!r} [{node['start_byte']}, {node['end_byte']})"
+    if node['rank'] is not None:
+        label += f" step {node['step']}, rank {node['rank']}"
+    lines = [label if root else f"{prefix}{'└─ ' if last else '├─ '}{label}"]
+    child_prefix = '' if root else prefix + ('   ' if last else '│  ')
+    for i, child in enumerate(node['children']):
+        lines.extend(format_tree(child, child_prefix, i == len(node['children']) - 1, False))
+    return lines
+
+
+def print_explanations(results: List[Dict], path: str = ""):
+    print(f"\n{'='*60}")
+    print(f"BPE Merges{': ' + path if path else ''}")
+    print(f"{'='*60}")
+    for result in results:
+        mark = '' if result['consistent'] else '  ✗ replay differs from the token'
+        print(f"\n[{result['index']}] id {result['id']}, {result['merges']} merge(s){mark}")
+        for line in format_tree(result['tree']):
+            print(f"  {line}")
@@ -0,0 +1,102 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Budget Gate - Fail when prompt/template files exceed a token budget
+
+check_file tokenizes one file and, when it is over budget, reports where the
+overflow starts: the first token past the budget, as a byte offset into the
+file on disk and a 1-based line/column. Everything from there to the end of
+the file is what has to go.
+
+tracked_files lists git-tracked files matching the prompt/template patterns,
+for running the gate over a whole repository.
+"""
+
+import fnmatch
+import subprocess
+from pathlib import Path
+from typing import Dict, Iterable, List, Union
+
+from source_text import read_source
+from token_spans import compute_token_spans
+
+DEFAULT_PATTERNS = ('*.prompt', '*.prompt.*', '*.tmpl', '*.j2', '*.jinja', '*.jinja2', 'prompts/*')
+
+
+def _line_col(data: bytes, offset: int):
+    line = data.count(b'\n', 0, offset) + 1
+    line_start = data.rfind(b'\n', 0, offset) + 1
+    return line, offset - line_start + 1
+
+
+def check_file(tokenizer, path: Union[str, Path], max_tokens: int, encoding: str = 'auto') -> Dict:
+    """Token count of path against max_tokens, with the overflow location."""
+    path = Path(path)
+    text, byte_map = read_source(path, encoding=encoding)
+    spans, _ = compute_token_spans(tokenizer, text)
+    result = {
+        'path': str(path),
+        'tokens': len(spans),
+        'max_tokens': max_tokens,
+        'ok': len(spans) <= max_tokens,
+    }
+    if result['ok']:
+        return result
+    data = path.read_bytes()
+    start = spans[max_tokens]['start_byte']
+    if byte_map is not None:
+        start = byte_map[start]
+    line, column = _line_col(data, start)
+    result.update({
+        'over_by': len(spans) - max_tokens,
+        'overflow_token': max_tokens,
+        'overflow_start_byte': start,
+        'overflow_end_byte': len(data),
+        'overflow_line': line,
+        'overflow_column': column,
+    })
+    return result
+
+
+def tracked_files(root: Union[str, Path] = '.', patterns: Iterable[str] = DEFAULT_PATTERNS) -> List[Path]:
+    """git-tracked files under root whose path or name matches one of patterns."""
+    root = Path(root)
+    try:
+        out = subprocess.run(['git', 'ls-files', '-z'], cwd=root, capture_output=True, check=True).stdout
+    except (OSError, subprocess.CalledProcessError) as e:
+        raise RuntimeError(f"Cannot list tracked files in {root}: {e}")
+    patterns = list(patterns)
+    files = []
+    for rel in out.decode('utf-8', errors='surrogateescape').split('\0'):
+        if rel and any(fnmatch.fnmatch(rel, p) or fnmatch.fnmatch(Path(rel).name, p) for p in patterns):
+            files.append(root / rel)
+    return files
+
+
+def check_files(tokenizer, paths: Iterable[Union[str, Path]], max_tokens: int,
+                encoding: str = 'auto') -> List[Dict]:
+    results = []
+    for path in paths:
+        try:
+            results.append(check_file(tokenizer, path, max_tokens, encoding))
+        except (OSError, UnicodeDecodeError) as e:
+            results.append({'path': str(path), 'ok': False, 'error': str(e)})
+    return results
+
+
+def print_budget_report(results: List[Dict], verbose: bool = False):
+    """Print failures (and passes with verbose)."""
+    for r in results:
+        if 'error' in r:
+            print(f"✗ {r['path']}: {r['error']}")
+        elif not r['ok']:
+            print(f"✗ {r['path']}: {r['tokens']} tokens > {r['max_tokens']} (over by {r['over_by']})")
+            print(f"    overflow from line {r['overflow_line']}, column {r['overflow_column']} "
+                  f"(bytes [{r['overflow_start_byte']}, {r['overflow_end_byte']}), token {r['overflow_token']})")
+        elif verbose:
+            print(f"✓ {r['path']}: {r['tokens']} / {r['max_tokens']} tokens")
+    failed = sum(1 for r in results if not r['ok'])
+    if failed:
+        print(f"\n✗ {failed} of {len(results)} files over budget")
+    else:
+        print(f"✓ {len(results)} files within budget")
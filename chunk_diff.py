@@ -0,0 +1,132 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Chunk Diff - Incremental re-chunking against an existing manifest
+
+A modified file is re-chunked with the manifest's parameters (token budget,
+source encoding, redaction) and its chunks
+are compared by ID with the manifest's chunks for that path:
+- unchanged: same ID (content and structure); offsets may have moved
+- modified:  an old and a new chunk with the same structural path but
+             different content (paired in file order)
+- added / removed: the remaining new / old chunks
+
+Embedding pipelines only need to re-embed modified and added chunks and
+delete removed ones; unchanged chunks just get their new offsets.
+
+Chunk boundaries and token offsets depend on the encoder, so diffing with
+a tokenizer whose fingerprint differs from the manifest's raises
+encoder_registry.EncoderMismatchError unless allow_encoder_change is set.
+"""
+
+from pathlib import Path
+from typing import Dict, List, Optional, Union
+
+from chunker import chunk_file, split_chunk_id
+from encoder_registry import check_fingerprints, fingerprint_of
+from manifest import build_manifest, chunks_by_path
+
+# Location fields refreshed on unchanged chunks
+LOCATION_FIELDS = ('start_byte', 'end_byte', 'start_line', 'end_line', 'start_token', 'end_token')
+
+
+def _struct_of(chunk_id: str) -> str:
+    _, fragment = split_chunk_id(chunk_id)
+    return fragment.rpartition('@')[0]
+
+
+def diff_chunks(old_chunks: List[Dict], new_chunks: List[Dict]) -> Dict:
+    """Compare the old and new chunk lists of one file."""
+    old_ids = {c['id'] for c in old_chunks}
+    new_ids = {c['id'] for c in new_chunks}
+    old_by_id = {c['id']: c for c in old_chunks}
+
+    unchanged = []
+    for chunk in new_chunks:
+        if chunk['id'] in old_ids:
+            old = old_by_id[chunk['id']]
+            unchanged.append(dict(chunk, moved=any(old.get(f) != chunk.get(f) for f in LOCATION_FIELDS),
+                                  old_start_byte=old['start_byte'], old_end_byte=old['end_byte']))
+
+    removed = [c for c in old_chunks if c['id'] not in new_ids]
+    added = [c for c in new_chunks if c['id'] not in old_ids]
+
+    # Pair removed/added chunks that share a structural path
+    modified = []
+    remaining_removed = list(removed)
+    still_added = []
+    for chunk in added:
+        struct = _struct_of(chunk['id'])
+        match = next((old for old in remaining_removed if _struct_of(old['id']) == struct), None)
+        if match is None:
+            still_added.append(chunk)
+            continue
+        remaining_removed.remove(match)
+        modified.append(dict(chunk, old_id=match['id'],
+                             old_start_byte=match['start_byte'], old_end_byte=match['end_byte']))
+
+    return {
+        'unchanged': unchanged,
+        'modified': modified,
+        'added': still_added,
+        'removed': remaining_removed,
+    }
+
+
+def diff_file(tokenizer, manifest: Dict, path: Union[str, Path], root: Union[str, Path] = '.',
+              invalid_utf8: str = 'replace', allow_encoder_change: bool = False,
+              encoding: Optional[str] = None) -> Dict:
+    """Re-chunk one file and diff it against the manifest's chunks for it.
+
+    encoding overrides the manifest's source encoding. A file that no
+    longer exists has all its chunks removed.
+    """
+    if not allow_encoder_change:
+        check_fingerprints(manifest['encoder'].get('fingerprint'), fingerprint_of(tokenizer),
+                           what='manifest chunks and re-chunked files')
+    root = Path(root)
+    path = Path(path)
+    full_path = path if path.is_absolute() else root / path
+    rel = full_path.relative_to(root).as_posix()
+    old_chunks = chunks_by_path(manifest).get(rel, [])
+    max_tokens = manifest.get('max_tokens') or 512
+    if encoding is None:
+        encoding = manifest.get('encoding') or 'auto'
+    if full_path.exists():
+        new_chunks = chunk_file(tokenizer, full_path, root, max_tokens, invalid_utf8,
+                                encoding=encoding, redact=bool(manifest.get('redact')))
+    else:
+        new_chunks = []
+    result = diff_chunks(old_chunks, new_chunks)
+    result['path'] = rel
+    result['chunks'] = new_chunks
+    return result
+
+
+def apply_file_diffs(manifest: Dict, diffs: List[Dict], fingerprint: Optional[str] = None) -> Dict:
+    """New manifest with the chunks of the diffed paths replaced."""
+    replaced = {d['path']: d['chunks'] for d in diffs}
+    chunks = []
+    for rel, old_chunks in chunks_by_path(manifest).items():
+        if rel not in replaced:
+            chunks.extend(old_chunks)
+    for rel in sorted(replaced):
+        chunks.extend(replaced[rel])
+    chunks.sort(key=lambda c: (c['path'], c['start_byte']))
+    encoder = manifest['encoder']
+    return build_manifest(chunks, encoder.get('model'), fingerprint or encoder['fingerprint'],
+                          manifest.get('max_tokens'), manifest.get('encoding') or 'auto',
+                          bool(manifest.get('redact')))
+
+
+def print_chunk_diff(diff: Dict):
+    """Print one file's chunk diff."""
+    moved = sum(1 for c in diff['unchanged'] if c['moved'])
+    print(f"\n{diff['path']}: {len(diff['unchanged'])} unchanged ({moved} moved), "
+          f"{len(diff['modified'])} modified, {len(diff['added'])} added, {len(diff['removed'])} removed")
+    for chunk in diff['modified']:
+        print(f"  ~ {chunk['old_id']} -> {chunk['id']}  bytes [{chunk['start_byte']}, {chunk['end_byte']})")
+    for chunk in diff['added']:
+        print(f"  + {chunk['id']}  bytes [{chunk['start_byte']}, {chunk['end_byte']})")
+    for chunk in diff['removed']:
+        print(f"  - {chunk['id']}")
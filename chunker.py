@@ -0,0 +1,336 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token-budget Chunker - Split source files into retrieval chunks with exact offsets
+
+Each chunk is a contiguous run of tokens of at most max_tokens, cut at the
+start of a line whenever possible (otherwise at a character boundary).
+When a grammar is available, every top-level definition also starts a new
+chunk.
+Chunks tile the file: byte ranges are [start_byte, end_byte) into the file
+on disk, line ranges are 1-based and inclusive (for citations), and
+[start_token, end_token) indexes the file's token stream.
+
+Chunk IDs are content-derived: "path#Struct.path@hash", where the
+structural path names the definition the chunk belongs to (when a grammar
+is available) and hash is a hash of the whitespace-normalized chunk text.
+Re-chunking after unrelated edits keeps IDs stable, so vector stores can
+upsert by ID; identical chunks under the same structure get "~2", "~3", ...
+
+ChunkResolver maps a chunk ID back to its source location, so retrieval hits
+can be rendered as precise excerpts.
+"""
+
+import bisect
+import hashlib
+import threading
+from pathlib import Path
+from typing import Dict, List, Optional, Tuple, Union
+
+import tracing
+from manifest import content_hash
+from repo_walker import language_for_path
+from source_text import decode_any, read_source
+from token_spans import compute_token_spans, encode_source, is_char_boundary
+
+DEFAULT_MAX_TOKENS = 512
+ID_HASH_CHARS = 12
+
+# Node type fragments of named definitions that make up structural paths
+_DEFINITION_HINTS = ('function', 'method', 'class', 'struct', 'interface', 'trait', 'impl',
+                     'enum', 'module', 'namespace', 'object', 'type_spec', 'constructor')
+
+# Per-thread parsers by language (None when the grammar is unavailable);
+# tree-sitter parsers must not be shared between threads
+_PARSERS = threading.local()
+
+
+def _line_starts(code_bytes: bytes) -> List[int]:
+    return [0] + [i + 1 for i, b in enumerate(code_bytes) if b == 0x0A]
+
+
+def normalize_for_id(data: bytes) -> bytes:
+    """Whitespace-normalize chunk bytes: LF line endings, no trailing spaces, no blank edges."""
+    lines = data.replace(b'\r\n', b'\n').split(b'\n')
+    return b'\n'.join(line.rstrip() for line in lines).strip(b'\n')
+
+
+def stable_chunk_id(path: str, struct_path: str, data: bytes) -> str:
+    """Content-derived chunk ID: "path#struct_path@hash"."""
+    digest = hashlib.sha256(normalize_for_id(data)).hexdigest()[:ID_HASH_CHARS]
+    return f"{path}#{struct_path}@{digest}"
+
+
+def parser_for_path(path) -> Optional[object]:
+    """Cached tree-sitter parser for a file's language (per thread), or None."""
+    language = language_for_path(path)
+    if language is None:
+        return None
+    parsers = getattr(_PARSERS, 'by_language', None)
+    if parsers is None:
+        parsers = _PARSERS.by_language = {}
+    if language not in parsers:
+        from lexical import load_parser
+        try:
+            parsers[language] = load_parser(language)
+        except Exception:
+            parsers[language] = None
+    return parsers[language]
+
+
+def _definition_name(node, code_bytes: bytes) -> Optional[str]:
+    if not any(hint in node.type for hint in _DEFINITION_HINTS):
+        return None
+    name = node.child_by_field_name('name') or node.child_by_field_name('type')
+    if name is None:
+        return None
+    return code_bytes[name.start_byte:name.end_byte].decode('utf-8', errors='replace')
+
+
+def definition_spans(tree, code_bytes: bytes) -> List[Tuple[int, int, str]]:
+    """(start_byte, end_byte, qualified name) of named definitions, outermost first."""
+    spans = []
+    stack = [(tree.root_node, '')]
+    while stack:
+        node, prefix = stack.pop()
+        name = _definition_name(node, code_bytes)
+        if name:
+            prefix = f"{prefix}.{name}" if prefix else name
+            spans.append((node.start_byte, node.end_byte, prefix))
+        for child in reversed(node.children):
+            stack.append((child, prefix))
+    spans.sort(key=lambda s: (s[0], -s[1]))
+    return spans
+
+
+def structural_path(definitions: List[Tuple[int, int, str]], start: int, end: int) -> str:
+    """Structural path of a chunk: its first definition, else the innermost enclosing one."""
+    enclosing = ''
+    for d_start, d_end, name in definitions:
+        if d_start >= end:
+            break
+        if d_start >= start:
+            return name
+        if d_end > start:
+            enclosing = name
+    return enclosing
+
+
+def _definition_cuts(spans: List[Dict], code_bytes: bytes, definitions: List[Tuple[int, int, str]]) -> List[int]:
+    """Token indices at the start of the lines of top-level definitions."""
+    starts = [s['start_byte'] for s in spans]
+    cuts = []
+    outer_end = -1
+    for d_start, d_end, _ in definitions:
+        if d_start < outer_end:
+            continue  # nested definition
+        outer_end = d_end
+        line_start = code_bytes.rfind(b'\n', 0, d_start) + 1
+        k = max(0, bisect.bisect_right(starts, line_start) - 1)
+        if k > 0 and is_char_boundary(code_bytes, starts[k]):
+            cuts.append(k)
+    return sorted(set(cuts))
+
+
+def _cut_points(spans: List[Dict], code_bytes: bytes, max_tokens: int, forced: List[int] = ()) -> List[int]:
+    """Token indices where chunks start (always begins with 0).
+
+    Chunks always start at forced indices (top-level definitions), so edits
+    inside one definition don't move the chunks of the others.
+    """
+    n = len(spans)
+    cuts = [0]
+    i = 0
+    forced = list(forced)
+    while i < n:
+        while forced and forced[0] <= i:
+            forced.pop(0)
+        stop = forced[0] if forced else n
+        if stop - i <= max_tokens:
+            if stop < n:
+                cuts.append(stop)
+            i = stop
+            continue
+        limit = i + max_tokens
+        cut = None
+        # Prefer the last token that starts a line
+        for k in range(limit, i, -1):
+            start = spans[k]['start_byte']
+            if start == 0 or code_bytes[start - 1] == 0x0A:
+                cut = k
+                break
+        if cut is None:
+            cut = limit
+            # Byte-fallback tokens can start mid-character
+            while cut > i + 1 and not is_char_boundary(code_bytes, spans[cut]['start_byte']):
+                cut -= 1
+        cuts.append(cut)
+        i = cut
+    return cuts
+
+
+@tracing.traced('chunk',
+                before=lambda a: {'encoder': tracing.encoder_name(a['tokenizer']), 'path': a['path'],
+                                  'structural': a['parser'] is not None},
+                after=lambda chunks, a: {'bytes': len(encode_source(a['text'])),
+                                         'tokens': chunks[-1]['end_token'] if chunks else 0,
+                                         'chunks': len(chunks)})
+def chunk_text(tokenizer, text: str, path: str = "",
+               max_tokens: int = DEFAULT_MAX_TOKENS,
+               byte_map: Optional[List[int]] = None,
+               parser=None) -> List[Dict]:
+    """Chunk one document.
+
+    path is recorded in each chunk and prefixes its ID; parser (tree-sitter)
+    supplies the structural part of the ID.
+    byte_map (from source_text.decode_source) remaps byte offsets to the
+    original file bytes; line numbers and content hashes are computed on
+    the decoded text.
+    """
+    if max_tokens <= 0:
+        raise ValueError("max_tokens must be positive")
+    code_bytes = encode_source(text)
+    spans, _ = compute_token_spans(tokenizer, text)
+    line_starts = _line_starts(code_bytes)
+
+    def _orig(pos: int) -> int:
+        if byte_map is not None and 0 <= pos < len(byte_map):
+            return byte_map[pos]
+        return pos
+
+    def _line_of(pos: int) -> int:
+        return bisect.bisect_right(line_starts, pos)
+
+    if not spans:
+        return []
+    definitions = definition_spans(parser.parse(code_bytes), code_bytes) if parser is not None else []
+    forced = _definition_cuts(spans, code_bytes, definitions) if definitions else []
+    cuts = _cut_points(spans, code_bytes, max_tokens, forced)
+    chunks = []
+    seen: Dict[str, int] = {}
+    for index, start_token in enumerate(cuts):
+        end_token = cuts[index + 1] if index + 1 < len(cuts) else len(spans)
+        start = 0 if index == 0 else spans[start_token]['start_byte']
+        end = spans[end_token]['start_byte'] if end_token < len(spans) else len(code_bytes)
+        chunk_id = stable_chunk_id(path, structural_path(definitions, start, end), code_bytes[start:end])
+        seen[chunk_id] = seen.get(chunk_id, 0) + 1
+        if seen[chunk_id] > 1:
+            chunk_id = f"{chunk_id}~{seen[chunk_id]}"
+        chunks.append({
+            'id': chunk_id,
+            'path': path,
+            'index': index,
+            # The first chunk also covers a BOM skipped by transcoding
+            'start_byte': 0 if index == 0 else _orig(start),
+            'end_byte': _orig(end),
+            'start_line': _line_of(start),
+            'end_line': _line_of(max(start, end - 1)),
+            'start_token': start_token,
+            'end_token': end_token,
+            'token_count': end_token - start_token,
+            'content_hash': content_hash(code_bytes[start:end]),
+        })
+    return chunks
+
+
+def chunk_file(tokenizer, path: Union[str, Path], root: Optional[Union[str, Path]] = None,
+               max_tokens: int = DEFAULT_MAX_TOKENS, invalid_utf8: str = 'replace',
+               structural: bool = True, encoding: str = 'auto', redact: bool = False) -> List[Dict]:
+    """Chunk a file; chunk paths are relative to root when given.
+
+    With structural=True the file's grammar (if compiled) adds definition
+    names to chunk IDs. With redact=True secrets are masked first
+    (redact.py); byte offsets still refer to the file, but IDs and hashes
+    describe the redacted content.
+    """
+    path = Path(path)
+    rel = path.relative_to(root).as_posix() if root else path.as_posix()
+    text, byte_map = read_source(path, invalid_utf8, encoding)
+    if redact:
+        from redact import redact_text
+        redacted = redact_text(text, byte_map=byte_map)
+        text, byte_map = redacted['text'], redacted['byte_map']
+    parser = parser_for_path(path) if structural else None
+    return chunk_text(tokenizer, text, rel, max_tokens, byte_map, parser)
+
+
+def split_chunk_id(chunk_id: str):
+    """Split "path#fragment" into (path, fragment)."""
+    path, sep, fragment = chunk_id.rpartition('#')
+    if not sep or not path:
+        raise ValueError(f"Malformed chunk ID: {chunk_id!r}")
+    return path, fragment
+
+
+class ChunkResolver:
+    """Resolve chunk IDs to file path, byte/line/token ranges and the source excerpt.
+
+    Files are re-chunked on demand with the same parameters used to produce
+    the IDs, and cached per path. IDs from chunk_file(..., redact=True) need
+    redact=True here too; their excerpts show the redacted text.
+    """
+
+    def __init__(self, tokenizer, root: Union[str, Path] = '.',
+                 max_tokens: int = DEFAULT_MAX_TOKENS, invalid_utf8: str = 'replace',
+                 encoding: str = 'auto', redact: bool = False):
+        self.tokenizer = tokenizer
+        self.root = Path(root)
+        self.max_tokens = max_tokens
+        self.invalid_utf8 = invalid_utf8
+        self.encoding = encoding
+        self.redact = redact
+        self._chunks: Dict[str, Dict[str, Dict]] = {}
+
+    def chunks_for(self, rel_path: str) -> Dict[str, Dict]:
+        with tracing.span('cache', cache='chunk_resolver', path=rel_path, hit=rel_path in self._chunks):
+            if rel_path not in self._chunks:
+                chunks = chunk_file(self.tokenizer, self.root / rel_path, self.root,
+                                    self.max_tokens, self.invalid_utf8, encoding=self.encoding,
+                                    redact=self.redact)
+                self._chunks[rel_path] = {c['id']: c for c in chunks}
+            return self._chunks[rel_path]
+
+    def resolve(self, chunk_id: str, with_text: bool = True) -> Dict:
+        """Return the chunk's location; raises KeyError for unknown IDs."""
+        rel_path, _ = split_chunk_id(chunk_id)
+        try:
+            chunk = self.chunks_for(rel_path)[chunk_id]
+        except FileNotFoundError:
+            raise KeyError(f"Source file not found for chunk {chunk_id!r}")
+        except KeyError:
+            raise KeyError(f"Unknown chunk ID: {chunk_id!r}")
+        location = dict(chunk, citation=f"{rel_path}:L{chunk['start_line']}-L{chunk['end_line']}")
+        if with_text:
+            with open(self.root / rel_path, 'rb') as f:
+                data = f.read()
+            # Decode the file as a whole so the chunk's bytes map back through the byte map
+            text, byte_map, _ = decode_any(data, 'replace', self.encoding)
+            if self.redact:
+                from redact import redact_text
+                redacted = redact_text(text, byte_map=byte_map)
+                text, byte_map = redacted['text'], redacted['byte_map']
+            code_bytes = text.encode('utf-8', 'surrogateescape')
+            if byte_map is None:
+                excerpt = code_bytes[chunk['start_byte']:chunk['end_byte']]
+            else:
+                lo = bisect.bisect_left(byte_map, chunk['start_byte'])
+                hi = bisect.bisect_left(byte_map, chunk['end_byte'])
+                excerpt = code_bytes[lo:hi]
+            location['text'] = excerpt.decode('utf-8', errors='replace')
+        return location
+
+    def invalidate(self, rel_path: Optional[str] = None):
+        """Drop cached chunks (for one path, or all) after files change."""
+        if rel_path is None:
+            self._chunks.clear()
+        else:
+            self._chunks.pop(rel_path, None)
+
+
+def print_excerpt(location: Dict):
+    """Print a resolved chunk as a numbered source excerpt."""
+    print(f"{location['id']}  ({location['citation']}, bytes [{location['start_byte']}, {location['end_byte']}), "
+          f"tokens [{location['start_token']}, {location['end_token']}))")
+    print("-" * 60)
+    for offset, line in enumerate(location.get('text', '').splitlines()):
+        print(f"{location['start_line'] + offset:>6} | {line}")
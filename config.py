@@ -0,0 +1,168 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Project Configuration - .tokoffset.yaml / .tokoffset.toml settings
+
+The first config file found in the working directory or its parents (up to
+the repository root, i.e. the first directory holding .git) supplies
+defaults for tokoffset.py and analyzer.py; command-line flags still win.
+
+  encoder: gpt2              # tokenizer model (alias: model)
+  encoding: auto             # source encoding
+  offset_unit: bytes         # bytes | utf16 | codepoints (analyzer.py offset columns)
+  max_tokens: 512            # chunk budget (chunk, resolve, index)
+  output_format: parquet     # export format
+  normalize: [nfkc]          # normalizer steps applied before every tokenization
+                             # (normalizers.py specs; spans still address the file)
+  ignore:                    # extra gitignore-style patterns for repository walks,
+                             # relative to the config file's directory
+    - "*.min.js"
+    - vendor/
+  commands:                  # per-command defaults, keyed by argument name
+                             # (tokoffset subcommands, and "analyzer" for analyzer.py)
+    scan:
+      batch_size: 128
+
+The same keys work in TOML (.tokoffset.toml). YAML needs PyYAML.
+"""
+
+import argparse
+import sys
+from pathlib import Path
+from typing import Dict, Optional, Union
+
+CONFIG_FILES = ('.tokoffset.yaml', '.tokoffset.yml', '.tokoffset.toml')
+OFFSET_UNITS = ('bytes', 'utf16', 'codepoints')
+
+# Config key -> argument dest
+_DESTS = {
+    'encoder': 'model',
+    'model': 'model',
+    'encoding': 'encoding',
+    'max_tokens': 'max_tokens',
+    'output_format': 'format',
+    'normalize': 'normalize',
+}
+_KNOWN_KEYS = set(_DESTS) | {'offset_unit', 'ignore', 'commands'}
+
+
+class ConfigError(ValueError):
+    """Raised for unreadable or invalid config files."""
+
+
+def find_config(start: Union[str, Path, None] = None) -> Optional[Path]:
+    """Nearest config file from start (default: cwd) up to the repository root."""
+    directory = Path(start or Path.cwd()).resolve()
+    for candidate in [directory, *directory.parents]:
+        for name in CONFIG_FILES:
+            path = candidate / name
+            if path.is_file():
+                return path
+        if (candidate / '.git').exists():
+            break
+    return None
+
+
+def _parse(path: Path) -> Dict:
+    data = path.read_bytes()
+    if path.suffix == '.toml':
+        try:
+            import tomllib
+        except ImportError:
+            try:
+                import tomli as tomllib
+            except ImportError:
+                raise ConfigError(f"{path}: TOML config needs Python 3.11+ or the 'tomli' package")
+        try:
+            return tomllib.loads(data.decode('utf-8'))
+        except (tomllib.TOMLDecodeError, UnicodeDecodeError) as e:
+            raise ConfigError(f"{path}: {e}")
+    try:
+        import yaml
+    except ImportError:
+        raise ConfigError(f"{path}: YAML config needs the 'PyYAML' package (pip install pyyaml)")
+    try:
+        return yaml.safe_load(data) or {}
+    except yaml.YAMLError as e:
+        raise ConfigError(f"{path}: {e}")
+
+
+def validate_config(config: Dict, source: str = "config") -> Dict:
+    """Check keys and value types; returns config."""
+    if not isinstance(config, dict):
+        raise ConfigError(f"{source}: expected a mapping at the top level")
+    unknown = sorted(set(config) - _KNOWN_KEYS)
+    if unknown:
+        raise ConfigError(f"{source}: unknown key(s): {', '.join(unknown)}")
+    if 'offset_unit' in config and config['offset_unit'] not in OFFSET_UNITS:
+        raise ConfigError(f"{source}: offset_unit must be one of {', '.join(OFFSET_UNITS)}")
+    if 'max_tokens' in config and (not isinstance(config['max_tokens'], int) or config['max_tokens'] <= 0):
+        raise ConfigError(f"{source}: max_tokens must be a positive integer")
+    normalize = config.get('normalize', [])
+    if not isinstance(normalize, list) or not all(isinstance(s, str) for s in normalize):
+        raise ConfigError(f"{source}: normalize must be a list of normalizer specs")
+    ignore = config.get('ignore', [])
+    if not isinstance(ignore, list) or not all(isinstance(p, str) for p in ignore):
+        raise ConfigError(f"{source}: ignore must be a list of patterns")
+    commands = config.get('commands', {})
+    if not isinstance(commands, dict) or not all(isinstance(v, dict) for v in commands.values()):
+        raise ConfigError(f"{source}: commands must map command names to settings")
+    return config
+
+
+def load_config(path: Union[str, Path]) -> Dict:
+    path = Path(path)
+    try:
+        config = _parse(path)
+    except OSError as e:
+        raise ConfigError(f"{path}: {e}")
+    config = validate_config(config, str(path))
+    config['_path'] = str(path)
+    return config
+
+
+def load_project_config(path: Union[str, Path, None] = None) -> Dict:
+    """Load path, or the discovered config file; {} when there is none."""
+    if path is None:
+        path = find_config()
+        if path is None:
+            return {}
+    return load_config(path)
+
+
+def defaults_for(config: Dict, command: Optional[str] = None) -> Dict:
+    """Argument defaults (dest -> value) the config gives one command."""
+    defaults = {dest: config[key] for key, dest in _DESTS.items() if key in config and key != 'model'}
+    if 'model' in config and 'encoder' not in config:
+        defaults['model'] = config['model']
+    unit = config.get('offset_unit')
+    if unit is not None:
+        defaults['emit_utf16'] = unit == 'utf16'
+        defaults['emit_codepoints'] = unit == 'codepoints'
+    if command is not None:
+        defaults.update(config.get('commands', {}).get(command, {}))
+    return defaults
+
+
+def apply_config(parser: argparse.ArgumentParser, config: Dict, command: Optional[str] = None):
+    """Set parser defaults from config for the arguments parser defines.
+
+    Per-command keys the parser does not define are reported on stderr;
+    top-level keys are shared, so those that do not apply are skipped quietly.
+    """
+    dests = {action.dest for action in parser._actions}
+    if command is not None:
+        for key in sorted(set(config.get('commands', {}).get(command, {})) - dests):
+            print(f"⚠️  {config.get('_path', 'config')}: commands.{command}.{key} is not an option of "
+                  f"'{command}'; ignored", file=sys.stderr)
+    defaults = {k: v for k, v in defaults_for(config, command).items() if k in dests}
+    if defaults:
+        parser.set_defaults(**defaults)
+
+
+def ignore_patterns(config: Dict):
+    """The 'ignore' list anchored at the config file's directory (None without one)."""
+    if not config.get('ignore'):
+        return None
+    from repo_walker import AnchoredPatterns
+    return AnchoredPatterns(config['ignore'], Path(config['_path']).parent)
@@ -0,0 +1,157 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Near-Duplicate Chunks - Token shingles, MinHash and LSH over a corpus
+
+Every chunk (chunker.py) is reduced to the set of its token n-grams
+("shingles", by token id). MinHash signatures with LSH banding propose
+candidate pairs; their exact shingle Jaccard similarity decides. Pairs at
+or above the threshold are reported with both chunks' source locations,
+and duplicate clusters name the chunks that can be dropped (all but the
+first chunk of each cluster, in path order).
+
+Chunks shorter than one shingle are skipped.
+"""
+
+import hashlib
+import random
+import struct
+from collections import defaultdict
+from pathlib import Path
+from typing import Dict, Iterable, List, Set, Tuple, Union
+
+from chunker import DEFAULT_MAX_TOKENS, chunk_text, parser_for_path
+from repo_walker import walk_repository
+from source_text import read_source
+from token_spans import compute_token_spans, encode_source
+
+DEFAULT_SHINGLE = 5
+DEFAULT_PERMUTATIONS = 64
+DEFAULT_BANDS = 16
+DEFAULT_THRESHOLD = 0.8
+
+_PRIME = (1 << 61) - 1
+
+
+def _token_key(span: Dict, code_bytes: bytes):
+    return span['id'] if span['id'] is not None else code_bytes[span['start_byte']:span['end_byte']]
+
+
+def shingles(keys: List, size: int = DEFAULT_SHINGLE) -> Set[int]:
+    """64-bit hashes of the token n-grams of keys."""
+    result = set()
+    for i in range(len(keys) - size + 1):
+        digest = hashlib.blake2b(repr(keys[i:i + size]).encode('utf-8'), digest_size=8).digest()
+        result.add(struct.unpack('<Q', digest)[0])
+    return result
+
+
+class MinHasher:
+    """MinHash signatures with a fixed, seeded family of hash permutations."""
+
+    def __init__(self, permutations: int = DEFAULT_PERMUTATIONS, seed: int = 1):
+        rng = random.Random(seed)
+        self.params = [(rng.randrange(1, _PRIME), rng.randrange(0, _PRIME)) for _ in range(permutations)]
+
+    def signature(self, shingle_set: Set[int]) -> Tuple[int, ...]:
+        return tuple(min((a * h + b) % _PRIME for h in shingle_set) for a, b in self.params)
+
+
+def jaccard(a: Set[int], b: Set[int]) -> float:
+    if not a and not b:
+        return 1.0
+    return len(a & b) / len(a | b)
+
+
+def collect_chunks(tokenizer, paths: Iterable[Union[str, Path]], max_tokens: int = DEFAULT_MAX_TOKENS,
+                   shingle: int = DEFAULT_SHINGLE, encoding: str = 'auto',
+                   ignore_patterns=None) -> List[Dict]:
+    """Chunks of every text file under paths, each with its 'shingles' set."""
+    chunks = []
+    for root in paths:
+        root = Path(root)
+        base = root if root.is_dir() else root.parent
+        for path in walk_repository(root, ignore_patterns=ignore_patterns):
+            try:
+                text, byte_map = read_source(path, encoding=encoding)
+            except (OSError, UnicodeDecodeError):
+                continue
+            code_bytes = encode_source(text)
+            spans, _ = compute_token_spans(tokenizer, text)
+            keys = [_token_key(s, code_bytes) for s in spans]
+            rel = path.relative_to(base).as_posix()
+            for chunk in chunk_text(tokenizer, text, rel, max_tokens, byte_map, parser_for_path(path)):
+                chunk['shingles'] = shingles(keys[chunk['start_token']:chunk['end_token']], shingle)
+                if chunk['shingles']:
+                    chunks.append(chunk)
+    return chunks
+
+
+def find_near_duplicates(chunks: List[Dict], threshold: float = DEFAULT_THRESHOLD,
+                         permutations: int = DEFAULT_PERMUTATIONS, bands: int = DEFAULT_BANDS) -> Dict:
+    """Near-duplicate pairs and clusters among chunks (collect_chunks output)."""
+    if permutations % bands:
+        raise ValueError("permutations must be a multiple of bands")
+    rows = permutations // bands
+    hasher = MinHasher(permutations)
+    buckets: Dict[Tuple, List[int]] = defaultdict(list)
+    for index, chunk in enumerate(chunks):
+        signature = hasher.signature(chunk['shingles'])
+        for band in range(bands):
+            buckets[(band, signature[band * rows:(band + 1) * rows])].append(index)
+
+    candidates = set()
+    for members in buckets.values():
+        for i, a in enumerate(members):
+            for b in members[i + 1:]:
+                candidates.add((a, b))
+
+    pairs = []
+    parent = list(range(len(chunks)))
+
+    def _find(i: int) -> int:
+        while parent[i] != i:
+            parent[i] = parent[parent[i]]
+            i = parent[i]
+        return i
+
+    for a, b in sorted(candidates):
+        similarity = jaccard(chunks[a]['shingles'], chunks[b]['shingles'])
+        if similarity < threshold:
+            continue
+        pairs.append({'similarity': round(similarity, 4),
+                      'a': _location(chunks[a]), 'b': _location(chunks[b])})
+        parent[_find(b)] = _find(a)
+    pairs.sort(key=lambda p: -p['similarity'])
+
+    groups: Dict[int, List[int]] = defaultdict(list)
+    for index in range(len(chunks)):
+        groups[_find(index)].append(index)
+    clusters = [[_location(chunks[i]) for i in sorted(members, key=lambda i: (chunks[i]['path'], chunks[i]['start_byte']))]
+                for members in groups.values() if len(members) > 1]
+    clusters.sort(key=lambda c: (c[0]['path'], c[0]['start_byte']))
+    return {
+        'chunks': len(chunks),
+        'candidates': len(candidates),
+        'pairs': pairs,
+        'clusters': clusters,
+        'redundant': [loc['id'] for cluster in clusters for loc in cluster[1:]],
+    }
+
+
+def _location(chunk: Dict) -> Dict:
+    return {key: chunk[key] for key in ('id', 'path', 'start_byte', 'end_byte', 'start_line', 'end_line', 'token_count')}
+
+
+def print_duplicates(result: Dict, limit: int = 20):
+    print(f"\n{'='*60}")
+    print("Near-Duplicate Chunks")
+    print(f"{'='*60}")
+    print(f"Chunks: {result['chunks']}  Candidate pairs: {result['candidates']}  "
+          f"Near-duplicate pairs: {len(result['pairs'])}  Redundant chunks: {len(result['redundant'])}")
+    for pair in result['pairs'][:limit]:
+        a, b = pair['a'], pair['b']
+        print(f"  {pair['similarity']:.2f}  {a['path']}:L{a['start_line']}-L{a['end_line']} [{a['start_byte']}, {a['end_byte']})"
+              f"  ~  {b['path']}:L{b['start_line']}-L{b['end_line']} [{b['start_byte']}, {b['end_byte']})")
+    if len(result['pairs']) > limit:
+        print(f"  ... {len(result['pairs']) - limit} more pairs")
@@ -0,0 +1,126 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Diagnostic Anchors - Map compiler/linter diagnostics onto tokens
+
+Understands the common output formats:
+  path:line:col: message        go vet, gcc/clang, eslint (unix), mypy
+  path:line: message            column 1
+  path(line,col): message       tsc
+
+Each diagnostic is resolved to a byte offset in the file on disk (through
+position_index.PositionIndex) and to the index of the token it lands on
+(token_index.TokenIndex). A position between tokens (e.g. in untokenized
+trailing whitespace) anchors to the next token, or the last one at the end
+of the file.
+
+The path:line:col format does not say what columns count, so the unit is
+guessed from the tool that usually reports on the file:
+  UTF-16 code units   tsc, and eslint on JavaScript/TypeScript files
+  code points         mypy on Python files
+  UTF-8 bytes         everything else (go vet, gcc/clang)
+pass column_unit to override.
+"""
+
+import re
+from collections import defaultdict
+from pathlib import Path
+from typing import Dict, Iterable, List, Optional, Union
+
+from position_index import PositionIndex
+from source_text import read_source
+from token_index import TokenIndex
+from token_spans import compute_token_spans
+
+_GNU = re.compile(r'^(?P<file>(?:[A-Za-z]:)?[^:\n]+?):(?P<line>\d+)(?::(?P<col>\d+))?:\s*(?P<msg>.*)$')
+_TSC = re.compile(r'^(?P<file>[^(\n]+?)\((?P<line>\d+),(?P<col>\d+)\):\s*(?P<msg>.*)$')
+
+# File extension -> column unit of the linters that report on it
+_EXTENSION_UNITS = {
+    '.js': 'utf16', '.jsx': 'utf16', '.mjs': 'utf16', '.cjs': 'utf16',
+    '.ts': 'utf16', '.tsx': 'utf16', '.mts': 'utf16', '.cts': 'utf16', '.vue': 'utf16',
+    '.py': 'codepoints', '.pyi': 'codepoints',
+}
+
+
+def parse_diagnostics(lines: Iterable[str]) -> List[Dict]:
+    """Diagnostics ({file, line, column, message, unit}) found in tool output."""
+    diagnostics = []
+    for raw in lines:
+        line = raw.rstrip('\r\n')
+        match = _TSC.match(line)
+        unit = 'utf16'
+        if match is None:
+            match = _GNU.match(line)
+            unit = None
+        if match is None:
+            continue
+        name = match.group('file').strip()
+        if unit is None:
+            unit = _EXTENSION_UNITS.get(Path(name).suffix.lower(), 'bytes')
+        diagnostics.append({
+            'file': name,
+            'line': int(match.group('line')),
+            'column': int(match.group('col') or 1),
+            'message': match.group('msg'),
+            'unit': unit,
+        })
+    return diagnostics
+
+
+def _file_index(tokenizer, path: Path, encoding: str):
+    data = path.read_bytes()
+    text, byte_map = read_source(path, encoding=encoding)
+    spans, _ = compute_token_spans(tokenizer, text)
+    if byte_map is not None:
+        spans = [dict(s, start_byte=byte_map[s['start_byte']], end_byte=byte_map[s['end_byte']]) for s in spans]
+    return data, PositionIndex(data), spans, TokenIndex(spans)
+
+
+def resolve_diagnostics(tokenizer, diagnostics: List[Dict], root: Union[str, Path] = '.',
+                        column_unit: Optional[str] = None, encoding: str = 'auto') -> List[Dict]:
+    """Add 'offset', 'token_index' and 'token' to each diagnostic.
+
+    Diagnostics for unreadable files get an 'error' instead.
+    """
+    root = Path(root)
+    by_file = defaultdict(list)
+    for diagnostic in diagnostics:
+        by_file[diagnostic['file']].append(diagnostic)
+
+    results = []
+    for name, items in by_file.items():
+        path = Path(name) if Path(name).is_absolute() else root / name
+        try:
+            data, positions, spans, index = _file_index(tokenizer, path, encoding)
+        except (OSError, UnicodeDecodeError) as e:
+            results.extend(dict(d, error=str(e)) for d in items)
+            continue
+        for diagnostic in items:
+            offset = positions.offset(diagnostic['line'], diagnostic['column'],
+                                      column_unit or diagnostic.get('unit', 'bytes'))
+            token_index = index.token_at(offset)
+            if token_index is None and spans:
+                token_index = min(index.overlapping(offset, offset)[0], len(spans) - 1)
+            token = None
+            if token_index is not None:
+                span = spans[token_index]
+                token = {
+                    'id': span['id'],
+                    'start_byte': span['start_byte'],
+                    'end_byte': span['end_byte'],
+                    'text': data[span['start_byte']:span['end_byte']].decode('utf-8', errors='replace'),
+                }
+            results.append(dict(diagnostic, offset=offset, token_index=token_index, token=token))
+    return results
+
+
+def print_anchors(results: List[Dict]):
+    for r in results:
+        where = f"{r['file']}:{r['line']}:{r['column']}"
+        if 'error' in r:
+            print(f"✗ {where}: {r['error']}")
+        elif r['token'] is None:
+            print(f"{where}  byte {r['offset']}  (no tokens)  {r['message']}")
+        else:
+            print(f"{where}  byte {r['offset']}  token {r['token_index']} {r['token']['text']!r}  {r['message']}")
@@ -0,0 +1,148 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Encoder Registry - Process-wide tokenizer cache keyed by (name, revision)
+
+get_encoder loads each (name, revision) once per process. Concurrent first
+requests for the same key wait for one load (single flight) instead of
+loading the vocabulary several times; a failed load is not cached, so a
+later call retries. Each entry carries the encoder fingerprint
+(manifest.encoder_fingerprint), computed once.
+
+The registry's tokenizers are shared by every caller in the process, so
+Encoder.tokenizer is a shared_encoder.SharedEncoder: safe from any thread
+and read-only. Use Encoder.tokenizer.copy() for a tokenizer to modify
+(e.g. add_tokens).
+
+Token streams persisted by this tool record that fingerprint (manifests,
+token stream headers, golden files). check_fingerprints is the guard for
+APIs comparing two streams: offsets and IDs of streams from different
+vocabularies do not correspond, so mixing them raises EncoderMismatchError
+instead of producing a meaningless diff.
+"""
+
+import os
+import threading
+import weakref
+from typing import Callable, Dict, List, Optional, Tuple
+
+from manifest import encoder_fingerprint
+from shared_encoder import SharedEncoder
+
+
+class EncoderMismatchError(ValueError):
+    """Raised when token streams of different encoders are combined."""
+
+
+class Encoder:
+    """A loaded tokenizer (as a SharedEncoder) with its fingerprint."""
+
+    def __init__(self, name: str, revision: Optional[str], tokenizer):
+        self.name = name
+        self.revision = revision
+        self.tokenizer = tokenizer if isinstance(tokenizer, SharedEncoder) else SharedEncoder(tokenizer)
+        self.fingerprint = self.tokenizer.fingerprint
+
+    def __repr__(self) -> str:
+        return f"Encoder({self.name!r}, revision={self.revision!r}, fingerprint={self.fingerprint[:19]!r})"
+
+
+def _load_pretrained(name: str, revision: Optional[str]):
+    os.environ.setdefault('TOKENIZERS_PARALLELISM', 'false')
+    from transformers import AutoTokenizer
+    if revision is None:
+        return AutoTokenizer.from_pretrained(name)
+    return AutoTokenizer.from_pretrained(name, revision=revision)
+
+
+class _Flight:
+    def __init__(self):
+        self.done = threading.Event()
+        self.encoder: Optional[Encoder] = None
+        self.error: Optional[BaseException] = None
+
+
+class EncoderRegistry:
+    """Single-flight cache of encoders; safe to use from any thread."""
+
+    def __init__(self, loader: Callable[[str, Optional[str]], object] = _load_pretrained):
+        self.loader = loader
+        self._lock = threading.Lock()
+        self._encoders: Dict[Tuple[str, Optional[str]], Encoder] = {}
+        self._flights: Dict[Tuple[str, Optional[str]], _Flight] = {}
+
+    def get(self, name: str, revision: Optional[str] = None) -> Encoder:
+        key = (name, revision)
+        with self._lock:
+            encoder = self._encoders.get(key)
+            if encoder is not None:
+                return encoder
+            flight = self._flights.get(key)
+            leader = flight is None
+            if leader:
+                flight = self._flights[key] = _Flight()
+        if not leader:
+            flight.done.wait()
+            if flight.error is not None:
+                raise flight.error
+            return flight.encoder
+        try:
+            flight.encoder = Encoder(name, revision, self.loader(name, revision))
+            with self._lock:
+                self._encoders[key] = flight.encoder
+            return flight.encoder
+        except BaseException as e:
+            flight.error = e
+            raise
+        finally:
+            with self._lock:
+                del self._flights[key]
+            flight.done.set()
+
+    def loaded(self) -> List[Encoder]:
+        with self._lock:
+            return list(self._encoders.values())
+
+    def clear(self):
+        with self._lock:
+            self._encoders.clear()
+
+
+REGISTRY = EncoderRegistry()
+
+# Fingerprints of tokenizer objects seen so far (serializing a tokenizer is not free)
+_fingerprints: "weakref.WeakKeyDictionary" = weakref.WeakKeyDictionary()
+_fingerprints_lock = threading.Lock()
+
+
+def get_encoder(name: str, revision: Optional[str] = None) -> Encoder:
+    """The process-wide encoder for (name, revision), loaded on first use."""
+    return REGISTRY.get(name, revision)
+
+
+def fingerprint_of(tokenizer) -> str:
+    """encoder_fingerprint of a tokenizer, cached per tokenizer object."""
+    if isinstance(tokenizer, SharedEncoder):
+        return tokenizer.fingerprint
+    try:
+        with _fingerprints_lock:
+            cached = _fingerprints.get(tokenizer)
+    except TypeError:
+        return encoder_fingerprint(tokenizer)
+    if cached is None:
+        cached = encoder_fingerprint(tokenizer)
+        with _fingerprints_lock:
+            _fingerprints[tokenizer] = cached
+    return cached
+
+
+def check_fingerprints(*fingerprints: Optional[str], what: str = 'token streams') -> Optional[str]:
+    """The common fingerprint of the given ones (None entries are unknown and skipped).
+
+    Raises EncoderMismatchError when two known fingerprints differ.
+    """
+    known = {fp for fp in fingerprints if fp}
+    if len(known) > 1:
+        listed = ', '.join(sorted(fp[:19] for fp in known))
+        raise EncoderMismatchError(f"Cannot combine {what} from different encoders ({listed})")
+    return known.pop() if known else None
@@ -0,0 +1,130 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Fill-in-the-Middle Prompts - Prefix/suffix/middle token segments around a cursor
+
+split_fim cuts a file at a cursor byte offset (optionally a selection
+[cursor, middle_end) that the completion replaces) and fits a FIM prompt
+into a token budget:
+
+  PSM  <prefix> prefix tokens <suffix> suffix tokens <middle>
+  SPM  <suffix> suffix tokens <prefix> prefix tokens <middle>
+
+Prefix and suffix are tokenized separately. The prefix keeps the tokens
+closest to the cursor and the suffix those closest to the selection end;
+the suffix gets suffix_share of the budget left after the sentinels and
+hands what it does not need to the prefix (and back). Each segment reports
+its exact byte range in the file, so the completion is spliced back with
+splice_completion.
+
+Sentinel strings differ per model family (SENTINELS); their IDs come from
+added_tokens.AddedTokens.
+"""
+
+from typing import Dict, List, Optional, Tuple
+
+from added_tokens import AddedTokens
+from offset_map import apply_edits, rewritten_offset
+from token_spans import compute_token_spans, encode_source, is_char_boundary
+
+SENTINELS = {
+    'default': ('<|fim_prefix|>', '<|fim_suffix|>', '<|fim_middle|>'),
+    'starcoder': ('<fim_prefix>', '<fim_suffix>', '<fim_middle>'),
+    'codellama': ('<PRE>', '<SUF>', '<MID>'),
+}
+FIM_MODES = ('psm', 'spm')
+
+
+def _segment(spans: List[Dict], keep: int, from_end: bool, offset: int) -> Tuple[List[Dict], int]:
+    """Spans of the kept tokens shifted by offset, and how many were dropped."""
+    keep = min(keep, len(spans))
+    kept = spans[len(spans) - keep:] if from_end else spans[:keep]
+    # Never start or end a segment inside a character
+    while kept and (kept[0 if from_end else -1]['partial']):
+        kept = kept[1:] if from_end else kept[:-1]
+    shifted = [dict(s, start_byte=s['start_byte'] + offset, end_byte=s['end_byte'] + offset) for s in kept]
+    return shifted, len(spans) - len(kept)
+
+
+def split_fim(tokenizer, text: str, cursor: int, budget: int, middle_end: Optional[int] = None,
+              byte_map: Optional[List[int]] = None, suffix_share: float = 0.25,
+              sentinels: str = 'default', mode: str = 'psm', added: Optional[AddedTokens] = None) -> Dict:
+    """Build a FIM prompt within budget tokens; offsets are file offsets when byte_map is given."""
+    if mode not in FIM_MODES:
+        raise ValueError(f"Unknown FIM mode: {mode}")
+    if sentinels not in SENTINELS:
+        raise ValueError(f"Unknown sentinel set: {sentinels}")
+    code_bytes = encode_source(text)
+
+    def _to_text(pos: int) -> int:
+        text_pos = rewritten_offset(byte_map, pos)
+        if not 0 <= text_pos <= len(code_bytes) or not is_char_boundary(code_bytes, text_pos):
+            raise ValueError(f"Offset {pos} is outside the text or inside a character")
+        return text_pos
+
+    def _file(pos: int) -> int:
+        return byte_map[pos] if byte_map is not None else pos
+
+    start = _to_text(cursor)
+    end = _to_text(middle_end) if middle_end is not None else start
+    if end < start:
+        raise ValueError(f"Selection end {middle_end} is before the cursor {cursor}")
+
+    added = added or AddedTokens(tokenizer)
+    names = SENTINELS[sentinels]
+    for name in names:
+        if name not in added:
+            added.register(name)
+    sentinel_ids = {name: added.ids(name) for name in names}
+    available = budget - sum(len(ids) for ids in sentinel_ids.values())
+    if available < 0:
+        raise ValueError(f"Budget {budget} does not fit the FIM sentinels")
+
+    prefix_spans, _ = compute_token_spans(tokenizer, code_bytes[:start].decode('utf-8', errors='surrogateescape'))
+    suffix_spans, _ = compute_token_spans(tokenizer, code_bytes[end:].decode('utf-8', errors='surrogateescape'))
+    suffix_budget = min(len(suffix_spans), int(available * suffix_share))
+    prefix_budget = min(len(prefix_spans), available - suffix_budget)
+    prefix, prefix_dropped = _segment(prefix_spans, prefix_budget, True, 0)
+    # Tokens of a character cut at the prefix start were dropped: the suffix may use their budget
+    suffix_budget = min(len(suffix_spans), available - len(prefix))
+    suffix, suffix_dropped = _segment(suffix_spans, suffix_budget, False, end)
+
+    def _report(spans: List[Dict], lo: int, hi: int, dropped: int) -> Dict:
+        for span in spans:
+            span['start_byte'], span['end_byte'] = _file(span['start_byte']), _file(span['end_byte'])
+        return {'bytes': [_file(lo), _file(hi)], 'ids': [s['id'] for s in spans], 'spans': spans, 'dropped_tokens': dropped}
+
+    segments = {
+        'prefix': _report(prefix, prefix[0]['start_byte'] if prefix else start, start, prefix_dropped),
+        'suffix': _report(suffix, end, suffix[-1]['end_byte'] if suffix else end, suffix_dropped),
+        'middle': {'bytes': [_file(start), _file(end)]},
+    }
+    pre, suf, mid = (sentinel_ids[name] for name in names)
+    if mode == 'psm':
+        ids = pre + segments['prefix']['ids'] + suf + segments['suffix']['ids'] + mid
+    else:
+        ids = suf + segments['suffix']['ids'] + pre + segments['prefix']['ids'] + mid
+    return dict(segments, ids=ids, tokens=len(ids), budget=budget, mode=mode, sentinels=list(names))
+
+
+def splice_completion(text: str, fim: Dict, completion: str,
+                      byte_map: Optional[List[int]] = None) -> Tuple[str, List[int]]:
+    """Replace the FIM middle with a completion; returns (new_text, byte_map to text).
+
+    The middle's file offsets are mapped back to text with byte_map when given.
+    """
+    start, end = fim['middle']['bytes']
+    start, end = rewritten_offset(byte_map, start), rewritten_offset(byte_map, end)
+    return apply_edits(text, [(start, end, completion)])
+
+
+def print_fim(fim: Dict, path: str = ""):
+    print(f"\n{'='*60}")
+    print(f"FIM Prompt{': ' + path if path else ''} ({fim['mode'].upper()})")
+    print(f"{'='*60}")
+    for name in ('prefix', 'suffix'):
+        segment = fim[name]
+        print(f"  {name:<7} bytes [{segment['bytes'][0]}, {segment['bytes'][1]})  {len(segment['ids'])} tokens"
+              + (f", {segment['dropped_tokens']} dropped" if segment['dropped_tokens'] else ''))
+    print(f"  middle  bytes [{fim['middle']['bytes'][0]}, {fim['middle']['bytes'][1]})")
+    print(f"Total: {fim['tokens']} of {fim['budget']} tokens")
@@ -0,0 +1,265 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Go AST Kinds - Annotate Go tokens with their go/ast node kind and declaration
+
+Every token gets:
+- 'ast_kind'  the innermost go/ast node type (BasicLit, Ident, CallExpr,
+              BlockStmt, ...) enclosing the token's non-whitespace bytes
+- 'decl'      the top-level declaration it belongs to, e.g. 'FuncDecl:main',
+              'FuncDecl:Person.Greet' (methods), 'GenDecl:Person' (type, var
+              and const specs), 'GenDecl:import'; None outside declarations
+
+Kinds are derived from the tree-sitter Go grammar: nodes without a go/ast
+counterpart (argument_list, expression_list, ...) are transparent, so the
+parentheses of a call belong to its CallExpr. A token straddling several
+nodes (e.g. '("') takes the innermost node containing all of it.
+
+select_tokens answers queries like "tokens inside string literals in
+function main": select_tokens(tokens, kind='BasicLit', decl='FuncDecl:main').
+"""
+
+import bisect
+from collections import Counter
+from typing import Dict, List, Optional
+
+from token_spans import compute_token_spans, encode_source
+
+# tree-sitter-go node type -> go/ast node type
+GO_AST_KINDS = {
+    'source_file': 'File',
+    'comment': 'Comment',
+    'function_declaration': 'FuncDecl',
+    'method_declaration': 'FuncDecl',
+    'import_declaration': 'GenDecl',
+    'const_declaration': 'GenDecl',
+    'var_declaration': 'GenDecl',
+    'type_declaration': 'GenDecl',
+    'import_spec': 'ImportSpec',
+    'const_spec': 'ValueSpec',
+    'var_spec': 'ValueSpec',
+    'type_spec': 'TypeSpec',
+    'type_alias': 'TypeSpec',
+    'parameter_list': 'FieldList',
+    'type_parameter_list': 'FieldList',
+    'field_declaration_list': 'FieldList',
+    'parameter_declaration': 'Field',
+    'variadic_parameter_declaration': 'Field',
+    'type_parameter_declaration': 'Field',
+    'field_declaration': 'Field',
+    'method_spec': 'Field',
+    'method_elem': 'Field',
+    'struct_type': 'StructType',
+    'interface_type': 'InterfaceType',
+    'pointer_type': 'StarExpr',
+    'array_type': 'ArrayType',
+    'slice_type': 'ArrayType',
+    'implicit_length_array_type': 'ArrayType',
+    'map_type': 'MapType',
+    'channel_type': 'ChanType',
+    'function_type': 'FuncType',
+    'qualified_type': 'SelectorExpr',
+    'generic_type': 'IndexExpr',
+    'parenthesized_type': 'ParenExpr',
+    'block': 'BlockStmt',
+    'expression_statement': 'ExprStmt',
+    'send_statement': 'SendStmt',
+    'inc_statement': 'IncDecStmt',
+    'dec_statement': 'IncDecStmt',
+    'assignment_statement': 'AssignStmt',
+    'short_var_declaration': 'AssignStmt',
+    'labeled_statement': 'LabeledStmt',
+    'go_statement': 'GoStmt',
+    'defer_statement': 'DeferStmt',
+    'return_statement': 'ReturnStmt',
+    'break_statement': 'BranchStmt',
+    'continue_statement': 'BranchStmt',
+    'goto_statement': 'BranchStmt',
+    'fallthrough_statement': 'BranchStmt',
+    'empty_statement': 'EmptyStmt',
+    'if_statement': 'IfStmt',
+    'for_statement': 'ForStmt',
+    'expression_switch_statement': 'SwitchStmt',
+    'type_switch_statement': 'TypeSwitchStmt',
+    'expression_case': 'CaseClause',
+    'type_case': 'CaseClause',
+    'default_case': 'CaseClause',
+    'select_statement': 'SelectStmt',
+    'communication_case': 'CommClause',
+    'call_expression': 'CallExpr',
+    'type_conversion_expression': 'CallExpr',
+    'selector_expression': 'SelectorExpr',
+    'index_expression': 'IndexExpr',
+    'slice_expression': 'SliceExpr',
+    'type_assertion_expression': 'TypeAssertExpr',
+    'unary_expression': 'UnaryExpr',
+    'binary_expression': 'BinaryExpr',
+    'parenthesized_expression': 'ParenExpr',
+    'composite_literal': 'CompositeLit',
+    'literal_value': 'CompositeLit',
+    'keyed_element': 'KeyValueExpr',
+    'func_literal': 'FuncLit',
+    'variadic_argument': 'Ellipsis',
+    'interpreted_string_literal': 'BasicLit',
+    'raw_string_literal': 'BasicLit',
+    'int_literal': 'BasicLit',
+    'float_literal': 'BasicLit',
+    'imaginary_literal': 'BasicLit',
+    'rune_literal': 'BasicLit',
+    'identifier': 'Ident',
+    'field_identifier': 'Ident',
+    'type_identifier': 'Ident',
+    'package_identifier': 'Ident',
+    'label_name': 'Ident',
+    'blank_identifier': 'Ident',
+    'true': 'Ident',
+    'false': 'Ident',
+    'nil': 'Ident',
+    'iota': 'Ident',
+}
+
+_GEN_DECLS = {
+    'import_declaration': 'import',
+    'const_declaration': 'const',
+    'var_declaration': 'var',
+    'type_declaration': 'type',
+}
+_SPECS = ('const_spec', 'var_spec', 'type_spec', 'type_alias')
+_WHITESPACE = b' \t\r\n\f\v'
+
+
+def _text(node, code_bytes: bytes) -> str:
+    return code_bytes[node.start_byte:node.end_byte].decode('utf-8', errors='replace')
+
+
+def _ast_kind(node, parent_kind: Optional[str]) -> Optional[str]:
+    kind = GO_AST_KINDS.get(node.type) if node.is_named else None
+    if kind == 'ForStmt' and any(c.type == 'range_clause' for c in node.children):
+        return 'RangeStmt'
+    if kind == 'CaseClause' and parent_kind == 'SelectStmt':
+        return 'CommClause'
+    if kind == 'UnaryExpr' and node.children and node.children[0].type == '*':
+        return 'StarExpr'
+    return kind
+
+
+def _spec_name(node, code_bytes: bytes) -> Optional[str]:
+    name = node.child_by_field_name('name')
+    return _text(name, code_bytes) if name is not None else None
+
+
+def _receiver_type(node, code_bytes: bytes) -> Optional[str]:
+    receiver = node.child_by_field_name('receiver')
+    stack = [receiver] if receiver is not None else []
+    while stack:
+        current = stack.pop()
+        if current.type == 'type_identifier':
+            return _text(current, code_bytes)
+        stack.extend(reversed(current.children))
+    return None
+
+
+def _declaration(node, code_bytes: bytes) -> Optional[str]:
+    """Declaration name for a top-level declaration node, or None."""
+    if node.type == 'function_declaration':
+        return f"FuncDecl:{_spec_name(node, code_bytes) or '_'}"
+    if node.type == 'method_declaration':
+        name = _spec_name(node, code_bytes) or '_'
+        receiver = _receiver_type(node, code_bytes)
+        return f"FuncDecl:{receiver}.{name}" if receiver else f"FuncDecl:{name}"
+    if node.type in _GEN_DECLS:
+        specs = []
+        stack = list(node.children)
+        while stack:
+            current = stack.pop()
+            if current.type in _SPECS:
+                specs.append(current)
+            elif current.type.endswith('_spec_list'):
+                stack.extend(current.children)
+        if node.type != 'import_declaration' and len(specs) == 1:
+            return f"GenDecl:{_spec_name(specs[0], code_bytes) or _GEN_DECLS[node.type]}"
+        return f"GenDecl:{_GEN_DECLS[node.type]}"
+    return None
+
+
+def _frame(node, kind: Optional[str], decl: Optional[str]):
+    children = node.children
+    return node, children, [c.end_byte for c in children], kind, decl
+
+
+def annotate_go_tokens(tokens: List[Dict], tree, code_bytes: bytes) -> List[Dict]:
+    """Add 'ast_kind' and 'decl' to each token span (in place); returns tokens.
+
+    Tokens must be sorted by position (compute_token_spans order).
+    """
+    root = tree.root_node
+    stack = [_frame(root, _ast_kind(root, None) or 'File', None)]
+    for token in tokens:
+        start, end = token['start_byte'], token['end_byte']
+        # Ignore the whitespace a token carries around its text
+        while start < end and code_bytes[start] in _WHITESPACE:
+            start += 1
+        while end > start and code_bytes[end - 1] in _WHITESPACE:
+            end -= 1
+        if start == end:
+            start, end = token['start_byte'], token['end_byte']
+
+        while len(stack) > 1 and not (stack[-1][0].start_byte <= start and end <= stack[-1][0].end_byte):
+            stack.pop()
+        while True:
+            node, children, child_ends, kind, decl = stack[-1]
+            i = bisect.bisect_right(child_ends, start)
+            if i == len(children):
+                break
+            child = children[i]
+            if not (child.start_byte <= start and end <= child.end_byte):
+                break
+            child_kind = _ast_kind(child, kind) or kind
+            child_decl = decl
+            if len(stack) == 1:
+                child_decl = _declaration(child, code_bytes)
+            elif child.type in _SPECS and decl and decl.startswith('GenDecl:') and len(stack) <= 3:
+                child_decl = f"GenDecl:{_spec_name(child, code_bytes) or decl[len('GenDecl:'):]}"
+            stack.append(_frame(child, child_kind, child_decl))
+
+        token['ast_kind'] = stack[-1][3]
+        token['decl'] = stack[-1][4]
+    return tokens
+
+
+def go_ast_tokens(tokenizer, parser, code: str) -> List[Dict]:
+    """Tokenize Go code and annotate every token span with its go/ast kind and declaration."""
+    code_bytes = encode_source(code)
+    tree = parser.parse(code_bytes)
+    tokens, _ = compute_token_spans(tokenizer, code)
+    return annotate_go_tokens(tokens, tree, code_bytes)
+
+
+def select_tokens(tokens: List[Dict], kind: Optional[str] = None, decl: Optional[str] = None) -> List[int]:
+    """Indices of the annotated tokens matching a go/ast kind and/or declaration."""
+    return [i for i, t in enumerate(tokens)
+            if (kind is None or t.get('ast_kind') == kind) and (decl is None or t.get('decl') == decl)]
+
+
+def summarize_go_ast(tokens: List[Dict]) -> Dict:
+    """Token counts per go/ast kind and per declaration."""
+    return {
+        'total': len(tokens),
+        'kinds': dict(Counter(t.get('ast_kind') for t in tokens).most_common()),
+        'decls': dict(Counter(t.get('decl') or '-' for t in tokens).most_common()),
+    }
+
+
+def print_go_ast_summary(summary: Dict, title: str = "", limit: int = 15):
+    """Print the per-kind and per-declaration tables."""
+    print(f"\n{'='*60}")
+    print(f"Go AST Kinds{': ' + title if title else ''} ({summary['total']} tokens)")
+    print(f"{'='*60}")
+    for heading, counts in (('Kind', summary['kinds']), ('Declaration', summary['decls'])):
+        print(f"{heading:<32} {'Tokens':>10}")
+        print("-" * 43)
+        for name, n in list(counts.items())[:limit]:
+            print(f"{name:<32} {n:>10}")
+        if len(counts) > limit:
+            print(f"... {len(counts) - limit} more")
+        print()
@@ -0,0 +1,179 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Coverage - Project Go cover profiles onto token ranges
+
+A Go cover profile (go test -coverprofile=cover.out) lists statement blocks:
+
+  mode: set
+  example.com/mod/pkg/file.go:10.13,12.2 2 1
+                             start   end  statements count
+
+Lines and columns are 1-based, columns in bytes. Each block is mapped to a
+byte range and to the tokens overlapping it. A token is 'covered' when a
+block with a non-zero count overlaps it, 'uncovered' when only zero-count
+blocks do, and 'none' outside every block (declarations, comments, ...).
+Token coverage is covered / (covered + uncovered).
+
+Profile paths are import paths; they are mapped to files under root using
+the module path from root/go.mod, falling back to the longest path suffix
+that exists under root.
+"""
+
+import re
+from collections import defaultdict
+from pathlib import Path
+from typing import Dict, Iterable, List, Optional, Tuple, Union
+
+from position_index import PositionIndex
+from source_text import read_source
+from token_index import TokenIndex
+from token_spans import compute_token_spans
+
+_BLOCK = re.compile(r'^(?P<file>.+):(?P<sl>\d+)\.(?P<sc>\d+),(?P<el>\d+)\.(?P<ec>\d+) (?P<stmts>\d+) (?P<count>\d+)$')
+
+STATUSES = ('covered', 'uncovered', 'none')
+
+
+class CoverProfileError(ValueError):
+    """Raised for malformed cover profiles."""
+
+
+def parse_cover_profile(lines: Iterable[str]) -> Dict:
+    """{'mode', 'files': {import path: [block, ...]}}; repeated blocks add up their counts."""
+    mode = None
+    merged: Dict[Tuple, Dict] = {}
+    for number, raw in enumerate(lines, 1):
+        line = raw.strip()
+        if not line:
+            continue
+        if line.startswith('mode:'):
+            mode = line.split(':', 1)[1].strip()
+            continue
+        match = _BLOCK.match(line)
+        if match is None:
+            raise CoverProfileError(f"Line {number}: not a cover profile block: {line!r}")
+        key = (match.group('file'), int(match.group('sl')), int(match.group('sc')),
+               int(match.group('el')), int(match.group('ec')))
+        if key in merged:
+            merged[key]['count'] += int(match.group('count'))
+            continue
+        merged[key] = {
+            'start_line': key[1], 'start_column': key[2],
+            'end_line': key[3], 'end_column': key[4],
+            'statements': int(match.group('stmts')),
+            'count': int(match.group('count')),
+        }
+    if mode is None:
+        raise CoverProfileError("Missing 'mode:' header")
+    files: Dict[str, List[Dict]] = defaultdict(list)
+    for key, block in merged.items():
+        files[key[0]].append(block)
+    return {'mode': mode, 'files': dict(files)}
+
+
+def module_path(root: Path) -> Optional[str]:
+    try:
+        for line in (root / 'go.mod').read_text(encoding='utf-8', errors='replace').splitlines():
+            if line.startswith('module '):
+                return line.split(None, 1)[1].strip().strip('"')
+    except OSError:
+        pass
+    return None
+
+
+def local_path(import_path: str, root: Path, module: Optional[str] = None) -> Optional[Path]:
+    """File under root for a profile path, or None."""
+    if module and import_path.startswith(module + '/'):
+        candidate = root / import_path[len(module) + 1:]
+        if candidate.is_file():
+            return candidate
+    parts = import_path.split('/')
+    for i in range(len(parts)):
+        candidate = root.joinpath(*parts[i:])
+        if candidate.is_file():
+            return candidate
+    return None
+
+
+def file_coverage(tokenizer, path: Path, blocks: List[Dict], encoding: str = 'auto') -> Dict:
+    """Token statuses and coverage of one file."""
+    data = path.read_bytes()
+    text, byte_map = read_source(path, encoding=encoding)
+    spans, _ = compute_token_spans(tokenizer, text)
+    if byte_map is not None:
+        spans = [dict(s, start_byte=byte_map[s['start_byte']], end_byte=byte_map[s['end_byte']]) for s in spans]
+    positions = PositionIndex(data)
+    index = TokenIndex(spans)
+
+    status = ['none'] * len(spans)
+    mapped = []
+    for block in sorted(blocks, key=lambda b: (b['start_line'], b['start_column'])):
+        start = positions.offset(block['start_line'], block['start_column'])
+        end = positions.offset(block['end_line'], block['end_column'])
+        lo, hi = index.overlapping(start, end)
+        for i in range(lo, hi):
+            if block['count'] > 0:
+                status[i] = 'covered'
+            elif status[i] == 'none':
+                status[i] = 'uncovered'
+        mapped.append(dict(block, start_byte=start, end_byte=end, start_token=lo, end_token=hi))
+
+    runs = []
+    for i, s in enumerate(status):
+        if runs and runs[-1]['status'] == s:
+            runs[-1]['end_token'] = i + 1
+        else:
+            runs.append({'status': s, 'start_token': i, 'end_token': i + 1})
+    for run in runs:
+        run['start_byte'], run['end_byte'] = index.byte_range(run['start_token'], run['end_token'])
+
+    counts = {s: status.count(s) for s in STATUSES}
+    measured = counts['covered'] + counts['uncovered']
+    return {
+        'tokens': len(spans),
+        **counts,
+        'token_coverage': counts['covered'] / measured if measured else None,
+        'blocks': mapped,
+        'runs': runs,
+    }
+
+
+def profile_coverage(tokenizer, profile: Dict, root: Union[str, Path] = '.',
+                     encoding: str = 'auto') -> Dict:
+    """Token coverage of every profile file found under root."""
+    root = Path(root)
+    module = module_path(root)
+    files = {}
+    missing = []
+    for import_path, blocks in sorted(profile['files'].items()):
+        path = local_path(import_path, root, module)
+        if path is None:
+            missing.append(import_path)
+            continue
+        result = file_coverage(tokenizer, path, blocks, encoding)
+        result['path'] = path.relative_to(root).as_posix()
+        files[import_path] = result
+    covered = sum(f['covered'] for f in files.values())
+    measured = covered + sum(f['uncovered'] for f in files.values())
+    return {
+        'mode': profile['mode'],
+        'files': files,
+        'missing': missing,
+        'covered': covered,
+        'uncovered': measured - covered,
+        'token_coverage': covered / measured if measured else None,
+    }
+
+
+def print_coverage(result: Dict):
+    print(f"\n{'='*60}")
+    print(f"Token Coverage (mode: {result['mode']})")
+    print(f"{'='*60}")
+    for name, f in result['files'].items():
+        pct = f"{f['token_coverage']:.1%}" if f['token_coverage'] is not None else '-'
+        print(f"{pct:>7}  {f['covered']:>6} / {f['covered'] + f['uncovered']:<6} tokens  {f['path']}")
+    for name in result['missing']:
+        print(f"✗ Not found under root: {name}")
+    total = f"{result['token_coverage']:.1%}" if result['token_coverage'] is not None else '-'
+    print(f"\nTotal: {total} of statement tokens covered ({result['covered']} covered, {result['uncovered']} uncovered)")
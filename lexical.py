@@ -0,0 +1,175 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Lexical Classes - Tag each token with the lexical class of its span
+
+Classes come from the tree-sitter leaves of the language grammar:
+identifier, keyword, string, number, comment, punctuation, and whitespace
+for bytes between leaves. A token covering several classes is tagged with
+the class covering most of its bytes (whitespace only wins when the token
+is all whitespace) and marked 'mixed'.
+
+Answers questions like "what fraction of my prompt tokens are comments".
+"""
+
+import bisect
+from pathlib import Path
+from typing import Dict, List, Optional, Tuple
+
+from token_spans import compute_token_spans, encode_source
+
+LEXICAL_CLASSES = ('identifier', 'keyword', 'string', 'number', 'comment', 'punctuation', 'whitespace', 'other')
+
+# Analyzer language key -> grammar symbol in the compiled libraries
+LANGUAGE_SYMBOLS = {
+    'python': 'python',
+    'javascript': 'javascript',
+    'typescript': 'typescript',
+    'java': 'java',
+    'c': 'c',
+    'cpp': 'cpp',
+    'csharp': 'c_sharp',
+    'go': 'go',
+    'ruby': 'ruby',
+    'rust': 'rust',
+    'scala': 'scala',
+}
+
+_STRING_HINTS = ('string', 'char_literal', 'character_literal', 'heredoc', 'template', 'rune_literal', 'regex')
+_NUMBER_HINTS = ('number', 'integer', 'float', 'int_literal', 'decimal', 'hex', 'octal', 'binary_literal', 'imaginary')
+_WHITESPACE = b' \t\r\n\f\v'
+
+
+def load_parser(language: str, build_dir: Optional[Path] = None):
+    """Create a tree-sitter parser for an analyzer language key."""
+    from tree_sitter import Language, Parser
+    if language not in LANGUAGE_SYMBOLS:
+        raise ValueError(f"Unsupported language: {language}")
+    build_dir = Path(build_dir) if build_dir else Path(__file__).resolve().parent / 'build'
+    for name in (f"languages_{language}.so", "languages.so", "multilang_languages.so"):
+        library_path = build_dir / name
+        if library_path.exists():
+            parser = Parser()
+            parser.set_language(Language(str(library_path), LANGUAGE_SYMBOLS[language]))
+            return parser
+    raise FileNotFoundError(f"No compiled grammar for {language} in {build_dir}")
+
+
+def classify_leaf(node_type: str, is_named: bool, inside: Optional[str] = None) -> str:
+    """Lexical class of a tree-sitter leaf; inside is the enclosing string/comment class."""
+    if inside:
+        return inside
+    lowered = node_type.lower()
+    if 'comment' in lowered:
+        return 'comment'
+    if any(hint in lowered for hint in _STRING_HINTS) or lowered == 'escape_sequence':
+        return 'string'
+    if any(hint in lowered for hint in _NUMBER_HINTS):
+        return 'number'
+    if is_named:
+        if 'identifier' in lowered or lowered in ('constant', 'self', 'this', 'super', 'type', 'name'):
+            return 'identifier'
+        if lowered in ('true', 'false', 'none', 'nil', 'null', 'null_literal', 'boolean', 'boolean_literal'):
+            return 'keyword'
+        return 'other'
+    # Anonymous leaves are the literal text of the grammar rule
+    if node_type[:1].isalpha() or node_type[:1] == '_':
+        return 'keyword'
+    return 'punctuation'
+
+
+def lexical_segments(tree) -> List[Tuple[int, int, str]]:
+    """Sorted (start_byte, end_byte, class) for every non-empty leaf of a tree."""
+    segments = []
+    stack = [(tree.root_node, None)]
+    while stack:
+        node, inside = stack.pop()
+        children = node.children
+        if not children:
+            if node.end_byte > node.start_byte:
+                segments.append((node.start_byte, node.end_byte, classify_leaf(node.type, node.is_named, inside)))
+            continue
+        # Strings and comments with inner structure (quotes, escapes) stay one class
+        if inside is None:
+            node_class = classify_leaf(node.type, True)
+            if node_class in ('string', 'comment'):
+                inside = node_class
+        for child in reversed(children):
+            stack.append((child, inside))
+    segments.sort()
+    return segments
+
+
+def _token_class(counts: Dict[str, int]) -> str:
+    non_ws = {k: v for k, v in counts.items() if k != 'whitespace' and v}
+    if not non_ws:
+        return 'whitespace'
+    return max(non_ws, key=lambda k: (non_ws[k], -LEXICAL_CLASSES.index(k)))
+
+
+def enrich_tokens(tokens: List[Dict], code_bytes: bytes, segments: List[Tuple[int, int, str]]) -> List[Dict]:
+    """Add 'lexical_class' and 'mixed' to each token span (in place); returns tokens.
+
+    Tokens may come in any order and overlap (e.g. several byte-fallback
+    tokens of one character).
+    """
+    segment_ends = [seg[1] for seg in segments]
+    for token in tokens:
+        start, end = token['start_byte'], token['end_byte']
+        # First leaf ending after the token start
+        seg_idx = bisect.bisect_right(segment_ends, start)
+        counts: Dict[str, int] = {}
+        pos = start
+        k = seg_idx
+        while pos < end:
+            if k < len(segments) and segments[k][0] <= pos:
+                seg_end = min(segments[k][1], end)
+                counts[segments[k][2]] = counts.get(segments[k][2], 0) + seg_end - pos
+                pos = seg_end
+                k += 1
+                continue
+            # Bytes between leaves
+            gap_end = min(segments[k][0], end) if k < len(segments) else end
+            for b in code_bytes[pos:gap_end]:
+                key = 'whitespace' if b in _WHITESPACE else 'other'
+                counts[key] = counts.get(key, 0) + 1
+            pos = gap_end
+        token['lexical_class'] = _token_class(counts)
+        token['mixed'] = sum(1 for k, v in counts.items() if k != 'whitespace' and v) > 1
+    return tokens
+
+
+def classify_tokens(tokenizer, parser, code: str) -> List[Dict]:
+    """Tokenize code and tag every token span with its lexical class."""
+    code_bytes = encode_source(code)
+    tree = parser.parse(code_bytes)
+    tokens, _ = compute_token_spans(tokenizer, code)
+    return enrich_tokens(tokens, code_bytes, lexical_segments(tree))
+
+
+def summarize_classes(tokens: List[Dict]) -> Dict:
+    """Token count and fraction per lexical class."""
+    counts = {cls: 0 for cls in LEXICAL_CLASSES}
+    for token in tokens:
+        counts[token.get('lexical_class', 'other')] += 1
+    total = len(tokens)
+    return {
+        'total': total,
+        'mixed': sum(1 for t in tokens if t.get('mixed')),
+        'classes': {
+            cls: {'tokens': n, 'fraction': n / total if total else 0.0}
+            for cls, n in counts.items()
+        },
+    }
+
+
+def print_class_summary(summary: Dict, title: str = ""):
+    """Print the per-class table."""
+    print(f"\n{'='*60}")
+    print(f"Lexical Classes{': ' + title if title else ''} ({summary['total']} tokens, {summary['mixed']} mixed)")
+    print(f"{'='*60}")
+    print(f"{'Class':<14} {'Tokens':>10} {'Fraction':>10}")
+    print("-" * 36)
+    for cls, entry in summary['classes'].items():
+        if entry['tokens']:
+            print(f"{cls:<14} {entry['tokens']:>10} {entry['fraction']:>9.1%}")
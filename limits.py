@@ -0,0 +1,116 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Request Limits - Backpressure for the tokenization server
+
+RequestLimits bounds what a server accepts:
+- max_request_bytes   larger request bodies are refused (HTTP-style 413)
+- max_concurrent      requests admitted at once, running or waiting for the
+                      tokenizer; more callers wait for a slot
+- queue_timeout       seconds a caller may wait (for a slot and then for its
+                      turn) before being refused (429)
+
+max_concurrent and queue_timeout default to DEFAULT_MAX_CONCURRENT and
+DEFAULT_QUEUE_TIMEOUT, so a busy server refuses instead of queueing without
+bound. Refusals raise LimitExceeded, which carries the HTTP status and a
+structured payload for the response. None disables a limit.
+"""
+
+import threading
+import time
+from contextlib import contextmanager
+from typing import Dict, Iterator, Optional
+
+PAYLOAD_TOO_LARGE = 413
+TOO_MANY_REQUESTS = 429
+
+DEFAULT_MAX_CONCURRENT = 4
+DEFAULT_QUEUE_TIMEOUT = 10.0
+
+
+class LimitExceeded(Exception):
+    """A request refused by RequestLimits."""
+
+    def __init__(self, status: int, message: str, **details):
+        super().__init__(message)
+        self.status = status
+        self.message = message
+        self.details = details
+
+    def to_dict(self) -> Dict:
+        return dict(self.details, status=self.status, reason=self.message)
+
+
+class RequestLimits:
+    """Admission control: per-request size, concurrency and queueing time."""
+
+    def __init__(self, max_request_bytes: Optional[int] = None,
+                 max_concurrent: Optional[int] = DEFAULT_MAX_CONCURRENT,
+                 queue_timeout: Optional[float] = DEFAULT_QUEUE_TIMEOUT):
+        for name, value in (('max_request_bytes', max_request_bytes),
+                            ('max_concurrent', max_concurrent)):
+            if value is not None and value <= 0:
+                raise ValueError(f"{name} must be positive")
+        if queue_timeout is not None and queue_timeout < 0:
+            raise ValueError("queue_timeout must not be negative")
+        self.max_request_bytes = max_request_bytes
+        self.max_concurrent = max_concurrent
+        self.queue_timeout = queue_timeout
+        self._slots = threading.BoundedSemaphore(max_concurrent) if max_concurrent else None
+        self._lock = threading.Lock()
+        self._admitted = 0
+        self.rejected = {PAYLOAD_TOO_LARGE: 0, TOO_MANY_REQUESTS: 0}
+
+    @property
+    def admitted(self) -> int:
+        """Requests currently holding a slot."""
+        return self._admitted
+
+    def _reject(self, status: int, message: str, **details) -> LimitExceeded:
+        with self._lock:
+            self.rejected[status] += 1
+        return LimitExceeded(status, message, **details)
+
+    def check_size(self, size: int):
+        """Refuse a request body of size bytes if it exceeds max_request_bytes."""
+        if self.max_request_bytes is not None and size > self.max_request_bytes:
+            raise self._reject(PAYLOAD_TOO_LARGE, "Request too large",
+                               size=size, limit=self.max_request_bytes)
+
+    def deadline(self) -> Optional[float]:
+        """time.monotonic() deadline for a request arriving now."""
+        return None if self.queue_timeout is None else time.monotonic() + self.queue_timeout
+
+    def acquire(self, lock, deadline: Optional[float], what: str = "server busy"):
+        """Acquire another lock (e.g. a dispatch lock) before deadline, or refuse with 429."""
+        timeout = -1 if deadline is None else max(0.0, deadline - time.monotonic())
+        if not lock.acquire(timeout=timeout):
+            raise self._reject(TOO_MANY_REQUESTS, f"Queue timeout: {what}",
+                               queue_timeout=self.queue_timeout)
+
+    @contextmanager
+    def admit(self, size: int = 0, deadline: Optional[float] = None) -> Iterator[Optional[float]]:
+        """Admit one request of size bytes; yields its deadline.
+
+        deadline defaults to one queue_timeout from now; servers that queue
+        requests before admitting them pass the deadline taken on arrival.
+        Raises LimitExceeded (413) for oversized requests and (429) when the
+        deadline has passed or no slot frees up before it.
+        """
+        self.check_size(size)
+        if deadline is None:
+            deadline = self.deadline()
+        elif time.monotonic() > deadline:
+            raise self._reject(TOO_MANY_REQUESTS, "Queue timeout: waited for a worker",
+                               queue_timeout=self.queue_timeout)
+        if self._slots is not None:
+            self.acquire(self._slots, deadline, f"{self.max_concurrent} concurrent request(s) admitted")
+        with self._lock:
+            self._admitted += 1
+        try:
+            yield deadline
+        finally:
+            with self._lock:
+                self._admitted -= 1
+            if self._slots is not None:
+                self._slots.release()
@@ -0,0 +1,66 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Logit Bias Helper - Token IDs covering a region of a text
+
+tokens_covering_span(tokenizer, text, start, end) tokenizes the text and
+returns the exact token IDs whose spans overlap [start, end), in order,
+plus whether the region is token-aligned (starts at the first token's start
+and ends at the last token's end). A non-aligned region shares its edge
+tokens with the surrounding text, so biasing those IDs affects more than
+the region itself.
+
+Offsets are UTF-8 bytes by default, or characters of the Python string
+with unit='chars'. logit_bias_map and banned_token_ids turn the IDs into
+the shapes completion APIs take.
+"""
+
+from typing import Dict, Iterable, List
+
+from token_index import TokenIndex
+from token_spans import build_char_to_byte, compute_token_spans, encode_source
+
+SPAN_UNITS = ('bytes', 'chars')
+
+
+def tokens_covering_span(tokenizer, text: str, start: int, end: int, unit: str = 'bytes') -> Dict:
+    """Token IDs overlapping [start, end) of text and whether the span is token-aligned.
+
+    Returns {'ids', 'tokens': [i, j), 'bytes': [s, e) covered by those
+    tokens, 'aligned', 'partial'}; 'partial' is True when an edge token is
+    a byte-fallback piece of a character.
+    """
+    if unit not in SPAN_UNITS:
+        raise ValueError(f"Unknown span unit: {unit}")
+    if unit == 'chars':
+        char_to_byte = build_char_to_byte(text)
+        if not (0 <= start <= end <= len(text)):
+            raise ValueError(f"Invalid character span [{start}, {end}) for a text of {len(text)} characters")
+        start, end = char_to_byte[start], char_to_byte[end]
+    elif not (0 <= start <= end <= len(encode_source(text))):
+        raise ValueError(f"Invalid byte span [{start}, {end})")
+
+    spans, _ = compute_token_spans(tokenizer, text)
+    index = TokenIndex(spans)
+    i, j = index.overlapping(start, end)
+    if start == end:
+        j = i
+    covered = spans[i:j]
+    lo, hi = index.byte_range(i, j)
+    return {
+        'ids': [s['id'] for s in covered],
+        'tokens': [i, j],
+        'bytes': [lo, hi],
+        'aligned': (lo, hi) == (start, end),
+        'partial': bool(covered) and (covered[0]['partial'] or covered[-1]['partial']),
+    }
+
+
+def logit_bias_map(ids: Iterable[int], bias: float = -100) -> Dict[str, float]:
+    """{token_id: bias} for an OpenAI-style logit_bias parameter (string keys)."""
+    return {str(token_id): bias for token_id in dict.fromkeys(ids) if token_id is not None}
+
+
+def banned_token_ids(ids: Iterable[int]) -> List[List[int]]:
+    """Distinct IDs as single-token sequences (HF generate's bad_words_ids)."""
+    return [[token_id] for token_id in dict.fromkeys(ids) if token_id is not None]
@@ -0,0 +1,509 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+LSP Helper - JSON-RPC 2.0 over stdio for editor extensions
+
+Messages use LSP base-protocol framing ("Content-Length: N\\r\\n\\r\\n" + JSON),
+so a VS Code extension can talk to it with vscode-jsonrpc. Offsets are
+UTF-8 bytes; pass "positions": true to also get LSP (UTF-16) ranges.
+
+Methods:
+- encode {uri | text, positions?}          -> {count, tokens}
+- count {uri | text}                       -> {count}, plus version for a uri
+- tokenAt {uri, position | offset}         -> {index, token}
+- shutdown / exit
+
+Document synchronization notifications (no response; query count {uri}
+for the token count after an update):
+- textDocument/didOpen {textDocument}
+- textDocument/didChange {textDocument, contentChanges}
+- textDocument/didClose {textDocument}
+
+A message with a malformed Content-Length header gets a parse error
+(id null) and the server keeps reading.
+
+With a metrics.ServiceMetrics attached, every request is counted and timed
+(see metrics.py); tokoffset lsp-helper --metrics_port serves them on /metrics.
+
+With limits.RequestLimits attached, oversized requests fail with
+REQUEST_TOO_LARGE and requests that cannot be admitted within the queue
+timeout fail with SERVER_BUSY; error.data holds {status: 413 | 429, reason,
+...}. serve() checks Content-Length against the size limit before reading
+a body and skips oversized ones unread (their id, method and uri are taken
+from the first bytes). A refused didOpen/didChange closes the document, so
+later requests report it as not open instead of answering from stale text,
+and the client gets a window/showMessage error saying so.
+
+serve() handles document notifications and shutdown/exit in order on the
+reading thread and runs every other request on a fixed pool of worker
+threads (max_concurrent of them, DEFAULT_WORKERS without limits), so
+requests queue for the tokenizer and responses may arrive out of order.
+A request's queue timeout runs from its arrival, so one left waiting for a
+worker too long is refused with SERVER_BUSY. handle() may also be called from
+several threads (e.g. by an embedding host); handlers run one at a time.
+"""
+
+import concurrent.futures
+import json
+import re
+import sys
+import threading
+import time
+from contextlib import contextmanager
+from typing import Any, BinaryIO, Callable, Dict, Iterator, Optional, Tuple
+
+from limits import PAYLOAD_TOO_LARGE, LimitExceeded
+from textbuf import TextBuffer
+
+# JSON-RPC error codes
+PARSE_ERROR = -32700
+INVALID_REQUEST = -32600
+METHOD_NOT_FOUND = -32601
+INVALID_PARAMS = -32602
+INTERNAL_ERROR = -32603
+# Server-defined error codes
+REQUEST_TOO_LARGE = -32001
+SERVER_BUSY = -32002
+
+# Cheap methods that must always apply, exempt from request limits
+_UNLIMITED_METHODS = ('textDocument/didClose', 'shutdown', 'exit')
+# Notifications that replace a document's text; refusing one closes it
+_DOCUMENT_UPDATES = ('textDocument/didOpen', 'textDocument/didChange')
+# Methods serve() handles on the reading thread, in arrival order
+_IN_ORDER_METHODS = _DOCUMENT_UPDATES + _UNLIMITED_METHODS
+
+# Worker threads serve() runs requests on when no concurrency limit is set
+DEFAULT_WORKERS = 4
+
+# window/showMessage type
+MESSAGE_ERROR = 1
+
+# Leading bytes of a skipped oversized message searched for its id, method and uri
+_PEEK_BYTES = 4096
+_PEEK_FIELDS = {name: re.compile(rb'"' + name.encode('ascii') + rb'"\s*:\s*("(?:[^"\\]|\\.)*"|-?\d+)')
+                for name in ('id', 'method', 'uri')}
+
+
+class RpcError(Exception):
+    """Error returned to the client as a JSON-RPC error object."""
+
+    def __init__(self, code: int, message: str, data: Any = None):
+        super().__init__(message)
+        self.code = code
+        self.message = message
+        self.data = data
+
+
+def read_message(stream: BinaryIO) -> Optional[bytes]:
+    """Read one framed message body; None at end of stream.
+
+    Raises RpcError (PARSE_ERROR) for a malformed Content-Length, after
+    consuming the header block.
+    """
+    content_length = read_headers(stream)
+    return stream.read(content_length) if content_length is not None else None
+
+
+def read_headers(stream: BinaryIO) -> Optional[int]:
+    """Read one message's header block; returns its Content-Length (None at end of stream)."""
+    content_length = None
+    while True:
+        line = stream.readline()
+        if not line:
+            return None
+        line = line.strip()
+        if not line:
+            if content_length is None:
+                continue
+            break
+        name, _, value = line.decode('ascii', errors='replace').partition(':')
+        if name.strip().lower() == 'content-length':
+            value = value.strip()
+            if not value.isdigit():
+                _skip_headers(stream)
+                raise RpcError(PARSE_ERROR, f"Invalid Content-Length: {value!r}")
+            content_length = int(value)
+    return content_length
+
+
+def skip_body(stream: BinaryIO, length: int) -> bytes:
+    """Consume a message body without keeping it; returns its first _PEEK_BYTES bytes."""
+    head = stream.read(min(length, _PEEK_BYTES))
+    remaining = length - len(head)
+    while remaining > 0:
+        chunk = stream.read(min(remaining, 65536))
+        if not chunk:
+            break
+        remaining -= len(chunk)
+    return head
+
+
+def show_message(message: str, message_type: int = MESSAGE_ERROR) -> Dict:
+    """A window/showMessage notification for the client."""
+    return {'jsonrpc': '2.0', 'method': 'window/showMessage', 'params': {'type': message_type, 'message': message}}
+
+
+def _skip_headers(stream: BinaryIO):
+    """Consume the rest of a header block (up to the blank line)."""
+    while True:
+        line = stream.readline()
+        if not line or not line.strip():
+            return
+
+
+def write_message(stream: BinaryIO, payload: Dict):
+    """Write one framed JSON message."""
+    body = json.dumps(payload, ensure_ascii=False).encode('utf-8')
+    stream.write(f"Content-Length: {len(body)}\r\n\r\n".encode('ascii'))
+    stream.write(body)
+    stream.flush()
+
+
+class LspHelper:
+    """JSON-RPC method handlers over a set of open TextBuffers."""
+
+    def __init__(self, tokenizer, metrics=None, limits=None):
+        self.tokenizer = tokenizer
+        self.metrics = metrics
+        self.limits = limits
+        self._dispatch_lock = threading.Lock()
+        self.documents: Dict[str, TextBuffer] = {}
+        self.versions: Dict[str, int] = {}
+        self.shutdown_requested = False
+        self.exit_requested = False
+        self.methods: Dict[str, Callable[[Dict], Any]] = {
+            'encode': self.encode,
+            'count': self.count,
+            'tokenAt': self.token_at,
+            'textDocument/didOpen': self.did_open,
+            'textDocument/didChange': self.did_change,
+            'textDocument/didClose': self.did_close,
+            'shutdown': self.shutdown,
+            'exit': self.exit,
+        }
+
+    # ------------------------------------------------------------------
+    # Helpers
+    # ------------------------------------------------------------------
+    @staticmethod
+    def _uri(params: Dict) -> Optional[str]:
+        """The document a request names, as 'uri' or 'textDocument.uri'."""
+        return params.get('uri') or (params.get('textDocument') or {}).get('uri')
+
+    def _buffer(self, params: Dict) -> TextBuffer:
+        """Resolve the buffer for a request: an open uri or inline text."""
+        uri = self._uri(params)
+        if uri is not None:
+            if uri not in self.documents:
+                raise RpcError(INVALID_PARAMS, f"Document not open: {uri}")
+            if self.metrics is not None:
+                self.metrics.document_lookups.inc(source='open')
+            return self.documents[uri]
+        if 'text' in params:
+            if self.metrics is not None:
+                self.metrics.document_lookups.inc(source='inline')
+            return TextBuffer(self.tokenizer, params['text'])
+        raise RpcError(INVALID_PARAMS, "Expected 'uri' or 'text'")
+
+    @staticmethod
+    def _token_json(buffer: TextBuffer, index: int, positions: bool) -> Dict:
+        token = buffer.tokens[index]
+        result = {
+            'index': index,
+            'id': token['id'],
+            'start_byte': token['start_byte'],
+            'end_byte': token['end_byte'],
+            'partial': token['partial'],
+        }
+        if positions:
+            start_line, start_char = buffer.offset_to_utf16_position(token['start_byte'])
+            end_line, end_char = buffer.offset_to_utf16_position(token['end_byte'])
+            result['range'] = {
+                'start': {'line': start_line, 'character': start_char},
+                'end': {'line': end_line, 'character': end_char},
+            }
+        return result
+
+    # ------------------------------------------------------------------
+    # Methods
+    # ------------------------------------------------------------------
+    def encode(self, params: Dict) -> Dict:
+        buffer = self._buffer(params)
+        positions = bool(params.get('positions'))
+        return {
+            'count': buffer.token_count(),
+            'tokens': [self._token_json(buffer, i, positions) for i in range(buffer.token_count())],
+        }
+
+    def count(self, params: Dict) -> Dict:
+        result = {'count': self._buffer(params).token_count()}
+        uri = self._uri(params)
+        if uri is not None:
+            result['version'] = self.versions[uri]
+        return result
+
+    def token_at(self, params: Dict) -> Dict:
+        buffer = self._buffer(params)
+        if 'offset' in params:
+            offset = int(params['offset'])
+        elif 'position' in params:
+            position = params['position']
+            offset = buffer.utf16_position_to_offset(position['line'], position['character'])
+        else:
+            raise RpcError(INVALID_PARAMS, "Expected 'position' or 'offset'")
+        index = buffer.token_at(offset)
+        return {
+            'offset': offset,
+            'index': index,
+            'token': self._token_json(buffer, index, True) if index is not None else None,
+        }
+
+    def did_open(self, params: Dict) -> Dict:
+        doc = params.get('textDocument') or {}
+        if 'uri' not in doc:
+            raise RpcError(INVALID_PARAMS, "Expected textDocument.uri")
+        uri = doc['uri']
+        self.documents[uri] = TextBuffer(self.tokenizer, doc.get('text', ''))
+        self.versions[uri] = doc.get('version', 0)
+        return {'uri': uri, 'version': self.versions[uri], 'count': self.documents[uri].token_count()}
+
+    def did_change(self, params: Dict) -> Dict:
+        doc = params.get('textDocument') or {}
+        buffer = self._buffer({'uri': doc.get('uri')})
+        changes = buffer.apply_content_changes(params.get('contentChanges') or [])
+        uri = doc['uri']
+        self.versions[uri] = doc.get('version', self.versions.get(uri, 0) + 1)
+        return {
+            'uri': uri,
+            'version': self.versions[uri],
+            'count': buffer.token_count(),
+            'changes': changes,
+        }
+
+    def did_close(self, params: Dict) -> None:
+        uri = (params.get('textDocument') or {}).get('uri')
+        self.documents.pop(uri, None)
+        self.versions.pop(uri, None)
+        return None
+
+    def shutdown(self, params: Dict) -> None:
+        self.shutdown_requested = True
+        return None
+
+    def exit(self, params: Dict) -> None:
+        self.exit_requested = True
+        return None
+
+    # ------------------------------------------------------------------
+    # Metrics
+    # ------------------------------------------------------------------
+    @staticmethod
+    def _work(method: str, params: Dict, result: Any) -> Tuple[int, int]:
+        """(tokens produced, text bytes tokenized) by one successful request."""
+        def utf8_len(text: str) -> int:
+            return len(text.encode('utf-8', 'surrogateescape'))
+
+        if method in ('encode', 'count'):
+            # open documents were tokenized (and counted) when opened or changed
+            inline = self._uri(params) is None and 'text' in params
+            return (result['count'], utf8_len(params['text'])) if inline else (0, 0)
+        if method == 'textDocument/didOpen':
+            return result['count'], utf8_len(params['textDocument'].get('text', ''))
+        if method == 'textDocument/didChange':
+            tokens = sum(c['new_end_token'] - c['start_token'] for c in result['changes'])
+            return tokens, sum(utf8_len(c.get('text', '')) for c in params.get('contentChanges') or [])
+        return 0, 0
+
+    @staticmethod
+    def _status(response: Dict) -> str:
+        error = response.get('error')
+        if error is None:
+            return 'ok'
+        if isinstance(error.get('data'), dict) and 'status' in error['data']:
+            return str(error['data']['status'])
+        return 'error'
+
+    def _observe(self, method: str, status: str, elapsed: float, params: Dict, result: Any):
+        m = self.metrics
+        m.requests.inc(method=method, status=status)
+        m.latency.observe(elapsed, method=method)
+        if status == 'ok':
+            tokens, nbytes = self._work(method, params, result)
+            if tokens:
+                m.tokens.inc(tokens, method=method)
+            if nbytes:
+                m.bytes_processed.inc(nbytes, method=method)
+        m.open_documents.set(len(self.documents))
+
+    # ------------------------------------------------------------------
+    # Dispatch
+    # ------------------------------------------------------------------
+    def handle(self, body: bytes) -> Optional[Dict]:
+        """Handle one message body; returns the message to send back.
+
+        That is the response for requests, and None for notifications
+        except a refused didOpen/didChange, which returns a
+        window/showMessage notification telling the client.
+        """
+        message, error = self._parse(body)
+        if error is not None:
+            return error
+        return self._dispatch(message, len(body))
+
+    def _parse(self, body: bytes) -> Tuple[Optional[Dict], Optional[Dict]]:
+        """(message, None), or (None, error response) for unparsable or invalid messages."""
+        try:
+            message = json.loads(body.decode('utf-8'))
+        except Exception as e:
+            if self.metrics is not None:
+                self.metrics.requests.inc(method='', status='parse_error')
+            return None, {'jsonrpc': '2.0', 'id': None, 'error': {'code': PARSE_ERROR, 'message': str(e)}}
+
+        if not isinstance(message, dict) or 'method' not in message:
+            if self.metrics is not None:
+                self.metrics.requests.inc(method='', status='invalid_request')
+            return None, {'jsonrpc': '2.0', 'id': message.get('id') if isinstance(message, dict) else None,
+                          'error': {'code': INVALID_REQUEST, 'message': 'Invalid request'}}
+        return message, None
+
+    def _dispatch(self, message: Dict, size: int, deadline: Optional[float] = None) -> Optional[Dict]:
+        msg_id = message.get('id')
+        is_notification = 'id' not in message
+        started = time.perf_counter()
+        response = self._call(message, msg_id, size, deadline)
+        if self.metrics is not None:
+            method = message['method'] if message['method'] in self.methods else 'unknown'
+            status = self._status(response)
+            params = message.get('params') if isinstance(message.get('params'), dict) else {}
+            self._observe(method, status, time.perf_counter() - started, params, response.get('result'))
+        if is_notification:
+            error = response.get('error')
+            if error is not None and error['code'] in (REQUEST_TOO_LARGE, SERVER_BUSY) \
+                    and message['method'] in _DOCUMENT_UPDATES:
+                uri = ((message.get('params') or {}).get('textDocument') or {}).get('uri')
+                return self._closed_message(uri, error['message'])
+            return None
+        return response
+
+    @staticmethod
+    def _closed_message(uri: Optional[str], reason: str) -> Dict:
+        return show_message(f"Token counts for {uri} stopped: {reason}. "
+                            "The document was closed; reopen it to resume.")
+
+    def refuse_oversized(self, head: bytes, error: LimitExceeded) -> Optional[Dict]:
+        """Answer a message refused by size before it was read, from its first bytes.
+
+        A didOpen/didChange closes its document and gets a
+        window/showMessage; anything else gets a REQUEST_TOO_LARGE error
+        with the id found (null if none was).
+        """
+        fields = {}
+        for name, pattern in _PEEK_FIELDS.items():
+            match = pattern.search(head)
+            if match:
+                try:
+                    fields[name] = json.loads(match.group(1))
+                except ValueError:
+                    pass
+        method = fields.get('method')
+        if self.metrics is not None:
+            self.metrics.requests.inc(method=method if method in self.methods else 'unknown',
+                                      status=str(error.status))
+        if method in _DOCUMENT_UPDATES and 'id' not in fields:
+            uri = fields.get('uri')
+            if uri is not None:
+                with self._dispatch_lock:
+                    self.did_close({'textDocument': {'uri': uri}})
+            return self._closed_message(uri, error.message)
+        return {'jsonrpc': '2.0', 'id': fields.get('id'),
+                'error': {'code': REQUEST_TOO_LARGE, 'message': error.message, 'data': error.to_dict()}}
+
+    @contextmanager
+    def _admitted(self, method: str, size: int, deadline: Optional[float] = None) -> Iterator[None]:
+        """Hold the dispatch lock for one request, applying the request limits.
+
+        deadline is the request's queue deadline when it was taken on
+        arrival (serve() does, so time spent waiting for a worker counts).
+        """
+        if self.limits is None or method in _UNLIMITED_METHODS:
+            with self._dispatch_lock:
+                yield
+            return
+        with self.limits.admit(size, deadline) as deadline:
+            self.limits.acquire(self._dispatch_lock, deadline, "waiting for the tokenizer")
+            try:
+                yield
+            finally:
+                self._dispatch_lock.release()
+
+    def _call(self, message: Dict, msg_id: Any, size: int = 0, deadline: Optional[float] = None) -> Dict:
+        try:
+            handler = self.methods.get(message['method'])
+            if handler is None:
+                raise RpcError(METHOD_NOT_FOUND, f"Method not found: {message['method']}")
+            params = message.get('params') or {}
+            if not isinstance(params, dict):
+                raise RpcError(INVALID_PARAMS, "params must be an object")
+            try:
+                with self._admitted(message['method'], size, deadline):
+                    result = handler(params)
+            except LimitExceeded as e:
+                if message['method'] in ('textDocument/didOpen', 'textDocument/didChange'):
+                    with self._dispatch_lock:
+                        self.did_close(params)
+                code = REQUEST_TOO_LARGE if e.status == PAYLOAD_TOO_LARGE else SERVER_BUSY
+                raise RpcError(code, e.message, e.to_dict())
+        except RpcError as e:
+            error = {'code': e.code, 'message': e.message}
+            if e.data is not None:
+                error['data'] = e.data
+            return {'jsonrpc': '2.0', 'id': msg_id, 'error': error}
+        except (KeyError, TypeError, ValueError) as e:
+            return {'jsonrpc': '2.0', 'id': msg_id, 'error': {'code': INVALID_PARAMS, 'message': str(e)}}
+        except Exception as e:
+            return {'jsonrpc': '2.0', 'id': msg_id, 'error': {'code': INTERNAL_ERROR, 'message': str(e)}}
+        return {'jsonrpc': '2.0', 'id': msg_id, 'result': result}
+
+    def serve(self, stdin: BinaryIO, stdout: BinaryIO) -> int:
+        """Serve requests until 'exit' or end of input; returns the exit code."""
+        write_lock = threading.Lock()
+        max_workers = self.limits.max_concurrent if self.limits is not None and self.limits.max_concurrent else DEFAULT_WORKERS
+        pool = concurrent.futures.ThreadPoolExecutor(max_workers=max_workers, thread_name_prefix='lsp-helper')
+
+        def _send(message: Optional[Dict]):
+            if message is not None:
+                with write_lock:
+                    write_message(stdout, message)
+
+        while not self.exit_requested:
+            try:
+                length = read_headers(stdin)
+            except RpcError as e:
+                if self.metrics is not None:
+                    self.metrics.requests.inc(method='', status='parse_error')
+                _send({'jsonrpc': '2.0', 'id': None, 'error': {'code': e.code, 'message': e.message}})
+                continue
+            if length is None:
+                break
+            if self.limits is not None:
+                try:
+                    self.limits.check_size(length)
+                except LimitExceeded as e:
+                    _send(self.refuse_oversized(skip_body(stdin, length), e))
+                    continue
+            body = stdin.read(length)
+            message, error = self._parse(body)
+            if error is not None:
+                _send(error)
+            elif 'id' not in message or message['method'] in _IN_ORDER_METHODS:
+                _send(self._dispatch(message, len(body)))
+            else:
+                deadline = self.limits.deadline() if self.limits is not None else None
+                pool.submit(lambda m=message, n=len(body), d=deadline: _send(self._dispatch(m, n, d)))
+        pool.shutdown(wait=True)
+        return 0 if self.shutdown_requested or not self.exit_requested else 1
+
+
+def run_stdio(tokenizer, metrics=None, limits=None) -> int:
+    """Run the helper on the process stdin/stdout."""
+    return LspHelper(tokenizer, metrics, limits).serve(sys.stdin.buffer, sys.stdout.buffer)
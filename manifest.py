@@ -0,0 +1,143 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Chunk Manifest - Versioned JSON listing of the chunks of a corpus
+
+Written by the chunker (tokoffset chunk --manifest) and read by downstream
+indexers. Layout (version 1):
+
+{
+  "format": "tokoffset-chunk-manifest",
+  "version": 1,
+  "created": "2024-05-01T12:00:00Z",
+  "encoder": {"model": "gpt2", "fingerprint": "sha256:..."},
+  "max_tokens": 512,
+  "encoding": "auto",
+  "redact": false,
+  "chunks": [
+    {"id", "path", "content_hash", "start_byte", "end_byte",
+     "start_line", "end_line", "start_token", "end_token", "token_count"},
+    ...
+  ]
+}
+
+Readers accept any manifest with the same major version and ignore fields
+they don't know, so fields can be added without a version bump.
+"""
+
+import hashlib
+import json
+import os
+import time
+from pathlib import Path
+from typing import Dict, Iterable, List, Optional, Union
+
+MANIFEST_FORMAT = 'tokoffset-chunk-manifest'
+MANIFEST_VERSION = 1
+REQUIRED_CHUNK_FIELDS = ('id', 'path', 'content_hash', 'start_byte', 'end_byte', 'token_count')
+
+
+class ManifestError(ValueError):
+    """Raised for files that are not readable chunk manifests."""
+
+
+def content_hash(data: bytes) -> str:
+    """Hash of chunk content as stored in manifests."""
+    return 'sha256:' + hashlib.sha256(data).hexdigest()
+
+
+def encoder_fingerprint(tokenizer) -> str:
+    """Fingerprint of a tokenizer's encoding behavior.
+
+    Uses the full serialized fast tokenizer (vocab, merges, normalizer,
+    pre-tokenizer) when available, else the vocab and special tokens.
+    Tokenizer wrappers (SharedEncoder, NormalizingEncoder) carry their own.
+    """
+    fingerprint = getattr(tokenizer, 'fingerprint', None)
+    if isinstance(fingerprint, str):
+        return fingerprint
+    backend = getattr(tokenizer, 'backend_tokenizer', None)
+    if backend is not None and hasattr(backend, 'to_str'):
+        payload = backend.to_str()
+    else:
+        vocab = tokenizer.get_vocab() if hasattr(tokenizer, 'get_vocab') else {}
+        payload = json.dumps({
+            'class': type(tokenizer).__name__,
+            'vocab': sorted(vocab.items()),
+            'special_ids': sorted(getattr(tokenizer, 'all_special_ids', []) or []),
+        }, ensure_ascii=False)
+    return 'sha256:' + hashlib.sha256(payload.encode('utf-8')).hexdigest()
+
+
+def build_manifest(chunks: Iterable[Dict], model: str, fingerprint: str,
+                   max_tokens: Optional[int] = None, encoding: str = 'auto',
+                   redact: bool = False) -> Dict:
+    """Assemble a manifest dict from chunker output.
+
+    encoding and redact are the chunk_file settings, so files can be
+    re-chunked the same way (manifests without them used the defaults).
+    """
+    return {
+        'format': MANIFEST_FORMAT,
+        'version': MANIFEST_VERSION,
+        'created': time.strftime('%Y-%m-%dT%H:%M:%SZ', time.gmtime()),
+        'encoder': {'model': model, 'fingerprint': fingerprint},
+        'max_tokens': max_tokens,
+        'encoding': encoding,
+        'redact': redact,
+        'chunks': list(chunks),
+    }
+
+
+def validate_manifest(manifest: Dict) -> Dict:
+    """Check format, version and required chunk fields; returns the manifest."""
+    if not isinstance(manifest, dict) or manifest.get('format') != MANIFEST_FORMAT:
+        raise ManifestError("Not a tokoffset chunk manifest")
+    version = manifest.get('version')
+    if not isinstance(version, int) or version != MANIFEST_VERSION:
+        raise ManifestError(f"Unsupported manifest version: {version!r} (expected {MANIFEST_VERSION})")
+    if 'fingerprint' not in (manifest.get('encoder') or {}):
+        raise ManifestError("Manifest has no encoder fingerprint")
+    seen = set()
+    for i, chunk in enumerate(manifest.get('chunks') or []):
+        missing = [f for f in REQUIRED_CHUNK_FIELDS if f not in chunk]
+        if missing:
+            raise ManifestError(f"Chunk {i} is missing fields: {', '.join(missing)}")
+        if chunk['id'] in seen:
+            raise ManifestError(f"Duplicate chunk ID: {chunk['id']}")
+        seen.add(chunk['id'])
+    return manifest
+
+
+def write_manifest(manifest: Dict, path: Union[str, Path]):
+    """Write a manifest atomically (temp file + rename)."""
+    validate_manifest(manifest)
+    path = Path(path)
+    tmp = path.with_name(path.name + '.tmp')
+    with open(tmp, 'w', encoding='utf-8') as f:
+        json.dump(manifest, f, ensure_ascii=False, indent=2)
+    os.replace(tmp, path)
+
+
+def load_manifest(path: Union[str, Path]) -> Dict:
+    """Read and validate a manifest file."""
+    try:
+        with open(path, 'r', encoding='utf-8') as f:
+            manifest = json.load(f)
+    except json.JSONDecodeError as e:
+        raise ManifestError(f"Invalid manifest JSON: {e}")
+    return validate_manifest(manifest)
+
+
+def chunks_by_id(manifest: Dict) -> Dict[str, Dict]:
+    return {chunk['id']: chunk for chunk in manifest['chunks']}
+
+
+def chunks_by_path(manifest: Dict) -> Dict[str, List[Dict]]:
+    """Chunks grouped per source path, in file order."""
+    grouped: Dict[str, List[Dict]] = {}
+    for chunk in manifest['chunks']:
+        grouped.setdefault(chunk['path'], []).append(chunk)
+    for chunks in grouped.values():
+        chunks.sort(key=lambda c: c['start_byte'])
+    return grouped
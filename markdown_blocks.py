@@ -0,0 +1,158 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Markdown Code Blocks - Fenced code blocks of a Markdown document as token ranges
+
+Fences follow CommonMark: a line of at least three backticks or tildes
+(indented at most three spaces) opens a block, the info string's first word
+names its language, and a line of the same character at least as long
+closes it (an unclosed block runs to the end of the document).
+
+For every block the report gives:
+- its language (info string mapped to an analyzer language key), fence and
+  content byte spans in the Markdown file, and 1-based lines
+- doc_tokens: the token range [i, j) of its content in the whole document's
+  token stream, and whether the content edges fall on token boundaries
+- the block tokenized on its own through the language-aware pipeline
+  (lexical.classify_tokens) with its lexical class counts, when a grammar
+  for the language is available
+"""
+
+import re
+from typing import Dict, List, Optional
+
+from lexical import LANGUAGE_SYMBOLS, classify_tokens, load_parser
+from token_index import TokenIndex
+from token_spans import compute_token_spans, encode_source
+
+_FENCE = re.compile(rb'^( {0,3})(`{3,}|~{3,})[ \t]*([^\r\n]*?)[ \t]*\r?$')
+
+# Info-string words that are not language keys
+LANGUAGE_ALIASES = {
+    'py': 'python', 'python3': 'python', 'py3': 'python',
+    'js': 'javascript', 'jsx': 'javascript', 'node': 'javascript',
+    'ts': 'typescript', 'tsx': 'typescript',
+    'golang': 'go',
+    'h': 'c',
+    'c++': 'cpp', 'cc': 'cpp', 'cxx': 'cpp', 'hpp': 'cpp',
+    'c#': 'csharp', 'cs': 'csharp',
+    'rb': 'ruby',
+    'rs': 'rust',
+    'sc': 'scala',
+}
+
+
+def block_language(info: str) -> Optional[str]:
+    """Analyzer language key named by a fence info string, or None."""
+    word = info.split()[0].lower().strip('{}.') if info.strip() else ''
+    word = LANGUAGE_ALIASES.get(word, word)
+    return word if word in LANGUAGE_SYMBOLS else None
+
+
+def find_fenced_blocks(code_bytes: bytes) -> List[Dict]:
+    """Fenced code blocks: byte spans of the fences and content, lines, info string."""
+    blocks = []
+    lines = code_bytes.split(b'\n')
+    pos = 0
+    open_block = None
+    for number, line in enumerate(lines, 1):
+        line_end = pos + len(line)
+        next_pos = line_end + 1 if number < len(lines) else line_end
+        match = _FENCE.match(line)
+        if open_block is None:
+            # Backtick fences cannot have backticks in the info string
+            if match and not (match.group(2)[:1] == b'`' and b'`' in match.group(3)):
+                open_block = {
+                    'fence': match.group(2),
+                    'info': match.group(3).decode('utf-8', errors='replace'),
+                    'start_byte': pos,
+                    'content_start': next_pos,
+                    'start_line': number,
+                }
+        elif match and not match.group(3) and match.group(2)[:1] == open_block['fence'][:1] \
+                and len(match.group(2)) >= len(open_block['fence']):
+            blocks.append(dict(open_block, content_end=pos, end_byte=next_pos, end_line=number))
+            open_block = None
+        pos = next_pos
+    if open_block is not None:
+        blocks.append(dict(open_block, content_end=len(code_bytes), end_byte=len(code_bytes),
+                           end_line=len(lines)))
+    for block in blocks:
+        block['content_start'] = min(block['content_start'], block['content_end'])
+        block['fence'] = block['fence'].decode('ascii')
+    return blocks
+
+
+def markdown_blocks(tokenizer, text: str, byte_map: Optional[List[int]] = None,
+                    parsers: Optional[Dict[str, object]] = None) -> Dict:
+    """Fenced blocks of a Markdown text with their document token ranges and own tokens.
+
+    parsers caches tree-sitter parsers by language between calls (None
+    marks an unavailable grammar).
+    """
+    code_bytes = encode_source(text)
+    spans, _ = compute_token_spans(tokenizer, text)
+    index = TokenIndex(spans)
+    boundaries = set(index.starts) | set(index.ends)
+    parsers = {} if parsers is None else parsers
+
+    def _orig(pos: int) -> int:
+        return byte_map[pos] if byte_map is not None else pos
+
+    results = []
+    for block in find_fenced_blocks(code_bytes):
+        start, end = block['content_start'], block['content_end']
+        language = block_language(block['info'])
+        content = code_bytes[start:end].decode('utf-8', errors='surrogateescape')
+        classes = None
+        if language:
+            if language not in parsers:
+                try:
+                    parsers[language] = load_parser(language)
+                except Exception:
+                    parsers[language] = None
+        if language and parsers[language] is not None:
+            own = classify_tokens(tokenizer, parsers[language], content)
+            classes = {}
+            for token in own:
+                classes[token['lexical_class']] = classes.get(token['lexical_class'], 0) + 1
+        else:
+            own, _ = compute_token_spans(tokenizer, content)
+        lo, hi = index.overlapping(start, end)
+        if start == end:
+            hi = lo
+        results.append({
+            'language': language,
+            'info': block['info'],
+            'fence': block['fence'],
+            'bytes': [_orig(block['start_byte']), _orig(block['end_byte'])],
+            'content_bytes': [_orig(start), _orig(end)],
+            'lines': [block['start_line'], block['end_line']],
+            'doc_tokens': [lo, hi],
+            'aligned': start in boundaries and end in boundaries,
+            'tokens': len(own),
+            'classes': classes,
+        })
+    return {
+        'tokens': len(spans),
+        'block_tokens': sum(b['doc_tokens'][1] - b['doc_tokens'][0] for b in results),
+        'blocks': results,
+    }
+
+
+def print_markdown_blocks(result: Dict, title: str = ""):
+    """Print one row per fenced block."""
+    print(f"\n{'='*60}")
+    print(f"Markdown Code Blocks{': ' + title if title else ''} ({len(result['blocks'])} blocks, "
+          f"{result['block_tokens']}/{result['tokens']} tokens in blocks)")
+    print(f"{'='*60}")
+    print(f"{'Lines':<12} {'Language':<12} {'Content bytes':<18} {'Doc tokens':<14} {'Alone':>6}")
+    print("-" * 66)
+    for block in result['blocks']:
+        lines = f"L{block['lines'][0]}-L{block['lines'][1]}"
+        language = block['language'] or (block['info'].split()[0] if block['info'].strip() else '-')
+        content = '[{}, {})'.format(*block['content_bytes'])
+        doc = '[{}, {})'.format(*block['doc_tokens']) + ('' if block['aligned'] else '*')
+        print(f"{lines:<12} {language:<12} {content:<18} {doc:<14} {block['tokens']:>6}")
+    if any(not b['aligned'] for b in result['blocks']):
+        print("* a token crosses the edge of the block content")
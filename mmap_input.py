@@ -0,0 +1,119 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Memory-mapped Large File Input - Windowed tokenization with absolute offsets
+
+Large files are mmapped and tokenized one window at a time, so only the
+current window is ever copied into a Python string. Windows are cut after
+a newline where possible (otherwise on a UTF-8 character boundary), and all
+emitted token spans carry absolute byte offsets into the file.
+
+Note: tokens never straddle a window cut, so token counts can differ
+slightly from tokenizing the whole file at once when a pre-tokenizer would
+have merged text across the cut newline.
+"""
+
+import mmap
+import time
+import argparse
+from pathlib import Path
+from typing import Dict, Iterator, List, Optional, Tuple, Union
+
+from source_text import INVALID_UTF8_POLICIES, decode_source
+from token_spans import compute_token_spans
+
+DEFAULT_WINDOW_BYTES = 4 * 1024 * 1024
+
+
+def _window_end(mm: mmap.mmap, start: int, window_bytes: int) -> int:
+    """Pick the end of the window starting at start."""
+    size = len(mm)
+    end = min(start + window_bytes, size)
+    if end >= size:
+        return size
+    newline = mm.rfind(b'\n', start, end)
+    if newline != -1:
+        return newline + 1
+    # No newline in the window: back off to a UTF-8 character boundary
+    cut = end
+    while cut > start and (mm[cut] & 0xC0) == 0x80:
+        cut -= 1
+    return cut if cut > start else end
+
+
+def iter_file_windows(path: Union[str, Path],
+                      window_bytes: int = DEFAULT_WINDOW_BYTES,
+                      invalid_utf8: str = 'replace') -> Iterator[Tuple[int, str, Optional[List[int]]]]:
+    """Yield (base_offset, text, byte_map) for successive windows of a file.
+
+    byte_map maps byte offsets of the window text to offsets inside the
+    window bytes (see source_text.decode_source); add base_offset to get
+    absolute file offsets.
+    """
+    if window_bytes <= 0:
+        raise ValueError("window_bytes must be positive")
+    with open(path, 'rb') as f:
+        if Path(path).stat().st_size == 0:
+            return
+        with mmap.mmap(f.fileno(), 0, access=mmap.ACCESS_READ) as mm:
+            start = 0
+            while start < len(mm):
+                end = _window_end(mm, start, window_bytes)
+                text, byte_map = decode_source(mm[start:end], invalid_utf8)
+                yield start, text, byte_map
+                start = end
+
+
+def tokenize_file_windowed(tokenizer,
+                           path: Union[str, Path],
+                           window_bytes: int = DEFAULT_WINDOW_BYTES,
+                           invalid_utf8: str = 'replace') -> Iterator[Dict]:
+    """Tokenize a file window by window, yielding spans with absolute byte offsets.
+
+    Each span gets a file-wide 'index' in addition to the fields produced
+    by token_spans.compute_token_spans.
+    """
+    index = 0
+    for base, text, byte_map in iter_file_windows(path, window_bytes, invalid_utf8):
+        spans, _ = compute_token_spans(tokenizer, text)
+        for span in spans:
+            start, end = span['start_byte'], span['end_byte']
+            if byte_map is not None:
+                start, end = byte_map[start], byte_map[end]
+            span['start_byte'] = base + start
+            span['end_byte'] = base + end
+            span['index'] = index
+            index += 1
+            yield span
+
+
+def main():
+    parser = argparse.ArgumentParser(description='Tokenize a large file through mmap windows')
+    parser.add_argument('file', help='File to tokenize')
+    parser.add_argument('--model', default='gpt2', help='Tokenizer model')
+    parser.add_argument('--window_mb', type=float, default=DEFAULT_WINDOW_BYTES / 1024 / 1024, help='Window size in MB')
+    parser.add_argument('--invalid_utf8', choices=INVALID_UTF8_POLICIES, default='replace', help='Handling of malformed UTF-8')
+    args = parser.parse_args()
+
+    from transformers import AutoTokenizer
+    tokenizer = AutoTokenizer.from_pretrained(args.model)
+
+    window_bytes = max(1, int(args.window_mb * 1024 * 1024))
+    start_time = time.time()
+    token_count = 0
+    last_end = 0
+    for span in tokenize_file_windowed(tokenizer, args.file, window_bytes, args.invalid_utf8):
+        token_count += 1
+        last_end = span['end_byte']
+    elapsed = time.time() - start_time
+    size = Path(args.file).stat().st_size
+
+    print(f"File: {args.file}")
+    print(f"  Size: {size/1024/1024:.2f} MB")
+    print(f"  Tokens: {token_count}")
+    print(f"  Last token end byte: {last_end}")
+    print(f"  Time: {elapsed:.2f} seconds ({size/1024/1024/elapsed if elapsed > 0 else 0:.2f} MB/sec)")
+
+
+if __name__ == "__main__":
+    main()
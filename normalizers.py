@@ -0,0 +1,260 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Normalizer Chain - Text normalization steps that keep offsets into the original
+
+Every normalizer describes its work as byte range replacements (edits) of
+its input, so offset_map.apply_edits yields a byte map back to that input
+and a chain composes the maps of all its steps. However many transforms
+ran, a position in the normalized text resolves to the original file:
+
+  chain = NormalizerChain([UnicodeNormalize('NFKC'), Lowercase(), RegexReplace(r'\\s+', ' ')])
+  spans, normalized, byte_map = normalized_token_spans(tokenizer, text, chain)
+
+Built-in steps (NORMALIZERS, by name for specs like 'nfkc,lowercase'):
+- lowercase       str.lower per character
+- strip_accents   drop combining marks after canonical decomposition
+- nfc/nfd/nfkc/nfkd  Unicode normalization
+- regex           RegexReplace(pattern, replacement), spec 'regex:PATTERN=>REPLACEMENT'
+
+Character steps work on clusters of a base character and its combining
+marks, so a token covering part of a replacement ('ﬁ' -> 'fi') maps back
+to the whole cluster. Add steps by subclassing Normalizer and
+implementing edits(), or with register_normalizer.
+
+NormalizingEncoder wraps a tokenizer so that it normalizes every text it
+is given and reports offsets into that text. Anything built on the
+tokenizer (compute_token_spans, chunking, TextBuffer, the LSP helper)
+then tokenizes normalized text and still returns original-file spans;
+tokoffset.py --normalize (or the config 'normalize' list) applies it to
+every command.
+"""
+
+import bisect
+import hashlib
+import json
+import re
+import unicodedata
+from typing import Callable, Dict, List, Optional, Tuple
+
+from manifest import encoder_fingerprint
+from offset_map import apply_edits, compose_byte_maps, project_span
+from token_spans import build_char_to_byte, compute_token_spans
+
+Edit = Tuple[int, int, str]
+
+
+class Normalizer:
+    """One normalization step; subclasses return byte range edits of their input."""
+
+    name = 'normalizer'
+
+    def edits(self, text: str) -> List[Edit]:
+        raise NotImplementedError
+
+    def apply(self, text: str) -> Tuple[str, Optional[List[int]]]:
+        """(normalized text, byte map to text), the map None when nothing changed."""
+        edits = self.edits(text)
+        return apply_edits(text, edits) if edits else (text, None)
+
+
+def _clusters(text: str):
+    """(start, end) char ranges of a base character and the combining marks after it."""
+    start = 0
+    for i in range(1, len(text) + 1):
+        if i == len(text) or not unicodedata.combining(text[i]):
+            yield start, i
+            start = i
+
+
+class ClusterNormalizer(Normalizer):
+    """A step transforming each character cluster on its own."""
+
+    def transform(self, cluster: str) -> str:
+        raise NotImplementedError
+
+    def edits(self, text: str) -> List[Edit]:
+        char_to_byte = build_char_to_byte(text)
+        edits = []
+        for start, end in _clusters(text):
+            cluster = text[start:end]
+            new = self.transform(cluster)
+            if new != cluster:
+                edits.append((char_to_byte[start], char_to_byte[end], new))
+        return edits
+
+
+class Lowercase(ClusterNormalizer):
+    name = 'lowercase'
+
+    def transform(self, cluster: str) -> str:
+        return cluster.lower()
+
+
+class StripAccents(ClusterNormalizer):
+    name = 'strip_accents'
+
+    def transform(self, cluster: str) -> str:
+        decomposed = unicodedata.normalize('NFD', cluster)
+        return unicodedata.normalize('NFC', ''.join(ch for ch in decomposed if not unicodedata.combining(ch)))
+
+
+class UnicodeNormalize(ClusterNormalizer):
+    def __init__(self, form: str = 'NFKC'):
+        if form not in ('NFC', 'NFD', 'NFKC', 'NFKD'):
+            raise ValueError(f"Unknown normalization form: {form}")
+        self.form = form
+        self.name = form.lower()
+
+    def transform(self, cluster: str) -> str:
+        return unicodedata.normalize(self.form, cluster)
+
+
+class RegexReplace(Normalizer):
+    """Replace every match of a pattern (re.sub replacement syntax)."""
+
+    name = 'regex'
+
+    def __init__(self, pattern: str, replacement: str, flags: int = 0):
+        self.pattern = re.compile(pattern, flags)
+        self.replacement = replacement
+
+    def edits(self, text: str) -> List[Edit]:
+        char_to_byte = build_char_to_byte(text)
+        edits = []
+        for match in self.pattern.finditer(text):
+            new = match.expand(self.replacement)
+            if new != match.group(0):
+                edits.append((char_to_byte[match.start()], char_to_byte[match.end()], new))
+        return edits
+
+
+# Step name -> factory taking the spec argument (the part after ':'), if any
+NORMALIZERS: Dict[str, Callable[[Optional[str]], Normalizer]] = {}
+
+
+def register_normalizer(name: str, factory: Callable[[Optional[str]], Normalizer]):
+    """Add (or replace) a named normalizer for chain specs."""
+    NORMALIZERS[name] = factory
+
+
+def _regex_step(argument: Optional[str]) -> Normalizer:
+    if not argument or '=>' not in argument:
+        raise ValueError("regex steps need 'regex:PATTERN=>REPLACEMENT'")
+    pattern, replacement = argument.split('=>', 1)
+    return RegexReplace(pattern, replacement)
+
+
+register_normalizer('lowercase', lambda _: Lowercase())
+register_normalizer('strip_accents', lambda _: StripAccents())
+for _form in ('NFC', 'NFD', 'NFKC', 'NFKD'):
+    register_normalizer(_form.lower(), lambda _, form=_form: UnicodeNormalize(form))
+register_normalizer('regex', _regex_step)
+
+
+class NormalizerChain:
+    """Normalizers applied in order, with their byte maps composed."""
+
+    def __init__(self, steps: List[Normalizer], specs: Optional[List[str]] = None):
+        self.steps = list(steps)
+        # The specs the chain was built from (identifies it in fingerprints)
+        self.specs = list(specs) if specs is not None else [step.name for step in self.steps]
+
+    @classmethod
+    def from_spec(cls, specs: List[str]) -> 'NormalizerChain':
+        """Build from step specs: a name, or 'name:argument' (see NORMALIZERS)."""
+        steps = []
+        for spec in specs:
+            name, _, argument = spec.partition(':')
+            if name not in NORMALIZERS:
+                raise ValueError(f"Unknown normalizer: {name}")
+            steps.append(NORMALIZERS[name](argument or None))
+        return cls(steps, specs)
+
+    def apply(self, text: str, byte_map: Optional[List[int]] = None) -> Tuple[str, Optional[List[int]]]:
+        """Normalize text; the byte map leads from the result back to the file.
+
+        Pass the source_text byte map of text (if any) to chain it.
+        """
+        for step in self.steps:
+            text, step_map = step.apply(text)
+            byte_map = compose_byte_maps(step_map, byte_map)
+        return text, byte_map
+
+
+def normalized_token_spans(tokenizer, text: str, chain: NormalizerChain,
+                           byte_map: Optional[List[int]] = None) -> Tuple[List[Dict], str, Optional[List[int]]]:
+    """Tokenize the normalized text; spans carry original offsets.
+
+    Returns (spans, normalized text, byte map). Each span's start_byte and
+    end_byte refer to the file; norm_start and norm_end to the normalized
+    text. A token covering part of a replaced range maps to the whole range.
+    """
+    normalized, norm_map = chain.apply(text, byte_map)
+    spans, _ = compute_token_spans(tokenizer, normalized)
+    for span in spans:
+        span['norm_start'], span['norm_end'] = span['start_byte'], span['end_byte']
+        span['start_byte'], span['end_byte'] = project_span(norm_map, span['start_byte'], span['end_byte'])
+    return spans, normalized, norm_map
+
+
+class NormalizingEncoder:
+    """Tokenizer stand-in that normalizes its input and reports offsets into it.
+
+    Calls with return_offsets_mapping get character offsets of the text
+    passed in; a token covering part of a replaced range covers the whole
+    range. Other attributes read the wrapped tokenizer. The fingerprint
+    covers the chain, so token streams from different chains do not mix.
+    """
+
+    def __init__(self, tokenizer, chain: NormalizerChain):
+        self.tokenizer = tokenizer
+        self.chain = chain
+        payload = json.dumps({'encoder': encoder_fingerprint(tokenizer), 'normalize': chain.specs})
+        self.fingerprint = 'sha256:' + hashlib.sha256(payload.encode('utf-8')).hexdigest()
+
+    @staticmethod
+    def _original_offsets(text: str, normalized: str, byte_map: Optional[List[int]], offsets):
+        if byte_map is None:
+            return offsets
+        norm_c2b = build_char_to_byte(normalized)
+        text_c2b = build_char_to_byte(text)
+        mapped = []
+        for pair in offsets:
+            if not isinstance(pair, (list, tuple)) or len(pair) != 2 or None in pair:
+                mapped.append(pair)
+                continue
+            s = max(0, min(pair[0], len(normalized)))
+            e = max(s, min(pair[1], len(normalized)))
+            sb, eb = project_span(byte_map, norm_c2b[s], norm_c2b[e])
+            mapped.append((bisect.bisect_right(text_c2b, sb) - 1, bisect.bisect_left(text_c2b, eb)))
+        return mapped
+
+    def __call__(self, text, *args, **kwargs):
+        single = isinstance(text, str)
+        texts = [text] if single else list(text)
+        applied = [self.chain.apply(t) for t in texts]
+        normalized = [n for n, _ in applied]
+        encoding = self.tokenizer(normalized[0] if single else normalized, *args, **kwargs)
+        offsets = encoding.get('offset_mapping') if kwargs.get('return_offsets_mapping') else None
+        if offsets is None:
+            return encoding
+        if single:
+            offsets = [offsets]
+        mapped = [self._original_offsets(t, n, m, o) for t, (n, m), o in zip(texts, applied, offsets)]
+        return dict(encoding, offset_mapping=mapped[0] if single else mapped)
+
+    def encode(self, text: str, *args, **kwargs):
+        return self.tokenizer.encode(self.chain.apply(text)[0], *args, **kwargs)
+
+    def tokenize(self, text: str, *args, **kwargs):
+        return self.tokenizer.tokenize(self.chain.apply(text)[0], *args, **kwargs)
+
+    def copy(self) -> 'NormalizingEncoder':
+        """A private copy of the wrapped tokenizer, normalizing with the same chain."""
+        return NormalizingEncoder(self.tokenizer.copy(), self.chain)
+
+    def __getattr__(self, name: str):
+        if name.startswith('_') or name == 'tokenizer':
+            raise AttributeError(name)
+        return getattr(self.tokenizer, name)
@@ -0,0 +1,284 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Notebook Cells - Cell-aware tokenization of Jupyter notebooks (.ipynb)
+
+Each code/markdown cell's source is tokenized on its own, and every token
+is reported twice:
+- cell_start_byte / cell_end_byte   UTF-8 offsets into the cell source
+- file_start_byte / file_end_byte   offsets into the raw .ipynb JSON
+
+Cell sources are JSON strings (or lists of line strings), so file offsets
+come from a small position-aware JSON reader that keeps, for every decoded
+source byte, the raw bytes it came from: an escape such as '\\n' or
+'\\u00e9' covers all of its escape sequence, and a token spanning several
+lines of a list-form source starts in one string literal and ends in
+another. Only nbformat 4 notebooks (top-level "cells") are supported.
+"""
+
+import re
+from collections import Counter
+from pathlib import Path
+from typing import Dict, List, Optional, Tuple, Union
+
+from token_spans import compute_token_spans
+
+_ESCAPES = {ord('"'): '"', ord('\\'): '\\', ord('/'): '/', ord('b'): '\b',
+            ord('f'): '\f', ord('n'): '\n', ord('r'): '\r', ord('t'): '\t'}
+_NUMBER = re.compile(rb'-?(?:0|[1-9]\d*)(?:\.\d+)?(?:[eE][+-]?\d+)?')
+_LITERALS = ((b'true', True), (b'false', False), (b'null', None))
+_JSON_WHITESPACE = b' \t\r\n'
+
+
+class NotebookError(ValueError):
+    pass
+
+
+class _SourceString:
+    """Decoded bytes of a JSON string with the raw range of each byte."""
+
+    def __init__(self):
+        self.data = bytearray()
+        self.raw_starts: List[int] = []
+        self.raw_ends: List[int] = []
+
+    def add(self, chunk: bytes, raw_start: int, raw_end: int):
+        self.data += chunk
+        self.raw_starts.extend([raw_start] * len(chunk))
+        self.raw_ends.extend([raw_end] * len(chunk))
+
+
+class _Reader:
+    """Recursive-descent JSON reader recording the source strings of cells."""
+
+    def __init__(self, data: bytes):
+        self.data = data
+        self.sources: Dict[Tuple, _SourceString] = {}
+        self.source_ranges: Dict[int, Tuple[int, int]] = {}
+
+    def _error(self, pos: int, what: str):
+        raise NotebookError(f"Invalid notebook JSON at byte {pos}: {what}")
+
+    def _skip(self, pos: int) -> int:
+        while pos < len(self.data) and self.data[pos] in _JSON_WHITESPACE:
+            pos += 1
+        return pos
+
+    def value(self, pos: int, path: Tuple) -> Tuple[object, int]:
+        pos = self._skip(pos)
+        if pos >= len(self.data):
+            self._error(pos, "unexpected end of input")
+        start = pos
+        head = self.data[pos]
+        if head == ord('{'):
+            result, pos = self._object(pos, path)
+        elif head == ord('['):
+            result, pos = self._array(pos, path)
+        elif head == ord('"'):
+            record = len(path) in (3, 4) and path[0] == 'cells' and path[2] == 'source'
+            result, pos = self._string(pos, _SourceString() if record else None, path)
+        else:
+            for word, literal in _LITERALS:
+                if self.data.startswith(word, pos):
+                    return literal, pos + len(word)
+            match = _NUMBER.match(self.data, pos)
+            if match is None:
+                self._error(pos, f"unexpected {chr(head)!r}")
+            text = match.group().decode('ascii')
+            return (float(text) if any(c in text for c in '.eE') else int(text)), match.end()
+        if len(path) == 3 and path[0] == 'cells' and path[2] == 'source':
+            self.source_ranges[path[1]] = (start, pos)
+        return result, pos
+
+    def _object(self, pos: int, path: Tuple) -> Tuple[Dict, int]:
+        result = {}
+        pos = self._skip(pos + 1)
+        if self.data[pos:pos + 1] == b'}':
+            return result, pos + 1
+        while True:
+            pos = self._skip(pos)
+            if self.data[pos:pos + 1] != b'"':
+                self._error(pos, "expected a key")
+            key, pos = self._string(pos, None, path)
+            pos = self._skip(pos)
+            if self.data[pos:pos + 1] != b':':
+                self._error(pos, "expected ':'")
+            result[key], pos = self.value(pos + 1, path + (key,))
+            pos = self._skip(pos)
+            if self.data[pos:pos + 1] == b',':
+                pos += 1
+            elif self.data[pos:pos + 1] == b'}':
+                return result, pos + 1
+            else:
+                self._error(pos, "expected ',' or '}'")
+
+    def _array(self, pos: int, path: Tuple) -> Tuple[List, int]:
+        result = []
+        pos = self._skip(pos + 1)
+        if self.data[pos:pos + 1] == b']':
+            return result, pos + 1
+        while True:
+            item, pos = self.value(pos, path + (len(result),))
+            result.append(item)
+            pos = self._skip(pos)
+            if self.data[pos:pos + 1] == b',':
+                pos += 1
+            elif self.data[pos:pos + 1] == b']':
+                return result, pos + 1
+            else:
+                self._error(pos, "expected ',' or ']'")
+
+    def _hex4(self, pos: int) -> int:
+        digits = self.data[pos:pos + 4]
+        if len(digits) != 4 or not all(chr(b) in '0123456789abcdefABCDEF' for b in digits):
+            self._error(pos, "bad \\u escape")
+        return int(digits, 16)
+
+    def _string(self, pos: int, source: Optional[_SourceString], path: Tuple) -> Tuple[str, int]:
+        out = bytearray()
+        pos += 1
+        data = self.data
+        while True:
+            end = pos
+            while end < len(data) and data[end] not in (0x22, 0x5C):
+                end += 1
+            if end >= len(data):
+                self._error(pos, "unterminated string")
+            out += data[pos:end]
+            if source is not None:
+                for i in range(pos, end):
+                    source.add(data[i:i + 1], i, i + 1)
+            pos = end
+            if data[pos] == 0x22:
+                break
+            escape = data[pos + 1] if pos + 1 < len(data) else None
+            if escape in _ESCAPES:
+                chunk, raw_end = _ESCAPES[escape].encode('utf-8'), pos + 2
+            elif escape == ord('u'):
+                code, raw_end = self._hex4(pos + 2), pos + 6
+                if 0xD800 <= code < 0xDC00 and data[raw_end:raw_end + 2] == b'\\u':
+                    low = self._hex4(raw_end + 2)
+                    if 0xDC00 <= low < 0xE000:
+                        code, raw_end = 0x10000 + ((code - 0xD800) << 10) + (low - 0xDC00), raw_end + 6
+                # Lone surrogates cannot be UTF-8 encoded
+                chunk = (chr(code) if not 0xD800 <= code < 0xE000 else '\ufffd').encode('utf-8')
+            else:
+                self._error(pos, "bad escape")
+            out += chunk
+            if source is not None:
+                source.add(chunk, pos, raw_end)
+            pos = raw_end
+        if source is not None:
+            self.sources[path] = source
+        return out.decode('utf-8', errors='replace'), pos + 1
+
+
+def parse_notebook(data: bytes) -> List[Dict]:
+    """Cells of an nbformat 4 notebook with their decoded source and raw byte map.
+
+    Each cell: {'index', 'cell_type', 'source', 'source_range', 'raw_starts',
+    'raw_ends'}; raw_starts[i]/raw_ends[i] are the file bytes holding source
+    byte i, and source_range the file bytes of the whole "source" value.
+    """
+    reader = _Reader(data)
+    start = len(b'\xef\xbb\xbf') if data.startswith(b'\xef\xbb\xbf') else 0
+    notebook, pos = reader.value(start, ())
+    if reader._skip(pos) != len(data):
+        reader._error(pos, "trailing data")
+    if not isinstance(notebook, dict) or not isinstance(notebook.get('cells'), list):
+        raise NotebookError("Not an nbformat 4 notebook (no top-level 'cells' list)")
+
+    pieces_by_cell: Dict[int, List[Tuple[Tuple, _SourceString]]] = {}
+    for path, piece in reader.sources.items():
+        pieces_by_cell.setdefault(path[1], []).append((path, piece))
+
+    cells = []
+    for index, cell in enumerate(notebook['cells']):
+        if not isinstance(cell, dict):
+            continue
+        source = _SourceString()
+        for _, piece in sorted(pieces_by_cell.get(index, []), key=lambda p: p[0]):
+            source.data += piece.data
+            source.raw_starts += piece.raw_starts
+            source.raw_ends += piece.raw_ends
+        source_range = reader.source_ranges.get(index)
+        cells.append({
+            'index': index,
+            'cell_type': cell.get('cell_type', 'code'),
+            'source': bytes(source.data).decode('utf-8'),
+            'source_range': list(source_range) if source_range else None,
+            'raw_starts': source.raw_starts,
+            'raw_ends': source.raw_ends,
+        })
+    return cells
+
+
+def _file_range(cell: Dict, start: int, end: int) -> List[int]:
+    starts, ends = cell['raw_starts'], cell['raw_ends']
+    if start < end:
+        return [starts[start], ends[end - 1]]
+    if start < len(starts):
+        pos = starts[start]
+    elif ends:
+        pos = ends[-1]
+    else:
+        pos = cell['source_range'][0] if cell['source_range'] else 0
+    return [pos, pos]
+
+
+def tokenize_notebook(tokenizer, path: Union[str, Path], cell_types: Optional[List[str]] = None) -> Dict:
+    """Per-cell token spans (cell and file offsets) and token counts of a notebook."""
+    cells = parse_notebook(Path(path).read_bytes())
+    results = []
+    for cell in cells:
+        if cell_types and cell['cell_type'] not in cell_types:
+            continue
+        spans, _ = compute_token_spans(tokenizer, cell['source'])
+        tokens = []
+        for span in spans:
+            file_start, file_end = _file_range(cell, span['start_byte'], span['end_byte'])
+            tokens.append({
+                'id': span['id'],
+                'cell_start_byte': span['start_byte'],
+                'cell_end_byte': span['end_byte'],
+                'file_start_byte': file_start,
+                'file_end_byte': file_end,
+                'partial': span['partial'],
+            })
+        results.append({
+            'index': cell['index'],
+            'cell_type': cell['cell_type'],
+            'token_count': len(tokens),
+            'bytes': len(cell['raw_starts']),
+            'lines': cell['source'].count('\n') + 1 if cell['source'] else 0,
+            'source_range': cell['source_range'],
+            'tokens': tokens,
+        })
+    by_type = Counter()
+    for cell in results:
+        by_type[cell['cell_type']] += cell['token_count']
+    return {
+        'path': str(path),
+        'cells': results,
+        'summary': {
+            'cells': len(results),
+            'tokens': sum(by_type.values()),
+            'tokens_by_type': dict(by_type),
+        },
+    }
+
+
+def print_notebook_report(result: Dict):
+    """Print per-cell token counts and totals."""
+    summary = result['summary']
+    print(f"\n{'='*60}")
+    print(f"Notebook Cells: {result['path']} ({summary['cells']} cells, {summary['tokens']} tokens)")
+    print(f"{'='*60}")
+    print(f"{'Cell':>5} {'Type':<10} {'Lines':>6} {'Bytes':>8} {'Tokens':>8}  JSON bytes")
+    print("-" * 60)
+    for cell in result['cells']:
+        where = '[{}, {})'.format(*cell['source_range']) if cell['source_range'] else '-'
+        print(f"{cell['index']:>5} {cell['cell_type']:<10} {cell['lines']:>6} {cell['bytes']:>8} "
+              f"{cell['token_count']:>8}  {where}")
+    for cell_type, tokens in summary['tokens_by_type'].items():
+        print(f"  {cell_type}: {tokens} tokens")
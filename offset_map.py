@@ -0,0 +1,79 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Offset Maps - Byte maps for text rewritten before tokenization
+
+Rewrites such as redaction replace byte ranges of a text with other text.
+apply_edits performs the replacements and returns a byte map in the same
+form as source_text.decode_source: byte_map[i] is the original byte offset
+for byte offset i of the new text (len(new bytes) + 1 entries). Inside a
+replacement, offsets map to the start of the replaced range and its end to
+the end of the range, so a token covering a whole replacement maps back to
+the whole original range.
+
+compose_byte_maps chains maps (rewritten text -> decoded text -> file), so
+results can always be projected back to the file on disk; rewritten_offset
+goes the other way, from an original offset to the rewritten text.
+"""
+
+import bisect
+from typing import Iterable, List, Optional, Tuple
+
+from token_spans import encode_source
+
+
+def apply_edits(text: str, edits: Iterable[Tuple[int, int, str]]) -> Tuple[str, List[int]]:
+    """Replace byte ranges (start, end, replacement) of text; returns (new_text, byte_map).
+
+    Edits must not overlap; they are applied in position order.
+    """
+    data = encode_source(text)
+    out = bytearray()
+    byte_map: List[int] = []
+    pos = 0
+    for start, end, replacement in sorted(edits, key=lambda e: (e[0], e[1])):
+        if start < pos or end < start or end > len(data):
+            raise ValueError(f"Overlapping or invalid edit [{start}, {end})")
+        out += data[pos:start]
+        byte_map.extend(range(pos, start))
+        new = encode_source(replacement)
+        out += new
+        byte_map.extend([start] * len(new))
+        pos = end
+    out += data[pos:]
+    byte_map.extend(range(pos, len(data) + 1))
+    return out.decode('utf-8', errors='surrogateescape'), byte_map
+
+
+def compose_byte_maps(inner: Optional[List[int]], outer: Optional[List[int]]) -> Optional[List[int]]:
+    """Map through inner (new -> intermediate) and then outer (intermediate -> file)."""
+    if inner is None:
+        return outer
+    if outer is None:
+        return inner
+    return [outer[pos] for pos in inner]
+
+
+def project_span(byte_map: Optional[List[int]], start: int, end: int) -> Tuple[int, int]:
+    """Original byte range of [start, end) in the rewritten text.
+
+    An end offset inside a replacement extends to the end of the replaced range.
+    """
+    if byte_map is None:
+        return start, end
+    orig_start, orig_end = byte_map[start], byte_map[end]
+    if 0 < end < len(byte_map) - 1 and byte_map[end - 1] == orig_end:
+        # Bytes of a replacement all map to its start; the first byte after it maps to its end
+        probe = end
+        while probe < len(byte_map) - 1 and byte_map[probe] == orig_end:
+            probe += 1
+        orig_end = byte_map[probe]
+    return orig_start, orig_end
+
+
+def rewritten_offset(byte_map: Optional[List[int]], offset: int) -> int:
+    """Byte offset in the rewritten text where an original offset lands.
+
+    An offset inside a replaced range lands right after its replacement.
+    """
+    return bisect.bisect_left(byte_map, offset) if byte_map is not None else offset
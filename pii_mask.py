@@ -0,0 +1,120 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+PII Masking - Remove externally detected sensitive spans at token granularity
+
+Given byte ranges flagged by a PII detector (file offsets, optional
+labels), mask_spans tokenizes the text, widens every range to the tokens
+covering it, and either replaces those tokens with a placeholder
+(mode='replace') or drops them (mode='drop'). Ranges touching the same
+token are merged into one removal.
+
+The result lists, per removal, the requested ranges, the affected token
+indices and the token-aligned bytes removed together with their SHA-256,
+so a compliance pipeline can prove what was removed (and that nothing of
+it reached the model) without keeping the data itself. It also gives the
+masked token IDs (placeholder tokens spliced in), the masked text and a
+byte map from the masked text back to the file.
+"""
+
+import hashlib
+from typing import Dict, Iterable, List, Optional, Union
+
+from offset_map import apply_edits, compose_byte_maps, rewritten_offset
+from token_index import TokenIndex
+from token_spans import compute_token_spans, encode_source
+
+MASK_MODES = ('replace', 'drop')
+DEFAULT_PLACEHOLDER = '[PII]'
+
+
+def _normalize_spans(spans: Iterable[Union[Dict, List, tuple]]) -> List[Dict]:
+    result = []
+    for span in spans:
+        if isinstance(span, dict):
+            start, end, label = span['start_byte'], span['end_byte'], span.get('label')
+        else:
+            start, end = span[0], span[1]
+            label = span[2] if len(span) > 2 else None
+        if end < start:
+            raise ValueError(f"Invalid span [{start}, {end})")
+        result.append({'start_byte': int(start), 'end_byte': int(end), 'label': label})
+    return sorted(result, key=lambda s: (s['start_byte'], s['end_byte']))
+
+
+def mask_spans(tokenizer, text: str, spans: Iterable[Union[Dict, List, tuple]],
+               mode: str = 'replace', placeholder: str = DEFAULT_PLACEHOLDER,
+               byte_map: Optional[List[int]] = None) -> Dict:
+    """Mask the tokens covering sensitive byte ranges; returns the masked IDs/text and an audit of removals.
+
+    Span offsets refer to the file; byte_map (source_text) relates the
+    decoded text to it.
+    """
+    if mode not in MASK_MODES:
+        raise ValueError(f"Unknown mask mode: {mode}")
+    code_bytes = encode_source(text)
+
+    def _to_text(pos: int) -> int:
+        return min(rewritten_offset(byte_map, pos), len(code_bytes))
+
+    def _to_file(pos: int) -> int:
+        return byte_map[pos] if byte_map is not None else pos
+
+    token_spans, _ = compute_token_spans(tokenizer, text)
+    index = TokenIndex(token_spans)
+
+    removals: List[Dict] = []
+    for span in _normalize_spans(spans):
+        start, end = _to_text(span['start_byte']), _to_text(span['end_byte'])
+        i, j = index.overlapping(start, end)
+        if start == end or i == j:
+            continue
+        if removals and i < removals[-1]['tokens'][1]:
+            last = removals[-1]
+            last['tokens'][1] = max(last['tokens'][1], j)
+            last['spans'].append(span)
+            continue
+        removals.append({'tokens': [i, j], 'spans': [span]})
+
+    edits = []
+    placeholder_ids = tokenizer.encode(placeholder, add_special_tokens=False) if mode == 'replace' else []
+    masked_ids: List = []
+    kept_from = 0
+    affected: List[int] = []
+    for removal in removals:
+        i, j = removal['tokens']
+        lo, hi = index.byte_range(i, j)
+        removed = code_bytes[lo:hi]
+        removal['bytes'] = [_to_file(lo), _to_file(hi)]
+        removal['sha256'] = hashlib.sha256(removed).hexdigest()
+        removal['labels'] = sorted({s['label'] for s in removal['spans'] if s['label']})
+        edits.append((lo, hi, placeholder if mode == 'replace' else ''))
+        masked_ids.extend(s['id'] for s in token_spans[kept_from:i])
+        masked_ids.extend(placeholder_ids)
+        kept_from = j
+        affected.extend(range(i, j))
+    masked_ids.extend(s['id'] for s in token_spans[kept_from:])
+
+    masked_text, mask_map = apply_edits(text, edits) if edits else (text, None)
+    return {
+        'mode': mode,
+        'tokens': len(token_spans),
+        'affected_tokens': affected,
+        'removals': removals,
+        'ids': masked_ids,
+        'text': masked_text,
+        'byte_map': compose_byte_maps(mask_map, byte_map),
+    }
+
+
+def print_mask_report(result: Dict, path: str = ""):
+    """Print one line per removal and the totals."""
+    print(f"\n{'='*60}")
+    print(f"PII Masking{': ' + path if path else ''} ({result['mode']})")
+    print(f"{'='*60}")
+    for removal in result['removals']:
+        labels = ','.join(removal['labels']) or '-'
+        print(f"  tokens [{removal['tokens'][0]}, {removal['tokens'][1]})  bytes [{removal['bytes'][0]}, "
+              f"{removal['bytes'][1]})  {labels}  sha256:{removal['sha256'][:16]}")
+    print(f"{len(result['affected_tokens'])} of {result['tokens']} tokens masked in "
+          f"{len(result['removals'])} removal(s); {len(result['ids'])} tokens remain")
@@ -0,0 +1,110 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Position Index - Line/column <-> byte offset conversion for a document
+
+Tools disagree on what a column counts:
+- 'bytes'       UTF-8 bytes (go vet, gcc, clang)
+- 'utf16'       UTF-16 code units (tsc, LSP)
+- 'codepoints'  Unicode code points (rustc, Python tracebacks)
+
+PositionIndex converts 1-based (line, column) pairs in any of these units
+to byte offsets into the document bytes and back. Lines past the end clamp
+to the end of the document; columns past the end of a line clamp to the
+line end (before its newline).
+
+utf16_length and utf16_prefix are the UTF-16 counting primitives the other
+offset converters (textbuf, streambuf, session) share.
+"""
+
+import bisect
+from array import array
+from functools import cached_property
+from typing import List, Tuple
+
+COLUMN_UNITS = ('bytes', 'utf16', 'codepoints')
+
+
+def utf16_length(text: str) -> int:
+    """UTF-16 code units of text (a lone surrogate counts as one)."""
+    return len(text.encode('utf-16-le', errors='surrogatepass')) // 2
+
+
+def utf16_prefix(text: str, units: int) -> str:
+    """The start of text covering units UTF-16 code units; a split surrogate pair is kept whole."""
+    count = 0
+    for i, ch in enumerate(text):
+        if count >= units:
+            return text[:i]
+        count += 2 if ord(ch) > 0xFFFF else 1
+    return text
+
+
+class PositionIndex:
+    """Line start table over a UTF-8 document."""
+
+    def __init__(self, data: bytes):
+        self.data = data
+        self.line_starts: List[int] = [0]
+        pos = data.find(b'\n')
+        while pos != -1:
+            self.line_starts.append(pos + 1)
+            pos = data.find(b'\n', pos + 1)
+
+    @property
+    def line_count(self) -> int:
+        return len(self.line_starts)
+
+    @cached_property
+    def utf16_offsets(self) -> array:
+        """UTF-16 code units before every byte offset (len(data) + 1 entries).
+
+        Bytes inside a character share the value of its first byte.
+        """
+        offsets = array('q', [0]) * (len(self.data) + 1)
+        pos = units = 0
+        for ch in self.data.decode('utf-8', errors='surrogateescape'):
+            size = len(ch.encode('utf-8', errors='surrogateescape'))
+            for i in range(size):
+                offsets[pos + i] = units
+            pos += size
+            units += 2 if ord(ch) > 0xFFFF else 1
+        offsets[pos] = units
+        return offsets
+
+    def _line_bounds(self, index: int) -> Tuple[int, int]:
+        start = self.line_starts[index]
+        end = self.line_starts[index + 1] - 1 if index + 1 < len(self.line_starts) else len(self.data)
+        if end > start and self.data[end - 1:end] == b'\r':
+            end -= 1
+        return start, end
+
+    def offset(self, line: int, column: int = 1, unit: str = 'bytes') -> int:
+        """Byte offset of a 1-based (line, column) position."""
+        if unit not in COLUMN_UNITS:
+            raise ValueError(f"Unknown column unit: {unit}")
+        if line < 1:
+            return 0
+        if line > len(self.line_starts):
+            return len(self.data)
+        start, end = self._line_bounds(line - 1)
+        column = max(column, 1) - 1
+        if unit == 'bytes':
+            return min(start + column, end)
+        text = self.data[start:end].decode('utf-8', errors='surrogateescape')
+        prefix = utf16_prefix(text, column) if unit == 'utf16' else text[:column]
+        return start + len(prefix.encode('utf-8', errors='surrogateescape'))
+
+    def position(self, offset: int, unit: str = 'bytes') -> Tuple[int, int]:
+        """1-based (line, column) of a byte offset."""
+        if unit not in COLUMN_UNITS:
+            raise ValueError(f"Unknown column unit: {unit}")
+        offset = max(0, min(offset, len(self.data)))
+        index = bisect.bisect_right(self.line_starts, offset) - 1
+        start = self.line_starts[index]
+        if unit == 'bytes':
+            return index + 1, offset - start + 1
+        prefix = self.data[start:offset].decode('utf-8', errors='surrogateescape')
+        if unit == 'utf16':
+            return index + 1, utf16_length(prefix) + 1
+        return index + 1, len(prefix) + 1
@@ -0,0 +1,118 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Profiling - CPU, memory and trace profiles of CLI runs, and a tokenization benchmark
+
+profiled() wraps a block and writes whichever profiles were asked for:
+- cpuprofile  cProfile stats (python -m pstats FILE, snakeviz FILE)
+- memprofile  tracemalloc snapshot (tracemalloc.Snapshot.load(FILE)); the
+              top allocation sites and the peak are printed as well
+- trace       the tracing.py spans (encode, chunk, align, cache) as Chrome
+              trace events, for chrome://tracing or ui.perfetto.dev
+
+run_benchmark tokenizes every file under a root several times and reports
+throughput (MB/s, tokens/s) and the slowest files. Run it with the
+profile flags to get something actionable to attach to a performance
+report.
+"""
+
+import cProfile
+import json
+import statistics
+import sys
+import time
+import tracemalloc
+from contextlib import contextmanager
+from pathlib import Path
+from typing import Dict, Iterator, Optional, Union
+
+import tracing
+from repo_walker import walk_repository
+from source_text import read_source
+from token_spans import compute_token_spans, encode_source
+
+
+@contextmanager
+def profiled(cpuprofile: Optional[str] = None, memprofile: Optional[str] = None,
+             trace: Optional[str] = None) -> Iterator[None]:
+    """Profile the block; each profile is written to its path when given.
+
+    Messages go to stderr so they do not mix with the command's output
+    (e.g. --json on stdout).
+    """
+    profiler = cProfile.Profile() if cpuprofile else None
+    if memprofile:
+        tracemalloc.start(25)
+    if trace:
+        tracing.start_recording()
+    if profiler is not None:
+        profiler.enable()
+    try:
+        yield
+    finally:
+        if profiler is not None:
+            profiler.disable()
+            profiler.dump_stats(cpuprofile)
+            print(f"📁 CPU profile saved to: {cpuprofile} (python -m pstats {cpuprofile})", file=sys.stderr)
+        if trace:
+            events = tracing.stop_recording()
+            with open(trace, 'w', encoding='utf-8') as f:
+                json.dump({'traceEvents': events, 'displayTimeUnit': 'ms'}, f)
+            print(f"📁 Trace ({len(events)} spans) saved to: {trace} (open in ui.perfetto.dev)", file=sys.stderr)
+        if memprofile:
+            snapshot = tracemalloc.take_snapshot()
+            _, peak = tracemalloc.get_traced_memory()
+            tracemalloc.stop()
+            snapshot.dump(memprofile)
+            print(f"📁 Memory profile saved to: {memprofile} (peak {peak / 1e6:.1f} MB)", file=sys.stderr)
+            for stat in snapshot.statistics('lineno')[:10]:
+                print(f"  {stat.size / 1e6:8.2f} MB  {stat.count:8} blocks  {stat.traceback[0]}", file=sys.stderr)
+
+
+def run_benchmark(tokenizer, root: Union[str, Path], repeat: int = 3, encoding: str = 'auto',
+                  ignore_patterns=None) -> Dict:
+    """Time compute_token_spans over every file under root, repeat times."""
+    documents = []
+    for path in walk_repository(root, ignore_patterns=ignore_patterns):
+        text, _ = read_source(path, encoding=encoding)
+        documents.append((str(path), text, len(encode_source(text))))
+    total_bytes = sum(size for _, _, size in documents)
+    rounds = []
+    per_file: Dict[str, float] = {}
+    tokens = 0
+    for _ in range(max(1, repeat)):
+        tokens = 0
+        round_start = time.perf_counter()
+        for name, text, _ in documents:
+            start = time.perf_counter()
+            spans, _ = compute_token_spans(tokenizer, text)
+            elapsed = time.perf_counter() - start
+            per_file[name] = min(per_file.get(name, elapsed), elapsed)
+            tokens += len(spans)
+        rounds.append(time.perf_counter() - round_start)
+    best = min(rounds)
+    return {
+        'files': len(documents),
+        'bytes': total_bytes,
+        'tokens': tokens,
+        'rounds': rounds,
+        'best_seconds': best,
+        'median_seconds': statistics.median(rounds),
+        'mb_per_second': total_bytes / best / 1e6 if best else 0.0,
+        'tokens_per_second': tokens / best if best else 0.0,
+        'slowest': sorted(per_file.items(), key=lambda item: -item[1])[:5],
+    }
+
+
+def print_benchmark(result: Dict):
+    print(f"\n{'='*60}")
+    print("Tokenization Benchmark")
+    print(f"{'='*60}")
+    print(f"Files: {result['files']}, {result['bytes']:,} bytes, {result['tokens']:,} tokens")
+    print(f"Rounds: {len(result['rounds'])}, best {result['best_seconds']:.3f}s, "
+          f"median {result['median_seconds']:.3f}s")
+    print(f"Throughput: {result['mb_per_second']:.2f} MB/s, {result['tokens_per_second']:,.0f} tokens/s")
+    if result['slowest']:
+        print("Slowest files:")
+        for name, seconds in result['slowest']:
+            print(f"  {seconds * 1000:8.1f} ms  {name}")
@@ -0,0 +1,95 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Secret Redaction - Mask secrets before tokenization, keep offsets to the original
+
+redact_text runs detectors over a text and replaces every match with a
+fixed-length placeholder ('[REDACTED]' by default, '{name}' expands to the
+detector name), so neither the secret nor its length reaches the
+tokenizer. It returns the redacted text with a byte map back to the
+original (offset_map.apply_edits), so token spans, chunks and line numbers
+computed on the redacted text can be projected onto the file on disk.
+
+Detectors are regular expressions registered by name; group 1, when the
+pattern has one, is the part to mask (the value of "password = ..."
+rather than the whole assignment). Add your own with register_detector.
+Overlapping matches are merged under the name of the one starting first.
+"""
+
+import re
+from typing import Dict, Iterable, List, Optional
+
+from offset_map import apply_edits, compose_byte_maps
+from token_spans import build_char_to_byte
+
+DEFAULT_PLACEHOLDER = '[REDACTED]'
+
+# Detector name -> compiled pattern (group 1, if any, is the secret)
+DETECTORS: Dict[str, re.Pattern] = {}
+
+
+def register_detector(name: str, pattern: str, flags: int = 0):
+    """Add (or replace) a named secret detector."""
+    DETECTORS[name] = re.compile(pattern, flags)
+
+
+register_detector('private_key', r'-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----')
+register_detector('aws_access_key', r'\b(?:AKIA|ASIA)[0-9A-Z]{16}\b')
+register_detector('github_token', r'\bgh[pousr]_[A-Za-z0-9]{36,}\b')
+register_detector('slack_token', r'\bxox[abposr]-[A-Za-z0-9-]{10,}')
+register_detector('google_api_key', r'\bAIza[0-9A-Za-z_\-]{35}')
+register_detector('api_key', r'\bsk-(?:[A-Za-z0-9_\-]{2,}-)?[A-Za-z0-9_\-]{20,}')
+register_detector('bearer_token', r'(?i)\bbearer\s+([A-Za-z0-9_\-.=+/]{16,})')
+register_detector('password', r'''(?i)\b(?:password|passwd|pwd|secret|api_?key|access_?token|auth_?token)\b["']?\s*[:=]\s*["']?([^\s"',;]{4,})''')
+
+
+def find_secrets(text: str, detectors: Optional[Iterable[str]] = None) -> List[Dict]:
+    """Non-overlapping secret matches {'detector', 'start_byte', 'end_byte'} in text, in order."""
+    names = list(detectors) if detectors is not None else list(DETECTORS)
+    unknown = [name for name in names if name not in DETECTORS]
+    if unknown:
+        raise ValueError(f"Unknown detector(s): {', '.join(unknown)}")
+    char_to_byte = build_char_to_byte(text)
+    found = []
+    for priority, name in enumerate(names):
+        pattern = DETECTORS[name]
+        for match in pattern.finditer(text):
+            group = 1 if pattern.groups else 0
+            if match.start(group) == match.end(group):
+                continue
+            found.append((match.start(group), -match.end(group), priority, name, match.end(group)))
+    found.sort()
+    matches = []
+    for start, _, _, name, end in found:
+        if matches and start < matches[-1]['_end']:
+            if end > matches[-1]['_end']:
+                matches[-1]['_end'] = end
+                matches[-1]['end_byte'] = char_to_byte[end]
+            continue
+        matches.append({'detector': name, 'start_byte': char_to_byte[start],
+                        'end_byte': char_to_byte[end], '_end': end})
+    for match in matches:
+        del match['_end']
+    return matches
+
+
+def redact_text(text: str, detectors: Optional[Iterable[str]] = None,
+                placeholder: str = DEFAULT_PLACEHOLDER,
+                byte_map: Optional[List[int]] = None) -> Dict:
+    """Redact secrets; returns {'text', 'byte_map', 'matches'}.
+
+    byte_map maps redacted-text bytes to original file bytes; pass the
+    source_text byte map of text (if any) to chain it. Match offsets refer
+    to the file as well.
+    """
+    matches = find_secrets(text, detectors)
+    edits = [(m['start_byte'], m['end_byte'], placeholder.replace('{name}', m['detector'])) for m in matches]
+    redacted, redact_map = apply_edits(text, edits) if edits else (text, None)
+    if byte_map is not None:
+        for match in matches:
+            match['start_byte'], match['end_byte'] = byte_map[match['start_byte']], byte_map[match['end_byte']]
+    return {
+        'text': redacted,
+        'byte_map': compose_byte_maps(redact_map, byte_map),
+        'matches': matches,
+    }
@@ -0,0 +1,348 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Repository Walker - Scan a repository for text files and summarize token counts
+
+- Honors .gitignore and .tokignore files at every directory level
+  (gitignore syntax: negation, directory-only and anchored patterns, '**'),
+  plus optional extra patterns (e.g. the project config 'ignore' list,
+  anchored at the config file's directory)
+- Skips binary files by sniffing their first bytes (UTF-16/32 text is kept)
+- Feeds files to the tokenizer in batches and aggregates token counts per
+  file and per directory
+"""
+
+import os
+import re
+from pathlib import Path
+from typing import Dict, Iterator, List, Optional, Tuple, Union
+
+from source_text import bom_encoding, detect_utf16, read_source
+from token_spans import ESCAPED_BYTE_PATTERN
+
+IGNORE_FILES = ('.gitignore', '.tokignore')
+ALWAYS_SKIPPED_DIRS = {'.git', '.hg', '.svn'}
+SNIFF_BYTES = 8192
+
+# File extension -> analyzer language key (mirrors QuickMultiLanguageAnalyzer.language_configs)
+LANGUAGE_EXTENSIONS = {
+    '.py': 'python',
+    '.js': 'javascript',
+    '.ts': 'typescript',
+    '.java': 'java',
+    '.c': 'c', '.h': 'c',
+    '.cpp': 'cpp', '.cc': 'cpp', '.cxx': 'cpp', '.hpp': 'cpp',
+    '.cs': 'csharp',
+    '.go': 'go',
+    '.rb': 'ruby',
+    '.rs': 'rust',
+    '.scala': 'scala',
+}
+
+
+def language_for_path(path) -> Optional[str]:
+    """Guess the analyzer language of a file from its extension."""
+    return LANGUAGE_EXTENSIONS.get(Path(path).suffix.lower())
+
+
+def _glob_to_regex(pattern: str) -> str:
+    """Translate a gitignore glob (without anchoring) into a regex body."""
+    out = []
+    i = 0
+    n = len(pattern)
+    while i < n:
+        c = pattern[i]
+        if pattern.startswith('**/', i):
+            out.append('(?:.*/)?')
+            i += 3
+        elif pattern.startswith('/**', i) and i + 3 == n:
+            out.append('/.*')
+            i += 3
+        elif pattern.startswith('**', i):
+            out.append('.*')
+            i += 2
+        elif c == '*':
+            out.append('[^/]*')
+            i += 1
+        elif c == '?':
+            out.append('[^/]')
+            i += 1
+        elif c == '[':
+            close = pattern.find(']', i + 2)
+            if close == -1:
+                out.append(re.escape(c))
+                i += 1
+            else:
+                body = pattern[i + 1:close]
+                if body.startswith('!'):
+                    body = '^' + body[1:]
+                out.append('[' + body.replace('\\', '\\\\') + ']')
+                i = close + 1
+        elif c == '\\' and i + 1 < n:
+            out.append(re.escape(pattern[i + 1]))
+            i += 2
+        else:
+            out.append(re.escape(c))
+            i += 1
+    return ''.join(out)
+
+
+class IgnoreRule:
+    """One gitignore pattern, relative to the directory of its ignore file."""
+
+    def __init__(self, pattern: str, base: str, negate: bool = False, prefix: str = ''):
+        self.negate = negate
+        self.dir_only = pattern.endswith('/')
+        pattern = pattern.rstrip('/')
+        anchored = '/' in pattern
+        pattern = pattern.lstrip('/')
+        body = _glob_to_regex(pattern)
+        if not anchored:
+            body = '(?:.*/)?' + body
+        self.regex = re.compile('^' + body + '$')
+        self.base = base
+        # Path of the walk root relative to the rule's directory, when the
+        # rule lives above the root
+        self.prefix = prefix
+
+    def matches(self, rel_path: str, is_dir: bool) -> bool:
+        if self.dir_only and not is_dir:
+            return False
+        if self.prefix:
+            rel_path = f"{self.prefix}/{rel_path}"
+        if self.base:
+            if not rel_path.startswith(self.base + '/'):
+                return False
+            rel_path = rel_path[len(self.base) + 1:]
+        return bool(self.regex.match(rel_path))
+
+
+def parse_ignore_file(path: Path, base: str) -> List[IgnoreRule]:
+    """Parse one ignore file; base is its directory relative to the repo root."""
+    try:
+        lines = path.read_text(encoding='utf-8', errors='replace').splitlines()
+    except OSError:
+        return []
+    return parse_ignore_lines(lines, base)
+
+
+def parse_ignore_lines(lines: List[str], base: str = '', prefix: str = '') -> List[IgnoreRule]:
+    """Parse gitignore-syntax lines; base is their directory relative to the repo root.
+
+    prefix is the repo root relative to their directory, for lines that live
+    above the root (see AnchoredPatterns).
+    """
+    rules = []
+    for line in lines:
+        line = line.rstrip('\r')
+        # Trailing spaces are ignored unless escaped
+        if not line.endswith('\\ '):
+            line = line.rstrip(' ')
+        if not line or line.startswith('#'):
+            continue
+        negate = line.startswith('!')
+        if negate:
+            line = line[1:]
+        elif line.startswith('\\#') or line.startswith('\\!'):
+            line = line[1:]
+        if line:
+            rules.append(IgnoreRule(line, base, negate, prefix))
+    return rules
+
+
+class AnchoredPatterns:
+    """Gitignore-style patterns relative to a fixed directory rather than the walk root.
+
+    The project config's 'ignore' list is anchored at the config file's
+    directory, so "/build" means the same directory whichever subdirectory
+    a command walks.
+    """
+
+    def __init__(self, patterns: List[str], directory: Union[str, Path]):
+        self.patterns = list(patterns)
+        self.directory = Path(directory)
+
+    def rules_for(self, root: Path) -> Optional[List[IgnoreRule]]:
+        """Rules for a walk of root; None when they ignore root itself."""
+        root = root.resolve()
+        directory = self.directory.resolve()
+        if root == directory or directory in root.parents:
+            prefix = root.relative_to(directory).as_posix() if root != directory else ''
+            parts = prefix.split('/') if prefix else []
+            unprefixed = parse_ignore_lines(self.patterns)
+            for depth in range(1, len(parts) + 1):
+                if is_ignored(unprefixed, '/'.join(parts[:depth]), True):
+                    return None
+            return parse_ignore_lines(self.patterns, prefix=prefix)
+        if root in directory.parents:
+            return parse_ignore_lines(self.patterns, base=directory.relative_to(root).as_posix())
+        # Disjoint trees: the patterns say nothing about root
+        return []
+
+
+def is_ignored(rules: List[IgnoreRule], rel_path: str, is_dir: bool) -> bool:
+    """Apply rules in order; the last matching rule decides."""
+    ignored = False
+    for rule in rules:
+        if rule.matches(rel_path, is_dir):
+            ignored = not rule.negate
+    return ignored
+
+
+def is_binary_file(path, sniff_bytes: int = SNIFF_BYTES) -> bool:
+    """Sniff the start of a file: NUL bytes or mostly control bytes mean binary."""
+    try:
+        with open(path, 'rb') as f:
+            head = f.read(sniff_bytes)
+    except OSError:
+        return True
+    if not head:
+        return False
+    # UTF-16/32 text is full of NUL bytes
+    if bom_encoding(head) or detect_utf16(head):
+        return False
+    if b'\x00' in head:
+        return True
+    try:
+        head.decode('utf-8')
+        return False
+    except UnicodeDecodeError as e:
+        # A multi-byte character cut by the sniff window is still text
+        if e.start >= len(head) - 3 and e.reason == 'unexpected end of data':
+            return False
+    control = sum(1 for b in head if b < 0x20 and b not in (0x09, 0x0A, 0x0C, 0x0D))
+    return control / len(head) > 0.3
+
+
+def walk_repository(root, ignore_files=IGNORE_FILES,
+                    ignore_patterns: Union[List[str], AnchoredPatterns, None] = None) -> Iterator[Path]:
+    """Yield text files under root in a stable order, honoring ignore files.
+
+    ignore_patterns apply before any ignore file: a plain list is relative to
+    root, AnchoredPatterns to their own directory.
+    """
+    root = Path(root)
+    if root.is_file():
+        if not is_binary_file(root):
+            yield root
+        return
+
+    def _walk(directory: Path, rel_dir: str, rules: List[IgnoreRule]):
+        local_rules = list(rules)
+        for name in ignore_files:
+            ignore_path = directory / name
+            if ignore_path.is_file():
+                local_rules.extend(parse_ignore_file(ignore_path, rel_dir))
+        try:
+            entries = sorted(os.scandir(directory), key=lambda e: e.name)
+        except OSError:
+            return
+        for entry in entries:
+            rel_path = f"{rel_dir}/{entry.name}" if rel_dir else entry.name
+            if entry.is_dir(follow_symlinks=False):
+                if entry.name in ALWAYS_SKIPPED_DIRS or is_ignored(local_rules, rel_path, True):
+                    continue
+                yield from _walk(Path(entry.path), rel_path, local_rules)
+            elif entry.is_file(follow_symlinks=False):
+                if is_ignored(local_rules, rel_path, False):
+                    continue
+                if is_binary_file(entry.path):
+                    continue
+                yield Path(entry.path)
+
+    if isinstance(ignore_patterns, AnchoredPatterns):
+        rules = ignore_patterns.rules_for(root)
+        if rules is None:
+            return
+    else:
+        rules = parse_ignore_lines(ignore_patterns or [])
+    yield from _walk(root, '', rules)
+
+
+def _count_batch(tokenizer, texts: List[str]) -> List[int]:
+    """Token counts for a batch of texts (falls back to one call per text)."""
+    texts = [ESCAPED_BYTE_PATTERN.sub('\ufffd', t) for t in texts]
+    try:
+        encoded = tokenizer(texts, add_special_tokens=False)
+        return [len(ids) for ids in encoded['input_ids']]
+    except Exception:
+        return [len(tokenizer.encode(t, add_special_tokens=False)) for t in texts]
+
+
+def summarize_repository(tokenizer, root, batch_size: int = 64,
+                         invalid_utf8: str = 'replace',
+                         max_file_bytes: Optional[int] = None,
+                         encoding: str = 'auto',
+                         ignore_patterns: Union[List[str], AnchoredPatterns, None] = None) -> Dict:
+    """Tokenize every text file under root and aggregate token counts.
+
+    Returns {'root', 'files': [...], 'directories': {rel_dir: {...}}, 'total': {...}}.
+    Directory totals include all files below that directory ('.' is the root).
+    """
+    root = Path(root)
+    base = root if root.is_dir() else root.parent
+    files: List[Dict] = []
+    directories: Dict[str, Dict] = {}
+
+    def _flush(batch: List[Tuple[Path, str, int]]):
+        counts = _count_batch(tokenizer, [text for _, text, _ in batch])
+        for (path, _, size), tokens in zip(batch, counts):
+            rel = path.relative_to(base).as_posix()
+            files.append({
+                'path': rel,
+                'language': language_for_path(path),
+                'bytes': size,
+                'tokens': tokens,
+            })
+            parts = rel.split('/')[:-1]
+            for depth in range(len(parts) + 1):
+                key = '/'.join(parts[:depth]) or '.'
+                entry = directories.setdefault(key, {'files': 0, 'bytes': 0, 'tokens': 0})
+                entry['files'] += 1
+                entry['bytes'] += size
+                entry['tokens'] += tokens
+
+    batch: List[Tuple[Path, str, int]] = []
+    skipped = 0
+    for path in walk_repository(root, ignore_patterns=ignore_patterns):
+        try:
+            size = path.stat().st_size
+            if max_file_bytes is not None and size > max_file_bytes:
+                skipped += 1
+                continue
+            text, _ = read_source(path, invalid_utf8, encoding)
+        except (OSError, UnicodeDecodeError):
+            skipped += 1
+            continue
+        batch.append((path, text, size))
+        if len(batch) >= batch_size:
+            _flush(batch)
+            batch = []
+    if batch:
+        _flush(batch)
+
+    total = directories.get('.', {'files': 0, 'bytes': 0, 'tokens': 0})
+    return {
+        'root': str(root),
+        'files': files,
+        'directories': dict(sorted(directories.items())),
+        'total': dict(total, skipped=skipped),
+    }
+
+
+def print_summary(summary: Dict, top: int = 20):
+    """Print a per-directory table and the largest files by tokens."""
+    print(f"\n{'='*60}")
+    print(f"Repository Token Summary: {summary['root']}")
+    print(f"{'='*60}")
+    total = summary['total']
+    print(f"Files: {total['files']}  Bytes: {total['bytes']}  Tokens: {total['tokens']}  Skipped: {total.get('skipped', 0)}")
+
+    print(f"\n{'Directory':<40} {'Files':>8} {'Tokens':>12}")
+    print("-" * 62)
+    for rel_dir, entry in summary['directories'].items():
+        print(f"{rel_dir:<40} {entry['files']:>8} {entry['tokens']:>12}")
+
+    print(f"\nLargest files by tokens:")
+    for entry in sorted(summary['files'], key=lambda f: f['tokens'], reverse=True)[:top]:
+        print(f"  {entry['tokens']:>10}  {entry['path']}")
@@ -0,0 +1,192 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Corpus Report - One token audit of a repository, as JSON and Markdown
+
+build_report tokenizes every file under a root, or a deterministic sample
+of them, and collects:
+- per-language files, bytes, tokens and tokens per byte
+- the largest files by tokens (and those over a context window)
+- an offset validation summary: token spans out of bounds, out of order,
+  overlapping, bytes no token covers, tokens splitting a character, and
+  which method produced the offsets (token_spans.compute_token_spans)
+
+Sampling hashes each relative path with the seed and keeps the lowest
+hashes, so the same seed picks the same files on every machine and run,
+independent of directory listing order. Sampled totals are extrapolated
+to the whole corpus by on-disk bytes.
+"""
+
+import hashlib
+from collections import Counter
+from datetime import datetime, timezone
+from pathlib import Path
+from typing import Dict, List, Optional, Union
+
+from repo_walker import language_for_path, walk_repository
+from source_text import read_source
+from token_spans import compute_token_spans, encode_source
+
+ISSUE_KINDS = ('out_of_bounds', 'out_of_order', 'overlap', 'uncovered_bytes')
+
+
+def sample_paths(paths: List[Path], base: Path, sample: Optional[float], seed: int = 0) -> List[Path]:
+    """Deterministic sample: a count (>= 1) or a fraction (< 1) of paths; all when sample is None."""
+    if sample is None:
+        return paths
+    count = int(sample) if sample >= 1 else max(1, round(len(paths) * sample))
+
+    def _key(path: Path) -> str:
+        return hashlib.sha256(f"{seed}:{path.relative_to(base).as_posix()}".encode('utf-8')).hexdigest()
+
+    return sorted(sorted(paths, key=_key)[:count])
+
+
+def validate_spans(spans: List[Dict], length: int) -> Counter:
+    """Offset problems of one document's token spans, counted by kind."""
+    issues = Counter()
+    covered_to = 0
+    prev_start = 0
+    for span in spans:
+        start, end = span['start_byte'], span['end_byte']
+        if not 0 <= start <= end <= length:
+            issues['out_of_bounds'] += 1
+            continue
+        if start < prev_start:
+            issues['out_of_order'] += 1
+        if start < covered_to:
+            issues['overlap'] += 1
+        elif start > covered_to:
+            issues['uncovered_bytes'] += start - covered_to
+        covered_to = max(covered_to, end)
+        prev_start = start
+    if length > covered_to:
+        issues['uncovered_bytes'] += length - covered_to
+    return issues
+
+
+def build_report(tokenizer, root: Union[str, Path], model: str, sample: Optional[float] = None,
+                 seed: int = 0, top: int = 20, context_window: Optional[int] = None,
+                 encoding: str = 'auto', ignore_patterns=None) -> Dict:
+    """Tokenize (a sample of) the files under root and aggregate the report."""
+    root = Path(root)
+    base = root if root.is_dir() else root.parent
+    all_paths = list(walk_repository(root, ignore_patterns=ignore_patterns))
+    paths = sample_paths(all_paths, base, sample, seed)
+    total_bytes = sum(path.stat().st_size for path in all_paths)
+
+    languages: Dict[str, Dict] = {}
+    files: List[Dict] = []
+    issues = Counter()
+    token_sources = Counter()
+    partial_tokens = 0
+    files_with_issues = 0
+    skipped = 0
+    # On-disk size of the sampled files: the extrapolation compares it with
+    # total_bytes, so both are measured the same way (decoded sizes differ for
+    # non-UTF-8 files)
+    sampled_file_bytes = 0
+    for path in paths:
+        try:
+            text, _ = read_source(path, encoding=encoding)
+            file_bytes = path.stat().st_size
+        except (OSError, UnicodeDecodeError):
+            skipped += 1
+            continue
+        size = len(encode_source(text))
+        sampled_file_bytes += file_bytes
+        spans, source = compute_token_spans(tokenizer, text)
+        file_issues = validate_spans(spans, size)
+        issues.update(file_issues)
+        files_with_issues += bool(file_issues)
+        token_sources[source] += 1
+        partial_tokens += sum(1 for span in spans if span['partial'])
+        language = language_for_path(path) or 'unknown'
+        entry = languages.setdefault(language, {'files': 0, 'bytes': 0, 'tokens': 0})
+        entry['files'] += 1
+        entry['bytes'] += size
+        entry['tokens'] += len(spans)
+        files.append({'path': path.relative_to(base).as_posix(), 'language': language,
+                      'bytes': size, 'tokens': len(spans)})
+
+    for entry in languages.values():
+        entry['tokens_per_byte'] = entry['tokens'] / entry['bytes'] if entry['bytes'] else 0.0
+    sampled_bytes = sum(f['bytes'] for f in files)
+    sampled_tokens = sum(f['tokens'] for f in files)
+    estimated = round(sampled_tokens * total_bytes / sampled_file_bytes) if sampled_file_bytes else 0
+    largest = sorted(files, key=lambda f: (-f['tokens'], f['path']))
+    report = {
+        'root': str(root),
+        'model': model,
+        'generated': datetime.now(timezone.utc).strftime('%Y-%m-%dT%H:%M:%SZ'),
+        'sample': {'requested': sample, 'seed': seed, 'files': len(files), 'of_files': len(all_paths)},
+        'total': {
+            'files': len(files),
+            'bytes': sampled_bytes,
+            'tokens': sampled_tokens,
+            'tokens_per_byte': sampled_tokens / sampled_bytes if sampled_bytes else 0.0,
+            'corpus_bytes': total_bytes,
+            'estimated_corpus_tokens': estimated if sample is not None else sampled_tokens,
+            'skipped': skipped,
+        },
+        'languages': dict(sorted(languages.items(), key=lambda item: -item[1]['tokens'])),
+        'largest_files': largest[:top],
+        'validation': {
+            'files_checked': len(files),
+            'files_with_issues': files_with_issues,
+            'issues': {kind: issues.get(kind, 0) for kind in ISSUE_KINDS},
+            'partial_tokens': partial_tokens,
+            'token_sources': dict(token_sources),
+        },
+    }
+    if context_window:
+        report['context_window'] = {
+            'tokens': context_window,
+            'files_over': [f for f in largest if f['tokens'] > context_window],
+            'corpus_windows': report['total']['estimated_corpus_tokens'] / context_window,
+        }
+    return report
+
+
+def render_markdown(report: Dict) -> str:
+    """The report as a Markdown document."""
+    total = report['total']
+    sample = report['sample']
+    lines = [
+        f"# Token Report: {report['root']}",
+        "",
+        f"Model `{report['model']}`, generated {report['generated']}.",
+        "",
+    ]
+    if sample['requested'] is not None:
+        lines += [f"Sampled {sample['files']} of {sample['of_files']} files (seed {sample['seed']}); "
+                  f"corpus estimate {total['estimated_corpus_tokens']:,} tokens for {total['corpus_bytes']:,} bytes.", ""]
+    lines += [
+        f"**{total['tokens']:,} tokens** in {total['files']} files ({total['bytes']:,} bytes, "
+        f"{total['tokens_per_byte']:.3f} tokens/byte), {total['skipped']} skipped.",
+        "",
+        "## Languages",
+        "",
+        "| Language | Files | Bytes | Tokens | Tokens/byte |",
+        "|---|---:|---:|---:|---:|",
+    ]
+    for language, entry in report['languages'].items():
+        lines.append(f"| {language} | {entry['files']} | {entry['bytes']:,} | {entry['tokens']:,} | "
+                     f"{entry['tokens_per_byte']:.3f} |")
+    lines += ["", "## Largest files", "", "| File | Language | Bytes | Tokens |", "|---|---|---:|---:|"]
+    for entry in report['largest_files']:
+        lines.append(f"| `{entry['path']}` | {entry['language']} | {entry['bytes']:,} | {entry['tokens']:,} |")
+    if 'context_window' in report:
+        window = report['context_window']
+        lines += ["", "## Context window", "",
+                  f"{len(window['files_over'])} file(s) exceed {window['tokens']:,} tokens; "
+                  f"the corpus fills {window['corpus_windows']:.1f} windows."]
+    validation = report['validation']
+    lines += ["", "## Offset validation", "",
+              f"{validation['files_with_issues']} of {validation['files_checked']} files with offset issues, "
+              f"{validation['partial_tokens']:,} tokens splitting a character.", "",
+              "| Check | Count |", "|---|---:|"]
+    lines += [f"| {kind} | {count:,} |" for kind, count in validation['issues'].items()]
+    lines += ["", "Offsets from: " + ', '.join(f"{source} ({n} files)" for source, n in
+                                                 sorted(validation['token_sources'].items())), ""]
+    return '\n'.join(lines)
@@ -0,0 +1,122 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Multi-Encoder Session - One document, several tokenizers, shared offset indices
+
+Tools that need counts or spans from several models for the same file
+(comparisons, budget checks per model) would otherwise rebuild the same
+indices for every encoder. A Session holds one document and builds each
+index once, on first use, for all encoders:
+
+- position_index  line/column <-> byte offset (position_index.PositionIndex)
+- char_to_byte    code point -> byte offset (UTF-16 offsets come from the
+                  position index's table)
+- graphemes       byte offsets of extended grapheme cluster starts (needs
+                  the 'regex' package)
+
+Token spans are computed once per encoder, keyed by its name, and kept as
+token_arena.TokenArena arrays over the shared document bytes, so a session
+holding many encoders stays compact. span() reads them in any of those units.
+"""
+
+import bisect
+from functools import cached_property
+from pathlib import Path
+from typing import Dict, List, Optional, Tuple, Union
+
+import tracing
+from position_index import PositionIndex
+from source_text import read_source
+from token_arena import TokenArena
+from token_spans import build_char_to_byte, compute_token_spans, encode_source
+
+SPAN_UNITS = ('bytes', 'codepoints', 'utf16', 'graphemes')
+
+
+class Session:
+    """A document with shared offset indices and per-encoder token spans."""
+
+    def __init__(self, text: str, byte_map: Optional[List[int]] = None, path: Optional[str] = None):
+        self.text = text
+        self.byte_map = byte_map
+        self.path = path
+        self._tokens: Dict[str, TokenArena] = {}
+
+    @classmethod
+    def from_file(cls, path: Union[str, Path], encoding: str = 'auto') -> 'Session':
+        text, byte_map = read_source(path, encoding=encoding)
+        return cls(text, byte_map, str(path))
+
+    @cached_property
+    def data(self) -> bytes:
+        return encode_source(self.text)
+
+    @cached_property
+    def position_index(self) -> PositionIndex:
+        return PositionIndex(self.data)
+
+    @cached_property
+    def char_to_byte(self) -> List[int]:
+        return build_char_to_byte(self.text)
+
+    @cached_property
+    def graphemes(self) -> List[int]:
+        """Byte offsets where grapheme clusters start, plus the end of the text."""
+        try:
+            import regex
+        except ImportError:
+            raise ImportError("Grapheme offsets need the 'regex' package (pip install regex)")
+        starts = [self.char_to_byte[match.start()] for match in regex.finditer(r'\X', self.text)]
+        starts.append(len(self.data))
+        return starts
+
+    # --- Per-encoder tokens
+
+    def tokens(self, tokenizer, name: Optional[str] = None) -> TokenArena:
+        """Tokens of the document for one encoder, computed once (arena[i] is a span dict)."""
+        key = name or tracing.encoder_name(tokenizer)
+        if key not in self._tokens:
+            spans, _ = compute_token_spans(tokenizer, self.text)
+            self._tokens[key] = TokenArena(self.data, spans)
+        return self._tokens[key]
+
+    def count(self, tokenizer, name: Optional[str] = None) -> int:
+        return len(self.tokens(tokenizer, name))
+
+    def counts(self, tokenizers: Dict[str, object]) -> Dict[str, int]:
+        """Token counts per encoder name."""
+        return {name: self.count(tokenizer, name) for name, tokenizer in tokenizers.items()}
+
+    def encoders(self) -> List[str]:
+        return list(self._tokens)
+
+    # --- Offset conversion
+
+    def convert(self, offset: int, unit: str, round_up: bool = False) -> int:
+        """A byte offset of the decoded text in another unit.
+
+        Offsets inside a character (or grapheme) round down to its start,
+        or up to its end with round_up.
+        """
+        if unit not in SPAN_UNITS:
+            raise ValueError(f"Unknown unit: {unit}")
+        if unit == 'bytes':
+            return offset
+        table = self.graphemes if unit == 'graphemes' else self.char_to_byte
+        index = bisect.bisect_left(table, offset) if round_up else bisect.bisect_right(table, offset) - 1
+        if unit == 'utf16':
+            return self.position_index.utf16_offsets[self.char_to_byte[index]]
+        return index
+
+    def span(self, name: str, index: int, unit: str = 'bytes') -> Tuple[int, int]:
+        """Token index of encoder name as [start, end) in unit; file offsets for 'bytes'."""
+        start, end = self._tokens[name].span(index)
+        if unit == 'bytes':
+            if self.byte_map is not None:
+                return self.byte_map[start], self.byte_map[end]
+            return start, end
+        return self.convert(start, unit), self.convert(end, unit, round_up=True)
+
+    def position(self, offset: int, unit: str = 'bytes') -> Tuple[int, int]:
+        """1-based (line, column) of a decoded-text byte offset."""
+        return self.position_index.position(offset, unit)
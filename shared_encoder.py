@@ -0,0 +1,166 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Shared Encoder - Thread-safe tokenizer access for concurrent callers
+
+Concurrency contract:
+- SharedEncoder methods may be called from any number of threads at once.
+  The vocab snapshot and fingerprint are computed once at construction and
+  are read-only afterwards.
+- Per-call state lives in pooled tokenizer clones: each call leases a clone
+  for its duration, so HF fast tokenizers never see concurrent calls (which
+  can fail with "Already borrowed" and silently degrade
+  token_spans.compute_token_spans to its heuristic fallback).
+- The tokenizer handed to SharedEncoder must not be modified afterwards
+  (add_tokens, truncation/padding settings); clones are made from it lazily.
+- A SharedEncoder stands in for the tokenizer anywhere one is expected
+  (compute_token_spans, TextBuffer, Session, LspHelper, chunk_file, ...):
+  calling it or any tokenizer method leases a clone for that call, and
+  other attributes read the prototype. Methods that modify a tokenizer
+  (add_tokens, add_special_tokens) raise TypeError; copy() gives a private
+  tokenizer to modify instead.
+- encoder_registry hands out SharedEncoders, so tokenizers from
+  get_encoder (and tokoffset.load_tokenizer) are safe to share. Plain
+  tokenizers passed directly to module functions are not: use one per
+  thread, or wrap them.
+- TextBuffer and LspHelper instances are single-writer objects.
+- tree-sitter parsers are not thread-safe; chunker.parser_for_path keeps one
+  per thread. source_text decoding is thread-safe.
+
+check_thread_safety runs the same texts sequentially and from many threads
+and reports any difference, as a runtime race check.
+"""
+
+import copy
+import queue
+import threading
+import concurrent.futures
+from contextlib import contextmanager
+from types import MappingProxyType
+from typing import Dict, Iterator, List, Optional, Sequence, Tuple
+
+from manifest import encoder_fingerprint
+from token_spans import compute_token_spans
+
+
+# Tokenizer methods that modify it; a shared tokenizer is read-only
+_MUTATING_METHODS = ('add_tokens', 'add_special_tokens')
+
+
+class SharedEncoder:
+    """Tokenizer facade that is safe for concurrent encode calls."""
+
+    def __init__(self, tokenizer, max_idle: Optional[int] = None):
+        if isinstance(tokenizer, SharedEncoder):
+            tokenizer = tokenizer.copy()
+        self._prototype = tokenizer
+        self._idle: "queue.LifoQueue" = queue.LifoQueue(maxsize=max_idle or 0)
+        self._clone_lock = threading.Lock()
+        self._clones = 0
+        vocab = tokenizer.get_vocab() if hasattr(tokenizer, 'get_vocab') else {}
+        self.vocab = MappingProxyType(dict(vocab))
+        self.fingerprint = encoder_fingerprint(tokenizer)
+        self.name = getattr(tokenizer, 'name_or_path', type(tokenizer).__name__)
+
+    @property
+    def clones(self) -> int:
+        """Number of tokenizer clones created so far (the pool's high-water mark)."""
+        return self._clones
+
+    def _new_clone(self):
+        clone = self.copy()
+        with self._clone_lock:
+            self._clones += 1
+        return clone
+
+    def copy(self):
+        """A private copy of the tokenizer, free to modify."""
+        # deepcopy reads the prototype; serialize it so copies never race each other
+        with self._clone_lock:
+            return copy.deepcopy(self._prototype)
+
+    @contextmanager
+    def lease(self) -> Iterator[object]:
+        """Borrow a tokenizer that no other thread uses until the block exits."""
+        try:
+            tokenizer = self._idle.get_nowait()
+        except queue.Empty:
+            tokenizer = self._new_clone()
+        try:
+            yield tokenizer
+        finally:
+            try:
+                self._idle.put_nowait(tokenizer)
+            except queue.Full:
+                pass
+
+    def token_spans(self, text: str) -> Tuple[List[Dict], str]:
+        """token_spans.compute_token_spans through a leased tokenizer."""
+        with self.lease() as tokenizer:
+            return compute_token_spans(tokenizer, text)
+
+    def encode(self, text: str, add_special_tokens: bool = False, **kwargs) -> List[int]:
+        with self.lease() as tokenizer:
+            return list(tokenizer.encode(text, add_special_tokens=add_special_tokens, **kwargs))
+
+    def count(self, text: str) -> int:
+        return len(self.encode(text))
+
+    # --- Tokenizer stand-in
+
+    def __call__(self, *args, **kwargs):
+        with self.lease() as tokenizer:
+            return tokenizer(*args, **kwargs)
+
+    def get_vocab(self) -> Dict[str, int]:
+        return dict(self.vocab)
+
+    def __getattr__(self, name: str):
+        if name.startswith('_'):
+            raise AttributeError(name)
+        if name in _MUTATING_METHODS:
+            raise TypeError(f"SharedEncoder is read-only: {name}() would modify the tokenizer "
+                            "other threads use; call it on SharedEncoder.copy()")
+        value = getattr(self._prototype, name)
+        if not callable(value):
+            return value
+
+        def _leased(*args, **kwargs):
+            with self.lease() as tokenizer:
+                return getattr(tokenizer, name)(*args, **kwargs)
+        return _leased
+
+
+def check_thread_safety(tokenizer, texts: Sequence[str], threads: int = 8, rounds: int = 3,
+                        shared: bool = False) -> Dict:
+    """Compare concurrent tokenization with a sequential baseline.
+
+    With shared=True all threads call the raw tokenizer (to demonstrate
+    races); otherwise they go through a SharedEncoder.
+    """
+    if isinstance(tokenizer, SharedEncoder):
+        tokenizer = tokenizer.copy()
+    baseline = [compute_token_spans(tokenizer, text) for text in texts]
+    encoder = None if shared else SharedEncoder(copy.deepcopy(tokenizer))
+
+    def _run(i: int):
+        if encoder is None:
+            return i, compute_token_spans(tokenizer, texts[i])
+        return i, encoder.token_spans(texts[i])
+
+    mismatches = []
+    calls = 0
+    with concurrent.futures.ThreadPoolExecutor(max_workers=threads) as ex:
+        for _ in range(rounds):
+            for i, result in ex.map(_run, range(len(texts))):
+                calls += 1
+                if result != baseline[i]:
+                    mismatches.append(i)
+    return {
+        'mode': 'raw shared tokenizer' if shared else 'SharedEncoder',
+        'threads': threads,
+        'calls': calls,
+        'mismatches': len(mismatches),
+        'mismatched_texts': sorted(set(mismatches)),
+        'clones': encoder.clones if encoder is not None else 0,
+    }
@@ -0,0 +1,338 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Source Text Loading - Decode source files under an invalid UTF-8 policy
+
+Policies:
+- 'error':   raise UnicodeDecodeError on malformed input
+- 'replace': substitute U+FFFD for each malformed sequence
+- 'raw':     keep malformed bytes as lone surrogates (surrogateescape), so
+             text.encode('utf-8', 'surrogateescape') gives back the file bytes;
+             in other encodings malformed bytes below 0x80 (which cannot be
+             escaped, e.g. half a UTF-16 surrogate) become U+FFFD
+
+Whatever the policy, decode_source returns a byte map from the UTF-8 bytes
+the analyzer works on to the original file bytes, so reported offsets can
+always address the file on disk.
+
+Files in other encodings (UTF-16/32, Latin-1/cp1252, GBK/GB18030, Big5,
+Shift-JIS, EUC-KR) are transcoded to UTF-8 by transcode_source, with the
+same kind of byte map back to the on-disk bytes. detect_encoding guesses
+the encoding from BOMs, NUL patterns and decoding heuristics; pass an
+explicit encoding when the guess is wrong. UTF-8 files with a few stray
+invalid bytes are still detected as UTF-8, so the invalid UTF-8 policy
+decides what happens to those bytes.
+"""
+
+import codecs
+import threading
+from pathlib import Path
+from typing import List, Optional, Tuple, Union
+
+INVALID_UTF8_POLICIES = ('error', 'replace', 'raw')
+_POLICY_ERRORS = {'error': 'strict', 'replace': 'replace', 'raw': 'surrogateescape'}
+
+# Checked in order: the UTF-32 LE BOM starts with the UTF-16 LE BOM
+_BOMS = (
+    (codecs.BOM_UTF32_LE, 'utf-32-le'),
+    (codecs.BOM_UTF32_BE, 'utf-32-be'),
+    (codecs.BOM_UTF8, 'utf-8-sig'),
+    (codecs.BOM_UTF16_LE, 'utf-16-le'),
+    (codecs.BOM_UTF16_BE, 'utf-16-be'),
+)
+_CJK_ENCODINGS = ('gb18030', 'big5', 'shift_jis', 'euc_kr')
+_SNIFF_BYTES = 65536
+
+# Per-thread list of (start, end) malformed ranges seen by the error handler
+_replaced = threading.local()
+_RECORDING_REPLACE = 'source_text.recording_replace'
+
+
+def _recording_replace(exc: UnicodeDecodeError):
+    _replaced.spans.append((exc.start, exc.end))
+    return '\ufffd', exc.end
+
+
+codecs.register_error(_RECORDING_REPLACE, _recording_replace)
+
+_RAW_ESCAPE = 'source_text.raw_escape'
+
+
+def _raw_escape(exc: UnicodeDecodeError):
+    bad = exc.object[exc.start:exc.end]
+    return ''.join(chr(0xDC00 + b) if b >= 0x80 else '\ufffd' for b in bad), exc.end
+
+
+codecs.register_error(_RAW_ESCAPE, _raw_escape)
+
+
+def decode_source(data: bytes, policy: str = 'replace') -> Tuple[str, Optional[List[int]]]:
+    """Decode bytes as UTF-8 under the given policy.
+
+    Returns (text, byte_map). byte_map[i] is the original byte offset for
+    byte offset i of text.encode('utf-8', 'surrogateescape'); it is None
+    when the two coincide (valid input, or the 'error'/'raw' policies).
+    """
+    if policy not in INVALID_UTF8_POLICIES:
+        raise ValueError(f"Unknown invalid UTF-8 policy: {policy}")
+
+    if policy == 'error':
+        return data.decode('utf-8'), None
+    if policy == 'raw':
+        return data.decode('utf-8', errors='surrogateescape'), None
+
+    try:
+        return data.decode('utf-8'), None
+    except UnicodeDecodeError:
+        pass
+
+    # 'replace' with malformed input: record where each U+FFFD came from
+    _replaced.spans = []
+    text = data.decode('utf-8', errors=_RECORDING_REPLACE)
+    replaced, _replaced.spans = _replaced.spans, []
+
+    byte_map: List[int] = []
+    pos = 0
+    for bad_start, bad_end in replaced:
+        byte_map.extend(range(pos, bad_start))
+        # The three bytes of U+FFFD all point at the malformed sequence start
+        byte_map.extend([bad_start] * 3)
+        pos = bad_end
+    byte_map.extend(range(pos, len(data) + 1))
+    return text, byte_map
+
+
+def detect_utf16(data: bytes) -> Optional[str]:
+    """Guess BOM-less UTF-16 from the NUL bytes of mostly-ASCII text."""
+    sample = data[:_SNIFF_BYTES]
+    if len(sample) < 4:
+        return None
+    even = sample[0::2]
+    odd = sample[1::2]
+    even_nul = even.count(0) / len(even)
+    odd_nul = odd.count(0) / len(odd)
+    if odd_nul > 0.4 and even_nul < 0.05:
+        return 'utf-16-le'
+    if even_nul > 0.4 and odd_nul < 0.05:
+        return 'utf-16-be'
+    return None
+
+
+def _is_cjk(cp: int) -> bool:
+    """CJK ideographs, CJK punctuation, kana, Hangul or fullwidth forms."""
+    return (0x4E00 <= cp <= 0x9FFF or 0x3000 <= cp <= 0x30FF
+            or 0xAC00 <= cp <= 0xD7AF or 0xFF00 <= cp <= 0xFFEF)
+
+
+def _pair_score(data: bytes, encoding: str) -> float:
+    """Fraction of high bytes in lead/trail pairs that decode to CJK characters.
+
+    Pairs are read as the double-byte decoder reads them, so trail bytes in
+    the ASCII range (Big5, GBK, Shift-JIS) stay with their lead byte.
+    Accented Latin letters are lone high bytes, and so are single-byte
+    half-width katakana, which Latin-1 letters also decode to. A pair whose
+    trail byte is an ASCII letter is just as likely an accented letter
+    inside a word and counts as lone.
+    """
+    paired = lone = 0
+    i = 0
+    n = len(data)
+    while i < n:
+        if data[i] < 0x80:
+            i += 1
+            continue
+        for width in (2, 4):
+            try:
+                ch = data[i:i + width].decode(encoding)
+            except UnicodeDecodeError:
+                continue
+            if len(ch) == 1 and _is_cjk(ord(ch)) and not data[i + 1:i + 2].isalpha():
+                paired += width
+                i += width
+                break
+        else:
+            lone += 1
+            i += 1
+    return paired / (paired + lone) if paired + lone else 0.0
+
+
+def _script_bonus(text: str, encoding: str) -> float:
+    """Prefer Shift-JIS for kana-rich text and EUC-KR for Hangul-rich text."""
+    # Japanese mixes kanji with kana; Korean is almost all Hangul. Mis-decoded
+    # Chinese text yields scattered kana and a Hangul/Hanja mix (GB2312's
+    # common hanzi rows overlap EUC-KR's Hangul rows), below the thresholds.
+    if encoding == 'shift_jis':
+        low, high, threshold = 0x3040, 0x30FF, 0.25
+    elif encoding == 'euc_kr':
+        low, high, threshold = 0xAC00, 0xD7AF, 0.8
+    else:
+        return 0.0
+    non_ascii = [ord(ch) for ch in text if ord(ch) > 0x7F]
+    if not non_ascii:
+        return 0.0
+    fraction = sum(1 for cp in non_ascii if low <= cp <= high) / len(non_ascii)
+    return fraction if fraction >= threshold else 0.0
+
+
+def detect_encoding(data: bytes) -> str:
+    """Guess the encoding of a byte string.
+
+    BOMs win; then BOM-less UTF-16, (nearly) valid UTF-8, and finally a
+    choice between CJK double-byte encodings (lead/trail byte pairs decoding
+    to CJK text) and single-byte Latin encodings.
+    """
+    bom = bom_encoding(data)
+    if bom:
+        return bom
+    utf16 = detect_utf16(data)
+    if utf16:
+        return utf16
+    try:
+        data.decode('utf-8')
+        return 'utf-8'
+    except UnicodeDecodeError as e:
+        # Only a character cut at the very end: still UTF-8
+        if e.start >= len(data) - 3 and e.reason == 'unexpected end of data':
+            return 'utf-8'
+
+    sample = data[:_SNIFF_BYTES]
+    if _mostly_utf8(sample, truncated=len(data) > len(sample)):
+        return 'utf-8'
+
+    best, best_score = None, 0.0
+    for encoding in _CJK_ENCODINGS:
+        try:
+            text = data.decode(encoding)
+        except UnicodeDecodeError:
+            continue
+        score = _pair_score(sample, encoding) + _script_bonus(text, encoding)
+        if score > best_score:
+            best, best_score = encoding, score
+    if best is not None and best_score >= 0.5:
+        return best
+    try:
+        data.decode('cp1252')
+        return 'cp1252'
+    except UnicodeDecodeError:
+        return 'latin-1'
+
+
+def _mostly_utf8(sample: bytes, truncated: bool = False) -> bool:
+    """UTF-8 with a few stray invalid bytes (at most 1% of the sample).
+
+    The stray bytes must either be outnumbered by valid multi-byte
+    characters or not look like accented letters inside Latin words; a
+    Latin-1 file with the odd accent is not UTF-8. A character cut by the
+    end of a truncated sample does not count.
+    """
+    _replaced.spans = []
+    text = sample.decode('utf-8', errors=_RECORDING_REPLACE)
+    bad, _replaced.spans = _replaced.spans, []
+    if truncated and bad and bad[-1][1] == len(sample) and len(sample) - bad[-1][0] < 4:
+        bad.pop()
+    invalid = sum(end - start for start, end in bad)
+    if invalid * 100 > len(sample):
+        return False
+    multibyte = sum(1 for ch in text if ord(ch) > 0x7F) - len(bad)
+    return invalid <= multibyte or _latin_score(sample) < 0.5
+
+
+def _latin_score(data: bytes) -> float:
+    """Fraction of high-byte runs that look like accented letters inside Latin words.
+
+    Accented Latin text has short runs (1-2 bytes) next to ASCII letters.
+    """
+    runs = 0
+    latin = 0
+    i = 0
+    n = len(data)
+    while i < n:
+        if data[i] < 0x80:
+            i += 1
+            continue
+        start = i
+        while i < n and data[i] >= 0x80:
+            i += 1
+        runs += 1
+        before = data[start - 1:start]
+        after = data[i:i + 1]
+        if i - start <= 2 and (before.isalpha() or after.isalpha()):
+            latin += 1
+    return latin / runs if runs else 1.0
+
+
+def transcode_source(data: bytes, encoding: str, policy: str = 'replace') -> Tuple[str, Optional[List[int]]]:
+    """Decode bytes in any codec, with a byte map back to the original bytes.
+
+    Returns (text, byte_map) like decode_source: byte_map[i] is the original
+    offset for byte i of text.encode('utf-8', 'surrogateescape'), plus a final
+    entry for the end of data. All UTF-8 bytes of one character point at the
+    first original byte of that character (for replacement characters after
+    malformed input, the byte the decoder stopped at). A leading BOM is
+    skipped.
+    """
+    if policy not in INVALID_UTF8_POLICIES:
+        raise ValueError(f"Unknown invalid UTF-8 policy: {policy}")
+    name = codecs.lookup(encoding).name
+    if name == 'utf-8':
+        return decode_source(data, policy)
+
+    bom = bom_encoding(data)
+    if name in ('utf-16', 'utf-32'):
+        # Byte order from the BOM, little-endian without one (like the codec)
+        name = codecs.lookup(bom).name if bom and bom.startswith(name) else name + '-le'
+    skip = 0
+    if bom and codecs.lookup(bom).name == name:
+        skip = len(next(b for b, enc in _BOMS if enc == bom))
+    if name == 'utf-8-sig':
+        name = 'utf-8'
+
+    # surrogateescape raises on malformed bytes below 0x80 (UTF-16/32 code units)
+    errors = _RAW_ESCAPE if policy == 'raw' else _POLICY_ERRORS[policy]
+    decoder = codecs.getincrementaldecoder(name)(errors)
+    chars: List[str] = []
+    byte_map: List[int] = []
+    seq_start = skip
+    for i in range(skip, len(data)):
+        out = decoder.decode(data[i:i + 1])
+        if out:
+            for ch in out:
+                byte_map.extend([seq_start] * len(ch.encode('utf-8', 'surrogateescape')))
+            chars.append(out)
+            seq_start = i + 1
+    out = decoder.decode(b'', final=True)
+    for ch in out:
+        byte_map.extend([seq_start] * len(ch.encode('utf-8', 'surrogateescape')))
+    chars.append(out)
+    byte_map.append(len(data))
+    return ''.join(chars), byte_map
+
+
+def bom_encoding(data: bytes) -> Optional[str]:
+    """The encoding named by a leading byte order mark, or None."""
+    for bom, encoding in _BOMS:
+        if data.startswith(bom):
+            return encoding
+    return None
+
+
+def decode_any(data: bytes, policy: str = 'replace', encoding: str = 'utf-8') -> Tuple[str, Optional[List[int]], str]:
+    """Decode bytes in a given encoding, or 'auto' to detect it.
+
+    Returns (text, byte_map, encoding used).
+    """
+    if encoding == 'auto':
+        encoding = detect_encoding(data)
+    if codecs.lookup(encoding).name == 'utf-8':
+        text, byte_map = decode_source(data, policy)
+    else:
+        text, byte_map = transcode_source(data, encoding, policy)
+    return text, byte_map, encoding
+
+
+def read_source(path: Union[str, Path], policy: str = 'replace', encoding: str = 'utf-8') -> Tuple[str, Optional[List[int]]]:
+    """Read a file and decode it (UTF-8 by default; 'auto' detects the encoding)."""
+    with open(path, 'rb') as f:
+        data = f.read()
+    text, byte_map, _ = decode_any(data, policy, encoding)
+    return text, byte_map
@@ -0,0 +1,88 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Span Alignment - Translate token ranges between two tokenizers of the same text
+
+Two tokenizers split the same text differently, but both token streams
+carry byte offsets into that text. SpanAligner maps a token range [i, j)
+of one stream to the minimal range of the other stream covering the same
+bytes:
+
+  {'tokens': [k, l], 'bytes': [start, end], 'covered_bytes': [s, e], 'exact': bool}
+
+'bytes' is the source range, 'covered_bytes' what the target tokens span;
+'exact' is True when both agree (the range boundaries are token boundaries
+in both streams). This is what re-targeting cached annotations (labels,
+attention spans, loss masks) from one model family to another needs.
+
+Offsets are decoded-text bytes; pass the source_text byte map to report
+file offsets instead.
+"""
+
+from typing import Dict, Iterable, List, Optional
+
+from token_index import TokenIndex
+from token_spans import compute_token_spans
+
+DIRECTIONS = ('a_to_b', 'b_to_a')
+
+
+class SpanAligner:
+    """Token range translation between two token streams of one text."""
+
+    def __init__(self, spans_a: List[Dict], spans_b: List[Dict], byte_map: Optional[List[int]] = None):
+        self.spans = {'a': spans_a, 'b': spans_b}
+        self.index = {'a': TokenIndex(spans_a), 'b': TokenIndex(spans_b)}
+        self.byte_map = byte_map
+
+    def _file(self, pos: int) -> int:
+        return self.byte_map[pos] if self.byte_map is not None else pos
+
+    def translate(self, start: int, end: int, direction: str = 'a_to_b') -> Dict:
+        """Minimal token range of the other stream covering tokens [start, end)."""
+        if direction not in DIRECTIONS:
+            raise ValueError(f"Unknown direction: {direction}")
+        source, target = ('a', 'b') if direction == 'a_to_b' else ('b', 'a')
+        lo, hi = self.index[source].byte_range(start, end)
+        k, l = self.index[target].overlapping(lo, hi)
+        if lo == hi:
+            # An empty range maps to an empty range at the same position.
+            l = k
+        covered_lo, covered_hi = self.index[target].byte_range(k, l) if k < l or lo == hi else (lo, hi)
+        return {
+            'tokens': [k, l],
+            'bytes': [self._file(lo), self._file(hi)],
+            'covered_bytes': [self._file(covered_lo), self._file(covered_hi)],
+            'exact': (covered_lo, covered_hi) == (lo, hi),
+        }
+
+    def translate_many(self, ranges: Iterable, direction: str = 'a_to_b') -> List[Dict]:
+        return [self.translate(start, end, direction) for start, end in ranges]
+
+    def boundary_agreement(self) -> float:
+        """Share of token boundaries of stream a that are also boundaries in stream b."""
+        ends_a = set(self.index['a'].ends)
+        if not ends_a:
+            return 1.0
+        return len(ends_a & set(self.index['b'].ends)) / len(ends_a)
+
+
+def align_tokenizers(tokenizer_a, tokenizer_b, text: str, byte_map: Optional[List[int]] = None) -> SpanAligner:
+    """Tokenize text with both tokenizers and return their aligner."""
+    spans_a, _ = compute_token_spans(tokenizer_a, text)
+    spans_b, _ = compute_token_spans(tokenizer_b, text)
+    return SpanAligner(spans_a, spans_b, byte_map)
+
+
+def print_alignment(aligner: SpanAligner, translations: List[Dict], ranges: List, path: str = ""):
+    """Print each translated range and the boundary agreement of both streams."""
+    print(f"\n{'='*60}")
+    print(f"Span Alignment{': ' + path if path else ''}")
+    print(f"{'='*60}")
+    print(f"Tokens: {len(aligner.spans['a'])} -> {len(aligner.spans['b'])}, "
+          f"shared boundaries: {aligner.boundary_agreement():.1%}")
+    for (start, end), result in zip(ranges, translations):
+        mark = '✓' if result['exact'] else '~'
+        print(f"  {mark} [{start}, {end}) -> [{result['tokens'][0]}, {result['tokens'][1]})  "
+              f"bytes [{result['bytes'][0]}, {result['bytes'][1]})"
+              + ('' if result['exact'] else f" widened to [{result['covered_bytes'][0]}, {result['covered_bytes'][1]})"))
@@ -0,0 +1,165 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+SQLite Token Inventory - Per-file token counts, chunks and spans in one database
+
+Tables:
+- meta(key, value)            model, encoder fingerprint, max_tokens, schema version
+- files(id, path, language, bytes, tokens, content_hash)
+- chunks(id, file_id, start_byte, end_byte, start_line, end_line,
+         start_token, end_token, token_count, content_hash)
+- tokens(file_id, token_index, token_id, start_byte, end_byte, partial)
+                              only with spans=True
+
+Re-indexing replaces the rows of each file in place, so the database can be
+refreshed incrementally. Example queries:
+
+  SELECT language, SUM(tokens) FROM files GROUP BY language;
+  SELECT path, tokens FROM files ORDER BY tokens DESC LIMIT 20;
+  SELECT f.path, COUNT(*) FROM tokens t JOIN files f ON f.id = t.file_id
+    WHERE t.token_id = 50256 GROUP BY f.path;
+"""
+
+import hashlib
+import sqlite3
+import time
+from pathlib import Path
+from typing import Dict, Union
+
+from chunker import DEFAULT_MAX_TOKENS, chunk_file
+from manifest import encoder_fingerprint
+from repo_walker import language_for_path, walk_repository
+from source_text import read_source
+from token_spans import compute_token_spans
+
+SCHEMA_VERSION = 1
+
+SCHEMA = """
+CREATE TABLE IF NOT EXISTS meta (
+    key TEXT PRIMARY KEY,
+    value TEXT
+);
+CREATE TABLE IF NOT EXISTS files (
+    id INTEGER PRIMARY KEY,
+    path TEXT NOT NULL UNIQUE,
+    language TEXT,
+    bytes INTEGER NOT NULL,
+    tokens INTEGER NOT NULL,
+    content_hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_language ON files(language);
+CREATE TABLE IF NOT EXISTS chunks (
+    id TEXT PRIMARY KEY,
+    file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    start_byte INTEGER NOT NULL,
+    end_byte INTEGER NOT NULL,
+    start_line INTEGER NOT NULL,
+    end_line INTEGER NOT NULL,
+    start_token INTEGER NOT NULL,
+    end_token INTEGER NOT NULL,
+    token_count INTEGER NOT NULL,
+    content_hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS chunks_file ON chunks(file_id, start_byte);
+CREATE TABLE IF NOT EXISTS tokens (
+    file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    token_index INTEGER NOT NULL,
+    token_id INTEGER,
+    start_byte INTEGER NOT NULL,
+    end_byte INTEGER NOT NULL,
+    partial INTEGER NOT NULL,
+    PRIMARY KEY (file_id, token_index)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS tokens_token_id ON tokens(token_id);
+CREATE INDEX IF NOT EXISTS tokens_offset ON tokens(file_id, start_byte);
+"""
+
+
+def open_index(db_path: Union[str, Path]) -> sqlite3.Connection:
+    """Open (creating if needed) an inventory database."""
+    conn = sqlite3.connect(str(db_path))
+    conn.execute("PRAGMA foreign_keys = ON")
+    conn.executescript(SCHEMA)
+    return conn
+
+
+def _set_meta(conn: sqlite3.Connection, values: Dict[str, object]):
+    conn.executemany("INSERT OR REPLACE INTO meta(key, value) VALUES (?, ?)",
+                     [(k, None if v is None else str(v)) for k, v in values.items()])
+
+
+def index_file(conn: sqlite3.Connection, tokenizer, path: Path, base: Path,
+               max_tokens: int = DEFAULT_MAX_TOKENS, spans: bool = False,
+               encoding: str = 'auto') -> Dict:
+    """Index one file, replacing any previous rows for it."""
+    rel = path.relative_to(base).as_posix()
+    data = path.read_bytes()
+    chunks = chunk_file(tokenizer, path, base, max_tokens, encoding=encoding)
+    token_count = sum(c['token_count'] for c in chunks)
+
+    conn.execute("DELETE FROM files WHERE path = ?", (rel,))
+    cur = conn.execute(
+        "INSERT INTO files(path, language, bytes, tokens, content_hash) VALUES (?, ?, ?, ?, ?)",
+        (rel, language_for_path(path), len(data), token_count, 'sha256:' + hashlib.sha256(data).hexdigest()))
+    file_id = cur.lastrowid
+    conn.executemany(
+        "INSERT OR REPLACE INTO chunks(id, file_id, start_byte, end_byte, start_line, end_line, "
+        "start_token, end_token, token_count, content_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+        [(c['id'], file_id, c['start_byte'], c['end_byte'], c['start_line'], c['end_line'],
+          c['start_token'], c['end_token'], c['token_count'], c['content_hash']) for c in chunks])
+
+    if spans:
+        text, byte_map = read_source(path, encoding=encoding)
+        token_spans, _ = compute_token_spans(tokenizer, text)
+        rows = []
+        for index, span in enumerate(token_spans):
+            start, end = span['start_byte'], span['end_byte']
+            if byte_map is not None:
+                start, end = byte_map[start], byte_map[end]
+            rows.append((file_id, index, span['id'], start, end, int(span['partial'])))
+        conn.executemany(
+            "INSERT INTO tokens(file_id, token_index, token_id, start_byte, end_byte, partial) "
+            "VALUES (?, ?, ?, ?, ?, ?)", rows)
+    return {'path': rel, 'tokens': token_count, 'chunks': len(chunks)}
+
+
+def build_index(tokenizer, root: Union[str, Path], db_path: Union[str, Path], model: str,
+                max_tokens: int = DEFAULT_MAX_TOKENS, spans: bool = False,
+                encoding: str = 'auto', prune: bool = True, ignore_patterns=None) -> Dict:
+    """Index every text file under root into db_path.
+
+    With prune=True, files no longer present under root are removed.
+    """
+    root = Path(root)
+    base = root if root.is_dir() else root.parent
+    conn = open_index(db_path)
+    indexed = 0
+    tokens = 0
+    seen = set()
+    try:
+        with conn:
+            _set_meta(conn, {
+                'schema_version': SCHEMA_VERSION,
+                'model': model,
+                'encoder_fingerprint': encoder_fingerprint(tokenizer),
+                'max_tokens': max_tokens,
+                'root': str(root),
+                'indexed_at': time.strftime('%Y-%m-%dT%H:%M:%SZ', time.gmtime()),
+            })
+            for path in walk_repository(root, ignore_patterns=ignore_patterns):
+                try:
+                    result = index_file(conn, tokenizer, path, base, max_tokens, spans, encoding)
+                except (OSError, UnicodeDecodeError):
+                    continue
+                seen.add(result['path'])
+                indexed += 1
+                tokens += result['tokens']
+            removed = 0
+            if prune:
+                stale = [row[0] for row in conn.execute("SELECT path FROM files") if row[0] not in seen]
+                for rel in stale:
+                    conn.execute("DELETE FROM files WHERE path = ?", (rel,))
+                removed = len(stale)
+    finally:
+        conn.close()
+    return {'files': indexed, 'tokens': tokens, 'removed': removed}
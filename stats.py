@@ -0,0 +1,161 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Statistics - Distributions over a tokenized corpus
+
+Collects, per corpus:
+- tokens per line
+- token length in bytes
+- most frequent tokens
+- tokens-per-byte ratio per language
+
+Results are plain dicts (JSON-ready) and can be printed as terminal tables.
+"""
+
+from collections import Counter, defaultdict
+from typing import Dict, Iterable, Optional
+
+from repo_walker import language_for_path, walk_repository
+from source_text import read_source
+from token_spans import compute_token_spans, encode_source
+
+
+def _histogram(counter: Counter) -> Dict[str, int]:
+    """Counter keyed by int -> JSON-friendly dict sorted by key."""
+    return {str(k): counter[k] for k in sorted(counter)}
+
+
+def _percentile(counter: Counter, fraction: float) -> int:
+    total = sum(counter.values())
+    if not total:
+        return 0
+    threshold = fraction * total
+    running = 0
+    for value in sorted(counter):
+        running += counter[value]
+        if running >= threshold:
+            return value
+    return max(counter)
+
+
+def _describe(counter: Counter) -> Dict:
+    total = sum(counter.values())
+    weighted = sum(k * v for k, v in counter.items())
+    return {
+        'count': total,
+        'mean': weighted / total if total else 0.0,
+        'p50': _percentile(counter, 0.5),
+        'p90': _percentile(counter, 0.9),
+        'p99': _percentile(counter, 0.99),
+        'max': max(counter) if counter else 0,
+        'histogram': _histogram(counter),
+    }
+
+
+class TokenStatistics:
+    """Accumulates token distributions document by document."""
+
+    def __init__(self, tokenizer, top_k: int = 50):
+        self.tokenizer = tokenizer
+        self.top_k = top_k
+        self.tokens_per_line: Counter = Counter()
+        self.token_length_bytes: Counter = Counter()
+        self.token_frequency: Counter = Counter()
+        self.language_totals: Dict[str, Dict[str, int]] = defaultdict(lambda: {'files': 0, 'bytes': 0, 'tokens': 0})
+        self.documents = 0
+
+    def add_document(self, text: str, language: Optional[str] = None):
+        """Tokenize one document and fold it into the distributions."""
+        code_bytes = encode_source(text)
+        spans, _ = compute_token_spans(self.tokenizer, text)
+
+        # A token is counted on the line where it starts
+        line_counts = Counter()
+        line = 0
+        next_newline = code_bytes.find(b'\n')
+        for span in spans:
+            while next_newline != -1 and span['start_byte'] > next_newline:
+                line += 1
+                next_newline = code_bytes.find(b'\n', next_newline + 1)
+            line_counts[line] += 1
+            self.token_length_bytes[span['end_byte'] - span['start_byte']] += 1
+            if span['id'] is not None:
+                self.token_frequency[span['id']] += 1
+        total_lines = code_bytes.count(b'\n') + (0 if code_bytes.endswith(b'\n') else 1) if code_bytes else 0
+        for i in range(total_lines):
+            self.tokens_per_line[line_counts.get(i, 0)] += 1
+
+        bucket = self.language_totals[language or 'unknown']
+        bucket['files'] += 1
+        bucket['bytes'] += len(code_bytes)
+        bucket['tokens'] += len(spans)
+        self.documents += 1
+
+    def _token_text(self, token_id: int) -> str:
+        try:
+            return self.tokenizer.decode([token_id], clean_up_tokenization_spaces=False)
+        except Exception:
+            return str(token_id)
+
+    def to_dict(self) -> Dict:
+        """Summarize the collected distributions as a JSON-ready dict."""
+        languages = {}
+        for lang, entry in sorted(self.language_totals.items()):
+            languages[lang] = dict(entry, tokens_per_byte=entry['tokens'] / entry['bytes'] if entry['bytes'] else 0.0)
+        return {
+            'documents': self.documents,
+            'tokens_per_line': _describe(self.tokens_per_line),
+            'token_length_bytes': _describe(self.token_length_bytes),
+            'most_frequent_tokens': [
+                {'id': token_id, 'text': self._token_text(token_id), 'count': count}
+                for token_id, count in self.token_frequency.most_common(self.top_k)
+            ],
+            'languages': languages,
+        }
+
+
+def collect_corpus_stats(tokenizer, paths: Iterable, top_k: int = 50, invalid_utf8: str = 'replace',
+                         encoding: str = 'auto', ignore_patterns=None) -> Dict:
+    """Collect statistics over files (or directories, walked with ignore rules)."""
+    stats = TokenStatistics(tokenizer, top_k=top_k)
+    for root in paths:
+        for path in walk_repository(root, ignore_patterns=ignore_patterns):
+            try:
+                text, _ = read_source(path, invalid_utf8, encoding)
+            except (OSError, UnicodeDecodeError):
+                continue
+            stats.add_document(text, language_for_path(path))
+    return stats.to_dict()
+
+
+def _print_distribution(title: str, dist: Dict, max_rows: int = 15):
+    print(f"\n{title}")
+    print(f"  count={dist['count']} mean={dist['mean']:.2f} p50={dist['p50']} p90={dist['p90']} p99={dist['p99']} max={dist['max']}")
+    histogram = dist['histogram']
+    if not histogram:
+        return
+    peak = max(histogram.values())
+    for key, value in list(histogram.items())[:max_rows]:
+        bar = '█' * max(1, int(value / peak * 30)) if value else ''
+        print(f"  {key:>6} | {value:>8} {bar}")
+    if len(histogram) > max_rows:
+        print(f"  ... {len(histogram) - max_rows} more buckets")
+
+
+def print_stats(result: Dict, top: int = 20):
+    """Print statistics as terminal tables."""
+    print(f"\n{'='*60}")
+    print(f"Token Statistics ({result['documents']} documents)")
+    print(f"{'='*60}")
+
+    print(f"\n{'Language':<14} {'Files':>8} {'Bytes':>12} {'Tokens':>12} {'Tokens/Byte':>12}")
+    print("-" * 62)
+    for lang, entry in result['languages'].items():
+        print(f"{lang:<14} {entry['files']:>8} {entry['bytes']:>12} {entry['tokens']:>12} {entry['tokens_per_byte']:>12.4f}")
+
+    _print_distribution("Tokens per line", result['tokens_per_line'])
+    _print_distribution("Token length (bytes)", result['token_length_bytes'])
+
+    print(f"\nMost frequent tokens:")
+    for entry in result['most_frequent_tokens'][:top]:
+        print(f"  {entry['count']:>10}  {entry['id']:>8}  {entry['text']!r}")
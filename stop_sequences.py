@@ -0,0 +1,117 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Stop Sequences - Streaming stop-string detection across token boundaries
+
+A stop string is often split across tokens ("\\n\\n###" may arrive as
+"\\n", "\\n#", "##"), and a multi-byte character may be split across
+byte-fallback tokens. StopSequenceMatcher works on the decoded output
+bytes, so neither matters:
+
+  matcher = StopSequenceMatcher(['###', '</answer>'], tokenizer)
+  for token_id in generate():
+      step = matcher.feed(token_id)
+      sys.stdout.write(step['text'])      # safe to show now
+      if step['stop']:
+          break                           # cut output at step['stop']['cut_byte']
+  sys.stdout.write(matcher.flush())
+
+Text that could still turn into a stop string (a suffix matching a stop
+prefix) or is an incomplete UTF-8 sequence is held back until the next
+token decides it. A match reports the byte offset to cut the output at (the
+start of the stop string), where it ends, and the index range of the tokens
+it spans. The earliest stop string wins; at equal starts, the longest.
+"""
+
+import bisect
+from typing import Dict, Iterable, List, Optional, Union
+
+from stream_decoder import complete_utf8_prefix
+from token_bytes import TokenBytes
+
+
+class StopSequenceMatcher:
+    """Incremental matcher of stop strings over a stream of tokens or bytes."""
+
+    def __init__(self, stop_sequences: Iterable[Union[str, bytes]], tokenizer=None):
+        self.stops = [s.encode('utf-8') if isinstance(s, str) else bytes(s) for s in stop_sequences]
+        if not self.stops or not all(self.stops):
+            raise ValueError("Stop sequences must be non-empty")
+        self.token_bytes = TokenBytes(tokenizer) if tokenizer is not None else None
+        self._longest = max(len(s) for s in self.stops)
+        self.output = bytearray()
+        self.token_starts: List[int] = []
+        self.emitted = 0
+        self.match: Optional[Dict] = None
+
+    def feed(self, token_id: int) -> Dict:
+        """Append one generated token; returns {'text', 'stop'}."""
+        if self.token_bytes is None:
+            raise ValueError("feed() needs a tokenizer; use feed_bytes()")
+        return self.feed_bytes(self.token_bytes(token_id))
+
+    def feed_bytes(self, data: bytes) -> Dict:
+        """Append one token's bytes; returns the newly releasable text and any stop match."""
+        if self.match is not None:
+            return {'text': '', 'stop': self.match}
+        self.token_starts.append(len(self.output))
+        search_from = max(0, len(self.output) - self._longest + 1)
+        self.output += data
+
+        found = None
+        for stop in self.stops:
+            pos = self.output.find(stop, search_from)
+            if pos != -1 and (found is None or (pos, -len(stop)) < (found[0], -len(found[1]))):
+                found = (pos, stop)
+        if found is not None:
+            pos, stop = found
+            first = bisect.bisect_right(self.token_starts, pos) - 1
+            last = bisect.bisect_left(self.token_starts, pos + len(stop)) - 1
+            self.match = {
+                'stop': stop.decode('utf-8', errors='replace'),
+                'cut_byte': pos,
+                'end_byte': pos + len(stop),
+                'tokens': [first, last + 1],
+                'split': last > first,
+            }
+            return {'text': self._release(pos), 'stop': self.match}
+        return {'text': self._release(len(self.output) - self._held_back()), 'stop': None}
+
+    def _held_back(self) -> int:
+        """Trailing bytes that may still become a stop string or complete a character."""
+        last = bytes(self.output[-4:])
+        held = len(last) - complete_utf8_prefix(last)
+        tail = bytes(self.output[-(self._longest - 1):]) if self._longest > 1 else b''
+        for size in range(min(len(tail), self._longest - 1), 0, -1):
+            suffix = tail[-size:]
+            if any(stop.startswith(suffix) for stop in self.stops):
+                return max(held, size)
+        return held
+
+    def _release(self, upto: int) -> str:
+        if upto <= self.emitted:
+            return ''
+        text = bytes(self.output[self.emitted:upto]).decode('utf-8', errors='replace')
+        self.emitted = upto
+        return text
+
+    def flush(self) -> str:
+        """Release everything held back (end of generation without a stop)."""
+        return self._release(self.match['cut_byte'] if self.match else len(self.output))
+
+    @property
+    def text(self) -> str:
+        """Output so far, cut at the stop string once one matched."""
+        end = self.match['cut_byte'] if self.match else len(self.output)
+        return bytes(self.output[:end]).decode('utf-8', errors='replace')
+
+
+def find_stop(tokenizer, ids: List[int], stop_sequences: Iterable[Union[str, bytes]]) -> Dict:
+    """Replay a token sequence through a matcher; returns the match (or None) and tokens consumed."""
+    matcher = StopSequenceMatcher(stop_sequences, tokenizer)
+    consumed = 0
+    for token_id in ids:
+        consumed += 1
+        if matcher.feed(token_id)['stop']:
+            break
+    return {'stop': matcher.match, 'tokens_consumed': consumed, 'text': matcher.text}
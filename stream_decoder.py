@@ -0,0 +1,97 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Stream Decoder - Display-safe incremental decoding of token IDs
+
+Tokens arriving one at a time (e.g. from an SSE stream) do not always end
+on a character boundary: byte-fallback tokenizers split a CJK character or
+emoji into '<0xE4>' '<0xB8>' '<0xAD>', and byte-level BPE tokens can end
+mid-character too. Decoding each token separately shows U+FFFD garbage.
+
+Decoder.push(token_id) buffers incomplete UTF-8 sequences and returns only
+complete characters, with the cumulative byte offsets of the emitted piece
+in the decoded output:
+
+  decoder = Decoder(tokenizer)
+  for token_id in stream:
+      piece = decoder.push(token_id)
+      if piece['text']:
+          render(piece['text'])             # bytes [piece['start_byte'], piece['end_byte'])
+  render(decoder.finish()['text'])
+
+Bytes that can never become a valid character are emitted as U+FFFD once
+that is certain, so a broken stream cannot stall the output.
+"""
+
+from typing import Dict, Iterable, List
+
+from token_bytes import TokenBytes
+
+
+def utf8_sequence_length(lead: int) -> int:
+    """Length of the UTF-8 sequence a lead byte announces (1 for invalid leads)."""
+    return 1 if lead < 0x80 else 2 if lead & 0xE0 == 0xC0 else 3 if lead & 0xF0 == 0xE0 else 4 if lead & 0xF8 == 0xF0 else 1
+
+
+def complete_utf8_prefix(data: bytes) -> int:
+    """Length of the longest prefix of data not ending inside a possibly valid UTF-8 sequence."""
+    for back in range(1, min(4, len(data)) + 1):
+        b = data[-back]
+        if b & 0xC0 == 0x80:
+            continue
+        if back < utf8_sequence_length(b):
+            # Only hold back a sequence that can still complete
+            try:
+                data[-back:].decode('utf-8')
+            except UnicodeDecodeError as e:
+                if e.reason == 'unexpected end of data':
+                    return len(data) - back
+        return len(data)
+    return len(data)
+
+
+class Decoder:
+    """Incremental token ID -> text decoder emitting whole characters only."""
+
+    def __init__(self, tokenizer):
+        self.token_bytes = TokenBytes(tokenizer)
+        self.pending = bytearray()
+        self.offset = 0
+        self.tokens = 0
+
+    def push(self, token_id: int) -> Dict:
+        """Add one token; returns {'text', 'start_byte', 'end_byte', 'token_index', 'pending'}."""
+        return self.push_bytes(self.token_bytes(token_id))
+
+    def push_bytes(self, data: bytes) -> Dict:
+        """Add one token's raw bytes (see token_bytes.TokenBytes)."""
+        self.tokens += 1
+        self.pending += data
+        return self._emit(complete_utf8_prefix(bytes(self.pending)))
+
+    def finish(self) -> Dict:
+        """Flush buffered bytes at the end of the stream (incomplete sequences become U+FFFD)."""
+        return self._emit(len(self.pending))
+
+    def _emit(self, size: int) -> Dict:
+        chunk = bytes(self.pending[:size])
+        del self.pending[:size]
+        start = self.offset
+        self.offset += len(chunk)
+        return {
+            'text': chunk.decode('utf-8', errors='replace'),
+            'start_byte': start,
+            'end_byte': self.offset,
+            'token_index': self.tokens - 1,
+            'pending': len(self.pending),
+        }
+
+
+def decode_stream(tokenizer, ids: Iterable[int]) -> List[Dict]:
+    """Decode a token sequence incrementally; one entry per token (plus a final flush if needed)."""
+    decoder = Decoder(tokenizer)
+    pieces = [decoder.push(token_id) for token_id in ids]
+    final = decoder.finish()
+    if final['text']:
+        pieces.append(final)
+    return pieces
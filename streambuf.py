@@ -0,0 +1,153 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Stream Buffer - UTF-8-safe accumulation of streamed model output
+
+StreamBuffer collects streamed tokens and keeps:
+- text            the output decoded so far, whole characters only (bytes of
+                  an unfinished UTF-8 sequence wait in 'pending')
+- span(i, unit)   where output token i sits in that text, for highlighting
+
+Spans are given in 'codepoints' (Python string indices), 'utf16' (JavaScript
+string indices, what browser UIs need) or 'bytes'. A token holding part of a
+character (byte-fallback '<0xE4>' pieces, byte-level BPE splits) is widened
+to the whole character, so several tokens can share one character's span;
+its span is None until the character is complete.
+
+Bytes that cannot start or continue a valid character show as U+FFFD, one
+per byte.
+"""
+
+import bisect
+from array import array
+from typing import List, Optional, Tuple
+
+from position_index import COLUMN_UNITS, utf16_length
+from stream_decoder import complete_utf8_prefix, utf8_sequence_length
+from token_bytes import TokenBytes
+
+
+class StreamBuffer:
+    """Accumulated streamed output with per-token text spans."""
+
+    def __init__(self, tokenizer=None):
+        self.token_bytes = TokenBytes(tokenizer) if tokenizer is not None else None
+        self.data = bytearray()
+        self.token_ends = array('q')
+        self._parts: List[str] = []
+        self._text = ''
+        self.complete = 0
+        # Per byte offset up to self.complete: code points / UTF-16 units before
+        # the character holding it, and whether a character starts there
+        self._codepoints = array('q', [0])
+        self._utf16 = array('q', [0])
+        self._boundary = bytearray(b'\x01')
+
+    def __len__(self) -> int:
+        return len(self.token_ends)
+
+    def append(self, token_id: int) -> str:
+        """Add one streamed token; returns the text that became displayable."""
+        if self.token_bytes is None:
+            raise ValueError("append() needs a tokenizer; use append_bytes()")
+        return self.append_bytes(self.token_bytes(token_id))
+
+    def append_bytes(self, data: bytes) -> str:
+        """Add one token's raw bytes; returns the text that became displayable."""
+        self.data += data
+        self.token_ends.append(len(self.data))
+        return self._advance(complete_utf8_prefix(bytes(self.data[self.complete:])) + self.complete)
+
+    def finish(self) -> str:
+        """End of stream: show leftover bytes of an unfinished character as U+FFFD."""
+        return self._advance(len(self.data))
+
+    def _advance(self, upto: int) -> str:
+        pieces = []
+        pos = self.complete
+        codepoints, utf16 = self._codepoints[-1], self._utf16[-1]
+        while pos < upto:
+            size = utf8_sequence_length(self.data[pos])
+            try:
+                char = bytes(self.data[pos:pos + size]).decode('utf-8') if pos + size <= upto else None
+            except UnicodeDecodeError:
+                char = None
+            if char is None:
+                char, size = '\ufffd', 1
+            pieces.append(char)
+            # Bytes inside the character map to its start
+            for _ in range(1, size):
+                self._codepoints.append(codepoints)
+                self._utf16.append(utf16)
+                self._boundary.append(0)
+            codepoints += 1
+            utf16 += utf16_length(char)
+            self._codepoints.append(codepoints)
+            self._utf16.append(utf16)
+            self._boundary.append(1)
+            pos += size
+        self.complete = pos
+        new_text = ''.join(pieces)
+        if new_text:
+            self._parts.append(new_text)
+            self._text = ''
+        return new_text
+
+    @property
+    def text(self) -> str:
+        """Displayable output so far."""
+        if not self._text and self._parts:
+            self._text = ''.join(self._parts)
+            self._parts = [self._text]
+        return self._text
+
+    @property
+    def pending(self) -> int:
+        """Bytes waiting for the rest of their character."""
+        return len(self.data) - self.complete
+
+    def _to_unit(self, pos: int, unit: str, round_up: bool) -> int:
+        if unit == 'bytes':
+            if round_up:
+                while not self._boundary[pos]:
+                    pos += 1
+            else:
+                while not self._boundary[pos]:
+                    pos -= 1
+            return pos
+        table = self._codepoints if unit == 'codepoints' else self._utf16
+        if round_up and not self._boundary[pos]:
+            while not self._boundary[pos]:
+                pos += 1
+        return table[pos]
+
+    def span(self, index: int, unit: str = 'codepoints') -> Optional[Tuple[int, int]]:
+        """Span of output token index in the text, or None while it is incomplete."""
+        if unit not in COLUMN_UNITS:
+            raise ValueError(f"Unknown unit: {unit}")
+        if not 0 <= index < len(self.token_ends):
+            raise IndexError(f"Token {index} outside 0..{len(self.token_ends)}")
+        start = self.token_ends[index - 1] if index else 0
+        end = self.token_ends[index]
+        if end > self.complete:
+            return None
+        return self._to_unit(start, unit, False), self._to_unit(end, unit, True)
+
+    def spans(self, unit: str = 'codepoints') -> List[Optional[Tuple[int, int]]]:
+        return [self.span(i, unit) for i in range(len(self.token_ends))]
+
+    def token_at(self, offset: int, unit: str = 'codepoints') -> Optional[int]:
+        """Index of the first complete token whose span contains offset, or None."""
+        if unit not in COLUMN_UNITS:
+            raise ValueError(f"Unknown unit: {unit}")
+        table = None if unit == 'bytes' else (self._codepoints if unit == 'codepoints' else self._utf16)
+        # Byte offset of the character holding offset
+        if table is None:
+            pos = offset
+        else:
+            pos = bisect.bisect_right(table, offset) - 1
+        if not 0 <= pos < self.complete:
+            return None
+        pos = self._to_unit(pos, 'bytes', False)
+        index = bisect.bisect_right(self.token_ends, pos)
+        return index if index < len(self.token_ends) else None
@@ -0,0 +1,223 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Structural Paths - Map JSON/YAML tokens to the path of the value they fall in
+
+Every token gets the JSONPath-style path of the innermost value containing
+it, e.g. $.scores.数学 or $.items[2].name. An object/mapping member spans
+from its key to the end of its value, so the tokens of a key count toward
+that entry; commas, brackets and braces count toward the enclosing
+container. A token straddling two values takes their common parent.
+
+summarize_paths totals the tokens per path, both the tokens directly in a
+value ('own') and in its whole subtree ('total'), answering "which keys of
+this config consume the most tokens".
+
+JSON is read by a small position-recording scanner; YAML goes through
+PyYAML's composer (node marks), so it needs the 'PyYAML' package. YAML
+streams with several documents prefix paths with the document index
+(doc1:$.key).
+"""
+
+import json
+import re
+from pathlib import Path
+from typing import Dict, List, Optional, Tuple, Union
+
+from token_spans import build_char_to_byte, compute_token_spans, encode_source
+
+STRUCTURED_FORMATS = ('json', 'yaml')
+FORMAT_EXTENSIONS = {'.json': 'json', '.yaml': 'yaml', '.yml': 'yaml'}
+
+_STRING = re.compile(rb'"(?:[^"\\]|\\.)*"', re.S)
+_SCALAR = re.compile(rb'-?(?:0|[1-9]\d*)(?:\.\d+)?(?:[eE][+-]?\d+)?|true|false|null')
+_WHITESPACE = b' \t\r\n\f\v'
+
+
+class StructureError(ValueError):
+    pass
+
+
+def format_path(path: Tuple, root: str = '$') -> str:
+    """JSONPath-style rendering of a key/index path."""
+    out = [root]
+    for part in path:
+        if isinstance(part, int):
+            out.append(f"[{part}]")
+        elif part.isidentifier():
+            out.append(f".{part}")
+        else:
+            out.append(f"[{json.dumps(part, ensure_ascii=False)}]")
+    return ''.join(out)
+
+
+def json_value_spans(code_bytes: bytes) -> List[Tuple[int, int, Tuple]]:
+    """(start_byte, end_byte, path) of every JSON value and object member."""
+    spans = []
+
+    def _skip(pos: int) -> int:
+        while pos < len(code_bytes) and code_bytes[pos] in b' \t\r\n':
+            pos += 1
+        return pos
+
+    def _fail(pos: int, what: str):
+        raise StructureError(f"Invalid JSON at byte {pos}: {what}")
+
+    def _value(pos: int, path: Tuple) -> int:
+        pos = _skip(pos)
+        head = code_bytes[pos:pos + 1]
+        start = pos
+        if head == b'{':
+            pos = _skip(pos + 1)
+            if code_bytes[pos:pos + 1] != b'}':
+                while True:
+                    match = _STRING.match(code_bytes, _skip(pos))
+                    if match is None:
+                        _fail(_skip(pos), "expected a key")
+                    key = json.loads(match.group().decode('utf-8', errors='replace'))
+                    pos = _skip(match.end())
+                    if code_bytes[pos:pos + 1] != b':':
+                        _fail(pos, "expected ':'")
+                    pos = _value(pos + 1, path + (key,))
+                    spans.append((match.start(), pos, path + (key,)))
+                    pos = _skip(pos)
+                    if code_bytes[pos:pos + 1] == b',':
+                        pos += 1
+                        continue
+                    if code_bytes[pos:pos + 1] != b'}':
+                        _fail(pos, "expected ',' or '}'")
+                    break
+            pos += 1
+        elif head == b'[':
+            pos = _skip(pos + 1)
+            index = 0
+            if code_bytes[pos:pos + 1] != b']':
+                while True:
+                    pos = _skip(_value(pos, path + (index,)))
+                    index += 1
+                    if code_bytes[pos:pos + 1] == b',':
+                        pos += 1
+                        continue
+                    if code_bytes[pos:pos + 1] != b']':
+                        _fail(pos, "expected ',' or ']'")
+                    break
+            pos += 1
+        else:
+            match = (_STRING if head == b'"' else _SCALAR).match(code_bytes, pos)
+            if match is None:
+                _fail(pos, "expected a value")
+            pos = match.end()
+        spans.append((start, pos, path))
+        return pos
+
+    end = _skip(_value(0, ()))
+    if end != len(code_bytes):
+        _fail(end, "trailing data")
+    return spans
+
+
+def yaml_value_spans(text: str) -> List[Tuple[int, int, str]]:
+    """(start_byte, end_byte, path) of every YAML node and mapping entry."""
+    try:
+        import yaml
+    except ImportError:
+        raise StructureError("YAML input needs the 'PyYAML' package (pip install pyyaml)")
+    char_to_byte = build_char_to_byte(text)
+    try:
+        documents = list(yaml.compose_all(text, Loader=yaml.SafeLoader))
+    except yaml.YAMLError as e:
+        raise StructureError(f"Invalid YAML: {e}")
+    spans = []
+
+    def _walk(node, path: Tuple, root: str, seen: set):
+        if id(node) in seen:
+            return
+        seen = seen | {id(node)}
+        rendered = format_path(path, root)
+        spans.append((char_to_byte[node.start_mark.index], char_to_byte[node.end_mark.index], rendered))
+        if isinstance(node, yaml.MappingNode):
+            for key, value in node.value:
+                child = path + (str(key.value) if isinstance(key, yaml.ScalarNode) else key.start_mark.index,)
+                spans.append((char_to_byte[key.start_mark.index], char_to_byte[value.end_mark.index],
+                              format_path(child, root)))
+                _walk(value, child, root, seen)
+        elif isinstance(node, yaml.SequenceNode):
+            for index, item in enumerate(node.value):
+                _walk(item, path + (index,), root, seen)
+
+    for number, document in enumerate(documents):
+        if document is not None:
+            _walk(document, (), f"doc{number}:$" if len(documents) > 1 else '$', set())
+    return spans
+
+
+def map_tokens_to_paths(tokens: List[Dict], code_bytes: bytes,
+                        value_spans: List[Tuple[int, int, object]]) -> List[Dict]:
+    """Add 'path' (innermost containing value) and 'ancestors' to each token (in place)."""
+    ordered = sorted(value_spans, key=lambda s: (s[0], -s[1]))
+    stack: List[Tuple[int, int, object]] = []
+    k = 0
+    for token in tokens:
+        start, end = token['start_byte'], token['end_byte']
+        while start < end and code_bytes[start] in _WHITESPACE:
+            start += 1
+        while end > start and code_bytes[end - 1] in _WHITESPACE:
+            end -= 1
+        if start == end:
+            start, end = token['start_byte'], token['end_byte']
+        while k < len(ordered) and ordered[k][0] <= start:
+            while stack and stack[-1][1] <= ordered[k][0]:
+                stack.pop()
+            stack.append(ordered[k])
+            k += 1
+        while stack and stack[-1][1] < max(end, start + 1):
+            stack.pop()
+        token['path'] = stack[-1][2] if stack else None
+        token['ancestors'] = list(dict.fromkeys(s[2] for s in stack))
+    return tokens
+
+
+def structure_tokens(tokenizer, text: str, fmt: str) -> List[Dict]:
+    """Tokenize a JSON/YAML document and tag every token with its structural path."""
+    if fmt not in STRUCTURED_FORMATS:
+        raise ValueError(f"Unknown structured format: {fmt}")
+    code_bytes = encode_source(text)
+    if fmt == 'json':
+        value_spans = [(s, e, format_path(p)) for s, e, p in json_value_spans(code_bytes)]
+    else:
+        value_spans = yaml_value_spans(text)
+    tokens, _ = compute_token_spans(tokenizer, text)
+    return map_tokens_to_paths(tokens, code_bytes, value_spans)
+
+
+def summarize_paths(tokens: List[Dict]) -> List[Dict]:
+    """Per path: tokens directly in it ('own') and in its subtree ('total'), largest first."""
+    own: Dict[str, int] = {}
+    total: Dict[str, int] = {}
+    for token in tokens:
+        if token['path'] is not None:
+            own[token['path']] = own.get(token['path'], 0) + 1
+        for path in token['ancestors']:
+            total[path] = total.get(path, 0) + 1
+    rows = [{'path': path, 'own': own.get(path, 0), 'total': n} for path, n in total.items()]
+    rows.sort(key=lambda r: (-r['total'], r['path']))
+    return rows
+
+
+def detect_format(path: Union[str, Path], fmt: Optional[str] = None) -> Optional[str]:
+    """Explicit format, else the one implied by the file extension."""
+    return fmt or FORMAT_EXTENSIONS.get(Path(path).suffix.lower())
+
+
+def print_path_summary(rows: List[Dict], token_count: int, title: str = "", top: int = 20):
+    """Print the paths consuming the most tokens."""
+    print(f"\n{'='*60}")
+    print(f"Structural Paths{': ' + title if title else ''} ({token_count} tokens, {len(rows)} paths)")
+    print(f"{'='*60}")
+    print(f"{'Total':>8} {'Share':>7} {'Own':>7}  Path")
+    print("-" * 60)
+    for row in rows[:top]:
+        share = row['total'] / token_count if token_count else 0.0
+        print(f"{row['total']:>8} {share:>6.1%} {row['own']:>7}  {row['path']}")
+    if len(rows) > top:
+        print(f"... {len(rows) - top} more paths")
@@ -0,0 +1,172 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Identifier Sub-words - How model tokens align to camelCase/snake_case parts
+
+Identifiers are split into sub-words ("parseHTTPResponse_v2" ->
+parse, HTTP, Response, v, 2) with UTF-8 byte offsets. Each split point is
+the gap between two sub-words (an underscore run, or empty for camelCase);
+it is matched when some token boundary falls inside the gap. Token
+boundaries strictly inside a sub-word split it mid-word.
+
+Only interior boundaries are measured: a token that also covers the space
+before an identifier does not count against it.
+"""
+
+import re
+from typing import Dict, List, Optional, Tuple
+
+import tracing
+from token_spans import compute_token_spans, encode_source
+
+IDENTIFIER_PATTERN = re.compile(rb'[A-Za-z_\x80-\xff][A-Za-z0-9_\x80-\xff]*')
+
+
+def _char_kind(ch: str) -> str:
+    if ch.isdigit():
+        return 'digit'
+    if ch.isupper():
+        return 'upper'
+    if ch.isalpha():
+        return 'lower'  # lowercase and caseless letters
+    return 'sep'
+
+
+def _subword_ranges(name: str) -> List[Tuple[int, int]]:
+    """Character ranges of the sub-words of an identifier."""
+    kinds = [_char_kind(ch) for ch in name]
+    ranges = []
+    start = None
+    for i, kind in enumerate(kinds):
+        if kind == 'sep':
+            if start is not None:
+                ranges.append((start, i))
+                start = None
+            continue
+        if start is None:
+            start = i
+            continue
+        prev = kinds[i - 1]
+        boundary = (
+            (prev == 'lower' and kind == 'upper')
+            or (prev == 'digit') != (kind == 'digit')
+            # End of an acronym: "HTTPResponse" -> HTTP | Response
+            or (prev == 'upper' and kind == 'upper' and i + 1 < len(name) and kinds[i + 1] == 'lower')
+        )
+        if boundary:
+            ranges.append((start, i))
+            start = i
+    if start is not None:
+        ranges.append((start, len(name)))
+    return ranges
+
+
+def split_identifier(name: str) -> List[Dict]:
+    """Split an identifier into sub-words with byte offsets relative to the identifier."""
+    subwords = []
+    for lo, hi in _subword_ranges(name):
+        start = len(name[:lo].encode('utf-8', 'surrogateescape'))
+        subwords.append({
+            'text': name[lo:hi],
+            'start_byte': start,
+            'end_byte': start + len(name[lo:hi].encode('utf-8', 'surrogateescape')),
+        })
+    return subwords
+
+
+def find_identifiers(code_bytes: bytes, segments: Optional[List[Tuple[int, int, str]]] = None) -> List[Tuple[int, int]]:
+    """Byte ranges of identifiers: from lexical segments when given, else by regex."""
+    if segments is not None:
+        return [(start, end) for start, end, cls in segments if cls == 'identifier']
+    return [m.span() for m in IDENTIFIER_PATTERN.finditer(code_bytes)]
+
+
+def align_identifier(code_bytes: bytes, start: int, end: int, boundaries: List[int]) -> Dict:
+    """Alignment of one identifier [start, end) against sorted token boundaries."""
+    name = code_bytes[start:end].decode('utf-8', errors='surrogateescape')
+    subwords = split_identifier(name)
+    for sw in subwords:
+        sw['start_byte'] += start
+        sw['end_byte'] += start
+    interior = [b for b in boundaries if start < b < end]
+
+    gaps = [(a['end_byte'], b['start_byte']) for a, b in zip(subwords, subwords[1:])]
+    matched_gaps = sum(1 for lo, hi in gaps if any(lo <= b <= hi for b in interior))
+    for sw in subwords:
+        sw['split'] = any(sw['start_byte'] < b < sw['end_byte'] for b in interior)
+    mid_word = sum(1 for b in interior if any(sw['start_byte'] < b < sw['end_byte'] for sw in subwords))
+
+    return {
+        'identifier': name,
+        'start_byte': start,
+        'end_byte': end,
+        'subwords': subwords,
+        'tokens': len(interior) + 1,
+        'split_points': len(gaps),
+        'matched_split_points': matched_gaps,
+        'mid_word_boundaries': mid_word,
+        'exact': matched_gaps == len(gaps) and mid_word == 0,
+    }
+
+
+@tracing.traced('align', kind='subwords',
+                before=lambda a: {'encoder': tracing.encoder_name(a['tokenizer'])},
+                after=lambda result, a: {'bytes': len(encode_source(a['code'])),
+                                         'identifiers': result['summary']['identifiers'],
+                                         'tokens': result['summary']['tokens']})
+def align_subwords(tokenizer, code: str, segments: Optional[List[Tuple[int, int, str]]] = None) -> Dict:
+    """Align model tokens to identifier sub-words across a piece of code.
+
+    segments: optional lexical.lexical_segments output, to take identifiers
+    from the grammar instead of a regex.
+    """
+    code_bytes = encode_source(code)
+    spans, _ = compute_token_spans(tokenizer, code)
+    boundaries = sorted({s['start_byte'] for s in spans} | {s['end_byte'] for s in spans})
+
+    identifiers = [align_identifier(code_bytes, start, end, boundaries)
+                   for start, end in find_identifiers(code_bytes, segments)]
+    identifiers = [ident for ident in identifiers if ident['subwords']]
+
+    subword_count = sum(len(i['subwords']) for i in identifiers)
+    split_points = sum(i['split_points'] for i in identifiers)
+    matched = sum(i['matched_split_points'] for i in identifiers)
+    tokens = sum(i['tokens'] for i in identifiers)
+    summary = {
+        'identifiers': len(identifiers),
+        'subwords': subword_count,
+        'tokens': tokens,
+        'tokens_per_subword': tokens / subword_count if subword_count else 0.0,
+        'split_point_recall': matched / split_points if split_points else 1.0,
+        'subwords_split_mid_word': sum(1 for i in identifiers for sw in i['subwords'] if sw['split']),
+        'exact_identifiers': sum(1 for i in identifiers if i['exact']),
+    }
+    summary['exact_fraction'] = summary['exact_identifiers'] / len(identifiers) if identifiers else 0.0
+    return {'summary': summary, 'identifiers': identifiers}
+
+
+def print_subword_report(result: Dict, title: str = "", worst: int = 15):
+    """Print the alignment summary and the least aligned identifiers."""
+    summary = result['summary']
+    print(f"\n{'='*60}")
+    print(f"Identifier Sub-word Alignment{': ' + title if title else ''}")
+    print(f"{'='*60}")
+    print(f"Identifiers: {summary['identifiers']}  Sub-words: {summary['subwords']}  Tokens: {summary['tokens']}")
+    print(f"Tokens per sub-word: {summary['tokens_per_subword']:.3f}")
+    print(f"Split-point recall: {summary['split_point_recall']:.1%}")
+    print(f"Sub-words split mid-word: {summary['subwords_split_mid_word']}")
+    print(f"Exactly aligned identifiers: {summary['exact_identifiers']} ({summary['exact_fraction']:.1%})")
+
+    misaligned = [i for i in result['identifiers'] if not i['exact']]
+    if misaligned:
+        print(f"\nLeast aligned identifiers:")
+        misaligned.sort(key=lambda i: (i['mid_word_boundaries'], i['split_points'] - i['matched_split_points']), reverse=True)
+        seen = set()
+        for ident in misaligned:
+            if ident['identifier'] in seen:
+                continue
+            seen.add(ident['identifier'])
+            parts = '|'.join(sw['text'] for sw in ident['subwords'])
+            print(f"  {ident['identifier']:<32} sub-words={parts} tokens={ident['tokens']} mid-word={ident['mid_word_boundaries']}")
+            if len(seen) >= worst:
+                break
@@ -5,8 +5,10 @@ Simplified Test Script - Works with quick_analyzer.py
 Tests basic Tree-sitter parsing and alignment score calculation functionality
 """
 
+import functools
 import os
 import sys
+import traceback
 from pathlib import Path
 from tree_sitter import Language, Parser
 from transformers import AutoTokenizer
@@ -228,6 +230,2542 @@ def test_code_samples():
     print(f"\nFound {found_files}/{len(expected_dirs)} language directories, {total_files} sample files in total")
     return found_files > 0
 
+def test_concurrent_encoding():
+    """Tokenize the code samples from many threads and compare with a sequential run"""
+    print("\n" + "=" * 60)
+    print("Testing Concurrent Encoding")
+    print("=" * 60)
+
+    try:
+        from encoder_registry import get_encoder
+        from repo_walker import walk_repository
+        from shared_encoder import check_thread_safety
+        from source_text import read_source
+        from token_spans import compute_token_spans
+        import concurrent.futures
+
+        texts = [read_source(path, encoding='auto')[0] for path in walk_repository('./code_samples')]
+        if not texts:
+            print("❌ No code samples to tokenize")
+            return False
+
+        result = check_thread_safety(AutoTokenizer.from_pretrained('gpt2'), texts, threads=8, rounds=3)
+        print(f"{'✓' if result['mismatches'] == 0 else '❌'} SharedEncoder: {result['calls']} calls on "
+              f"{result['threads']} threads, {result['mismatches']} mismatches")
+
+        # The registry's tokenizer is what every tokoffset command shares
+        tokenizer = get_encoder('gpt2').tokenizer
+        baseline = [compute_token_spans(tokenizer, text) for text in texts]
+        with concurrent.futures.ThreadPoolExecutor(max_workers=8) as ex:
+            concurrent_results = list(ex.map(lambda text: compute_token_spans(tokenizer, text), texts * 3))
+        registry_mismatches = sum(1 for i, spans in enumerate(concurrent_results) if spans != baseline[i % len(texts)])
+        print(f"{'✓' if registry_mismatches == 0 else '❌'} Registry tokenizer: {len(concurrent_results)} calls, "
+              f"{registry_mismatches} mismatches")
+        return result['mismatches'] == 0 and registry_mismatches == 0
+
+    except Exception as e:
+        print(f"❌ Error during testing: {e}")
+        import traceback
+        traceback.print_exc()
+        return False
+
+def test_golden_files():
+    """Compare the gpt2 tokens and offsets of the code samples with the committed golden files"""
+    print("\n" + "=" * 60)
+    print("Testing Golden Files")
+    print("=" * 60)
+
+    try:
+        from tokentest import golden_path, print_golden_results, run_golden
+
+        golden_dir = golden_path('./golden', 'gpt2', '').parent
+        if not golden_dir.is_dir():
+            print(f"⚠️  No golden files in {golden_dir}, skipping the golden comparison")
+            print("  Record them with: python tokoffset.py golden code_samples --update")
+            if os.environ.get('CI'):
+                print("❌ Golden files are required in CI")
+                return False
+            return True
+
+        results = run_golden(AutoTokenizer.from_pretrained('gpt2'), './code_samples', './golden', 'gpt2')
+        print_golden_results(results)
+        if any(r['status'] == 'missing' for r in results):
+            print("  Record them with: python tokoffset.py golden code_samples --update")
+        return bool(results) and all(r['status'] == 'match' for r in results)
+
+    except Exception as e:
+        print(f"❌ Error during testing: {e}")
+        import traceback
+        traceback.print_exc()
+        return False
+
+# Module tests run by main() after the tests above, in definition order
+MODULE_TESTS = []
+
+def module_test(title):
+    """Register a module test: prints its banner and turns an exception into a failure"""
+    def decorate(func):
+        @functools.wraps(func)
+        def wrapper():
+            print("\n" + "=" * 60)
+            print(f"Testing {title}")
+            print("=" * 60)
+            try:
+                return func()
+            except Exception as e:
+                print(f"❌ Error during testing: {e}")
+                traceback.print_exc()
+                return False
+        MODULE_TESTS.append((title, wrapper))
+        return wrapper
+    return decorate
+
+def check(condition, description):
+    """Print one expectation as ✓/❌ and return whether it held"""
+    print(f"{'✓' if condition else '❌'} {description}")
+    return bool(condition)
+
+@functools.lru_cache(maxsize=None)
+def gpt2_tokenizer():
+    """The gpt2 tokenizer the module tests share"""
+    return AutoTokenizer.from_pretrained('gpt2')
+
+class ByteFallbackTokenizer:
+    """Llama-style stand-in: ASCII characters are tokens, other characters become '<0xNN>' byte tokens
+
+    Every byte token of a character reports the character's offsets, or with
+    empty_trailing=True only the first one does and the rest get (s, s).
+    """
+
+    def __init__(self, empty_trailing=False):
+        self.empty_trailing = empty_trailing
+        self.pieces = []
+
+    def _id(self, piece):
+        if piece not in self.pieces:
+            self.pieces.append(piece)
+        return self.pieces.index(piece)
+
+    def __call__(self, text, add_special_tokens=False, return_offsets_mapping=False, **kwargs):
+        ids, offsets = [], []
+        for i, ch in enumerate(text):
+            if ch.isascii():
+                ids.append(self._id(ch))
+                offsets.append((i, i + 1))
+                continue
+            for n, b in enumerate(ch.encode('utf-8')):
+                ids.append(self._id(f'<0x{b:02X}>'))
+                offsets.append((i, i) if self.empty_trailing and n else (i, i + 1))
+        encoding = {'input_ids': ids}
+        if return_offsets_mapping:
+            encoding['offset_mapping'] = offsets
+        return encoding
+
+    def encode(self, text, add_special_tokens=False):
+        return self(text)['input_ids']
+
+    def convert_ids_to_tokens(self, ids):
+        if isinstance(ids, int):
+            return self.pieces[ids]
+        return [self.pieces[i] for i in ids]
+
+    def decode(self, ids, **kwargs):
+        data = b''
+        for piece in self.convert_ids_to_tokens(ids):
+            data += bytes([int(piece[3:5], 16)]) if piece.startswith('<0x') else piece.encode('utf-8')
+        return data.decode('utf-8', errors='replace')
+
+@module_test("Code-Point Offsets")
+def test_codepoint_offsets():
+    """Spans carry offsets in the unit chosen for compute_token_spans"""
+    import bisect
+    from token_spans import build_byte_to_unit, build_char_to_byte, compute_token_spans, encode_source
+
+    code = "name = 'é中😀'\nx = 1"
+    spans, _ = compute_token_spans(gpt2_tokenizer(), code, 'codepoints')
+    char_to_byte = build_char_to_byte(code)
+    expected = [(bisect.bisect_right(char_to_byte, s['start_byte']) - 1,
+                 bisect.bisect_left(char_to_byte, s['end_byte'])) for s in spans]
+    results = [
+        check([(s['start_codepoint'], s['end_codepoint']) for s in spans] == expected,
+              "Code point offsets match str indices"),
+        check(spans[-1]['end_codepoint'] == len(code), "Last span ends at len(code)"),
+        check('start_codepoint' not in compute_token_spans(gpt2_tokenizer(), code)[0][0],
+              "Byte mode adds no extra offsets"),
+    ]
+    utf16 = build_byte_to_unit(code, 'utf16')
+    results.append(check(utf16[-1] == len(code) + 1, "Emoji counts as two UTF-16 units"))
+
+    # Raw policy keeps malformed bytes as escaped surrogates, which plain UTF-8 cannot encode
+    raw = b'a\xff\xfeb'.decode('utf-8', 'surrogateescape')
+    index = build_byte_to_unit(raw, 'codepoints')
+    results.append(check(index == [0, 1, 2, 3, 4] and len(index) == len(encode_source(raw)) + 1,
+                         "Escaped raw bytes count as one code point each"))
+    raw_spans, _ = compute_token_spans(gpt2_tokenizer(), raw, 'codepoints')
+    results.append(check(raw_spans[-1]['end_codepoint'] == len(raw), "Raw-policy text gets code point spans"))
+    try:
+        compute_token_spans(gpt2_tokenizer(), code, 'runes')
+        results.append(check(False, "Unknown offset unit is rejected"))
+    except ValueError:
+        results.append(check(True, "Unknown offset unit is rejected"))
+    return all(results)
+
+@module_test("Byte-Fallback Spans")
+def test_byte_fallback_spans():
+    """Byte tokens get one byte each, are flagged partial and coalesce into whole characters"""
+    from token_spans import coalesce_partial_spans, compute_token_spans, encode_source
+
+    code = 'a中b😀'
+    code_bytes = encode_source(code)
+    results = []
+    for empty_trailing in (False, True):
+        spans, source = compute_token_spans(ByteFallbackTokenizer(empty_trailing), code)
+        label = 'empty trailing offsets' if empty_trailing else 'shared offsets'
+        results.append(check([(s['start_byte'], s['end_byte']) for s in spans] == [(i, i + 1) for i in range(len(code_bytes))],
+                             f"One byte per byte token ({label})"))
+        results.append(check([s['partial'] for s in spans] == [False, True, True, True, False, True, True, True, True],
+                             f"Bytes inside a character are partial ({label})"))
+    merged = coalesce_partial_spans(spans, code_bytes)
+    results.append(check([(m['start_byte'], m['end_byte'], m['token_indices']) for m in merged] ==
+                         [(0, 1, [0]), (1, 4, [1, 2, 3]), (4, 5, [4]), (5, 9, [5, 6, 7, 8])],
+                         "Partial runs coalesce into whole characters"))
+    results.append(check(not any(m['partial'] for m in merged), "Coalesced spans are complete"))
+    truncated = coalesce_partial_spans(spans[:7], code_bytes)
+    results.append(check(truncated[-1]['partial'] and truncated[-1]['token_indices'] == [5, 6],
+                         "A truncated character stays partial"))
+    results.append(check(coalesce_partial_spans([], b'') == [], "Empty input coalesces to nothing"))
+    return all(results)
+
+@module_test("Invalid UTF-8 Policies")
+def test_invalid_utf8_policies():
+    """Every policy on malformed UTF-8 and UTF-16 input keeps offsets on the original bytes"""
+    from source_text import INVALID_UTF8_POLICIES, decode_source, transcode_source
+    from token_spans import encode_source
+
+    def decode(data, encoding, policy):
+        return decode_source(data, policy) if encoding == 'utf-8' else transcode_source(data, encoding, policy)
+
+    def original(text, byte_map, needle):
+        pos = encode_source(text).find(needle.encode('utf-8'))
+        return byte_map[pos] if byte_map is not None else pos
+
+    samples = [
+        ('UTF-8', b'a\xff\xfe = "\xc3\xa9" + end\n', 'utf-8'),
+        ('UTF-16 (lone surrogate)', 'a = '.encode('utf-16-le') + b'\x00\xd8' + ' + end\n'.encode('utf-16-le'), 'utf-16-le'),
+        ('UTF-16 (odd length)', 'x = end'.encode('utf-16-le') + b'\x0a', 'utf-16-le'),
+    ]
+    results = []
+    for label, data, encoding in samples:
+        expected_end = data.find('end'.encode(encoding))
+        for policy in INVALID_UTF8_POLICIES:
+            if policy == 'error':
+                try:
+                    decode(data, encoding, policy)
+                    results.append(check(False, f"{label}, error: raises UnicodeDecodeError"))
+                except UnicodeDecodeError:
+                    results.append(check(True, f"{label}, error: raises UnicodeDecodeError"))
+                continue
+            text, byte_map = decode(data, encoding, policy)
+            if byte_map is not None:
+                results.append(check(len(byte_map) == len(encode_source(text)) + 1,
+                                     f"{label}, {policy}: byte map covers every UTF-8 byte"))
+            results.append(check(original(text, byte_map, 'end') == expected_end,
+                                 f"{label}, {policy}: offsets after the bad bytes address the original data"))
+            if policy == 'replace':
+                results.append(check('\ufffd' in text, f"{label}, replace: U+FFFD marks the bad bytes"))
+            if policy == 'raw' and encoding == 'utf-8':
+                results.append(check(encode_source(text) == data, f"{label}, raw: bytes round-trip"))
+    return all(results)
+
+@module_test("Memory-Mapped Windows")
+def test_mmap_windows():
+    """Windowed tokenization of a file reports absolute offsets on character boundaries"""
+    import tempfile
+    from mmap_input import iter_file_windows, tokenize_file_windowed
+
+    data = ('def f():\n    return "中文😀"\n' * 5).encode('utf-8') + b'x' * 40 + b'\xff' + '终'.encode('utf-8')
+    with tempfile.TemporaryDirectory() as tmp:
+        path = Path(tmp) / 'big.py'
+        path.write_bytes(data)
+        empty = Path(tmp) / 'empty.py'
+        empty.write_bytes(b'')
+
+        windows = list(iter_file_windows(path, window_bytes=16))
+        spans = list(tokenize_file_windowed(gpt2_tokenizer(), path, window_bytes=16))
+        results = [
+            check(b''.join(data[base:(windows[i + 1][0] if i + 1 < len(windows) else len(data))]
+                           for i, (base, _, _) in enumerate(windows)) == data, "Windows reassemble the file"),
+            check(all((data[base] & 0xC0) != 0x80 for base, _, _ in windows), "Windows start on character boundaries"),
+            check([s['index'] for s in spans] == list(range(len(spans))), "Token indices run across windows"),
+            check(all(0 <= s['start_byte'] < s['end_byte'] <= len(data) for s in spans), "Spans stay inside the file"),
+            check(spans[-1]['end_byte'] == len(data), "Last span ends at the file end (no trailing newline)"),
+            check(data[spans[-1]['start_byte']:].decode('utf-8').endswith('终'),
+                  "Offsets after replacement address the original bytes"),
+            check(list(tokenize_file_windowed(gpt2_tokenizer(), empty)) == [], "Empty file yields no tokens"),
+        ]
+    try:
+        list(iter_file_windows(path, window_bytes=0))
+        results.append(check(False, "Non-positive window size is rejected"))
+    except ValueError:
+        results.append(check(True, "Non-positive window size is rejected"))
+    return all(results)
+
+@module_test("Text Buffer Edits")
+def test_text_buffer_random_edits():
+    """Random inserts/deletes keep TextBuffer tokens equal to tokenizing the whole text"""
+    import random
+    from textbuf import TextBuffer
+    from token_spans import compute_token_spans
+
+    def boundaries(text):
+        offsets, pos = [], 0
+        for ch in text:
+            offsets.append(pos)
+            pos += len(ch.encode('utf-8'))
+        return offsets + [pos]
+
+    def key(spans):
+        return [(s['id'], s['start_byte'], s['end_byte'], s['partial']) for s in spans]
+
+    pieces = ['def', ' foo', '(x)', ':', '\n', '    ', '  ', 'return', ' 中文', '😀', 'é', ' = ', '"s"', '#', '\n\n', '\t', 'x1']
+    results = []
+    for label, tokenizer in (('gpt2', gpt2_tokenizer()), ('byte fallback', ByteFallbackTokenizer())):
+        rng = random.Random(336)
+        buf = TextBuffer(tokenizer, 'def f(x):\n    return "中文😀"\n')
+        failures = 0
+        for step in range(300):
+            text = buf.text()
+            offsets = boundaries(text)
+            if rng.random() < 0.55 or len(offsets) < 3:
+                at = rng.choice(offsets)
+                buf.insert(at, ''.join(rng.choice(pieces) for _ in range(rng.randint(1, 3))))
+            else:
+                start = rng.randrange(len(offsets) - 1)
+                end = min(len(offsets) - 1, start + rng.randint(1, 8))
+                buf.delete(offsets[start], offsets[end])
+            expected, _ = compute_token_spans(tokenizer, buf.text())
+            if key(buf.tokens) != key(expected):
+                failures += 1
+                if failures == 1:
+                    print(f"  step {step}: {buf.text()!r}")
+        results.append(check(failures == 0, f"{label}: 300 random edits match full retokenization ({failures} mismatches)"))
+        results.append(check(buf.line_starts == [0] + [i + 1 for i, b in enumerate(buf.get_bytes()) if b == 0x0A],
+                             f"{label}: line starts follow the edits"))
+
+    try:
+        TextBuffer(gpt2_tokenizer(), '中').insert(1, 'x')
+        results.append(check(False, "Edits inside a UTF-8 sequence are rejected"))
+    except ValueError:
+        results.append(check(True, "Edits inside a UTF-8 sequence are rejected"))
+    return all(results)
+
+@module_test("LSP Content Changes")
+def test_lsp_content_changes():
+    """didChange events with UTF-16 ranges edit the buffer like the equivalent string edits"""
+    from textbuf import TextBuffer
+    from token_spans import compute_token_spans
+
+    def change(start, end, text):
+        return {'range': {'start': {'line': start[0], 'character': start[1]},
+                          'end': {'line': end[0], 'character': end[1]}}, 'text': text}
+
+    buf = TextBuffer(gpt2_tokenizer(), 's = "😀x"\nprint(s)\n')
+    summaries = buf.apply_content_changes([
+        change((0, 7), (0, 8), 'yz'),          # after the emoji: UTF-16 column 7 is byte 9
+        change((1, 6), (1, 7), 's, "é"'),
+        change((1, 0), (0, 4), ''),            # reversed range
+        change((5, 0), (9, 0), '# end'),       # past the end clamps
+    ])
+    expected, _ = compute_token_spans(gpt2_tokenizer(), buf.text())
+    results = [
+        check(buf.text() == 's = print(s, "é")\n# end', "Changes apply in order with UTF-16 columns"),
+        check(summaries[0]['start_byte'] == 9, "Column after a surrogate pair maps past the emoji bytes"),
+        check([s['version'] for s in summaries] == [1, 2, 3, 4], "Each change bumps the version"),
+        check([(t['id'], t['start_byte'], t['end_byte']) for t in buf.tokens] ==
+              [(t['id'], t['start_byte'], t['end_byte']) for t in expected], "Tokens match a full retokenization"),
+        check(buf.offset_to_utf16_position(len(buf)) == (1, 5), "End offset maps back to an LSP position"),
+    ]
+    summary = buf.apply_content_change({'text': ''})
+    results.append(check(buf.text() == '' and buf.tokens == [] and summary['new_end_token'] == 0,
+                         "A change without a range replaces the whole document"))
+    return all(results)
+
+def run_lsp_session(helper, messages):
+    """Feed framed messages to helper.serve() and return (exit code, decoded replies)"""
+    import io
+    import json
+    from lsp_helper import read_message, write_message
+
+    stdin, stdout = io.BytesIO(), io.BytesIO()
+    for message in messages:
+        write_message(stdin, message)
+    stdin.seek(0)
+    code = helper.serve(stdin, stdout)
+    stdout.seek(0)
+    replies = []
+    while True:
+        body = read_message(stdout)
+        if body is None:
+            return code, replies
+        replies.append(json.loads(body))
+
+@module_test("LSP Helper")
+def test_lsp_helper():
+    """serve() answers over LSP framing on a bounded worker pool"""
+    import threading
+    from lsp_helper import DEFAULT_WORKERS, LspHelper
+
+    class ThreadCountingTokenizer:
+        """Records how many lsp-helper worker threads are alive while tokenizing"""
+        def __init__(self, tokenizer):
+            self.tokenizer = tokenizer
+            self.max_workers = 0
+
+        def __call__(self, *args, **kwargs):
+            alive = sum(1 for t in threading.enumerate() if t.name.startswith('lsp-helper'))
+            self.max_workers = max(self.max_workers, alive)
+            return self.tokenizer(*args, **kwargs)
+
+        def __getattr__(self, name):
+            return getattr(self.tokenizer, name)
+
+    uri = 'file:///a.py'
+    tokenizer = ThreadCountingTokenizer(gpt2_tokenizer())
+    messages = [
+        {'jsonrpc': '2.0', 'method': 'textDocument/didOpen',
+         'params': {'textDocument': {'uri': uri, 'version': 1, 'text': 'x = 1\n'}}},
+        {'jsonrpc': '2.0', 'method': 'textDocument/didChange',
+         'params': {'textDocument': {'uri': uri, 'version': 2},
+                    'contentChanges': [{'range': {'start': {'line': 0, 'character': 4},
+                                                  'end': {'line': 0, 'character': 5}}, 'text': '42 + y'}]}},
+        {'jsonrpc': '2.0', 'id': 1, 'method': 'count', 'params': {'textDocument': {'uri': uri}}},
+        {'jsonrpc': '2.0', 'id': 2, 'method': 'count', 'params': {'uri': uri}},
+    ]
+    messages += [{'jsonrpc': '2.0', 'id': 10 + i, 'method': 'encode', 'params': {'text': f'value_{i} = {i}'}}
+                 for i in range(20)]
+    messages += [{'jsonrpc': '2.0', 'id': 99, 'method': 'shutdown'}, {'jsonrpc': '2.0', 'method': 'exit'}]
+    code, replies = run_lsp_session(LspHelper(tokenizer), messages)
+    by_id = {reply.get('id'): reply for reply in replies}
+    expected_count = len(gpt2_tokenizer()('x = 42 + y\n')['input_ids'])
+    results = [
+        check(code == 0, "Exits cleanly after shutdown/exit"),
+        check(by_id[1].get('result') == {'count': expected_count, 'version': 2},
+              "count {textDocument: {uri}} returns the count and version"),
+        check(by_id[2].get('result') == by_id[1].get('result'), "count {uri} gives the same answer"),
+        check(all('result' in by_id[10 + i] for i in range(20)), "All 20 encode requests are answered"),
+        check(tokenizer.max_workers <= DEFAULT_WORKERS,
+              f"At most {DEFAULT_WORKERS} worker threads ({tokenizer.max_workers} seen)"),
+    ]
+    return all(results)
+
+def write_tree(root, files):
+    """Create files (relative path -> str or bytes) under root"""
+    for rel, content in files.items():
+        path = Path(root) / rel
+        path.parent.mkdir(parents=True, exist_ok=True)
+        if isinstance(content, bytes):
+            path.write_bytes(content)
+        else:
+            path.write_text(content, encoding='utf-8')
+
+@module_test("Repository Walker")
+def test_repo_walker():
+    """Ignore files, binary sniffing and per-directory token totals"""
+    import tempfile
+    from repo_walker import summarize_repository, walk_repository
+
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {
+            '.gitignore': '*.log\n!keep.log\nbuild/\n/top.txt\n**/gen/*.py\n',
+            'main.py': 'print("hi")\n',
+            'top.txt': 'ignored at the root only',
+            'debug.log': 'ignored',
+            'keep.log': 'kept by negation',
+            'build/out.py': 'ignored directory',
+            'src/top.txt': 'not anchored here',
+            'src/gen/auto.py': 'ignored by **',
+            'src/.tokignore': 'secret.py\n',
+            'src/secret.py': 'ignored by the nested .tokignore',
+            'src/util.py': 'def f():\n    return 1',
+            'src/utf16.txt': '\ufeffwide text'.encode('utf-16-le'),
+            'src/image.bin': b'\x89PNG\x00\x00\x01\x02',
+            'src/empty.py': '',
+            '.git/config': 'never walked',
+        })
+        walked = [p.relative_to(tmp).as_posix() for p in walk_repository(tmp)]
+        summary = summarize_repository(gpt2_tokenizer(), tmp, batch_size=2)
+        limited = summarize_repository(gpt2_tokenizer(), tmp, max_file_bytes=15)
+        extra = [p.relative_to(tmp).as_posix() for p in walk_repository(tmp, ignore_patterns=['src/'])]
+
+    files = {f['path']: f for f in summary['files']}
+    results = [
+        check(walked == ['.gitignore', 'keep.log', 'main.py', 'src/.tokignore', 'src/empty.py', 'src/top.txt',
+                         'src/utf16.txt', 'src/util.py'], f"Walked files honor ignore rules: {walked}"),
+        check(files['src/empty.py']['tokens'] == 0, "Empty file counts zero tokens"),
+        check(files['src/util.py']['tokens'] == len(gpt2_tokenizer()('def f():\n    return 1')['input_ids']),
+              "File without a trailing newline is counted whole"),
+        check(files['src/utf16.txt']['tokens'] > 0 and files['main.py']['language'] == 'python',
+              "UTF-16 text is kept and languages come from extensions"),
+        check(summary['total']['tokens'] == sum(f['tokens'] for f in summary['files'])
+              and summary['directories']['src']['files'] == 5, "Directory totals add up"),
+        check(limited['total']['skipped'] > 0 and all(f['bytes'] <= 15 for f in limited['files']),
+              "max_file_bytes skips larger files"),
+        check(not any(p.startswith('src/') for p in extra), "Extra ignore patterns apply"),
+    ]
+    return all(results)
+
+@module_test("Token Statistics")
+def test_token_statistics():
+    """Per-line counts, token lengths and language totals, including edge cases"""
+    from stats import TokenStatistics
+
+    def per_line(text):
+        stats = TokenStatistics(ByteFallbackTokenizer())
+        stats.add_document(text, 'python')
+        return stats.to_dict()
+
+    # ByteFallbackTokenizer makes every ASCII character one token
+    results = [
+        check(per_line('')['tokens_per_line']['count'] == 0, "Empty document has no lines"),
+        check(per_line('')['languages']['python'] == {'files': 1, 'bytes': 0, 'tokens': 0, 'tokens_per_byte': 0.0},
+              "Empty document still counts as a file"),
+        check(per_line('ab\ncd')['tokens_per_line']['histogram'] == {'2': 1, '3': 1},
+              "Last line without a trailing newline is counted"),
+        check(per_line('ab\n')['tokens_per_line']['histogram'] == {'3': 1},
+              "A trailing newline does not add an empty line"),
+        check(per_line('a\n\nb')['tokens_per_line']['histogram'] == {'1': 2, '2': 1},
+              "A token starting on a newline byte counts on the line it ends"),
+    ]
+    wide = per_line('中')
+    results.append(check(wide['token_length_bytes']['histogram'] == {'1': 3}, "Byte tokens are one byte long"))
+
+    stats = TokenStatistics(gpt2_tokenizer(), top_k=3)
+    stats.add_document('x = 1\ny = x + x\n', 'python')
+    stats.add_document('let x = x;', 'javascript')
+    summary = stats.to_dict()
+    results.append(check(summary['documents'] == 2 and summary['tokens_per_line']['count'] == 3,
+                         "Lines are counted across documents"))
+    results.append(check(summary['token_length_bytes']['count'] == sum(v['tokens'] for v in summary['languages'].values()),
+                         "Every token has a length"))
+    results.append(check(len(summary['most_frequent_tokens']) == 3
+                         and summary['most_frequent_tokens'][0]['text'].strip() == 'x', "Most frequent token comes first"))
+    return all(results)
+
+class FakeNode:
+    """Minimal tree-sitter node: type, byte range, children and is_named"""
+    def __init__(self, type, start_byte, end_byte, children=(), is_named=True, fields=None):
+        self.type = type
+        self.start_byte = start_byte
+        self.end_byte = end_byte
+        self.children = list(children)
+        self.is_named = is_named
+        self.fields = fields or {}
+        self.root_node = self
+
+    def child_by_field_name(self, name):
+        return self.fields.get(name)
+
+class DefinitionParser:
+    """Stand-in parser: every 'def name' / 'class Name' line starts a definition running to the next one"""
+    def parse(self, data):
+        import re
+        matches = list(re.finditer(rb'^(def|class) (\w+)', data, re.M))
+        definitions = []
+        for i, match in enumerate(matches):
+            end = matches[i + 1].start() if i + 1 < len(matches) else len(data)
+            name = FakeNode('identifier', *match.span(2))
+            kind = 'function_definition' if match.group(1) == b'def' else 'class_definition'
+            definitions.append(FakeNode(kind, match.start(), end, [name], fields={'name': name}))
+        return FakeNode('module', 0, len(data), definitions)
+
+@module_test("Lexical Classes")
+def test_lexical_classes():
+    """Leaf classification and majority classes for tokens spanning several leaves"""
+    from lexical import enrich_tokens, lexical_segments, summarize_classes
+
+    code = b'foo( 1  #abc'
+    segments = [(0, 3, 'identifier'), (3, 4, 'punctuation'), (5, 6, 'number'), (8, 12, 'comment')]
+    spans = [(0, 4), (3, 6), (6, 8), (7, 12), (0, 12)]
+    tokens = enrich_tokens([{'start_byte': s, 'end_byte': e} for s, e in spans], code, segments)
+    results = [
+        check([(t['lexical_class'], t['mixed']) for t in tokens] == [
+            ('identifier', True), ('number', True), ('whitespace', False), ('comment', False), ('comment', True)],
+            "Tokens over several leaves take the majority class (ties by class order)"),
+        check(enrich_tokens([], code, segments) == [], "No tokens, nothing to tag"),
+        check(enrich_tokens([{'start_byte': 0, 'end_byte': 2}], b'??', [])[0]['lexical_class'] == 'other',
+              "Bytes outside any leaf that are not whitespace are 'other'"),
+    ]
+
+    # s = "a\n"  # c
+    tree = FakeNode('module', 0, 15, [
+        FakeNode('assignment', 0, 8, [
+            FakeNode('identifier', 0, 1),
+            FakeNode('=', 2, 3, is_named=False),
+            FakeNode('string', 4, 8, [FakeNode('"', 4, 5, is_named=False), FakeNode('escape_sequence', 5, 7),
+                                      FakeNode('"', 7, 8, is_named=False)]),
+        ]),
+        FakeNode('comment', 10, 13),
+        FakeNode('if', 13, 15, is_named=False),
+    ])
+    results.append(check(lexical_segments(tree) == [(0, 1, 'identifier'), (2, 3, 'punctuation'), (4, 5, 'string'),
+                                                    (5, 7, 'string'), (7, 8, 'string'), (10, 13, 'comment'),
+                                                    (13, 15, 'keyword')],
+                         "String children stay strings; anonymous words are keywords"))
+    summary = summarize_classes(tokens)
+    results.append(check(summary['total'] == 5 and summary['mixed'] == 3 and summary['classes']['comment']['tokens'] == 2,
+                         "Summary counts classes and mixed tokens"))
+    results.append(check(summarize_classes([])['classes']['identifier']['fraction'] == 0.0, "Empty summary has zero fractions"))
+    return all(results)
+
+@module_test("Identifier Sub-words")
+def test_identifier_subwords():
+    """Splitting identifiers and scoring token boundaries against sub-word gaps"""
+    from subwords import align_identifier, align_subwords, split_identifier
+
+    def texts(name):
+        return [sw['text'] for sw in split_identifier(name)]
+
+    results = [
+        check(texts('parseHTTPResponse_v2') == ['parse', 'HTTP', 'Response', 'v', '2'], "camelCase, acronym and digits split"),
+        check(texts('__init__') == ['init'] and texts('_') == [], "Underscore runs are separators"),
+        check([(sw['start_byte'], sw['end_byte']) for sw in split_identifier('größeWert')] == [(0, 7), (7, 11)],
+              "Sub-word offsets are UTF-8 bytes"),
+    ]
+    code = b'x = get_value'
+    exact = align_identifier(code, 4, 13, [0, 1, 4, 7, 8, 13])
+    mid = align_identifier(code, 4, 13, [4, 6, 13])
+    results.append(check(exact['exact'] and exact['matched_split_points'] == 1 and exact['tokens'] == 3,
+                         "Boundaries inside the underscore gap match the split point"))
+    results.append(check(not mid['exact'] and mid['mid_word_boundaries'] == 1 and mid['subwords'][0]['split'],
+                         "A boundary inside a sub-word splits it mid-word"))
+    report = align_subwords(gpt2_tokenizer(), 'total_count = maxValue + 1\n')
+    results.append(check(report['summary']['identifiers'] == 2 and report['summary']['subwords'] == 4,
+                         "Identifiers are found by regex without segments"))
+    empty = align_subwords(gpt2_tokenizer(), '')
+    results.append(check(empty['summary']['identifiers'] == 0 and empty['summary']['split_point_recall'] == 1.0,
+                         "Empty input has no identifiers"))
+    return all(results)
+
+@module_test("Chunker and Resolver")
+def test_chunker_resolver():
+    """Chunks tile the file within the token budget and resolve back to their excerpt"""
+    import tempfile
+    from chunker import ChunkResolver, chunk_file, chunk_text, split_chunk_id
+
+    text = ''.join(f'def f{i}(x):\n    return x * {i}  # 中文\n\n' for i in range(12))
+    chunks = chunk_text(gpt2_tokenizer(), text, 'a.py', max_tokens=20)
+    data = text.encode('utf-8')
+    results = [
+        check(chunks[0]['start_byte'] == 0 and chunks[-1]['end_byte'] == len(data)
+              and all(a['end_byte'] == b['start_byte'] for a, b in zip(chunks, chunks[1:])), "Chunks tile the text"),
+        check(all(0 < c['token_count'] <= 20 for c in chunks), "Every chunk fits the token budget"),
+        check(all(c['start_byte'] == 0 or data[c['start_byte'] - 1] == 0x0A for c in chunks),
+              "Chunks start at line starts"),
+        check(len({c['id'] for c in chunks}) == len(chunks) and all(c['id'].startswith('a.py#') for c in chunks),
+              "Chunk IDs are unique and carry the path"),
+        check(chunk_text(gpt2_tokenizer(), '', 'empty.py') == [], "Empty text has no chunks"),
+    ]
+    one = chunk_text(gpt2_tokenizer(), 'x = 1', 'b.py', max_tokens=100)
+    results.append(check(len(one) == 1 and one[0]['end_line'] == 1 and one[0]['end_byte'] == 5,
+                         "A short file without a trailing newline is one chunk"))
+    repeated = chunk_text(gpt2_tokenizer(), 'x = 1\n' * 8, 'c.py', max_tokens=4)
+    ids = [c['id'] for c in repeated]
+    results.append(check(len(set(ids)) == len(ids) and any(i.endswith('~2') and i[:-2] in ids for i in ids),
+                         "Identical chunks get numbered IDs"))
+    try:
+        split_chunk_id('no-fragment')
+        results.append(check(False, "Malformed chunk IDs are rejected"))
+    except ValueError:
+        results.append(check(True, "Malformed chunk IDs are rejected"))
+
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'pkg/a.py': text})
+        file_chunks = chunk_file(gpt2_tokenizer(), Path(tmp) / 'pkg/a.py', tmp, max_tokens=20)
+        resolver = ChunkResolver(gpt2_tokenizer(), tmp, max_tokens=20)
+        located = resolver.resolve(file_chunks[3]['id'])
+        results.append(check(located['text'] == data[located['start_byte']:located['end_byte']].decode('utf-8')
+                             and located['citation'] == f"pkg/a.py:L{located['start_line']}-L{located['end_line']}",
+                             "Resolved chunk gives its excerpt and citation"))
+        try:
+            resolver.resolve('pkg/a.py#@000000000000')
+            results.append(check(False, "Unknown chunk IDs raise KeyError"))
+        except KeyError:
+            results.append(check(True, "Unknown chunk IDs raise KeyError"))
+    return all(results)
+
+@module_test("Chunk Manifest")
+def test_chunk_manifest():
+    """Manifests round-trip through disk and reject foreign or broken files"""
+    import json
+    import tempfile
+    from chunker import chunk_text
+    from manifest import (ManifestError, build_manifest, chunks_by_path, encoder_fingerprint,
+                          load_manifest, write_manifest)
+
+    chunks = chunk_text(gpt2_tokenizer(), 'a = 1\nb = 2\n' * 10, 'a.py', max_tokens=8)
+    fingerprint = encoder_fingerprint(gpt2_tokenizer())
+    manifest = build_manifest(chunks, 'gpt2', fingerprint, max_tokens=8, redact=True)
+    results = [check(fingerprint.startswith('sha256:') and fingerprint == encoder_fingerprint(gpt2_tokenizer()),
+                     "Encoder fingerprint is stable")]
+
+    def rejected(broken):
+        try:
+            write_manifest(broken, path)
+            return False
+        except ManifestError:
+            return True
+
+    with tempfile.TemporaryDirectory() as tmp:
+        path = Path(tmp) / 'manifest.json'
+        write_manifest(manifest, path)
+        loaded = load_manifest(path)
+        results.append(check(loaded == manifest and not (Path(tmp) / 'manifest.json.tmp').exists(),
+                             "Written manifest loads back unchanged"))
+        results.append(check(loaded['redact'] is True and loaded['max_tokens'] == 8, "Chunking settings are recorded"))
+        results.append(check(rejected(dict(manifest, version=2)), "Other major versions are rejected"))
+        results.append(check(rejected(dict(manifest, encoder={'model': 'gpt2'})), "A missing fingerprint is rejected"))
+        results.append(check(rejected(dict(manifest, chunks=chunks + chunks[:1])), "Duplicate chunk IDs are rejected"))
+        results.append(check(rejected(dict(manifest, chunks=[{'id': 'x'}])), "Chunks missing fields are rejected"))
+        path.write_text('{not json', encoding='utf-8')
+        try:
+            load_manifest(path)
+            results.append(check(False, "Invalid JSON is rejected"))
+        except ManifestError:
+            results.append(check(True, "Invalid JSON is rejected"))
+        extra = dict(manifest, future_field=1, chunks=[dict(c, future=True) for c in chunks])
+        path.write_text(json.dumps(extra), encoding='utf-8')
+        results.append(check(load_manifest(path)['future_field'] == 1, "Unknown fields are accepted"))
+    grouped = chunks_by_path(build_manifest(list(reversed(chunks)), 'gpt2', fingerprint))
+    results.append(check([c['start_byte'] for c in grouped['a.py']] == [c['start_byte'] for c in chunks],
+                         "Chunks are grouped per path in file order"))
+    results.append(check(build_manifest([], 'gpt2', fingerprint)['chunks'] == [], "Empty manifest is valid"))
+    return all(results)
+
+@module_test("Stable Chunk IDs")
+def test_stable_chunk_ids():
+    """IDs depend on structure and normalized content, so unrelated edits keep them"""
+    from chunker import chunk_text, normalize_for_id, stable_chunk_id
+
+    results = [
+        check(normalize_for_id(b'\n\nx = 1  \r\ny\t\n\n') == b'x = 1\ny', "Whitespace normalization"),
+        check(stable_chunk_id('a.py', 'f', b'x = 1\r\n') == stable_chunk_id('a.py', 'f', b'x = 1   \n'),
+              "Line endings and trailing spaces do not change the ID"),
+        check(stable_chunk_id('a.py', 'f', b'x') != stable_chunk_id('a.py', 'g', b'x'), "The structural path is part of the ID"),
+    ]
+
+    def source(body):
+        return f'def alpha():\n    return 1\n\ndef beta():\n    {body}\n\nclass Gamma:\n    pass\n'
+
+    before = chunk_text(gpt2_tokenizer(), source('return 2'), 'a.py', max_tokens=64, parser=DefinitionParser())
+    after = chunk_text(gpt2_tokenizer(), source('total = 2 + 40\n    return total'), 'a.py',
+                       max_tokens=64, parser=DefinitionParser())
+    ids_before = {c['id'].split('@')[0]: c['id'] for c in before}
+    ids_after = {c['id'].split('@')[0]: c['id'] for c in after}
+    results.append(check(sorted(ids_before) == ['a.py#Gamma', 'a.py#alpha', 'a.py#beta'],
+                         "Each top-level definition starts a chunk named after it"))
+    results.append(check(ids_before['a.py#alpha'] == ids_after['a.py#alpha'] and ids_before['a.py#Gamma'] == ids_after['a.py#Gamma'],
+                         "Chunks outside the edit keep their IDs"))
+    results.append(check(ids_before['a.py#beta'] != ids_after['a.py#beta'], "The edited chunk gets a new ID"))
+    return all(results)
+
+@module_test("Chunk Diff")
+def test_chunk_diff():
+    """Re-chunking against a manifest sorts chunks into unchanged, modified, added and removed"""
+    import tempfile
+    from chunk_diff import apply_file_diffs, diff_chunks, diff_file
+    from chunker import chunk_file
+    from encoder_registry import EncoderMismatchError
+    from manifest import build_manifest, encoder_fingerprint
+
+    def chunk(chunk_id, start):
+        return {'id': chunk_id, 'path': 'a.py', 'start_byte': start, 'end_byte': start + 10, 'start_line': 1,
+                'end_line': 1, 'start_token': 0, 'end_token': 1}
+
+    old = [chunk('a.py#f@1', 0), chunk('a.py#g@2', 10), chunk('a.py#h@3', 20)]
+    new = [chunk('a.py#f@1', 0), chunk('a.py#g@9', 10), chunk('a.py#k@4', 20), chunk('a.py#h@3', 30)]
+    diff = diff_chunks(old, new)
+    results = [
+        check([c['id'] for c in diff['unchanged']] == ['a.py#f@1', 'a.py#h@3'], "Same IDs are unchanged"),
+        check([c['moved'] for c in diff['unchanged']] == [False, True], "Unchanged chunks that moved are flagged"),
+        check([(c['old_id'], c['id']) for c in diff['modified']] == [('a.py#g@2', 'a.py#g@9')],
+              "Same structural path with new content is modified"),
+        check([c['id'] for c in diff['added']] == ['a.py#k@4'] and diff['removed'] == [], "New structure is added"),
+        check(diff_chunks([], []) == {'unchanged': [], 'modified': [], 'added': [], 'removed': []}, "Empty diff"),
+    ]
+
+    tokenizer = gpt2_tokenizer()
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'a.py': 'x = 1\n' * 30, 'b.py': 'y = 2\n'})
+        chunks = chunk_file(tokenizer, Path(tmp) / 'a.py', tmp, 16) + chunk_file(tokenizer, Path(tmp) / 'b.py', tmp, 16)
+        manifest = build_manifest(chunks, 'gpt2', encoder_fingerprint(tokenizer), max_tokens=16)
+        write_tree(tmp, {'a.py': 'x = 1\n' * 29 + 'x = 2\n'})
+        edited = diff_file(tokenizer, manifest, 'a.py', tmp)
+        (Path(tmp) / 'b.py').unlink()
+        deleted = diff_file(tokenizer, manifest, 'b.py', tmp)
+        try:
+            diff_file(tokenizer, dict(manifest, encoder={'model': 'other', 'fingerprint': 'sha256:0'}), 'a.py', tmp)
+            mismatch = False
+        except EncoderMismatchError:
+            mismatch = True
+    results.append(check(edited['unchanged'] and (edited['modified'] or edited['added'])
+                         and not any(c['moved'] for c in edited['unchanged']), "Editing the last line keeps earlier chunks"))
+    results.append(check(deleted['chunks'] == [] and len(deleted['removed']) == 1, "A deleted file removes its chunks"))
+    results.append(check(mismatch, "A different encoder fingerprint is refused"))
+    updated = apply_file_diffs(manifest, [edited, deleted])
+    results.append(check([c['path'] for c in updated['chunks']] == ['a.py'] * len(edited['chunks'])
+                         and updated['max_tokens'] == 16, "Applying diffs replaces the diffed paths"))
+    return all(results)
+
+@module_test("Encoding Detection")
+def test_encoding_detection():
+    """Encodings are detected and transcoded text maps back to the file bytes"""
+    from source_text import decode_any, detect_encoding, transcode_source
+    from token_spans import encode_source
+
+    chinese = 'def 函数():\n    return "中文字符串测试"  # 注释内容\n' * 3
+    samples = [
+        (chinese.encode('utf-8'), 'utf-8'),
+        (chinese.encode('utf-16'), 'utf-16-le'),
+        (chinese.encode('utf-16-be'), 'utf-16-be'),
+        (chinese.encode('gb18030'), 'gb18030'),
+        ('繁體中文測試內容資料\n'.encode('big5'), 'big5'),
+        ('日本語のテキストです。ひらがなとカタカナ\n'.encode('shift_jis'), 'shift_jis'),
+        ('한국어 텍스트입니다 안녕하세요\n'.encode('euc_kr'), 'euc_kr'),
+        ('café résumé naïve\n'.encode('cp1252'), 'cp1252'),
+    ]
+    results = [check(detect_encoding(data) == expected, f"Detects {expected}") for data, expected in samples]
+    results.append(check(detect_encoding(b'') == 'utf-8', "Empty input is UTF-8"))
+    results.append(check(detect_encoding(chinese.encode('utf-8')[:-2]) == 'utf-8', "A character cut at the end is still UTF-8"))
+
+    data = '\ufeffx = "é中"\ny'.encode('utf-16-le')
+    text, byte_map = transcode_source(data, 'utf-16')
+    utf8 = encode_source(text)
+    results.append(check(text == 'x = "é中"\ny', "BOM is skipped"))
+    results.append(check(len(byte_map) == len(utf8) + 1 and byte_map[-1] == len(data), "Byte map covers the text"))
+    results.append(check(byte_map[utf8.index('中'.encode('utf-8'))] == data.index('中'.encode('utf-16-le')),
+                         "UTF-8 bytes of a character map to its UTF-16 position"))
+    text, byte_map, used = decode_any('naïve'.encode('cp1252'), encoding='auto')
+    results.append(check(text == 'naïve' and used == 'cp1252' and byte_map[encode_source(text).index(b'v')] == 3,
+                         "decode_any detects and maps single-byte encodings"))
+    return all(results)
+
+@module_test("Shared Encoder")
+def test_shared_encoder():
+    """SharedEncoder matches the plain tokenizer from many threads and stays read-only"""
+    import concurrent.futures
+    from shared_encoder import SharedEncoder
+    from token_spans import compute_token_spans
+
+    tokenizer = gpt2_tokenizer()
+    shared = SharedEncoder(tokenizer)
+    texts = [f'def f{i}(x):\n    return "中文{i}" * x\n' for i in range(16)]
+    expected = [compute_token_spans(tokenizer, text) for text in texts]
+    with concurrent.futures.ThreadPoolExecutor(max_workers=8) as ex:
+        concurrent_spans = list(ex.map(shared.token_spans, texts * 4))
+    results = [
+        check(all(spans == expected[i % len(texts)] for i, spans in enumerate(concurrent_spans)),
+              "Concurrent token_spans match the sequential baseline"),
+        check(1 <= shared.clones <= 8, f"Clones stay within the thread count ({shared.clones})"),
+        check(shared.encode(texts[0]) == tokenizer.encode(texts[0], add_special_tokens=False)
+              and shared.count('') == 0, "encode/count match the tokenizer"),
+        check(compute_token_spans(shared, texts[1]) == expected[1], "Works wherever a tokenizer is expected"),
+    ]
+    try:
+        shared.add_tokens(['<new>'])
+        results.append(check(False, "add_tokens is refused"))
+    except TypeError:
+        results.append(check(True, "add_tokens is refused"))
+    try:
+        shared.vocab['<new>'] = 1
+        results.append(check(False, "The vocab snapshot is read-only"))
+    except TypeError:
+        results.append(check(True, "The vocab snapshot is read-only"))
+    private = shared.copy()
+    results.append(check(not isinstance(private, SharedEncoder) and private is not tokenizer,
+                         "copy() gives a private tokenizer"))
+    return all(results)
+
+@module_test("Token Stream Format")
+def test_token_stream_format():
+    """Binary token streams round-trip spans and guard against other encoders"""
+    import io
+    from encoder_registry import EncoderMismatchError
+    from token_spans import compute_token_spans
+    from token_stream import (MAGIC, TokenStreamError, TokenStreamReader, TokenStreamWriter, encode_document,
+                              json_size)
+
+    code = 'def f(x):\n    return "中文😀" * x\n'
+    documents = {
+        'a.py': compute_token_spans(gpt2_tokenizer(), code)[0],
+        'edge': [{'id': None, 'start_byte': 5, 'end_byte': 6, 'partial': True},
+                 {'id': 50000, 'start_byte': 2, 'end_byte': 9, 'partial': False},
+                 {'id': 0, 'start_byte': 300, 'end_byte': 301, 'partial': False}],
+        'empty': [],
+    }
+    stream = io.BytesIO()
+    with TokenStreamWriter(stream, fingerprint='sha256:abc') as writer:
+        for name, spans in documents.items():
+            writer.write_document(name, spans)
+    data = stream.getvalue()
+    reader = TokenStreamReader(io.BytesIO(data), fingerprint='sha256:abc')
+    results = [
+        check(reader.documents() == documents, "Documents round-trip (None ids, partial, overlaps, empty)"),
+        check(reader.fingerprint == 'sha256:abc' and writer.tokens == len(documents['a.py']) + 3,
+              "Header keeps the encoder fingerprint"),
+        check(len(data) < json_size(documents), "Binary stream is smaller than JSON"),
+    ]
+    try:
+        TokenStreamReader(io.BytesIO(data), fingerprint='sha256:other')
+        results.append(check(False, "A different encoder is refused"))
+    except EncoderMismatchError:
+        results.append(check(True, "A different encoder is refused"))
+    version1 = MAGIC + bytes([1, 0]) + encode_document('old', documents['edge'])
+    results.append(check(TokenStreamReader(io.BytesIO(version1)).documents() == {'old': documents['edge']},
+                         "Version 1 streams (no fingerprint) are still readable"))
+    for label, broken in (("Truncated streams", data[:-2]), ("Foreign files", b'PK\x03\x04'),
+                          ("Unknown versions", MAGIC + bytes([9, 0]))):
+        try:
+            TokenStreamReader(io.BytesIO(broken)).documents()
+            results.append(check(False, f"{label} are rejected"))
+        except TokenStreamError:
+            results.append(check(True, f"{label} are rejected"))
+    try:
+        import zstandard  # noqa: F401
+    except ImportError:
+        print("⚠️  zstandard not installed, skipping the compressed round-trip")
+        return all(results)
+    compressed = io.BytesIO()
+    with TokenStreamWriter(compressed, compress=True) as writer:
+        writer.write_document('a.py', documents['a.py'])
+    results.append(check(TokenStreamReader(io.BytesIO(compressed.getvalue())).documents() == {'a.py': documents['a.py']},
+                         "zstd streams round-trip"))
+    return all(results)
+
+@module_test("Arrow Export")
+def test_arrow_export():
+    """Token rows carry file offsets; tables round-trip when pyarrow is installed"""
+    import tempfile
+    from arrow_export import _batches, iter_token_rows, write_token_table
+
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'a.py': 'x = "中文"\n', 'sub/b.txt': '\ufeffwide = 1'.encode('utf-16-le'), 'empty.py': ''})
+        rows = list(iter_token_rows(gpt2_tokenizer(), [tmp], with_classes=False))
+        data = (Path(tmp) / 'sub/b.txt').read_bytes()
+        wide = [r for r in rows if r['doc_id'] == 'sub/b.txt']
+        results = [
+            check(sorted({r['doc_id'] for r in rows}) == ['a.py', 'sub/b.txt'], "One doc_id per non-empty file"),
+            check(all([r['token_index'] for r in rows if r['doc_id'] == d] == list(range(sum(r['doc_id'] == d for r in rows)))
+                      for d in ('a.py', 'sub/b.txt')), "Token indices restart per document"),
+            check(wide[-1]['end'] == len(data) and data[wide[0]['start']:wide[0]['end']].decode('utf-16-le').strip() == 'wide',
+                  "Offsets address the UTF-16 file bytes"),
+            check(all(r['class'] is None for r in rows), "No classes without grammars"),
+            check([len(b['doc_id']) for b in _batches(rows, 4)] == [4] * (len(rows) // 4) + ([len(rows) % 4] if len(rows) % 4 else []),
+                  "Rows are written in fixed-size batches"),
+        ]
+        try:
+            import pyarrow.ipc
+            import pyarrow.parquet as pq
+        except ImportError:
+            print("⚠️  pyarrow not installed, skipping the Parquet/Arrow round-trip")
+            return all(results)
+        parquet_path = Path(tmp) / 'tokens.parquet'
+        arrow_path = Path(tmp) / 'tokens.arrow'
+        results.append(check(write_token_table(rows, parquet_path, batch_rows=3) == len(rows), "Parquet row count"))
+        results.append(check(pq.read_table(parquet_path).to_pylist() == rows, "Parquet table reads back the rows"))
+        write_token_table(rows, arrow_path)
+        with pyarrow.ipc.open_file(str(arrow_path)) as reader:
+            results.append(check(reader.read_all().to_pylist() == rows, "Arrow IPC table reads back the rows"))
+    return all(results)
+
+@module_test("SQLite Inventory")
+def test_sqlite_index():
+    """Indexing stores files, chunks and spans and prunes deleted files"""
+    import os
+    import tempfile
+    from sqlite_index import build_index, open_index
+    from token_spans import compute_token_spans
+
+    tokenizer = gpt2_tokenizer()
+    with tempfile.TemporaryDirectory() as tmp:
+        root = Path(tmp) / 'repo'
+        db = Path(tmp) / 'index.db'
+        write_tree(root, {'a.py': 'def f():\n    return 1\n', 'b.py': 'x = "中"', 'empty.py': ''})
+        summary = build_index(tokenizer, root, db, 'gpt2', spans=True)
+        conn = open_index(db)
+        try:
+            files = dict(conn.execute("SELECT path, tokens FROM files"))
+            spans, _ = compute_token_spans(tokenizer, 'x = "中"')
+            stored = conn.execute("SELECT t.start_byte, t.end_byte FROM tokens t JOIN files f ON f.id = t.file_id "
+                                  "WHERE f.path = 'b.py' ORDER BY t.token_index").fetchall()
+            results = [
+                check(summary['files'] == 3 and summary['tokens'] == sum(files.values()), "Summary matches the files table"),
+                check(files.get('empty.py') == 0, "Empty file is indexed with zero tokens"),
+                check(stored == [(s['start_byte'], s['end_byte']) for s in spans], "Token rows store the span offsets"),
+                check(dict(conn.execute("SELECT key, value FROM meta"))['model'] == 'gpt2', "Model recorded in meta"),
+            ]
+        finally:
+            conn.close()
+
+        os.remove(root / 'a.py')
+        summary = build_index(tokenizer, root, db, 'gpt2', spans=True)
+        conn = open_index(db)
+        try:
+            results.append(check(summary['removed'] == 1, "Deleted file is pruned"))
+            results.append(check(conn.execute("SELECT COUNT(*) FROM chunks c LEFT JOIN files f ON f.id = c.file_id "
+                                              "WHERE f.id IS NULL").fetchone()[0] == 0, "Pruning cascades to chunks"))
+            results.append(check(conn.execute("SELECT COUNT(*) FROM tokens").fetchone()[0] == len(spans),
+                                 "Re-indexing replaces token rows instead of duplicating them"))
+        finally:
+            conn.close()
+    return all(results)
+
+@module_test("Service Metrics")
+def test_metrics():
+    """Request counters, document lookups and the /metrics endpoint"""
+    import urllib.request
+    from lsp_helper import LspHelper
+    from metrics import Histogram, ServiceMetrics, serve_metrics
+
+    metrics = ServiceMetrics()
+    uri = 'file:///m.py'
+    messages = [
+        {'jsonrpc': '2.0', 'method': 'textDocument/didOpen',
+         'params': {'textDocument': {'uri': uri, 'version': 1, 'text': 'a = 1\n'}}},
+        {'jsonrpc': '2.0', 'id': 1, 'method': 'count', 'params': {'uri': uri}},
+        {'jsonrpc': '2.0', 'id': 2, 'method': 'count', 'params': {'textDocument': {'uri': uri}}},
+        {'jsonrpc': '2.0', 'id': 3, 'method': 'encode', 'params': {'text': 'b = 2'}},
+        {'jsonrpc': '2.0', 'id': 4, 'method': 'count', 'params': {'uri': 'file:///closed.py'}},
+        {'jsonrpc': '2.0', 'id': 5, 'method': 'shutdown'}, {'jsonrpc': '2.0', 'method': 'exit'},
+    ]
+    run_lsp_session(LspHelper(gpt2_tokenizer(), metrics=metrics), messages)
+    histogram = Histogram('h', 'test', buckets=(1.0, 2.0))
+    histogram.observe(1.5)
+    text = metrics.render()
+    results = [
+        check(metrics.document_lookups.value(source='open') == 2, "Two lookups of the open document"),
+        check(metrics.document_lookups.value(source='inline') == 1, "One inline-text lookup"),
+        check(metrics.requests.value(method='count', status='ok') == 2, "Successful count requests counted"),
+        check(metrics.requests.value(method='encode', status='ok') == 1, "Encode request counted"),
+        check('tokoffset_document_lookups_total{source="open"} 2' in text and 'buffer_cache' not in text,
+              "Rendered under the document lookup name"),
+        check(histogram.render()[2:5] == ['h_bucket{le="1.0"} 0', 'h_bucket{le="2.0"} 1', 'h_bucket{le="+Inf"} 1'],
+              "Histogram buckets are cumulative"),
+    ]
+    server = serve_metrics(metrics, 0)
+    try:
+        host, port = server.server_address[:2]
+        with urllib.request.urlopen(f'http://{host}:{port}/metrics') as response:
+            results.append(check(response.read().decode('utf-8') == metrics.render(), "/metrics serves the registry"))
+    finally:
+        server.shutdown()
+    return all(results)
+
+@module_test("Tracing Hooks")
+def test_tracing():
+    """Recorded spans carry their attributes; disabled tracing is a no-op"""
+    import tracing
+    from chunker import chunk_text
+    from token_spans import compute_token_spans
+
+    tokenizer = gpt2_tokenizer()
+    code = 'def f():\n    return "é"\n'
+    results = [check(not tracing.tracing_enabled() or tracing.get_tracer() is not None,
+                     "Tracing is off without a recorder or OpenTelemetry")]
+    events = tracing.start_recording()
+    try:
+        spans, _ = compute_token_spans(tokenizer, code)
+        chunks = chunk_text(tokenizer, code, path='f.py')
+        compute_token_spans(tokenizer, '')
+        with tracing.span('align', kind='rules', language=None) as s:
+            s.set_attribute('score', None)
+            s.set_attribute('rules', 3)
+    finally:
+        recorded = tracing.stop_recording()
+    by_name = {}
+    for event in recorded:
+        by_name.setdefault(event['name'], []).append(event)
+    encode = by_name.get('tokoffset.encode', [])
+    results += [
+        check(recorded is events and tracing.stop_recording() == [], "stop_recording returns the recorded list once"),
+        check(len(encode) >= 2 and encode[0]['args']['bytes'] == len(code.encode('utf-8'))
+              and encode[0]['args']['tokens'] == len(spans), "Encode span records bytes and tokens"),
+        check(encode[-1]['args']['tokens'] == 0 and encode[-1]['args']['bytes'] == 0, "Empty input records zero"),
+        check(by_name.get('tokoffset.chunk', [{}])[0].get('args', {}).get('chunks') == len(chunks),
+              "Chunk span records the chunk count"),
+        check(by_name.get('tokoffset.align', [{}])[0].get('args') == {'kind': 'rules', 'rules': 3},
+              "None attributes are skipped"),
+        check(all(e['ph'] == 'X' and e['dur'] >= 0 for e in recorded), "Events are Chrome complete events"),
+    ]
+    calls = []
+
+    @tracing.traced('probe')
+    def probe(x):
+        calls.append(x)
+        return x
+
+    results.append(check(probe(7) == 7 and calls == [7], "traced functions run unchanged when tracing is off"))
+    return all(results)
+
+@module_test("Request Limits")
+def test_request_limits():
+    """Defaults are bounded and contention produces a structured 429"""
+    import threading
+    import time
+    from limits import DEFAULT_MAX_CONCURRENT, DEFAULT_QUEUE_TIMEOUT, LimitExceeded, RequestLimits
+    from lsp_helper import REQUEST_TOO_LARGE, SERVER_BUSY, LspHelper
+    from tokoffset import build_parser
+
+    class SlowTokenizer:
+        """Holds the tokenizer for a fixed time per call"""
+        def __init__(self, tokenizer, delay):
+            self.tokenizer = tokenizer
+            self.delay = delay
+
+        def __call__(self, *args, **kwargs):
+            time.sleep(self.delay)
+            return self.tokenizer(*args, **kwargs)
+
+        def __getattr__(self, name):
+            return getattr(self.tokenizer, name)
+
+    args = build_parser().parse_args(['lsp-helper'])
+    defaults = RequestLimits()
+    results = [
+        check(args.max_concurrent == DEFAULT_MAX_CONCURRENT > 0 and args.queue_timeout == DEFAULT_QUEUE_TIMEOUT > 0,
+              "lsp-helper ships non-zero concurrency and queue timeout defaults"),
+        check(defaults.max_concurrent == DEFAULT_MAX_CONCURRENT and defaults.queue_timeout == DEFAULT_QUEUE_TIMEOUT,
+              "RequestLimits() uses the same defaults"),
+    ]
+    try:
+        with RequestLimits(max_concurrent=1).admit(deadline=time.monotonic() - 1):
+            pass
+        results.append(check(False, "An expired arrival deadline is refused"))
+    except LimitExceeded as e:
+        results.append(check(e.status == 429, "An expired arrival deadline is refused"))
+
+    # serve(): 8 requests, 2 workers, each request holding the tokenizer for 0.1s
+    limits = RequestLimits(max_request_bytes=4096, max_concurrent=2, queue_timeout=0.05)
+    messages = [{'jsonrpc': '2.0', 'id': i, 'method': 'encode', 'params': {'text': f'x{i} = {i}'}} for i in range(8)]
+    messages.append({'jsonrpc': '2.0', 'id': 'big', 'method': 'encode', 'params': {'text': 'y' * 8192}})
+    messages += [{'jsonrpc': '2.0', 'id': 99, 'method': 'shutdown'}, {'jsonrpc': '2.0', 'method': 'exit'}]
+    helper = LspHelper(SlowTokenizer(gpt2_tokenizer(), 0.1), limits=limits)
+    _, replies = run_lsp_session(helper, messages)
+    by_id = {reply.get('id'): reply for reply in replies}
+    busy = [by_id[i]['error'] for i in range(8) if 'error' in by_id[i]]
+    results += [
+        check(any('result' in by_id[i] for i in range(8)), "Some requests are served"),
+        check(len(busy) > 0 and all(e['code'] == SERVER_BUSY for e in busy), f"{len(busy)} requests refused as busy"),
+        check(all(e['data']['status'] == 429 and e['data']['queue_timeout'] == 0.05 and e['data']['reason']
+                  for e in busy), "Busy errors carry {status: 429, reason, queue_timeout}"),
+        check(by_id['big']['error']['code'] == REQUEST_TOO_LARGE and by_id['big']['error']['data']['status'] == 413,
+              "Oversized request refused with 413"),
+        check(limits.rejected[429] == len(busy) and limits.admitted == 0, "Refusals counted and all slots released"),
+    ]
+
+    # handle() from several threads shares the same admission control
+    helper = LspHelper(SlowTokenizer(gpt2_tokenizer(), 0.1),
+                       limits=RequestLimits(max_concurrent=1, queue_timeout=0.02))
+    responses = []
+    threads = [threading.Thread(target=lambda i=i: responses.append(helper.handle(
+        ('{"jsonrpc": "2.0", "id": %d, "method": "encode", "params": {"text": "a"}}' % i).encode('utf-8'))))
+        for i in range(4)]
+    for thread in threads:
+        thread.start()
+    for thread in threads:
+        thread.join()
+    results.append(check(sum('result' in r for r in responses) >= 1
+                         and any(r.get('error', {}).get('data', {}).get('status') == 429 for r in responses),
+                         "Concurrent handle() calls get a 429 under contention"))
+    return all(results)
+
+@module_test("Project Config")
+def test_config():
+    """Config discovery, validation and parser defaults"""
+    import contextlib
+    import io
+    import tempfile
+    import tokoffset
+    from config import ConfigError, defaults_for, find_config, load_config, validate_config
+
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {
+            '.tokoffset.yaml': 'encoder: gpt2-large\n',
+            'repo/.git/HEAD': 'ref: refs/heads/main\n',
+            'repo/.tokoffset.yaml': ('model: gpt2\nmax_tokens: 256\noffset_unit: utf16\n'
+                                     'commands:\n  scan:\n    batch_size: 128\n'),
+            'repo/src/pkg/x.py': '',
+            'other/.git/HEAD': '',
+            'other/src/empty/.tokoffset.yaml': '',
+            'bad/.tokoffset.yaml': 'max_tokens: [1\n',
+        })
+        root = Path(tmp)
+        config = load_config(find_config(root / 'repo/src/pkg'))
+        parser = tokoffset.build_parser(config)
+        scan = parser.parse_args(['scan', '.'])
+        chunk = parser.parse_args(['chunk', '.', '--max_tokens', '64'])
+        results = [
+            check(find_config(root / 'repo/src/pkg') == root / 'repo/.tokoffset.yaml', "Nearest config found upwards"),
+            check(find_config(root / 'other/src') is None, "Search stops at the repository root"),
+            check(load_config(root / 'other/src/empty/.tokoffset.yaml') == {'_path': str(root / 'other/src/empty/.tokoffset.yaml')},
+                  "An empty config file loads as no settings"),
+            check(scan.model == 'gpt2' and scan.batch_size == 128, "Top-level and per-command defaults apply"),
+            check(chunk.max_tokens == 64, "Command-line flags win over the config"),
+            check(defaults_for(config)['emit_utf16'] is True and defaults_for(config)['emit_codepoints'] is False,
+                  "offset_unit maps to the analyzer flags"),
+        ]
+        for bad, what in (({'colour': 1}, "unknown key"), ({'max_tokens': 0}, "non-positive max_tokens"),
+                          ({'offset_unit': 'words'}, "unknown offset unit"), ({'ignore': 'vendor/'}, "ignore not a list"),
+                          ({'commands': {'scan': 3}}, "command settings not a mapping")):
+            try:
+                validate_config(bad)
+                results.append(check(False, f"Rejects {what}"))
+            except ConfigError:
+                results.append(check(True, f"Rejects {what}"))
+        stderr = io.StringIO()
+        with contextlib.redirect_stderr(stderr):
+            code = tokoffset.main(['--config', str(root / 'bad/.tokoffset.yaml'), 'scan', '.'])
+        results.append(check(code == 2 and 'bad/.tokoffset.yaml' in stderr.getvalue(), "Malformed config exits with 2"))
+    return all(results)
+
+@module_test("Repository Watcher")
+def test_watcher():
+    """Changed regions, incremental counts and manifest updates"""
+    import json
+    import os
+    import tempfile
+    from token_spans import compute_token_spans
+    from watcher import RepositoryWatcher, changed_region
+
+    tokenizer = gpt2_tokenizer()
+    mtimes = iter(range(1, 100))
+
+    def count(text):
+        return len(compute_token_spans(tokenizer, text)[0])
+
+    def rewrite(path, text):
+        """Write text with a fresh mtime, so the change shows even within one clock tick"""
+        path.write_text(text, encoding='utf-8')
+        mtime = next(mtimes) * 10**9
+        os.utime(path, ns=(mtime, mtime))
+
+    results = [
+        check(changed_region(b'abc', b'abc') == (3, 3, 3), "Identical content has an empty region"),
+        check(changed_region('aé'.encode(), 'aè'.encode()) == (1, 3, 3), "Region widens to character boundaries"),
+        check(changed_region(b'', b'x') == (0, 0, 1), "Insertion into an empty file"),
+        check(changed_region(b'abab', b'ab') == (2, 4, 2), "Truncation keeps the common prefix"),
+    ]
+    with tempfile.TemporaryDirectory() as tmp:
+        root = Path(tmp) / 'src'
+        manifest_path = root / 'chunks.manifest.json'
+        write_tree(root, {'a.py': 'def f():\n    return 1\n', 'b.py': 'x = 1', 'empty.py': ''})
+        watcher = RepositoryWatcher(tokenizer, root, model='gpt2', manifest_path=manifest_path)
+        initial = watcher.start()
+        results.append(check(initial['files'] == 3 and initial['tokens'] == count('def f():\n    return 1\n') + count('x = 1'),
+                             "Initial totals over every file, including an empty one"))
+        results.append(check(watcher.refresh() == [], "Writing the manifest does not trigger a refresh"))
+
+        rewrite(root / 'b.py', 'x = 12345')
+        rewrite(root / 'c.py', 'print("中")')
+        os.remove(root / 'a.py')
+        events = {e['path']: e for e in watcher.refresh()}
+        manifest = json.loads(manifest_path.read_text(encoding='utf-8'))
+        results += [
+            check(events['b.py']['event'] == 'modified' and events['b.py']['tokens'] == count('x = 12345')
+                  and events['b.py']['delta'] == count('x = 12345') - count('x = 1'), "Modified file recounted"),
+            check(events['c.py']['event'] == 'added' and events['c.py']['chunks']['added'] == 1, "Added file chunked"),
+            check(events['a.py']['event'] == 'removed' and events['a.py']['chunks']['removed'] >= 1, "Removed file dropped"),
+            check(watcher.total_tokens == count('x = 12345') + count('print("中")'), "Total follows the edits"),
+            check(sorted({c['path'] for c in manifest['chunks']}) == ['b.py', 'c.py'], "Manifest rewritten with the changes"),
+        ]
+        rewrite(root / 'b.py', 'x = 12345')
+        results.append(check(watcher.refresh() == [], "A touch without content change emits nothing"))
+    return all(results)
+
+@module_test("Token Budget Check")
+def test_budget_check():
+    """check --max-tokens / --max_tokens exit codes and overflow positions"""
+    import contextlib
+    import io
+    import json
+    import tempfile
+    import tokoffset
+
+    def run(argv):
+        stdout = io.StringIO()
+        with contextlib.redirect_stdout(stdout):
+            code = tokoffset.main(['--no_config', 'check'] + argv)
+        return code, stdout.getvalue()
+
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'long.txt': 'word ' * 30 + '\nlast line', 'empty.txt': ''})
+        long_path, empty_path = str(Path(tmp) / 'long.txt'), str(Path(tmp) / 'empty.txt')
+        code, out = run(['--max-tokens', '10', '--json', long_path, empty_path])
+        report = {Path(r['path']).name: r for r in json.loads(out)}
+        code_underscore, out_underscore = run(['--max_tokens', '10', '--json', long_path, empty_path])
+        code_ok, _ = run(['--max-tokens', '1000', long_path])
+        code_missing, out_missing = run([long_path])
+    results = [
+        check(code == 1 and not report['long.txt']['ok'], "--max-tokens flags the file over budget (exit 1)"),
+        check(report['long.txt']['over_by'] == report['long.txt']['tokens'] - 10
+              and report['long.txt']['overflow_line'] == 1, "Overflow position reported"),
+        check(report['empty.txt']['ok'] and report['empty.txt']['tokens'] == 0, "Empty file is within budget"),
+        check((code_underscore, out_underscore) == (code, out), "--max_tokens is the same option"),
+        check(code_ok == 0, "Within budget exits 0"),
+        check(code_missing == 2 and '--max_tokens' in out_missing, "Missing budget exits 2"),
+    ]
+    return all(results)
+
+@module_test("Token Diff")
+def test_token_diff():
+    """Diff runs rebuild both versions and address the files on disk"""
+    import tempfile
+    from encoder_registry import EncoderMismatchError
+    from token_diff import diff_files, diff_spans, diff_token_streams
+    from token_spans import compute_token_spans
+
+    tokenizer = gpt2_tokenizer()
+    old, new = 'x = 1\ny = 2\n', 'x = 1\ny = 42\nz = 3'
+    result = diff_token_streams(old, new, tokenizer)
+    runs, summary = result['runs'], result['summary']
+    same = diff_token_streams(old, old, tokenizer)
+    from_empty = diff_token_streams('', new, tokenizer)
+    results = [
+        check(''.join(r['old_text'] for r in runs if r['op'] != 'insert') == old, "Equal + deleted runs rebuild the old text"),
+        check(''.join(r['new_text'] for r in runs if r['op'] != 'delete') == new, "Equal + inserted runs rebuild the new text"),
+        check(summary['equal'] + summary['deleted'] == summary['old_tokens']
+              and summary['equal'] + summary['inserted'] == summary['new_tokens'], "Summary adds up"),
+        check(runs[0]['op'] == 'equal' and runs[0]['old_tokens'][0] == 0, "Unchanged prefix is an equal run"),
+        check([r['op'] for r in same['runs']] == ['equal'] and same['summary']['deleted'] == 0, "Identical texts: one equal run"),
+        check([r['op'] for r in from_empty['runs']] == ['insert'] and from_empty['runs'][0]['old_bytes'] == [0, 0],
+              "Diff from an empty text is one insert at byte 0"),
+        check(diff_token_streams('', '', tokenizer)['runs'] == [], "Two empty texts have no runs"),
+    ]
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'old.txt': 'a = "é"\n', 'new.txt': '\ufeffa = "è"\n'.encode('utf-16-le')})
+        file_result = diff_files(tokenizer, Path(tmp) / 'old.txt', Path(tmp) / 'new.txt')
+        data = (Path(tmp) / 'new.txt').read_bytes()
+        inserted = [r for r in file_result['runs'] if r['op'] == 'insert']
+        results.append(check(inserted and all(data[r['new_bytes'][0]:r['new_bytes'][1]].decode('utf-16-le') == r['new_text']
+                                              for r in inserted), "Inserted runs address the UTF-16 file bytes"))
+    spans = compute_token_spans(tokenizer, old)[0]
+    try:
+        diff_spans(old, spans, old, spans, old_fingerprint='sha256:aaaa', new_fingerprint='sha256:bbbb')
+        results.append(check(False, "Streams of different encoders are refused"))
+    except EncoderMismatchError:
+        results.append(check(True, "Streams of different encoders are refused"))
+    return all(results)
+
+@module_test("Near-Duplicate Chunks")
+def test_dedup():
+    """Identical chunks cluster; short and unrelated ones do not"""
+    import tempfile
+    from dedup import collect_chunks, find_near_duplicates, jaccard, shingles
+
+    body = 'def total(values):\n    result = 0\n    for value in values:\n        result += value\n    return result\n'
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {
+            'a.py': body,
+            'b.py': body.rstrip('\n'),
+            'c.py': 'class Config:\n    name = "service"\n    port = 8080\n    hosts = ["a", "b", "c"]\n',
+            'd.py': 'x',
+            'e.py': '',
+        })
+        chunks = collect_chunks(gpt2_tokenizer(), [tmp], shingle=3)
+        result = find_near_duplicates(chunks, threshold=0.8)
+    paths = sorted({c['path'] for c in chunks})
+    results = [
+        check(shingles([1, 2], size=3) == set() and len(shingles([1, 2, 3, 1, 2, 3], size=3)) == 3,
+              "Shingles are the distinct n-grams"),
+        check(jaccard(set(), set()) == 1.0 and jaccard({1, 2}, {2, 3}) == 1 / 3, "Jaccard similarity"),
+        check(paths == ['a.py', 'b.py', 'c.py'], "Chunks shorter than a shingle and empty files are skipped"),
+        check(len(result['clusters']) == 1 and [loc['path'] for loc in result['clusters'][0]] == ['a.py', 'b.py'],
+              "Files differing by a trailing newline form one cluster"),
+        check(result['redundant'] == [result['clusters'][0][1]['id']], "Only the later chunk is redundant"),
+        check(all(p['similarity'] >= 0.8 for p in result['pairs']) and result['pairs'], "Pairs meet the threshold"),
+    ]
+    try:
+        find_near_duplicates(chunks, permutations=10, bands=3)
+        results.append(check(False, "Bands must divide the permutations"))
+    except ValueError:
+        results.append(check(True, "Bands must divide the permutations"))
+    return all(results)
+
+@module_test("Token Index")
+def test_token_index():
+    """Bisect queries agree with a linear scan"""
+    import random
+    from token_index import TokenIndex
+    from token_spans import compute_token_spans
+
+    def expected_range(spans, keep):
+        hits = [i for i, s in enumerate(spans) if keep(s['start_byte'], s['end_byte'])]
+        return (hits[0], hits[-1] + 1) if hits else None
+
+    rng = random.Random(7)
+    results = []
+    for name, tokenizer, text in (('gpt2', gpt2_tokenizer(), 'def f(x):\n    return "中文" + x\n'),
+                                  ('byte fallback', ByteFallbackTokenizer(), 'a中b')):
+        spans, _ = compute_token_spans(tokenizer, text)
+        index = TokenIndex(spans)
+        size = spans[-1]['end_byte']
+        mismatches = 0
+        for _ in range(300):
+            a = rng.randrange(size + 1)
+            b = rng.randrange(a, size + 1)
+            lo, hi = index.overlapping(a, b)
+            if a == b:
+                want = expected_range(spans, lambda s, e: s <= a < e)
+            else:
+                want = expected_range(spans, lambda s, e: s < b and e > a)
+            mismatches += (lo, hi) != want and not (want is None and lo == hi)
+            lo, hi = index.covering(a, b)
+            want = expected_range(spans, lambda s, e: a <= s and e <= b)
+            mismatches += (lo, hi) != want and not (want is None and lo == hi)
+            at = index.token_at(a)
+            want = expected_range(spans, lambda s, e: s <= a < e)
+            mismatches += at != (want[0] if want else None)
+        results.append(check(mismatches == 0, f"{name}: overlapping/covering/token_at match a linear scan"))
+        results.append(check(index.byte_range(0, len(index)) == (0, size) and index.byte_range(len(index), len(index)) == (size, size),
+                             f"{name}: byte_range of all tokens and of the end"))
+
+    empty = TokenIndex([])
+    results.append(check(len(empty) == 0 and empty.overlapping(0, 0) == (0, 0) and empty.byte_range(0, 0) == (0, 0)
+                         and empty.token_at(0) is None, "Empty index answers empty ranges"))
+    for what, call in (("out-of-order spans", lambda: TokenIndex([{'start_byte': 2, 'end_byte': 3}, {'start_byte': 0, 'end_byte': 1}])),
+                       ("reversed byte range", lambda: empty.overlapping(3, 1)),
+                       ("token range past the end", lambda: empty.byte_range(0, 1))):
+        try:
+            call()
+            results.append(check(False, f"Rejects {what}"))
+        except (ValueError, IndexError):
+            results.append(check(True, f"Rejects {what}"))
+    return all(results)
+
+@module_test("Diagnostic Anchors")
+def test_diagnostics():
+    """Column units, position round-trips and diagnostic-to-token anchoring"""
+    import tempfile
+    from diagnostics import parse_diagnostics, resolve_diagnostics
+    from position_index import PositionIndex
+
+    text = 'a😀b\r\nçd\nlast'
+    data = text.encode('utf-8')
+    positions = PositionIndex(data)
+    round_trips = all(positions.offset(*positions.position(offset, unit), unit) == offset
+                      for unit in ('bytes', 'utf16', 'codepoints')
+                      for offset in range(len(data) + 1)
+                      if offset in (0, 1, 5, 6, 8, 10, 11, 12, len(data)))
+    results = [
+        check(positions.line_count == 3, "Three lines without a trailing newline"),
+        check([positions.offset(1, 4, unit) for unit in ('bytes', 'utf16', 'codepoints')] == [3, 5, 6],
+              "Column 4 differs per unit after an astral character"),
+        check(positions.offset(1, 99) == 6 and positions.offset(9, 1) == len(data) and positions.offset(0, 5) == 0,
+              "Columns clamp before CRLF and lines clamp to the document"),
+        check(round_trips, "offset(position(x)) == x at character boundaries"),
+        check(positions.position(len(data), 'utf16') == (3, 5), "End of the last line"),
+        check(PositionIndex(b'').position(0) == (1, 1) and PositionIndex(b'').offset(1, 5) == 0, "Empty document"),
+    ]
+
+    parsed = parse_diagnostics([
+        'main.go:2:5: unreachable code\n',
+        'src/app.ts(1,4): error TS2304: Cannot find name\n',
+        'tool.py:1: note: module docstring\n',
+        'C:\\work\\x.c:3:1: warning: unused\n',
+        'not a diagnostic\n',
+    ])
+    results.append(check([(d['file'], d['line'], d['column'], d['unit']) for d in parsed] == [
+        ('main.go', 2, 5, 'bytes'), ('src/app.ts', 1, 4, 'utf16'), ('tool.py', 1, 1, 'codepoints'),
+        ('C:\\work\\x.c', 3, 1, 'bytes')], "Formats, default column and per-extension units"))
+
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'src/app.ts': 'let 😀 = foo;\n', 'main.go': 'package main\n', 'empty.go': ''})
+        resolved = resolve_diagnostics(gpt2_tokenizer(), parse_diagnostics([
+            'src/app.ts(1,10): error TS2304: Cannot find name',
+            'main.go:1:99: past the line end',
+            'empty.go:1:1: empty file',
+            'gone.go:1:1: missing file',
+        ]), root=tmp)
+        by_file = {d['file']: d for d in resolved}
+        results += [
+            check(by_file['src/app.ts']['offset'] == 11 and by_file['src/app.ts']['token']['text'].strip() == 'foo',
+                  "UTF-16 column after an emoji lands on 'foo'"),
+            check(by_file['main.go']['offset'] == 12
+                  and by_file['main.go']['token']['start_byte'] <= 12 < by_file['main.go']['token']['end_byte'],
+                  "Past-the-end column clamps to the line end and its token"),
+            check(by_file['empty.go']['token_index'] is None and by_file['empty.go']['offset'] == 0, "Empty file has no token"),
+            check('error' in by_file['gone.go'], "Missing file reports an error"),
+        ]
+    return all(results)
+
+@module_test("Go Token Coverage")
+def test_go_coverage():
+    """Cover profile blocks mapped onto token statuses"""
+    import tempfile
+    from go_coverage import CoverProfileError, parse_cover_profile, profile_coverage
+
+    source = 'package main\n\nfunc f(x int) int {\n\tif x > 0 {\n\t\treturn 1\n\t}\n\treturn 0\n}'
+    profile = parse_cover_profile([
+        'mode: count\n',
+        'example.com/demo/cmd/main.go:3.19,4.11 1 1\n',
+        'example.com/demo/cmd/main.go:4.11,6.3 1 0\n',
+        'example.com/demo/cmd/main.go:7.2,7.10 1 0\n',
+        'example.com/demo/cmd/main.go:7.2,7.10 1 2\n',
+        'other.org/vendored/lib.go:1.1,1.5 1 1\n',
+        '\n',
+    ])
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'go.mod': 'module example.com/demo\n\ngo 1.21\n', 'cmd/main.go': source})
+        result = profile_coverage(gpt2_tokenizer(), profile, tmp)
+    data = source.encode('utf-8')
+    main_go = result['files']['example.com/demo/cmd/main.go']
+
+    def status_of(snippet):
+        start = data.index(snippet.encode('utf-8'))
+        return {run['status'] for run in main_go['runs'] if run['start_byte'] < start + len(snippet) and run['end_byte'] > start}
+
+    results = [
+        check(len(profile['files']['example.com/demo/cmd/main.go']) == 3
+              and profile['files']['example.com/demo/cmd/main.go'][2]['count'] == 2, "Repeated blocks add up their counts"),
+        check(main_go['path'] == 'cmd/main.go' and result['missing'] == ['other.org/vendored/lib.go'],
+              "Paths resolved through go.mod; unknown ones reported missing"),
+        check(status_of('package main') == {'none'}, "Code outside blocks is 'none'"),
+        check(status_of('return 1') == {'uncovered'}, "Zero-count block is uncovered"),
+        check(status_of('return 0') == {'covered'}, "Block on the unterminated last line is covered"),
+        check(main_go['covered'] + main_go['uncovered'] + main_go['none'] == main_go['tokens']
+              and main_go['runs'][-1]['end_token'] == main_go['tokens'], "Runs tile every token"),
+        check(result['token_coverage'] == main_go['covered'] / (main_go['covered'] + main_go['uncovered']),
+              "Token coverage is covered / measured"),
+    ]
+    for what, lines in (("missing mode header", ['a.go:1.1,1.2 1 1']), ("malformed block", ['mode: set', 'a.go:1,2 1 1'])):
+        try:
+            parse_cover_profile(lines)
+            results.append(check(False, f"Rejects a {what}"))
+        except CoverProfileError:
+            results.append(check(True, f"Rejects a {what}"))
+    empty = profile_coverage(gpt2_tokenizer(), parse_cover_profile(['mode: set']), '.')
+    results.append(check(empty['token_coverage'] is None and empty['files'] == {}, "Empty profile has no coverage"))
+    return all(results)
+
+@module_test("Go AST Kinds")
+def test_go_ast():
+    """go/ast kinds and declarations from a hand-built Go syntax tree"""
+    from go_ast import _declaration, annotate_go_tokens, select_tokens, summarize_go_ast
+    from token_spans import compute_token_spans
+
+    code = 'package main\n\nfunc main() {\n\tprintln("hi")\n}'
+    data = code.encode('utf-8')
+
+    def at(type, snippet, children=(), is_named=True, fields=None, start=0):
+        offset = data.index(snippet.encode('utf-8'), start)
+        return FakeNode(type, offset, offset + len(snippet.encode('utf-8')), children, is_named, fields)
+
+    call_start = data.index(b'println')
+    literal = at('interpreted_string_literal', '"hi"')
+    arguments = at('argument_list', '("hi")', [at('(', '(', is_named=False, start=call_start), literal,
+                                                at(')', ')', is_named=False, start=call_start)])
+    call = at('call_expression', 'println("hi")', [at('identifier', 'println'), arguments])
+    block = at('block', '{\n\tprintln("hi")\n}', [at('{', '{', is_named=False),
+                                                      at('expression_statement', 'println("hi")', [call]),
+                                                      at('}', '}', is_named=False)])
+    name = at('identifier', 'main', start=data.index(b'func'))
+    function = at('function_declaration', code[data.index(b'func'):],
+                  [at('func', 'func', is_named=False), name, at('parameter_list', '()'), block], fields={'name': name})
+    package = at('package_clause', 'package main', [at('package', 'package', is_named=False),
+                                                    at('package_identifier', 'main')])
+    tree = FakeNode('source_file', 0, len(data), [package, function])
+
+    tokens, _ = compute_token_spans(gpt2_tokenizer(), code)
+    annotate_go_tokens(tokens, tree, data)
+
+    def token_for(snippet):
+        offset = data.index(snippet.encode('utf-8'))
+        return next(t for t in tokens if t['start_byte'] <= offset < t['end_byte'])
+
+    literal_tokens = [tokens[i] for i in select_tokens(tokens, kind='BasicLit', decl='FuncDecl:main')]
+    summary = summarize_go_ast(tokens)
+    results = [
+        check(all('ast_kind' in t and 'decl' in t for t in tokens), "Every token is annotated"),
+        check(token_for('package')['decl'] is None and token_for('package')['ast_kind'] == 'File',
+              "Package clause is outside declarations"),
+        check(token_for('println')['ast_kind'] == 'Ident' and token_for('println')['decl'] == 'FuncDecl:main',
+              "Callee is an Ident in FuncDecl:main"),
+        check(literal_tokens and all(literal.start_byte <= t['start_byte'] and t['end_byte'] <= literal.end_byte
+                                     for t in literal_tokens), "BasicLit tokens lie inside the string literal"),
+        check(token_for('}')['ast_kind'] == 'BlockStmt', "Closing brace on the unterminated last line is in the block"),
+        check(sum(summary['kinds'].values()) == summary['total'] == len(tokens), "Summary counts every token"),
+    ]
+
+    method_code = b'func (p *Person) Greet() {}'
+    receiver_type = FakeNode('type_identifier', 9, 15)
+    receiver = FakeNode('parameter_list', 5, 16, [FakeNode('parameter_declaration', 6, 15, [
+        FakeNode('identifier', 6, 7), FakeNode('pointer_type', 8, 15, [receiver_type])])])
+    method = FakeNode('method_declaration', 0, len(method_code), [receiver],
+                      fields={'name': FakeNode('field_identifier', 17, 22), 'receiver': receiver})
+    var_code = b'var limit = 3'
+    spec = FakeNode('var_spec', 4, 13, [FakeNode('identifier', 4, 9)], fields={'name': FakeNode('identifier', 4, 9)})
+    results += [
+        check(_declaration(method, method_code) == 'FuncDecl:Person.Greet', "Methods are named Receiver.Method"),
+        check(_declaration(FakeNode('var_declaration', 0, 13, [spec]), var_code) == 'GenDecl:limit',
+              "A single-spec declaration is named after its spec"),
+        check(annotate_go_tokens([], tree, data) == [], "No tokens, nothing to annotate"),
+    ]
+    return all(results)
+
+@module_test("Notebook Cells")
+def test_notebook():
+    """Cell sources decode from escapes and tokens map back to the raw JSON"""
+    import json
+    import re
+    import tempfile
+    from notebook import NotebookError, parse_notebook, tokenize_notebook
+
+    raw = ('\ufeff{"cells": [\n'
+           ' {"cell_type": "code", "metadata": {}, "outputs": [], "source": ["import os\\n", "print(\\"caf\\u00e9\\")"]},\n'
+           ' {"cell_type": "markdown", "metadata": {}, "source": "# Title\\tend\\ud83d\\ude00"},\n'
+           ' {"cell_type": "code", "metadata": {}, "source": ""}\n'
+           '], "metadata": {}, "nbformat": 4, "nbformat_minor": 5}').encode('utf-8')
+    with tempfile.TemporaryDirectory() as tmp:
+        path = Path(tmp) / 'demo.ipynb'
+        path.write_bytes(raw)
+        result = tokenize_notebook(gpt2_tokenizer(), path)
+        code_only = tokenize_notebook(gpt2_tokenizer(), path, cell_types=['code'])
+    cells = parse_notebook(raw)
+
+    def raw_matches(cell, token):
+        """The raw JSON of a token, joined across list-form lines, decodes to its source bytes"""
+        fragment = raw[token['file_start_byte']:token['file_end_byte']].decode('utf-8')
+        fragment = re.sub(r'(?<!\\)"\s*,\s*"', '', fragment)
+        source = cells[cell['index']]['source'].encode('utf-8')[token['cell_start_byte']:token['cell_end_byte']]
+        return json.loads('"' + fragment + '"').encode('utf-8') == source
+
+    results = [
+        check([c['source'] for c in cells] == ['import os\nprint("café")', '# Title\tend😀', ''],
+              "Sources decode from list form, escapes and surrogate pairs"),
+        check(all(t['partial'] or raw_matches(c, t) for c in result['cells'] for t in c['tokens']),
+              "File ranges of whole-character tokens decode back to the token bytes"),
+        check(result['cells'][2]['token_count'] == 0 and result['cells'][2]['lines'] == 0, "Empty cell has no tokens"),
+        check(result['cells'][0]['lines'] == 2, "Unterminated last line still counts"),
+        check(code_only['summary']['cells'] == 2 and set(code_only['summary']['tokens_by_type']) == {'code'},
+              "cell_types filters the cells"),
+        check(result['summary']['tokens'] == sum(c['token_count'] for c in result['cells']), "Summary totals the cells"),
+    ]
+    escaped = raw.index(b'\\u00e9')
+    results.append(check(any(t['file_start_byte'] <= escaped and escaped + 6 <= t['file_end_byte']
+                             for t in result['cells'][0]['tokens']), "A token covers the whole \\u00e9 escape"))
+    for what, data in (("trailing data", b'{"cells": []} x'), ("missing cells", b'{"worksheets": []}'),
+                       ("unterminated string", b'{"cells": [{"source": "abc')):
+        try:
+            parse_notebook(data)
+            results.append(check(False, f"Rejects {what}"))
+        except NotebookError:
+            results.append(check(True, f"Rejects {what}"))
+    return all(results)
+
+@module_test("Markdown Code Blocks")
+def test_markdown_blocks():
+    """CommonMark fences, block byte spans and document token ranges"""
+    from markdown_blocks import block_language, find_fenced_blocks, markdown_blocks
+    from token_spans import compute_token_spans
+
+    text = ('# Guide\n'
+            '```py title="x"\nprint("é")\n```\n'
+            '    ```not a fence\n'
+            '``` inline `code` ```\n'
+            '~~~~\n~~~\nstill inside\n~~~~~\n'
+            '```\n```\n'
+            '```go\nfunc main() {}')
+    data = text.encode('utf-8')
+    blocks = find_fenced_blocks(data)
+    result = markdown_blocks(gpt2_tokenizer(), text, parsers={'python': None, 'go': None})
+    spans, _ = compute_token_spans(gpt2_tokenizer(), text)
+    python_block = result['blocks'][0]
+    lo, hi = python_block['doc_tokens']
+    results = [
+        check(block_language('py title="x"') == 'python' and block_language('{.golang}') == 'go'
+              and block_language('') is None and block_language('mermaid') is None, "Info strings map to languages"),
+        check([b['info'] for b in blocks] == ['py title="x"', '', '', 'go'], "Indented and backtick-info lines are not fences"),
+        check(data[blocks[0]['content_start']:blocks[0]['content_end']] == 'print("é")\n'.encode('utf-8'),
+              "Content excludes both fences"),
+        check(data[blocks[1]['content_start']:blocks[1]['content_end']] == b'~~~\nstill inside\n',
+              "A shorter fence does not close a longer one"),
+        check(blocks[2]['content_start'] == blocks[2]['content_end'] and result['blocks'][2]['doc_tokens'][0]
+              == result['blocks'][2]['doc_tokens'][1], "Empty block has an empty token range"),
+        check(blocks[3]['content_end'] == len(data) and blocks[3]['end_line'] == text.count('\n') + 1,
+              "Unclosed block runs to the end of an unterminated document"),
+        check(spans[lo - 1]['end_byte'] <= blocks[0]['content_start'] < spans[lo]['end_byte']
+              and spans[hi - 1]['start_byte'] < blocks[0]['content_end'] <= spans[hi]['start_byte'],
+              "doc_tokens are exactly the tokens overlapping the content"),
+        check(python_block['classes'] is None and python_block['tokens'] == len(compute_token_spans(gpt2_tokenizer(), 'print("é")\n')[0]),
+              "Without a grammar the block is tokenized on its own"),
+        check(find_fenced_blocks(b'') == [], "Empty document has no blocks"),
+    ]
+    return all(results)
+
+@module_test("Structural Paths")
+def test_structure_paths():
+    """JSON and YAML tokens tagged with the path of their value"""
+    from structure_paths import (StructureError, detect_format, format_path, structure_tokens,
+                                 summarize_paths)
+
+    tokenizer = gpt2_tokenizer()
+    text = '{"scores": {"数学": 90, "a b": 1}, "items": [1, {"name": "x"}]}'
+    data = text.encode('utf-8')
+    tokens = structure_tokens(tokenizer, text, 'json')
+
+    def path_at(tokens, data, snippet):
+        offset = data.index(snippet.encode('utf-8'))
+        return next(t['path'] for t in tokens if t['start_byte'] <= offset < t['end_byte'])
+
+    rows = {row['path']: row for row in summarize_paths(tokens)}
+    results = [
+        check(format_path(('scores', '数学', 'a b', 2)) == '$.scores.数学["a b"][2]', "Paths render JSONPath-style"),
+        check(path_at(tokens, data, '90') == '$.scores.数学', "Number token belongs to its key"),
+        check(path_at(tokens, data, 'name') == '$.items[1].name', "Key tokens count toward their entry"),
+        check(path_at(tokens, data, '}]}') in ('$.items[1]', '$.items', '$'), "Closing brackets belong to a container"),
+        check(rows['$']['total'] == len(tokens), "The root subtree holds every token"),
+        check(rows['$.scores']['total'] >= rows['$.scores.数学']['total'] + rows['$.scores["a b"]']['total'],
+              "Subtree totals include the children"),
+    ]
+    yaml_text = 'name: demo\nports:\n  - 80\n  - 443\n---\nname: second'
+    yaml_data = yaml_text.encode('utf-8')
+    yaml_tokens = structure_tokens(tokenizer, yaml_text, 'yaml')
+    results += [
+        check(path_at(yaml_tokens, yaml_data, '443') == 'doc0:$.ports[1]', "YAML sequence items are indexed"),
+        check(path_at(yaml_tokens, yaml_data, 'second') == 'doc1:$.name', "Later documents get their own prefix"),
+        check(detect_format('a/b.YML') == 'yaml' and detect_format('x.txt') is None and detect_format('x.txt', 'json') == 'json',
+              "Format from the extension unless given"),
+    ]
+    for what, bad in (("trailing data", '{} {}'), ("missing colon", '{"a" 1}'), ("empty document", '')):
+        try:
+            structure_tokens(tokenizer, bad, 'json')
+            results.append(check(False, f"Rejects JSON with {what}"))
+        except StructureError:
+            results.append(check(True, f"Rejects JSON with {what}"))
+    return all(results)
+
+@module_test("Logit Bias Helper")
+def test_logit_bias():
+    """Covering token IDs, alignment and the API shapes"""
+    from logit_bias import banned_token_ids, logit_bias_map, tokens_covering_span
+    from token_spans import compute_token_spans
+
+    tokenizer = gpt2_tokenizer()
+    text = 'say café now'
+    spans, _ = compute_token_spans(tokenizer, text)
+    whole = tokens_covering_span(tokenizer, text, spans[1]['start_byte'], spans[1]['end_byte'])
+    inner = tokens_covering_span(tokenizer, text, spans[1]['start_byte'] + 1, spans[1]['end_byte'])
+    chars = tokens_covering_span(tokenizer, text, 4, 8, unit='chars')
+    as_bytes = tokens_covering_span(tokenizer, text, 4, 9)
+    empty = tokens_covering_span(tokenizer, text, 3, 3)
+    fallback = tokens_covering_span(ByteFallbackTokenizer(), 'a中b', 1, 4)
+    results = [
+        check(whole['ids'] == [spans[1]['id']] and whole['aligned'], "A whole token is aligned"),
+        check(inner['ids'] == whole['ids'] and not inner['aligned'] and inner['bytes'] == whole['bytes'],
+              "A region inside a token is not aligned and reports the token's bytes"),
+        check(chars == as_bytes, "Character offsets convert to bytes around 'é'"),
+        check(empty['ids'] == [] and empty['tokens'][0] == empty['tokens'][1], "An empty region covers no tokens"),
+        check(fallback['partial'] and fallback['aligned'] and len(fallback['ids']) == 3,
+              "A byte-fallback character is covered by all its pieces and flagged partial"),
+        check(logit_bias_map([5, 7, 5, None], -50) == {'5': -50, '7': -50}, "logit_bias keys are distinct string IDs"),
+        check(banned_token_ids([5, 7, 5, None]) == [[5], [7]], "bad_words_ids are distinct single-token lists"),
+    ]
+    for what, call in (("an unknown unit", lambda: tokens_covering_span(tokenizer, text, 0, 1, unit='words')),
+                       ("a reversed range", lambda: tokens_covering_span(tokenizer, text, 3, 1)),
+                       ("a range past the end", lambda: tokens_covering_span(tokenizer, text, 0, 99))):
+        try:
+            call()
+            results.append(check(False, f"Rejects {what}"))
+        except ValueError:
+            results.append(check(True, f"Rejects {what}"))
+    return all(results)
+
+@module_test("Stop Sequences")
+def test_stop_sequences():
+    """Stop strings split across tokens and characters split across bytes"""
+    from stop_sequences import StopSequenceMatcher, find_stop
+
+    matcher = StopSequenceMatcher(['\n\n###'])
+    steps = [matcher.feed_bytes(piece) for piece in (b'Answer: 4', b'\n', b'\n#', b'##', b' more')]
+    match = steps[3]['stop']
+    results = [
+        check([s['text'] for s in steps[:3]] == ['Answer: 4', '', ''], "Possible stop prefixes are held back"),
+        check(match is not None and match['cut_byte'] == 9 and match['end_byte'] == 14, "Match cut at the stop start"),
+        check(match['tokens'] == [1, 4] and match['split'], "Match spans tokens 1..3"),
+        check(steps[4] == {'text': '', 'stop': match} and matcher.flush() == '' and matcher.text == 'Answer: 4',
+              "Nothing is released after the stop"),
+    ]
+
+    matcher = StopSequenceMatcher(['</a>'])
+    first, second = matcher.feed_bytes(b'caf\xc3'), matcher.feed_bytes(b'\xa9 <')
+    results += [
+        check(first['text'] == 'caf' and second['text'] == 'é ', "Split UTF-8 characters wait for their last byte"),
+        check(matcher.flush() == '<' and matcher.match is None, "flush releases held text without a stop"),
+    ]
+
+    matcher = StopSequenceMatcher(['ab', 'abc', 'x'])
+    results.append(check(matcher.feed_bytes(b'zabcx')['stop']['stop'] == 'abc', "Earliest start wins, then the longest"))
+
+    tokenizer = gpt2_tokenizer()
+    ids = tokenizer('Hello\n\n### rest')['input_ids']
+    found = find_stop(tokenizer, ids, ['###'])
+    results += [
+        check(found['stop'] is not None and found['text'] == 'Hello\n\n', "find_stop replays token IDs"),
+        check(find_stop(tokenizer, [], ['###']) == {'stop': None, 'tokens_consumed': 0, 'text': ''}, "No tokens, no stop"),
+    ]
+    for what, call in (("an empty stop string", lambda: StopSequenceMatcher([''])),
+                       ("no stop strings", lambda: StopSequenceMatcher([])),
+                       ("feed() without a tokenizer", lambda: StopSequenceMatcher(['x']).feed(1))):
+        try:
+            call()
+            results.append(check(False, f"Rejects {what}"))
+        except ValueError:
+            results.append(check(True, f"Rejects {what}"))
+    return all(results)
+
+@module_test("Stream Decoder")
+def test_stream_decoder():
+    """Incremental decoding emits whole characters with contiguous offsets"""
+    from stream_decoder import Decoder, complete_utf8_prefix, decode_stream
+
+    decoder = Decoder(gpt2_tokenizer())
+    pieces = [decoder.push_bytes(b) for b in (b'\xe4', b'\xb8', b'\xad', b'ok')]
+    results = [
+        check([p['text'] for p in pieces] == ['', '', '中', 'ok'] and [p['pending'] for p in pieces] == [1, 2, 0, 0],
+              "A split character is held until complete"),
+        check([(p['start_byte'], p['end_byte']) for p in pieces] == [(0, 0), (0, 0), (0, 3), (3, 5)],
+              "Offsets are cumulative output bytes"),
+        check(complete_utf8_prefix(b'a\xff') == 2 and complete_utf8_prefix(b'a\xe4\x41') == 3
+              and complete_utf8_prefix(b'a\xf0\x9f') == 1 and complete_utf8_prefix(b'') == 0,
+              "Only sequences that can still complete are held back"),
+    ]
+    decoder = Decoder(gpt2_tokenizer())
+    broken = decoder.push_bytes(b'\xff')
+    truncated = decoder.push_bytes(b'\xe4\xb8')
+    final = decoder.finish()
+    results += [
+        check(broken['text'] == '\ufffd', "An invalid lead byte is emitted at once as U+FFFD"),
+        check(truncated['text'] == '' and final['text'] == '\ufffd' and final['pending'] == 0,
+              "finish() flushes an incomplete sequence as U+FFFD"),
+    ]
+
+    tokenizer = ByteFallbackTokenizer()
+    text = 'a中b😀'
+    ids = tokenizer(text)['input_ids']
+    streamed = decode_stream(tokenizer, ids)
+    results += [
+        check(''.join(p['text'] for p in streamed) == text, "Byte-fallback pieces decode to the text"),
+        check(all('\ufffd' not in p['text'] for p in streamed), "No replacement characters mid-stream"),
+        check(all(a['end_byte'] == b['start_byte'] for a, b in zip(streamed, streamed[1:])), "Pieces are contiguous"),
+        check(decode_stream(tokenizer, []) == [], "Empty stream decodes to nothing"),
+    ]
+    return all(results)
+
+@module_test("Stream Buffer")
+def test_streambuf():
+    """Per-token spans in code points, UTF-16 units and bytes while streaming"""
+    from streambuf import StreamBuffer
+
+    buffer = StreamBuffer()
+    shown = [buffer.append_bytes(b) for b in (b'hi ', b'\xf0\x9f', b'\x98\x80', b'!')]
+    results = [
+        check(shown == ['hi ', '', '😀', '!'] and buffer.text == 'hi 😀!' and buffer.pending == 0,
+              "Text grows by whole characters"),
+        check(buffer.spans() == [(0, 3), (3, 4), (3, 4), (4, 5)], "Both halves of the emoji share its code point span"),
+        check(buffer.spans('utf16') == [(0, 3), (3, 5), (3, 5), (5, 6)], "UTF-16 spans count the surrogate pair"),
+        check(buffer.spans('bytes') == [(0, 3), (3, 7), (3, 7), (7, 8)], "Byte spans widen to the character"),
+        check(buffer.token_at(3) == 1 and buffer.token_at(4, 'utf16') == 1 and buffer.token_at(5, 'utf16') == 3
+              and buffer.token_at(99) is None, "token_at finds the first token of a character"),
+    ]
+    buffer = StreamBuffer()
+    buffer.append_bytes(b'a\xe4\xb8')
+    incomplete, pending = buffer.span(0), buffer.pending
+    tail = buffer.finish()
+    results += [
+        check(incomplete is None and pending == 2, "A token ending mid-character has no span until finished"),
+        check(tail == '\ufffd\ufffd' and buffer.text == 'a\ufffd\ufffd', "finish() shows leftover bytes as U+FFFD, one per byte"),
+        check(buffer.span(0) == (0, 3), "The span covers the replacement characters"),
+    ]
+    empty = StreamBuffer()
+    results.append(check(len(empty) == 0 and empty.text == '' and empty.finish() == '' and empty.spans() == [],
+                         "Empty stream"))
+    tokenizer = ByteFallbackTokenizer()
+    streamed = StreamBuffer(tokenizer)
+    for token_id in tokenizer('x中')['input_ids']:
+        streamed.append(token_id)
+    results.append(check(streamed.text == 'x中' and streamed.spans() == [(0, 1), (1, 2), (1, 2), (1, 2)],
+                         "Byte-fallback IDs widen to their character"))
+    for what, call in (("an unknown unit", lambda: streamed.span(0, 'words')),
+                       ("a token index past the end", lambda: streamed.span(9)),
+                       ("append() without a tokenizer", lambda: empty.append(1))):
+        try:
+            call()
+            results.append(check(False, f"Rejects {what}"))
+        except (ValueError, IndexError):
+            results.append(check(True, f"Rejects {what}"))
+    return all(results)
+
+@module_test("Redacted Chunk IDs")
+def test_redacted_chunk_ids():
+    """IDs from chunk --redact resolve with resolve --redact and never show the secret"""
+    import contextlib
+    import io
+    import json
+    import tempfile
+    import tokoffset
+    from chunker import ChunkResolver, chunk_file
+
+    secret = 'AKIA' + 'ABCDEFGHIJKLMNOP'
+    source = f'def connect():\n    key = "{secret}"\n    return key\n\nprint(connect())'
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'cfg.py': source})
+        chunks = chunk_file(gpt2_tokenizer(), Path(tmp) / 'cfg.py', tmp, max_tokens=12, redact=True)
+        plain_ids = {c['id'] for c in chunk_file(gpt2_tokenizer(), Path(tmp) / 'cfg.py', tmp, max_tokens=12)}
+        resolver = ChunkResolver(gpt2_tokenizer(), tmp, max_tokens=12, redact=True)
+        located = [resolver.resolve(c['id']) for c in chunks]
+        redacted_only = [c['id'] for c in chunks if c['id'] not in plain_ids]
+        try:
+            ChunkResolver(gpt2_tokenizer(), tmp, max_tokens=12).resolve(redacted_only[0])
+            unredacted_resolves = True
+        except (KeyError, IndexError):
+            unredacted_resolves = False
+
+        output = Path(tmp) / 'chunks.jsonl'
+        with contextlib.redirect_stdout(io.StringIO()):
+            tokoffset.main(['--no_config', 'chunk', str(Path(tmp) / 'cfg.py'), '--redact', '--max_tokens', '12',
+                            '--output', str(output)])
+        cli_ids = [json.loads(line)['id'] for line in output.read_text(encoding='utf-8').splitlines()]
+        stdout = io.StringIO()
+        with contextlib.redirect_stdout(stdout):
+            code = tokoffset.main(['--no_config', 'resolve', *cli_ids, '--root', tmp, '--max_tokens', '12',
+                                   '--redact', '--json'])
+        cli_located = [json.loads(line) for line in stdout.getvalue().splitlines()]
+    results = [
+        check([l['id'] for l in located] == [c['id'] for c in chunks], "Every redacted chunk ID resolves"),
+        check(all(secret not in l['text'] for l in located) and any('[REDACTED]' in l['text'] for l in located),
+              "Excerpts show the redacted text"),
+        check(located[-1]['end_byte'] == len(source.encode('utf-8')), "Offsets still address the file"),
+        check(redacted_only and not unredacted_resolves, "Redaction changes the IDs, which need --redact to resolve"),
+        check(code == 0 and [l['id'] for l in cli_located] == cli_ids, "chunk --redact IDs resolve via resolve --redact"),
+    ]
+    return all(results)
+
+@module_test("PII Masking")
+def test_pii_mask():
+    """Ranges widen to tokens, merge when they share one and are audited by hash"""
+    import hashlib
+    from pii_mask import mask_spans
+    from token_spans import compute_token_spans
+
+    tokenizer = gpt2_tokenizer()
+    text = 'Contact Jane Doe at jane@example.com today'
+    data = text.encode('utf-8')
+    name = (data.index(b'Jane'), data.index(b' at'))
+    email = (data.index(b'jane@'), data.index(b' today'))
+    replaced = mask_spans(tokenizer, text, [{'start_byte': email[0], 'end_byte': email[1], 'label': 'EMAIL'},
+                                            (name[0], name[1], 'NAME')])
+    dropped = mask_spans(tokenizer, text, [(name[0] + 1, name[0] + 2), (name[0] + 2, name[1])], mode='drop')
+    spans, _ = compute_token_spans(tokenizer, text)
+    results = [
+        check(len(replaced['removals']) == 2 and [r['labels'] for r in replaced['removals']] == [['NAME'], ['EMAIL']],
+              "Removals are sorted and labelled"),
+        check('Jane' not in replaced['text'] and 'example' not in replaced['text'] and replaced['text'].count('[PII]') == 2,
+              "Replace mode splices in the placeholder"),
+        check(all(r['sha256'] == hashlib.sha256(data[r['bytes'][0]:r['bytes'][1]]).hexdigest() for r in replaced['removals']),
+              "Audit hashes are of the removed file bytes"),
+        check(all(r['bytes'] == [spans[r['tokens'][0]]['start_byte'], spans[r['tokens'][1] - 1]['end_byte']]
+                  and r['bytes'][0] <= r['spans'][0]['start_byte'] and r['spans'][-1]['end_byte'] <= r['bytes'][1]
+                  for r in replaced['removals']), "Removed bytes are the tokens around each range"),
+        check(len(dropped['removals']) == 1 and len(dropped['removals'][0]['spans']) == 2,
+              "Ranges touching the same token merge into one removal"),
+        check(dropped['ids'] == [s['id'] for i, s in enumerate(spans) if i not in dropped['affected_tokens']],
+              "Drop mode keeps every other token ID"),
+        check(mask_spans(tokenizer, text, [])['text'] == text and mask_spans(tokenizer, text, [(3, 3)])['removals'] == [],
+              "No or empty ranges leave the text unchanged"),
+        check(mask_spans(tokenizer, '', [(0, 0)])['ids'] == [], "Empty text"),
+    ]
+    try:
+        mask_spans(tokenizer, text, [(5, 2)])
+        results.append(check(False, "Reversed ranges are rejected"))
+    except ValueError:
+        results.append(check(True, "Reversed ranges are rejected"))
+    return all(results)
+
+@module_test("Golden Snapshots")
+def test_golden_snapshots():
+    """Golden files record, match, and report drift, missing and orphaned samples"""
+    import os
+    import tempfile
+    from tokentest import golden_path, run_golden
+
+    tokenizer = ByteFallbackTokenizer()
+    with tempfile.TemporaryDirectory() as tmp:
+        corpus, golden_dir = Path(tmp) / 'samples', Path(tmp) / 'golden'
+        write_tree(corpus, {'a.txt': 'x = "中"', 'go/b.go': 'package b\n', 'empty.txt': ''})
+        recorded = run_golden(tokenizer, corpus, golden_dir, 'org/model', update=True)
+        matched = run_golden(tokenizer, corpus, golden_dir, 'org/model')
+        lines = golden_path(golden_dir, 'org/model', 'a.txt').read_text(encoding='utf-8').splitlines()
+
+        (corpus / 'a.txt').write_text('x = "文"', encoding='utf-8')
+        os.remove(corpus / 'go/b.go')
+        write_tree(corpus, {'new.txt': 'y'})
+        drifted = {r['file']: r for r in run_golden(tokenizer, corpus, golden_dir, 'org/model')}
+    results = [
+        check(len(recorded) == 3 and golden_path(golden_dir, 'org/model', 'a.txt').parent == golden_dir / 'org__model',
+              "Golden files are recorded per model directory"),
+        check(all(r['status'] == 'match' for r in matched) and len(matched) == 3, "A fresh recording matches"),
+        check(lines[0] == '# tokoffset golden v1' and lines[-1].split('\t')[2:4] == ['8', '9'],
+              "One tab-separated line per token, offsets in bytes"),
+        check(drifted['a.txt']['status'] == 'mismatch' and drifted['a.txt']['diff'], "Changed tokens are a mismatch with a diff"),
+        check(drifted['new.txt']['status'] == 'missing' and drifted['go/b.go']['status'] == 'orphaned',
+              "New samples are missing and deleted ones orphaned"),
+        check(drifted['empty.txt']['status'] == 'match', "An empty sample keeps matching"),
+    ]
+    return all(results)
+
+@module_test("Span Alignment")
+def test_span_alignment():
+    """Token ranges translate between tokenizers, widening where boundaries disagree"""
+    from span_align import align_tokenizers
+
+    text = 'x = "中文"'
+    aligner = align_tokenizers(gpt2_tokenizer(), ByteFallbackTokenizer(), text)
+    whole = aligner.translate(0, len(aligner.spans['a']))
+    inside = aligner.translate(6, 7, direction='b_to_a')
+    results = [
+        check(whole['tokens'] == [0, len(aligner.spans['b'])] and whole['exact'], "The whole text maps to the whole text"),
+        check(all(aligner.translate(k, l, 'b_to_a')['tokens'] == [i, i + 1]
+                  for i in range(len(aligner.spans['a']))
+                  for k, l in [aligner.translate(i, i + 1)['tokens']]), "Exact translations round-trip"),
+        check(not inside['exact'] and inside['bytes'] == [6, 7] and inside['covered_bytes'][0] < 6 < 7 < inside['covered_bytes'][1],
+              "A range inside a multi-byte token widens and is not exact"),
+        check(aligner.translate(1, 1) == {'tokens': [1, 1], 'bytes': [1, 1], 'covered_bytes': [1, 1], 'exact': True},
+              "An empty range maps to an empty range"),
+        check(0.0 <= aligner.boundary_agreement() <= 1.0 and align_tokenizers(gpt2_tokenizer(), ByteFallbackTokenizer(), '').translate(0, 0)['tokens'] == [0, 0],
+              "Boundary agreement is a share; empty text aligns"),
+    ]
+    try:
+        aligner.translate(0, 1, direction='sideways')
+        results.append(check(False, "Unknown directions are rejected"))
+    except ValueError:
+        results.append(check(True, "Unknown directions are rejected"))
+    return all(results)
+
+@module_test("Char-to-Byte Scan")
+def test_char_to_byte_scan():
+    """The fast char-to-byte paths match the per-character walk"""
+    from token_spans import build_char_to_byte, encode_source
+
+    def walk(code):
+        offsets = [0]
+        for ch in code:
+            offsets.append(offsets[-1] + len(ch.encode('utf-8', 'surrogateescape')))
+        return offsets
+
+    samples = {
+        'empty': '',
+        'ASCII': 'def f(x):\n    return x',
+        'mixed UTF-8': 'x = "中文" # café',
+        'emoji and no trailing newline': 'a😀b👋🏽',
+        'escaped raw bytes': 'ok \udcff\udc80 中',
+        'only continuation escapes': '\udc80',
+    }
+    results = []
+    for name, code in samples.items():
+        offsets = build_char_to_byte(code)
+        results.append(check(offsets == walk(code) and offsets[-1] == len(encode_source(code)) and len(offsets) == len(code) + 1,
+                             f"{name}: offsets match the walk"))
+    return all(results)
+
+@module_test("Token Arena")
+def test_token_arena():
+    """Arena-backed tokens round-trip the span dicts they were built from"""
+    from token_arena import TokenArena
+    from token_spans import compute_token_spans, encode_source
+
+    text = 'x = "中文"'
+    spans, _ = compute_token_spans(ByteFallbackTokenizer(), text)
+    arena = TokenArena.from_text(ByteFallbackTokenizer(), text)
+    partial = next(i for i, s in enumerate(spans) if s['partial'])
+    manual = TokenArena(b'ab', [{'id': None, 'start_byte': 0, 'end_byte': 2}])
+    results = [
+        check(arena.to_spans() == spans and arena.token_ids() == [s['id'] for s in spans], "Spans and IDs round-trip"),
+        check(b''.join(arena.bytes(i) for i in range(len(arena))) == encode_source(text)
+              and arena.span(partial) == (spans[partial]['start_byte'], spans[partial]['end_byte']),
+              "Token bytes cover the document"),
+        check(arena.is_partial(partial) and '\\x' in arena.text(partial), "Partial characters are escaped in token text"),
+        check(manual.id(0) is None and manual[0] == {'id': None, 'start_byte': 0, 'end_byte': 2, 'partial': False},
+              "A missing ID is kept as None"),
+        check(arena.nbytes == len(encode_source(text)) + len(arena) * (1 + 3 * arena.ids.itemsize), "nbytes counts every buffer"),
+        check(len(TokenArena.from_text(ByteFallbackTokenizer(), '')) == 0 and TokenArena(b'').nbytes == 0, "Empty document"),
+    ]
+    try:
+        manual.append(1, 1, 3)
+        results.append(check(False, "Spans past the document are rejected"))
+    except ValueError:
+        results.append(check(len(manual) == 1, "Spans past the document are rejected"))
+    return all(results)
+
+@module_test("Token Byte Lookups")
+def test_token_byte_lookups():
+    """Per-token tables are exact-key lookups, resolved once per ID"""
+    from token_bytes import BYTE_LEVEL_ALPHABET, TokenBytes
+    from token_spans import encode_source
+
+    class CountingTokenizer(ByteFallbackTokenizer):
+        lookups = 0
+
+        def decode(self, ids, **kwargs):
+            return ''.join(self.pieces[i] for i in ids)
+
+        def convert_ids_to_tokens(self, ids):
+            CountingTokenizer.lookups += 1
+            return super().convert_ids_to_tokens(ids)
+
+    tokenizer = CountingTokenizer()
+    text = 'a = "中中"\na = "中"'
+    ids = tokenizer.encode(text)
+    token_bytes = TokenBytes(tokenizer)
+    results = [
+        check(token_bytes.join(ids) == encode_source(text) and token_bytes.join([]) == b'', "Joined token bytes are the text"),
+        check(CountingTokenizer.lookups == len(set(ids)), "Each distinct ID is looked up once"),
+        check(len(BYTE_LEVEL_ALPHABET) == 256 and sorted(BYTE_LEVEL_ALPHABET.values()) == list(range(256)),
+              "The byte-level alphabet covers every byte once"),
+    ]
+    return all(results)
+
+@module_test("Profiling")
+def test_profiling():
+    """Profile flags write loadable profiles and the benchmark counts the corpus"""
+    import io
+    import json
+    import pstats
+    import tempfile
+    import tracemalloc
+    from contextlib import redirect_stderr
+    import tracing
+    from profiling import profiled, run_benchmark
+    from token_spans import compute_token_spans
+
+    tokenizer = ByteFallbackTokenizer()
+    with tempfile.TemporaryDirectory() as tmp:
+        paths = {name: str(Path(tmp) / name) for name in ('cpu.prof', 'mem.snap', 'trace.json')}
+        stderr = io.StringIO()
+        with redirect_stderr(stderr):
+            with profiled(paths['cpu.prof'], paths['mem.snap'], paths['trace.json']):
+                compute_token_spans(tokenizer, 'x = "中"')
+        stats = pstats.Stats(paths['cpu.prof'])
+        snapshot = tracemalloc.Snapshot.load(paths['mem.snap'])
+        with open(paths['trace.json'], encoding='utf-8') as f:
+            trace = json.load(f)
+
+        write_tree(Path(tmp) / 'corpus', {'a.py': 'x = 1\n', 'b.txt': '中文', 'empty.txt': ''})
+        bench = run_benchmark(tokenizer, Path(tmp) / 'corpus', repeat=2)
+    results = [
+        check(stats.total_calls > 0 and isinstance(snapshot, tracemalloc.Snapshot), "CPU and memory profiles load"),
+        check(any(e['name'] == 'tokoffset.encode' and e['ph'] == 'X' and e['dur'] >= 0 for e in trace['traceEvents']),
+              "The trace holds the tokenizer spans as Chrome events"),
+        check(not tracing.tracing_enabled() or tracing.get_tracer() is not None, "Recording stops with the block"),
+        check('CPU profile saved' in stderr.getvalue() and 'peak' in stderr.getvalue(), "Profile messages go to stderr"),
+        check(bench['files'] == 3 and bench['bytes'] == 12 and bench['tokens'] == 12 and len(bench['rounds']) == 2,
+              "The benchmark counts files, bytes and tokens"),
+        check(len(bench['slowest']) == 3 and bench['mb_per_second'] >= 0, "Slowest files are listed"),
+    ]
+    return all(results)
+
+@module_test("BPE Merge Explanation")
+def test_bpe_explain():
+    """Merge trees replay the BPE merges of every token"""
+    import json
+    import re
+    from bpe_explain import ExplainError, explain, format_tree
+
+    merges = ['l o', 'lo w', 'e r', 'low er']
+    vocab = {piece: i for i, piece in enumerate(['l', 'o', 'w', 'e', 'r', 'x', 'y', ' ', 'lo', 'low', 'er', 'lower', 'xy'])}
+
+    class TinyBPE:
+        """Words are single tokens; the serialized model holds the merges that build them"""
+        backend_tokenizer = type('Backend', (), {'to_str': lambda self: json.dumps(
+            {'model': {'type': 'BPE', 'vocab': vocab, 'merges': merges}})})()
+        pieces = {i: piece for piece, i in vocab.items()}
+
+        def __call__(self, text, add_special_tokens=False, return_offsets_mapping=False, **kwargs):
+            found = list(re.finditer(r'\S+|\s', text))
+            encoding = {'input_ids': [vocab[m.group()] for m in found]}
+            if return_offsets_mapping:
+                encoding['offset_mapping'] = [m.span() for m in found]
+            return encoding
+
+        def convert_ids_to_tokens(self, ids):
+            return self.pieces[ids] if isinstance(ids, int) else [self.pieces[i] for i in ids]
+
+    text = 'low lower xy'
+    results_by_piece = {r['piece']: r for r in explain(TinyBPE(), text)}
+    lower = results_by_piece['lower']['tree']
+    mapped = explain(TinyBPE(), text, byte_map=[b + 100 for b in range(len(text) + 1)], start=2, end=3)
+    results = [
+        check(results_by_piece['low']['merges'] == 2 and results_by_piece['lower']['merges'] == 4
+              and results_by_piece[' ']['merges'] == 0, "Merge counts per token"),
+        check(lower['rank'] == 3 and lower['step'] == 4 and [c['token'] for c in lower['children']] == ['low', 'er']
+              and (lower['start_byte'], lower['end_byte']) == (4, 9), "The root is the last merge over the token's bytes"),
+        check([c['step'] for c in lower['children']] == [2, 3] and lower['children'][0]['children'][0]['token'] == 'lo',
+              "Children record the merge order"),
+        check(not results_by_piece['xy']['consistent'] and results_by_piece['xy']['tree']['rank'] is None
+              and all(r['consistent'] for p, r in results_by_piece.items() if p != 'xy'),
+              "Tokens the merges cannot build are flagged"),
+        check(len(mapped) == 1 and (mapped[0]['tree']['start_byte'], mapped[0]['tree']['end_byte']) == (104, 109),
+              "Token ranges and file offsets"),
+        check(format_tree(lower)[0] == "'lower' [4, 9) step 4, rank 3" and len(format_tree(lower)) == 9,
+              "The tree prints one node per line"),
+        check(explain(TinyBPE(), '') == [], "Empty text"),
+    ]
+    try:
+        explain(ByteFallbackTokenizer(), text)
+        results.append(check(False, "Tokenizers without merges are rejected"))
+    except ExplainError:
+        results.append(check(True, "Tokenizers without merges are rejected"))
+    return all(results)
+
+@module_test("Token Show")
+def test_token_show():
+    """Highlighted output marks token boundaries, counts tokens per line and wraps by display width"""
+    from token_show import RESET, SHARED_BACKGROUND, char_width, render
+
+    tokenizer = ByteFallbackTokenizer()
+
+    def plain(text, **options):
+        return list(render(tokenizer, text, color=False, **options))
+
+    results = [
+        check(plain('ab\n中c') == ['1   3 │ a¦b', '2   4 │ 中¦c'], "Separators without color; the gutter counts tokens"),
+        check(plain('ab\n中c\n') == ['1   3 │ a¦b', '2   5 │ 中¦c'], "A final newline adds no empty line"),
+        check(plain('ab\tc\n', show_whitespace=True) == ['1   5 │ a¦b¦→ ¦c¦↵'], "Whitespace marks and tab stops"),
+        check(plain('中' * 8, width=17) == ['1  24 │ ' + '¦'.join('中' * 5), '      │ ' + '¦'.join('中' * 3)],
+              "Wide characters count two columns when wrapping"),
+        check(plain('a\nb\nc', lines=(2, 2)) == ['2   2 │ b'], "A line range selects lines"),
+        check(list(render(tokenizer, 'a中', color=True)) == ['1   4 │ \033[48;5;24ma' + RESET + SHARED_BACKGROUND + '中' + RESET],
+              "A character split across tokens gets the shared color"),
+        check(char_width('中') == 2 and char_width('\u0301') == 0 and char_width('a') == 1, "Character widths"),
+        check(plain('') == ['1   0 │ '], "Empty text"),
+    ]
+    return all(results)
+
+@module_test("Whitespace Analytics")
+def test_whitespace_stats():
+    """Tokens are charged to whitespace regions by their bytes; minimizing maps back to the file"""
+    import re
+    from whitespace_stats import estimate_savings, minimize_whitespace, whitespace_regions, whitespace_stats
+
+    class IndentTokenizer(ByteFallbackTokenizer):
+        """A line break and the next line's indentation are one token"""
+
+        def __call__(self, text, add_special_tokens=False, return_offsets_mapping=False, **kwargs):
+            found = list(re.finditer(r'\n *|.', text, re.S))
+            encoding = {'input_ids': [self._id(m.group()) for m in found]}
+            if return_offsets_mapping:
+                encoding['offset_mapping'] = [m.span() for m in found]
+            return encoding
+
+    text = 'def f():\n    x = 1  \n\n\n\n    return x'
+    stats = whitespace_stats(IndentTokenizer(), text)
+    cats = stats['categories']
+    minimized, byte_map = minimize_whitespace(text)
+    data = text.encode('utf-8')
+    results = [
+        check(whitespace_regions(text) == [(9, 13, 'indent'), (18, 20, 'trailing'), (21, 22, 'blank'), (22, 23, 'blank'),
+                                           (23, 24, 'blank'), (24, 28, 'indent')], "Regions by category"),
+        check(round(cats['indent']['tokens'], 6) == 1.6 and cats['trailing']['tokens'] == 2 and round(cats['blank']['tokens'], 6) == 2.2,
+              "A token across a line break is charged in proportion to its bytes"),
+        check(stats['whitespace_only_tokens'] == 5 and cats['indent']['spans'] == [[9, 13], [24, 28]], "Whole tokens and region spans"),
+        check(minimized == 'def f():\n\tx = 1\n\n\treturn x', "Indents become tabs, blank runs collapse, trailing space goes"),
+        check(data[byte_map[minimized.index('return')]:].startswith(b'return') and byte_map[-1] == len(data),
+              "The byte map points into the original"),
+        check(minimize_whitespace('a\r\n  \r\n') == ('a\r\n\r\n', [0, 1, 2, 5, 6, 7]), "CRLF line breaks are kept"),
+        check(whitespace_regions('a  ') == [(1, 3, 'trailing')] and whitespace_regions('  \n') == [(0, 3, 'blank')],
+              "Trailing whitespace without a final newline; whitespace-only lines"),
+        check(estimate_savings(ByteFallbackTokenizer(), text)['saved'] == 10, "Savings count tokens before and after"),
+        check(whitespace_regions('') == [] and minimize_whitespace('') == ('', [0])
+              and whitespace_stats(ByteFallbackTokenizer(), '')['share'] == 0.0, "Empty text"),
+    ]
+    try:
+        minimize_whitespace(text, indent='none')
+        results.append(check(False, "Unknown indent modes are rejected"))
+    except ValueError:
+        results.append(check(True, "Unknown indent modes are rejected"))
+    return all(results)
+
+@module_test("Added Token Injection")
+def test_added_tokens():
+    """Added tokens get zero-width spans at their injection points; other tokens keep file offsets"""
+    from added_tokens import AddedTokens
+    from token_index import TokenIndex
+    from token_spans import compute_token_spans
+
+    tokenizer = ByteFallbackTokenizer()
+    added = AddedTokens(tokenizer)
+    added.register('<pre>', token_ids=[900])
+    added.register('<suf>', token_ids=[901, 902])
+    text = 'ab中c'
+    result = added.inject(text, [(5, '<suf>'), (0, '<pre>'), (5, '<pre>'), (6, '<pre>')])
+    plain, _ = compute_token_spans(tokenizer, text)
+    shifted = added.inject(text, [(5, '<pre>')], byte_map=[b + 3 for b in range(len(text.encode('utf-8')) + 1)])
+    results = [
+        check(result['ids'][:1] == [900] and result['ids'][-1] == 900 and [i['start_byte'] for i in result['injections']] == [0, 5, 5, 6],
+              "Injections at the start, the end and one position keep their order"),
+        check(result['ids'][result['injections'][1]['indices'][0]:][:3] == [901, 902, 900], "Multi-token added tokens stay together"),
+        check([s for s in result['spans'] if 'added' not in s] == plain, "Text tokens keep their offsets"),
+        check(all(s['start_byte'] == s['end_byte'] for s in result['spans'] if 'added' in s) and len(TokenIndex(result['spans'])) == len(result['spans']),
+              "Added tokens are zero-width and the stream indexes"),
+        check(shifted['injections'][0]['start_byte'] == 5 and shifted['spans'][-1]['end_byte'] == 9, "Positions are file offsets with a byte map"),
+        check(added.inject('', [(0, '<pre>')])['ids'] == [900], "Injection into empty text"),
+    ]
+    for description, call in (("Points inside a UTF-8 character are rejected", lambda: added.inject(text, [(3, '<pre>')])),
+                              ("Points past the text are rejected", lambda: added.inject(text, [(7, '<pre>')])),
+                              ("Points before the byte map are rejected", lambda: added.inject(text, [(1, '<pre>')], byte_map=[b + 3 for b in range(7)])),
+                              ("Tokens outside the vocabulary need IDs", lambda: added.register('<mid>'))):
+        try:
+            call()
+            results.append(check(False, description))
+        except ValueError:
+            results.append(check(True, description))
+    try:
+        added.inject(text, [(0, '<mid>')])
+        results.append(check(False, "Unregistered tokens are rejected"))
+    except KeyError:
+        results.append(check(True, "Unregistered tokens are rejected"))
+    return all(results)
+
+@module_test("FIM Prompts")
+def test_fim():
+    """FIM prompts fit the budget around the cursor and report file byte ranges"""
+    from added_tokens import AddedTokens
+    from fim import SENTINELS, splice_completion, split_fim
+
+    tokenizer = ByteFallbackTokenizer()
+    added = AddedTokens(tokenizer)
+    for i, name in enumerate(SENTINELS['default']):
+        added.register(name, token_ids=[900 + i])
+    text = 'abcdefghij'
+    psm = split_fim(tokenizer, text, 4, 7, added=added)
+    spm = split_fim(tokenizer, text, 4, 7, middle_end=6, mode='spm', added=added)
+    cut = split_fim(tokenizer, '中b', 3, 5, added=added)
+    roomy = split_fim(tokenizer, text, 4, 100, added=added)
+    shifted = split_fim(tokenizer, text, 7, 100, byte_map=[b + 3 for b in range(len(text) + 1)], added=added)
+    results = [
+        check(psm['ids'][0] == 900 and psm['ids'][4] == 901 and psm['ids'][-1] == 902 and psm['tokens'] == 7,
+              "PSM order within the budget"),
+        check(psm['prefix']['bytes'] == [1, 4] and psm['suffix']['bytes'] == [4, 5] and psm['prefix']['dropped_tokens'] == 1,
+              "The prefix keeps the tokens nearest the cursor"),
+        check(spm['ids'][0] == 901 and spm['suffix']['bytes'][0] == 6 and spm['middle']['bytes'] == [4, 6],
+              "SPM order; the suffix starts after the selection"),
+        check(cut['prefix']['ids'] == [] and cut['prefix']['bytes'] == [3, 3] and cut['suffix']['bytes'] == [3, 4],
+              "Segments never start inside a character; the suffix takes the freed budget"),
+        check(roomy['prefix']['bytes'] == [0, 4] and roomy['suffix']['bytes'] == [4, 10] and roomy['tokens'] == 13,
+              "Unused suffix budget goes to the prefix"),
+        check(shifted['middle']['bytes'] == [7, 7] and shifted['prefix']['bytes'] == [3, 7], "Offsets are file offsets with a byte map"),
+        check(splice_completion(text, spm, 'XY')[0] == 'abcdXYghij', "The completion replaces the selection"),
+        check(split_fim(tokenizer, '', 0, 3, added=added)['ids'] == [900, 901, 902], "Empty text"),
+    ]
+    for description, call in (("Budgets below the sentinels are rejected", lambda: split_fim(tokenizer, text, 4, 2, added=added)),
+                              ("A cursor inside a character is rejected", lambda: split_fim(tokenizer, '中b', 1, 10, added=added)),
+                              ("A selection ending before the cursor is rejected", lambda: split_fim(tokenizer, text, 4, 10, middle_end=2, added=added)),
+                              ("Unknown modes are rejected", lambda: split_fim(tokenizer, text, 4, 10, mode='pms', added=added))):
+        try:
+            call()
+            results.append(check(False, description))
+        except ValueError:
+            results.append(check(True, description))
+    return all(results)
+
+@module_test("Multi-Encoder Session")
+def test_session():
+    """A session tokenizes once per encoder and reads spans in every unit"""
+    import importlib.util
+    import tempfile
+    from session import Session
+
+    session = Session('a😀\nb')
+    tokenizer = ByteFallbackTokenizer()
+    arena = session.tokens(tokenizer, 'bf')
+    with tempfile.TemporaryDirectory() as tmp:
+        path = Path(tmp) / 'bom.txt'
+        path.write_bytes(b'\xef\xbb\xbfab')
+        from_file = Session.from_file(path)
+        from_file.tokens(tokenizer, 'bf')
+    results = [
+        check(session.tokens(tokenizer, 'bf') is arena and session.counts({'bf': tokenizer, 'gpt2': gpt2_tokenizer()})['bf'] == 7
+              and session.encoders() == ['bf', 'gpt2'], "Tokens are computed once per encoder"),
+        check([session.span('bf', i, 'utf16') for i in (0, 1, 5)] == [(0, 1), (1, 3), (3, 4)]
+              and [session.span('bf', i, 'codepoints') for i in (1, 6)] == [(1, 2), (3, 4)],
+              "Byte tokens of one character widen to the whole character"),
+        check(session.position(6) == (2, 1) and session.convert(3, 'utf16') == 1 and session.convert(3, 'utf16', round_up=True) == 3,
+              "Offsets inside a character round down or up"),
+        check(from_file.span('bf', 1) == (4, 5) and from_file.path.endswith('bom.txt'), "Spans are file offsets past a BOM"),
+        check(Session('').count(tokenizer) == 0 and Session('').convert(0, 'utf16') == 0, "Empty document"),
+    ]
+    if importlib.util.find_spec('regex'):
+        results.append(check(Session('e\u0301x').graphemes == [0, 3, 4], "Grapheme clusters group combining marks"))
+    else:
+        try:
+            Session('x').graphemes
+            results.append(check(False, "Graphemes without 'regex' raise ImportError"))
+        except ImportError:
+            results.append(check(True, "Graphemes without 'regex' raise ImportError"))
+    try:
+        session.convert(0, 'lines')
+        results.append(check(False, "Unknown units are rejected"))
+    except ValueError:
+        results.append(check(True, "Unknown units are rejected"))
+    return all(results)
+
+@module_test("Corpus Report")
+def test_report():
+    """Reports total a corpus, sample it deterministically and validate offsets"""
+    import tempfile
+    from report import build_report, render_markdown, sample_paths, validate_spans
+
+    tokenizer = ByteFallbackTokenizer()
+    with tempfile.TemporaryDirectory() as tmp:
+        root = Path(tmp) / 'corpus'
+        write_tree(root, {'a.py': 'x = 1', 'b.txt': '中', 'c.py': '', 'd/e.go': 'package e\n'})
+        full = build_report(tokenizer, root, 'bf', context_window=5)
+        sampled = build_report(tokenizer, root, 'bf', sample=2, seed=7)
+        paths = sorted(root.rglob('*.*'))
+        picked = sample_paths(paths, root, 2, seed=7)
+        markdown = render_markdown(sampled)
+        empty_root = Path(tmp) / 'empty'
+        empty_root.mkdir()
+        empty = build_report(tokenizer, empty_root, 'bf', sample=0.5)
+    total = full['total']
+    results = [
+        check(total['files'] == 4 and total['bytes'] == 18 and total['tokens'] == 18 and total['estimated_corpus_tokens'] == 18,
+              "Totals cover every file"),
+        check(full['languages']['python'] == {'files': 2, 'bytes': 5, 'tokens': 5, 'tokens_per_byte': 1.0},
+              "Per-language totals"),
+        check(full['largest_files'][0]['path'] == 'd/e.go' and [f['path'] for f in full['context_window']['files_over']] == ['d/e.go'],
+              "Largest files and files over the context window"),
+        check(full['validation']['partial_tokens'] == 3 and not any(full['validation']['issues'].values()),
+              "Valid offsets; split characters are counted"),
+        check(picked == sample_paths(paths[::-1], root, 2, seed=7) and len(picked) == 2
+              and sorted(f['path'] for f in sampled['largest_files']) == [p.relative_to(root).as_posix() for p in picked],
+              "A seed picks the same files in any order"),
+        check(sampled['total']['estimated_corpus_tokens'] > 0 and '## Offset validation' in markdown and 'seed 7' in markdown,
+              "Sampled reports extrapolate and render"),
+        check(validate_spans([{'start_byte': 0, 'end_byte': 2}, {'start_byte': 1, 'end_byte': 3}, {'start_byte': 0, 'end_byte': 9},
+                              {'start_byte': 5, 'end_byte': 6}], 8) == {'overlap': 1, 'out_of_bounds': 1, 'uncovered_bytes': 4},
+              "Overlaps, out-of-bounds spans and uncovered bytes"),
+        check(validate_spans([], 0) == {} and empty['total']['files'] == 0 and empty['total']['estimated_corpus_tokens'] == 0,
+              "Empty documents and corpora"),
+    ]
+    return all(results)
+
+@module_test("Normalizing Encoder")
+def test_normalizing_encoder():
+    """Normalized tokenization keeps file offsets, in the API and across commands"""
+    import contextlib
+    import io
+    import json
+    import tempfile
+    import tokoffset
+    from normalizers import NormalizerChain, NormalizingEncoder, normalized_token_spans
+    from shared_encoder import SharedEncoder
+    from token_spans import compute_token_spans
+
+    chain = NormalizerChain.from_spec(['nfkc', 'lowercase'])
+    text = 'ﬁX 中'
+    spans, normalized, _ = normalized_token_spans(ByteFallbackTokenizer(), text, chain)
+    encoder = NormalizingEncoder(SharedEncoder(ByteFallbackTokenizer()), chain)
+    wrapped, _ = compute_token_spans(encoder, text)
+    private = encoder.copy()
+    with tempfile.TemporaryDirectory() as tmp:
+        write_tree(tmp, {'a.txt': 'xa yb', 'b.txt': 'Ab Cd'})
+
+        def run(argv):
+            stdout = io.StringIO()
+            with contextlib.redirect_stdout(stdout):
+                code = tokoffset.main(['--no_config'] + argv)
+            return code, json.loads(stdout.getvalue())
+
+        _, once = run(['normalize', str(Path(tmp) / 'a.txt'), '--steps', 'regex:a=>aa', '--json'])
+        _, both = run(['--normalize', 'regex:a=>aa', 'normalize', str(Path(tmp) / 'a.txt'), '--steps', 'regex:a=>aa', '--json'])
+        code, aligned = run(['--normalize', r'regex:\s+=>', 'align', str(Path(tmp) / 'b.txt'), '--tokens', '0:1',
+                             '--target_model', 'gpt2', '--json'])
+    expected_ids = [s['id'] for s in compute_token_spans(tokoffset.load_tokenizer('gpt2'), 'xaa yb')[0]]
+    results = [
+        check(normalized == 'fix 中' and (spans[0]['start_byte'], spans[0]['end_byte']) == (0, 3) and spans[-1]['end_byte'] == 8,
+              "Tokens of replaced ranges map to the whole original range"),
+        check([(s['start_byte'], s['end_byte']) for s in wrapped] == [(s['start_byte'], s['end_byte']) for s in spans],
+              "The wrapper reports the same file spans"),
+        check(isinstance(private, NormalizingEncoder) and private.chain is chain and not isinstance(private.tokenizer, SharedEncoder),
+              "copy() keeps the normalization on a private tokenizer"),
+        check([s['id'] for s in once] == expected_ids and [s['id'] for s in both] == expected_ids,
+              "normalize applies its steps once, with or without --normalize"),
+        check(code == 0 and aligned[0]['tokens'] == [0, 1] and aligned[0]['exact'], "align normalizes both tokenizers"),
+        check(normalized_token_spans(ByteFallbackTokenizer(), '', chain)[:2] == ([], ''), "Empty text"),
+    ]
+    try:
+        NormalizerChain.from_spec(['titlecase'])
+        results.append(check(False, "Unknown steps are rejected"))
+    except ValueError:
+        results.append(check(True, "Unknown steps are rejected"))
+    return all(results)
+
+@module_test("Encoder Registry")
+def test_encoder_registry():
+    """Encoders load once per (name, revision), concurrently too, and fingerprints guard stream mixing"""
+    import threading
+    import time
+    from concurrent.futures import ThreadPoolExecutor
+    from encoder_registry import EncoderMismatchError, EncoderRegistry, check_fingerprints, fingerprint_of
+    from shared_encoder import SharedEncoder
+
+    loads = []
+    failures = {'flaky': 1}
+    release = threading.Event()
+
+    def loader(name, revision):
+        loads.append((name, revision))
+        if name == 'slow':
+            release.wait(5)
+        if failures.get(name):
+            failures[name] -= 1
+            raise OSError(f"{name} unavailable")
+        return ByteFallbackTokenizer()
+
+    registry = EncoderRegistry(loader)
+    with ThreadPoolExecutor(max_workers=4) as pool:
+        futures = [pool.submit(registry.get, 'slow') for _ in range(4)]
+        time.sleep(0.05)
+        release.set()
+        concurrent = [f.result() for f in futures]
+    try:
+        registry.get('flaky')
+        first_failed = False
+    except OSError:
+        first_failed = True
+    retried = registry.get('flaky')
+    pinned = registry.get('slow', 'v1')
+    tokenizer = ByteFallbackTokenizer()
+    results = [
+        check(all(e is concurrent[0] for e in concurrent) and loads.count(('slow', None)) == 1,
+              "Concurrent first requests share one load"),
+        check(first_failed and retried.name == 'flaky' and loads.count(('flaky', None)) == 2, "Failed loads are retried"),
+        check(pinned is not concurrent[0] and pinned.revision == 'v1' and len(registry.loaded()) == 3, "Revisions are separate entries"),
+        check(isinstance(pinned.tokenizer, SharedEncoder) and pinned.fingerprint == pinned.tokenizer.fingerprint,
+              "Registry tokenizers are shared and fingerprinted"),
+        check(fingerprint_of(tokenizer) == fingerprint_of(tokenizer) and fingerprint_of(pinned.tokenizer) == pinned.fingerprint,
+              "Fingerprints are cached per tokenizer"),
+        check(check_fingerprints('sha256:a', None, 'sha256:a') == 'sha256:a' and check_fingerprints() is None
+              and check_fingerprints(None, '') is None, "Unknown fingerprints are skipped"),
+    ]
+    registry.clear()
+    results.append(check(registry.loaded() == [] and registry.get('slow') is not concurrent[0], "clear() drops every encoder"))
+    try:
+        check_fingerprints('sha256:a', 'sha256:b', what='chunk manifests')
+        results.append(check(False, "Different fingerprints are rejected"))
+    except EncoderMismatchError as e:
+        results.append(check('chunk manifests' in str(e), "Different fingerprints are rejected"))
+    return all(results)
+
 def main():
     """Main test function"""
     print("Quick Analyzer Simplified Test")
@@ -238,6 +2776,15 @@ def main():
     
     # Test code samples
     samples_test_passed = test_code_samples()
+
+    # Test concurrent encoding
+    concurrency_test_passed = test_concurrent_encoding()
+
+    # Test golden files
+    golden_test_passed = test_golden_files()
+
+    # Module tests
+    module_results = [(title, test()) for title, test in MODULE_TESTS]
     
     print("\n" + "=" * 60)
     print("Test Summary")
@@ -252,8 +2799,22 @@ def main():
         print("✓ Code samples test passed")
     else:
         print("❌ Code samples test failed")
+
+    if concurrency_test_passed:
+        print("✓ Concurrent encoding test passed")
+    else:
+        print("❌ Concurrent encoding test failed")
+
+    if golden_test_passed:
+        print("✓ Golden files test passed")
+    else:
+        print("❌ Golden files test failed")
+
+    for title, passed in module_results:
+        print(f"{'✓' if passed else '❌'} {title} test {'passed' if passed else 'failed'}")
+    modules_passed = all(passed for _, passed in module_results)
     
-    if core_test_passed and samples_test_passed:
+    if core_test_passed and samples_test_passed and concurrency_test_passed and golden_test_passed and modules_passed:
         print("\n🎉 All tests passed! You can use analyzer.py for complete analysis")
         print("\nRecommended command:")
         print("  python analyzer.py")
@@ -263,7 +2824,7 @@ def main():
             print("  - Make sure all dependencies are installed: pip install -r requirements.txt")
             print("  - Run analyzer.py first to compile language libraries")
     
-    return core_test_passed and samples_test_passed
+    return core_test_passed and samples_test_passed and concurrency_test_passed and golden_test_passed and modules_passed
 
 if __name__ == "__main__":
     success = main()
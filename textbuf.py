@@ -0,0 +1,325 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Editable Text Buffer - Piece table that keeps token spans in sync with edits
+
+TextBuffer backs long-lived editor sessions: text lives in a piece table
+(original bytes + append-only added bytes), and every edit retokenizes only
+a small region around the change. Token spans and line starts are kept as
+absolute UTF-8 byte offsets.
+
+Resynchronization: after an edit the region from the start of the edited
+line is retokenized, growing line by line until the new tokens past the
+region end match the old (shifted) tokens again, so tokenizer work per
+edit is proportional to the edited region rather than the document.
+
+The bookkeeping around it is not: tokens and line starts after the edit
+are shifted in a linear pass, and locating an offset walks the piece list,
+so an edit also costs O(tokens + pieces) in plain list operations. That is
+cheap next to tokenizing, but it grows with the document.
+"""
+
+import bisect
+from typing import Dict, List, Optional, Tuple
+
+from position_index import utf16_length, utf16_prefix
+from token_spans import compute_token_spans, encode_source
+
+# Piece buffers
+_ORIGINAL = 0
+_ADDED = 1
+
+
+class TextBuffer:
+    """Piece-table text buffer with an incrementally maintained token stream."""
+
+    def __init__(self, tokenizer, text: str = ""):
+        self.tokenizer = tokenizer
+        self._buffers = [encode_source(text), bytearray()]
+        # Each piece is [buffer, start, length]
+        self._pieces: List[List[int]] = []
+        if self._buffers[_ORIGINAL]:
+            self._pieces.append([_ORIGINAL, 0, len(self._buffers[_ORIGINAL])])
+        self._length = len(self._buffers[_ORIGINAL])
+        self.version = 0
+
+        self.tokens: List[Dict] = self._tokenize_range(0, self._length)
+        self._starts: Optional[List[int]] = None
+        self.line_starts: List[int] = [0] + [i + 1 for i, b in enumerate(self._buffers[_ORIGINAL]) if b == 0x0A]
+
+    def __len__(self) -> int:
+        return self._length
+
+    # ------------------------------------------------------------------
+    # Text access
+    # ------------------------------------------------------------------
+    def get_bytes(self, start: int = 0, end: Optional[int] = None) -> bytes:
+        """Return the buffer bytes in [start, end)."""
+        end = self._length if end is None else end
+        start = max(0, min(start, self._length))
+        end = max(start, min(end, self._length))
+        out = bytearray()
+        pos = 0
+        for buf, pstart, plen in self._pieces:
+            if pos >= end:
+                break
+            if pos + plen > start:
+                lo = max(start - pos, 0)
+                hi = min(end - pos, plen)
+                out += self._buffers[buf][pstart + lo:pstart + hi]
+            pos += plen
+        return bytes(out)
+
+    def text(self) -> str:
+        """Return the whole buffer as text."""
+        return self.get_bytes().decode('utf-8', errors='surrogateescape')
+
+    def token_count(self) -> int:
+        return len(self.tokens)
+
+    # ------------------------------------------------------------------
+    # Editing
+    # ------------------------------------------------------------------
+    def insert(self, offset: int, text: str) -> Dict:
+        """Insert text at a byte offset."""
+        return self.replace(offset, offset, text)
+
+    def delete(self, start: int, end: int) -> Dict:
+        """Delete bytes in [start, end)."""
+        return self.replace(start, end, "")
+
+    def replace(self, start: int, end: int, text: str) -> Dict:
+        """Replace bytes in [start, end) with text.
+
+        Returns the change summary: byte range before/after the edit and the
+        token range that was replaced, i.e. old tokens
+        [start_token, old_end_token) became [start_token, new_end_token).
+        """
+        if not (0 <= start <= end <= self._length):
+            raise ValueError(f"Edit range [{start}, {end}) outside buffer of {self._length} bytes")
+        for pos in (start, end):
+            if not self._is_char_boundary(pos):
+                raise ValueError(f"Edit offset {pos} falls inside a UTF-8 sequence")
+
+        new_bytes = encode_source(text)
+        delta = len(new_bytes) - (end - start)
+
+        self._splice_pieces(start, end, new_bytes)
+        self._length += delta
+        self._update_line_starts(start, end, new_bytes)
+        change = self._retokenize(start, end, start + len(new_bytes), delta)
+        self._starts = None
+        self.version += 1
+        return change
+
+    def _is_char_boundary(self, pos: int) -> bool:
+        if pos <= 0 or pos >= self._length:
+            return True
+        return (self.get_bytes(pos, pos + 1)[0] & 0xC0) != 0x80
+
+    def _split_at(self, offset: int) -> int:
+        """Ensure a piece starts at offset; return that piece's index."""
+        pos = 0
+        for idx, (buf, pstart, plen) in enumerate(self._pieces):
+            if pos == offset:
+                return idx
+            if pos < offset < pos + plen:
+                inner = offset - pos
+                self._pieces[idx:idx + 1] = [[buf, pstart, inner], [buf, pstart + inner, plen - inner]]
+                return idx + 1
+            pos += plen
+        return len(self._pieces)
+
+    def _splice_pieces(self, start: int, end: int, new_bytes: bytes):
+        first = self._split_at(start)
+        last = self._split_at(end)
+        replacement = []
+        if new_bytes:
+            added = self._buffers[_ADDED]
+            replacement.append([_ADDED, len(added), len(new_bytes)])
+            added += new_bytes
+        self._pieces[first:last] = replacement
+
+    def _update_line_starts(self, start: int, end: int, new_bytes: bytes):
+        delta = len(new_bytes) - (end - start)
+        lo = bisect.bisect_right(self.line_starts, start)
+        hi = bisect.bisect_right(self.line_starts, end)
+        inserted = [start + i + 1 for i, b in enumerate(new_bytes) if b == 0x0A]
+        shifted = [ls + delta for ls in self.line_starts[hi:]]
+        self.line_starts[lo:] = inserted + shifted
+
+    # ------------------------------------------------------------------
+    # Incremental retokenization
+    # ------------------------------------------------------------------
+    def _tokenize_range(self, start: int, end: int) -> List[Dict]:
+        if end <= start:
+            return []
+        text = self.get_bytes(start, end).decode('utf-8', errors='surrogateescape')
+        spans, _ = compute_token_spans(self.tokenizer, text)
+        for span in spans:
+            span['start_byte'] += start
+            span['end_byte'] += start
+        return spans
+
+    def _next_line_end(self, pos: int) -> int:
+        """Offset just past the line containing pos (or the buffer end)."""
+        idx = bisect.bisect_right(self.line_starts, pos)
+        return self.line_starts[idx] if idx < len(self.line_starts) else self._length
+
+    def _token_starts(self) -> List[int]:
+        """Start offsets of self.tokens, rebuilt once per edit."""
+        if self._starts is None:
+            self._starts = [t['start_byte'] for t in self.tokens]
+        return self._starts
+
+    def _retokenize(self, start: int, old_end: int, new_end: int, delta: int) -> Dict:
+        old_tokens = self.tokens
+        old_starts = self._token_starts()
+
+        # Restart one token before the token covering the start of the edited
+        # line: whitespace runs may merge across the line start
+        line_idx = bisect.bisect_right(self.line_starts, start) - 1
+        line_start = self.line_starts[line_idx] if line_idx >= 0 else 0
+        first = max(0, bisect.bisect_right(old_starts, line_start) - 2)
+        # A run of whitespace tokens (blank lines, indentation) can merge into
+        # one token once the edit changes what follows; restart before the run
+        while first > 0 and self._is_whitespace_token(old_tokens[first - 1]):
+            first -= 1
+        # Byte-fallback tokens can start mid-character; restart on a character
+        while first > 0 and not self._is_char_boundary(old_tokens[first]['start_byte']):
+            first -= 1
+        region_start = min(old_tokens[first]['start_byte'], start) if first < len(old_tokens) else line_start
+
+        # Old tokens entirely after the edit, shifted into new coordinates
+        tail_idx = bisect.bisect_left(old_starts, old_end)
+        tail = [dict(t, start_byte=t['start_byte'] + delta, end_byte=t['end_byte'] + delta)
+                for t in old_tokens[tail_idx:]]
+        tail_starts = [t['start_byte'] for t in tail]
+
+        region_end = self._next_line_end(new_end)
+        while True:
+            # Grow the region to the next old token boundary
+            k = self._next_tail_boundary(tail_starts, region_end)
+            region_end = tail_starts[k] if k < len(tail) else self._length
+            k_ahead = self._next_tail_boundary(tail_starts, self._next_line_end(region_end))
+            lookahead_end = tail_starts[k_ahead] if k_ahead < len(tail) else self._length
+
+            new_tokens = self._tokenize_range(region_start, lookahead_end)
+            if lookahead_end >= self._length:
+                break
+            ahead_new = [t for t in new_tokens if t['start_byte'] >= region_end]
+            ahead_old = tail[k:k_ahead]
+            if self._same_tokens(ahead_new, ahead_old):
+                break
+            region_end = lookahead_end
+
+        keep_tail = [t for t in tail if t['start_byte'] >= lookahead_end]
+        self.tokens = old_tokens[:first] + new_tokens + keep_tail
+
+        return {
+            'version': self.version + 1,
+            'start_byte': start,
+            'old_end_byte': old_end,
+            'new_end_byte': new_end,
+            'start_token': first,
+            'old_end_token': len(old_tokens) - len(keep_tail),
+            'new_end_token': first + len(new_tokens),
+        }
+
+    def _is_whitespace_token(self, token: Dict) -> bool:
+        return self.get_bytes(token['start_byte'], token['end_byte']).isspace()
+
+    def _next_tail_boundary(self, tail_starts: List[int], pos: int) -> int:
+        """Index of the first tail token starting at or after pos on a character boundary."""
+        k = bisect.bisect_left(tail_starts, pos)
+        while k < len(tail_starts) and not self._is_char_boundary(tail_starts[k]):
+            k += 1
+        return k
+
+    @staticmethod
+    def _same_tokens(a: List[Dict], b: List[Dict]) -> bool:
+        if len(a) != len(b):
+            return False
+        return all(
+            x['id'] == y['id'] and x['start_byte'] == y['start_byte'] and x['end_byte'] == y['end_byte']
+            for x, y in zip(a, b)
+        )
+
+    # ------------------------------------------------------------------
+    # Offset queries
+    # ------------------------------------------------------------------
+    def offset_to_position(self, offset: int) -> Tuple[int, int]:
+        """Map a byte offset to a 0-based (line, byte column)."""
+        offset = max(0, min(offset, self._length))
+        line = bisect.bisect_right(self.line_starts, offset) - 1
+        return line, offset - self.line_starts[line]
+
+    def position_to_offset(self, line: int, column: int) -> int:
+        """Map a 0-based (line, byte column) to a byte offset."""
+        if line < 0:
+            return 0
+        if line >= len(self.line_starts):
+            return self._length
+        return min(self.line_starts[line] + max(0, column), self._next_line_end(self.line_starts[line]))
+
+    def _line_text(self, line: int) -> str:
+        """Text of a line without its line terminator."""
+        start = self.line_starts[line]
+        data = self.get_bytes(start, self._next_line_end(start))
+        if data.endswith(b'\n'):
+            data = data[:-1]
+        if data.endswith(b'\r'):
+            data = data[:-1]
+        return data.decode('utf-8', errors='surrogateescape')
+
+    def utf16_position_to_offset(self, line: int, character: int) -> int:
+        """Map an LSP position (0-based line, UTF-16 character) to a byte offset.
+
+        Characters past the end of the line clamp to the line end, and lines
+        past the end of the document clamp to the document end.
+        """
+        if line < 0:
+            return 0
+        if line >= len(self.line_starts):
+            return self._length
+        prefix = utf16_prefix(self._line_text(line), character)
+        return self.line_starts[line] + len(prefix.encode('utf-8', 'surrogateescape'))
+
+    def offset_to_utf16_position(self, offset: int) -> Tuple[int, int]:
+        """Map a byte offset to an LSP position (0-based line, UTF-16 character)."""
+        line, column = self.offset_to_position(offset)
+        start = self.line_starts[line]
+        prefix = self.get_bytes(start, start + column).decode('utf-8', errors='surrogateescape')
+        return line, utf16_length(prefix)
+
+    # ------------------------------------------------------------------
+    # LSP integration
+    # ------------------------------------------------------------------
+    def apply_content_change(self, change: Dict) -> Dict:
+        """Apply one LSP TextDocumentContentChangeEvent.
+
+        change is {'range': {'start': {'line', 'character'}, 'end': {...}}, 'text': str}
+        with UTF-16 positions, or {'text': str} to replace the whole document.
+        Returns the replace() summary; the changed tokens are
+        self.tokens[start_token:new_end_token].
+        """
+        text = change.get('text', '')
+        rng = change.get('range')
+        if rng is None:
+            return self.replace(0, self._length, text)
+        start = self.utf16_position_to_offset(rng['start']['line'], rng['start']['character'])
+        end = self.utf16_position_to_offset(rng['end']['line'], rng['end']['character'])
+        if end < start:
+            start, end = end, start
+        return self.replace(start, end, text)
+
+    def apply_content_changes(self, changes: List[Dict]) -> List[Dict]:
+        """Apply a didChange contentChanges list in order (each against the previous result)."""
+        return [self.apply_content_change(change) for change in changes]
+
+    def token_at(self, offset: int) -> Optional[int]:
+        """Index of the token covering a byte offset, or None."""
+        idx = bisect.bisect_right(self._token_starts(), offset) - 1
+        if 0 <= idx < len(self.tokens) and self.tokens[idx]['start_byte'] <= offset < self.tokens[idx]['end_byte']:
+            return idx
+        return None
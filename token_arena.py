@@ -0,0 +1,93 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Arena - Compact in-memory storage of a document's tokens
+
+A list of span dicts costs a dict and several int objects per token
+(~250 bytes). TokenArena keeps one document in a few contiguous buffers
+instead:
+
+  data      the document bytes, which all token texts are slices of
+  ids       array('q'), -1 for tokens without an id
+  starts    array('q') byte offsets
+  ends      array('q') byte offsets
+  partial   bytearray of 0/1 flags
+
+about 25 bytes per token plus the text, and no per-token objects for the
+garbage collector to track. Tokens are read through accessors (id, span,
+bytes, text, partial) or materialized as span dicts in the token_spans
+format on demand, so callers never depend on the layout.
+"""
+
+from array import array
+from typing import Dict, Iterable, Iterator, List, Optional, Tuple
+
+from token_spans import compute_token_spans, encode_source
+
+
+class TokenArena:
+    """One document's tokens in contiguous arrays."""
+
+    __slots__ = ('data', 'ids', 'starts', 'ends', 'partial')
+
+    def __init__(self, data: bytes, spans: Iterable[Dict] = ()):
+        self.data = bytes(data)
+        self.ids = array('q')
+        self.starts = array('q')
+        self.ends = array('q')
+        self.partial = bytearray()
+        for span in spans:
+            self.append(span['id'], span['start_byte'], span['end_byte'], span.get('partial', False))
+
+    @classmethod
+    def from_text(cls, tokenizer, text: str) -> 'TokenArena':
+        spans, _ = compute_token_spans(tokenizer, text)
+        return cls(encode_source(text), spans)
+
+    def append(self, token_id: Optional[int], start: int, end: int, partial: bool = False):
+        if not 0 <= start <= end <= len(self.data):
+            raise ValueError(f"Token span [{start}, {end}) outside the document")
+        self.ids.append(-1 if token_id is None else token_id)
+        self.starts.append(start)
+        self.ends.append(end)
+        self.partial.append(1 if partial else 0)
+
+    def __len__(self) -> int:
+        return len(self.ids)
+
+    def id(self, i: int) -> Optional[int]:
+        token_id = self.ids[i]
+        return None if token_id < 0 else token_id
+
+    def span(self, i: int) -> Tuple[int, int]:
+        return self.starts[i], self.ends[i]
+
+    def bytes(self, i: int) -> bytes:
+        return self.data[self.starts[i]:self.ends[i]]
+
+    def text(self, i: int) -> str:
+        """Token text; bytes of a partial character are escaped as \\xNN."""
+        return self.bytes(i).decode('utf-8', errors='backslashreplace')
+
+    def is_partial(self, i: int) -> bool:
+        return bool(self.partial[i])
+
+    def __getitem__(self, i: int) -> Dict:
+        """Token i as a token_spans span dict."""
+        return {'id': self.id(i), 'start_byte': self.starts[i], 'end_byte': self.ends[i],
+                'partial': bool(self.partial[i])}
+
+    def __iter__(self) -> Iterator[Dict]:
+        return (self[i] for i in range(len(self)))
+
+    def to_spans(self) -> List[Dict]:
+        return list(self)
+
+    def token_ids(self) -> List[Optional[int]]:
+        return [self.id(i) for i in range(len(self))]
+
+    @property
+    def nbytes(self) -> int:
+        """Bytes held by the buffers (text included)."""
+        return (len(self.data) + len(self.partial)
+                + (len(self.ids) + len(self.starts) + len(self.ends)) * self.ids.itemsize)
@@ -0,0 +1,84 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Bytes - The raw bytes each token ID stands for
+
+Decoding token IDs one at a time through tokenizer.decode loses bytes: a
+token holding half of a UTF-8 character decodes to U+FFFD. TokenBytes
+recovers the exact bytes from the token piece instead:
+- byte-fallback pieces ('<0xE4>') are that byte
+- byte-level BPE pieces (GPT-2 style, 'Ġhello') map back through the
+  byte-to-unicode alphabet
+- SentencePiece pieces ('▁hello') use a space for '▁'
+- anything else falls back to tokenizer.decode([id])
+
+Special tokens decode to their text. Results are cached per ID.
+"""
+
+from typing import Dict, List, Optional
+
+from token_spans import BYTE_FALLBACK_PATTERN
+
+
+def _byte_level_alphabet() -> Dict[str, int]:
+    """GPT-2's reversible byte -> printable character table, inverted."""
+    printable = list(range(ord('!'), ord('~') + 1)) + list(range(ord('¡'), ord('¬') + 1)) \
+        + list(range(ord('®'), ord('ÿ') + 1))
+    codes = printable[:]
+    extra = 0
+    for b in range(256):
+        if b not in printable:
+            printable.append(b)
+            codes.append(256 + extra)
+            extra += 1
+    return {chr(c): b for b, c in zip(printable, codes)}
+
+
+# Printable character -> byte of byte-level BPE vocabularies (GPT-2 and descendants)
+BYTE_LEVEL_ALPHABET = _byte_level_alphabet()
+
+
+def is_byte_level(tokenizer) -> bool:
+    """Whether the tokenizer's vocabulary spells bytes with BYTE_LEVEL_ALPHABET."""
+    if getattr(tokenizer, 'byte_decoder', None):
+        return True
+    backend = getattr(tokenizer, 'backend_tokenizer', None)
+    decoder = getattr(backend, 'decoder', None)
+    return decoder is not None and type(decoder).__name__ == 'ByteLevel'
+
+
+class TokenBytes:
+    """Cached token ID -> bytes lookup for one tokenizer."""
+
+    def __init__(self, tokenizer):
+        self.tokenizer = tokenizer
+        self.byte_level = is_byte_level(tokenizer)
+        self.special_ids = set(getattr(tokenizer, 'all_special_ids', None) or ())
+        self._cache: Dict[int, bytes] = {}
+
+    def __call__(self, token_id: int) -> bytes:
+        cached = self._cache.get(token_id)
+        if cached is None:
+            cached = self._cache[token_id] = self._lookup(token_id)
+        return cached
+
+    def _lookup(self, token_id: int) -> bytes:
+        piece: Optional[str] = None
+        if token_id not in self.special_ids:
+            try:
+                piece = self.tokenizer.convert_ids_to_tokens(token_id)
+            except Exception:
+                piece = None
+        if isinstance(piece, str):
+            match = BYTE_FALLBACK_PATTERN.match(piece)
+            if match:
+                return bytes([int(match.group(1), 16)])
+            if self.byte_level and all(ch in BYTE_LEVEL_ALPHABET for ch in piece):
+                return bytes(BYTE_LEVEL_ALPHABET[ch] for ch in piece)
+            if '▁' in piece:
+                return piece.replace('▁', ' ').encode('utf-8')
+        return self.tokenizer.decode([token_id], clean_up_tokenization_spaces=False).encode('utf-8')
+
+    def join(self, ids: List[int]) -> bytes:
+        """Bytes of a token ID sequence."""
+        return b''.join(self(token_id) for token_id in ids)
@@ -0,0 +1,126 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Diff - Token-level differences between two versions of a document
+
+The token streams of both versions are aligned (difflib, tokens compared by
+id and bytes) and reported as runs:
+
+  {'op': 'equal' | 'delete' | 'insert',
+   'old_tokens': [i1, i2], 'new_tokens': [j1, j2],
+   'old_bytes': [s1, e1], 'new_bytes': [s2, e2],
+   'old_text': ..., 'new_text': ...}
+
+Byte ranges refer to the files on disk. A replaced region is reported as a
+delete run followed by an insert run at the same position; empty ranges
+mark the position in the other version.
+
+diff_spans compares token streams computed elsewhere (e.g. read back from
+a token stream file); streams with different encoder fingerprints are
+refused (encoder_registry.EncoderMismatchError). Results carry the
+fingerprint as 'encoder'.
+"""
+
+import difflib
+from pathlib import Path
+from typing import Dict, List, Optional, Union
+
+from encoder_registry import check_fingerprints, fingerprint_of
+from source_text import read_source
+from token_spans import compute_token_spans, encode_source
+
+
+def _token_keys(spans: List[Dict], code_bytes: bytes) -> List[tuple]:
+    return [(s['id'], code_bytes[s['start_byte']:s['end_byte']]) for s in spans]
+
+
+def _byte_range(spans: List[Dict], start: int, end: int, length: int,
+                byte_map: Optional[List[int]]) -> List[int]:
+    if start < end:
+        lo, hi = spans[start]['start_byte'], spans[end - 1]['end_byte']
+    else:
+        lo = hi = spans[start]['start_byte'] if start < len(spans) else length
+    if byte_map is not None:
+        lo, hi = byte_map[lo], byte_map[hi]
+    return [lo, hi]
+
+
+def diff_token_streams(old_text: str, new_text: str, tokenizer,
+                       old_byte_map: Optional[List[int]] = None,
+                       new_byte_map: Optional[List[int]] = None) -> Dict:
+    """Diff the token streams of two texts; returns {'runs', 'summary', 'encoder'}."""
+    old_spans, _ = compute_token_spans(tokenizer, old_text)
+    new_spans, _ = compute_token_spans(tokenizer, new_text)
+    fingerprint = fingerprint_of(tokenizer)
+    return diff_spans(old_text, old_spans, new_text, new_spans, old_byte_map, new_byte_map,
+                      fingerprint, fingerprint)
+
+
+def diff_spans(old_text: str, old_spans: List[Dict], new_text: str, new_spans: List[Dict],
+               old_byte_map: Optional[List[int]] = None, new_byte_map: Optional[List[int]] = None,
+               old_fingerprint: Optional[str] = None, new_fingerprint: Optional[str] = None) -> Dict:
+    """Diff two token streams of the same encoder; returns {'runs', 'summary', 'encoder'}."""
+    encoder = check_fingerprints(old_fingerprint, new_fingerprint)
+    old_bytes, new_bytes = encode_source(old_text), encode_source(new_text)
+    matcher = difflib.SequenceMatcher(None, _token_keys(old_spans, old_bytes),
+                                      _token_keys(new_spans, new_bytes), autojunk=False)
+
+    def _run(op: str, i1: int, i2: int, j1: int, j2: int) -> Dict:
+        ob = _byte_range(old_spans, i1, i2, len(old_bytes), None)
+        nb = _byte_range(new_spans, j1, j2, len(new_bytes), None)
+        return {
+            'op': op,
+            'old_tokens': [i1, i2],
+            'new_tokens': [j1, j2],
+            'old_bytes': _byte_range(old_spans, i1, i2, len(old_bytes), old_byte_map),
+            'new_bytes': _byte_range(new_spans, j1, j2, len(new_bytes), new_byte_map),
+            'old_text': old_bytes[ob[0]:ob[1]].decode('utf-8', errors='replace'),
+            'new_text': new_bytes[nb[0]:nb[1]].decode('utf-8', errors='replace'),
+        }
+
+    runs = []
+    for tag, i1, i2, j1, j2 in matcher.get_opcodes():
+        if tag == 'equal':
+            runs.append(_run('equal', i1, i2, j1, j2))
+            continue
+        if i2 > i1:
+            runs.append(_run('delete', i1, i2, j1, j1))
+        if j2 > j1:
+            runs.append(_run('insert', i2, i2, j1, j2))
+
+    summary = {
+        'old_tokens': len(old_spans),
+        'new_tokens': len(new_spans),
+        'equal': sum(r['old_tokens'][1] - r['old_tokens'][0] for r in runs if r['op'] == 'equal'),
+        'deleted': sum(r['old_tokens'][1] - r['old_tokens'][0] for r in runs if r['op'] == 'delete'),
+        'inserted': sum(r['new_tokens'][1] - r['new_tokens'][0] for r in runs if r['op'] == 'insert'),
+    }
+    return {'runs': runs, 'summary': summary, 'encoder': encoder}
+
+
+def diff_files(tokenizer, old_path: Union[str, Path], new_path: Union[str, Path],
+               encoding: str = 'auto', invalid_utf8: str = 'replace') -> Dict:
+    """Token diff of two files; byte ranges refer to each file on disk."""
+    old_text, old_map = read_source(old_path, invalid_utf8, encoding)
+    new_text, new_map = read_source(new_path, invalid_utf8, encoding)
+    result = diff_token_streams(old_text, new_text, tokenizer, old_map, new_map)
+    result['old_path'] = str(old_path)
+    result['new_path'] = str(new_path)
+    return result
+
+
+def print_token_diff(result: Dict, show_equal: bool = False):
+    """Print the changed runs ('-' deleted, '+' inserted) and a summary."""
+    summary = result['summary']
+    print(f"--- {result.get('old_path', 'old')}  ({summary['old_tokens']} tokens)")
+    print(f"+++ {result.get('new_path', 'new')}  ({summary['new_tokens']} tokens)")
+    for run in result['runs']:
+        if run['op'] == 'equal':
+            if show_equal:
+                print(f"  tokens {run['old_tokens']} = {run['new_tokens']}  {run['new_text']!r}")
+            continue
+        if run['op'] == 'delete':
+            print(f"- tokens {run['old_tokens']} bytes {run['old_bytes']}  {run['old_text']!r}")
+        else:
+            print(f"+ tokens {run['new_tokens']} bytes {run['new_bytes']}  {run['new_text']!r}")
+    print(f"{summary['equal']} equal, {summary['deleted']} deleted, {summary['inserted']} inserted tokens")
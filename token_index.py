@@ -0,0 +1,77 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Index - O(log n) byte-range queries over a token span list
+
+TokenIndex keeps token starts and ends in two compact arrays and answers:
+- overlapping(a, b)   token range [i, j) of tokens overlapping bytes [a, b)
+- covering(a, b)      token range of tokens lying entirely inside [a, b)
+- byte_range(i, j)    bytes [start, end) covered by tokens [i, j)
+- token_at(offset)    index of the token containing a byte offset
+
+Spans come from token_spans.compute_token_spans: sorted, with non-
+decreasing start and end offsets. A zero-width token (start == end)
+overlaps a range only when it sits strictly inside it.
+"""
+
+import bisect
+from array import array
+from typing import Dict, Iterable, Optional, Tuple
+
+
+class TokenIndex:
+    """Immutable interval index over token byte spans."""
+
+    def __init__(self, spans: Iterable[Dict]):
+        self.starts = array('q')
+        self.ends = array('q')
+        prev_start = prev_end = 0
+        for i, span in enumerate(spans):
+            start, end = span['start_byte'], span['end_byte']
+            if start < prev_start or end < prev_end or end < start:
+                raise ValueError(f"Token {i} [{start}, {end}) is out of order")
+            self.starts.append(start)
+            self.ends.append(end)
+            prev_start, prev_end = start, end
+
+    def __len__(self) -> int:
+        return len(self.starts)
+
+    def overlapping(self, start: int, end: int) -> Tuple[int, int]:
+        """Token range [i, j) overlapping bytes [start, end).
+
+        An empty range selects the token(s) containing that position.
+        """
+        if end < start:
+            raise ValueError(f"Invalid byte range [{start}, {end})")
+        lo = bisect.bisect_right(self.ends, start)
+        if start == end:
+            hi = bisect.bisect_right(self.starts, start)
+        else:
+            hi = bisect.bisect_left(self.starts, end)
+        return lo, max(lo, hi)
+
+    def covering(self, start: int, end: int) -> Tuple[int, int]:
+        """Token range [i, j) of the tokens inside bytes [start, end)."""
+        if end < start:
+            raise ValueError(f"Invalid byte range [{start}, {end})")
+        lo = bisect.bisect_left(self.starts, start)
+        hi = bisect.bisect_right(self.ends, end)
+        return lo, max(lo, hi)
+
+    def byte_range(self, i: int, j: int) -> Tuple[int, int]:
+        """Bytes [start, end) covered by tokens [i, j); empty ranges sit at token i."""
+        n = len(self.starts)
+        if not (0 <= i <= j <= n):
+            raise IndexError(f"Token range [{i}, {j}) outside 0..{n}")
+        if i == j:
+            pos = self.starts[i] if i < n else (self.ends[n - 1] if n else 0)
+            return pos, pos
+        return self.starts[i], self.ends[j - 1]
+
+    def token_at(self, offset: int) -> Optional[int]:
+        """Index of the non-empty token containing offset, or None."""
+        i = bisect.bisect_right(self.ends, offset)
+        if i < len(self.starts) and self.starts[i] <= offset < self.ends[i]:
+            return i
+        return None
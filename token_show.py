@@ -0,0 +1,131 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Show - Source text with token boundaries highlighted in the terminal
+
+Each token gets a background color, alternating between two so neighbors
+stay distinguishable; characters shared by several tokens (byte-level
+splits of one UTF-8 character) get a third. A gutter shows the line number
+and how many tokens start on the line:
+
+     12   7 │ def parse(data):
+
+Lines wider than the terminal wrap under a blank gutter. Wide East Asian
+characters count as two columns and combining marks as none, so wrapping
+matches what the terminal draws. Without color (--color never, or output
+that is not a terminal) token boundaries are marked with '¦' instead.
+"""
+
+import bisect
+import shutil
+import sys
+import unicodedata
+from typing import Iterator, List, Optional, Tuple
+
+from token_spans import build_char_to_byte, coalesce_partial_spans, compute_token_spans, encode_source
+
+BACKGROUNDS = ('\033[48;5;24m', '\033[48;5;58m')
+SHARED_BACKGROUND = '\033[48;5;88m'
+RESET = '\033[0m'
+SEPARATOR = '¦'
+WHITESPACE_MARKS = {' ': '·', '\t': '→', '\n': '↵'}
+
+
+def char_width(ch: str) -> int:
+    """Terminal columns of a character: 2 for wide/fullwidth, 0 for combining marks."""
+    if unicodedata.combining(ch):
+        return 0
+    return 2 if unicodedata.east_asian_width(ch) in ('W', 'F') else 1
+
+
+def _display(ch: str, column: int, tab_size: int, show_whitespace: bool) -> Tuple[str, int]:
+    """Printable form of a character at a column, and its width."""
+    if ch == '\t':
+        width = tab_size - column % tab_size
+        return ('→' + ' ' * (width - 1) if show_whitespace else ' ' * width), width
+    if show_whitespace and ch in WHITESPACE_MARKS:
+        return WHITESPACE_MARKS[ch], 1
+    if '\udc80' <= ch <= '\udcff':
+        return '\ufffd', 1
+    if ord(ch) < 0x20 or ord(ch) == 0x7F:
+        return chr(0x2400 + ord(ch)) if ord(ch) < 0x20 else '␡', 1
+    return ch, char_width(ch)
+
+
+def render(tokenizer, text: str, color: bool = True, width: Optional[int] = None,
+           lines: Optional[Tuple[int, int]] = None, tab_size: int = 4,
+           show_whitespace: bool = False) -> Iterator[str]:
+    """Yield the highlighted output lines; lines is an inclusive 1-based range."""
+    spans, _ = compute_token_spans(tokenizer, text)
+    units = coalesce_partial_spans(spans, encode_source(text))
+    char_to_byte = build_char_to_byte(text)
+    # Owning unit of every character, -1 where no token covers it
+    owner = [-1] * len(text)
+    for u, unit in enumerate(units):
+        lo = bisect.bisect_left(char_to_byte, unit['start_byte'])
+        hi = bisect.bisect_left(char_to_byte, unit['end_byte'])
+        for i in range(lo, min(hi, len(text))):
+            owner[i] = u
+    # Units are in file order: tokens starting on a line are a difference of prefix sums
+    unit_starts = [unit['start_byte'] for unit in units]
+    tokens_before = [0]
+    for unit in units:
+        tokens_before.append(tokens_before[-1] + len(unit['token_indices']))
+
+    source_lines = text.split('\n')
+    if len(source_lines) > 1 and not source_lines[-1]:
+        source_lines.pop()  # No empty line after a final newline
+    first, last = lines if lines else (1, len(source_lines))
+    number_width = len(str(len(source_lines)))
+    gutter_width = number_width + 7
+    width = width or shutil.get_terminal_size().columns
+    available = max(10, width - gutter_width)
+    starts: List[int] = [0]
+    for line in source_lines[:-1]:
+        starts.append(starts[-1] + len(line) + 1)
+
+    for number in range(max(1, first), min(last, len(source_lines)) + 1):
+        line_start = starts[number - 1]
+        line_end = line_start + len(source_lines[number - 1])
+        line_bytes = (char_to_byte[line_start], char_to_byte[min(line_end + 1, len(text))])
+        count = (tokens_before[bisect.bisect_left(unit_starts, line_bytes[1])]
+                 - tokens_before[bisect.bisect_left(unit_starts, line_bytes[0])])
+        out = [f"{number:>{number_width}} {count:>3} │ "]
+        column = 0
+        current = None
+        # The newline belongs to the line it ends
+        for i in range(line_start, min(line_end + 1, len(text))):
+            ch = text[i]
+            if ch == '\n' and not show_whitespace:
+                break
+            piece, w = _display(ch, column, tab_size, show_whitespace)
+            if column + w > available and column > 0:
+                out.append(RESET if color and current is not None and current >= 0 else '')
+                yield ''.join(out)
+                out = [' ' * (gutter_width - 2) + '│ ']
+                column = 0
+                piece, w = _display(ch, column, tab_size, show_whitespace)
+                current = None
+            if owner[i] != current:
+                if color:
+                    if current is not None and current >= 0:
+                        out.append(RESET)
+                    if owner[i] >= 0:
+                        unit = units[owner[i]]
+                        out.append(SHARED_BACKGROUND if len(unit['token_indices']) > 1 else BACKGROUNDS[owner[i] % 2])
+                elif current is not None:
+                    out.append(SEPARATOR)
+                current = owner[i]
+            out.append(piece)
+            column += w
+        if color and current is not None and current >= 0:
+            out.append(RESET)
+        yield ''.join(out)
+
+
+def show(tokenizer, text: str, color: Optional[bool] = None, **options):
+    """Print the highlighted text; color defaults to whether stdout is a terminal."""
+    if color is None:
+        color = sys.stdout.isatty()
+    for line in render(tokenizer, text, color=color, **options):
+        print(line)
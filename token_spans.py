@@ -0,0 +1,253 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Span Helpers - Map tokenizer output to UTF-8 byte spans
+
+Each span is a dict with 'id', 'start_byte', 'end_byte' and 'partial'.
+A span is partial when it covers only part of a UTF-8 sequence, which
+happens with byte-fallback tokenizers (Llama-style '<0xE4>' tokens) on
+CJK text and emoji.
+"""
+
+import re
+from itertools import compress
+from typing import Dict, List, Optional, Tuple
+
+import tracing
+from position_index import COLUMN_UNITS
+
+# Byte-fallback token pieces look like '<0xE4>'
+BYTE_FALLBACK_PATTERN = re.compile(r'^<0x([0-9A-Fa-f]{2})>$')
+
+# Malformed bytes kept by the 'raw' invalid UTF-8 policy (see source_text.py)
+ESCAPED_BYTE_PATTERN = re.compile('[\udc80-\udcff]')
+
+# Offset unit -> suffix of the span/rule keys holding offsets in that unit
+UNIT_KEYS = {'utf16': 'utf16', 'codepoints': 'codepoint'}
+
+# Byte -> 1 if a UTF-8 character can start there, 0 for continuation bytes
+_CHAR_START_TABLE = bytes(0 if 0x80 <= b < 0xC0 else 1 for b in range(256))
+
+
+def encode_source(code: str) -> bytes:
+    """Encode text to the bytes offsets refer to (escaped raw bytes round-trip)."""
+    return code.encode('utf-8', 'surrogateescape')
+
+
+def build_char_to_byte(code: str) -> List[int]:
+    """Build a char index -> UTF-8 byte offset mapping (len(code) + 1 entries)."""
+    if code.isascii():
+        return list(range(len(code) + 1))
+    if not ESCAPED_BYTE_PATTERN.search(code):
+        # Characters start at every byte that is not a continuation byte;
+        # translate + compress keep the scan in C
+        data = code.encode('utf-8')
+        char_to_byte = list(compress(range(len(data)), data.translate(_CHAR_START_TABLE)))
+        char_to_byte.append(len(data))
+        return char_to_byte
+    # Escaped raw bytes encode to lone continuation bytes: walk the characters
+    char_to_byte = [0] * (len(code) + 1)
+    bpos = 0
+    for i, ch in enumerate(code):
+        char_to_byte[i] = bpos
+        bpos += len(ch.encode('utf-8', 'surrogateescape'))
+    char_to_byte[len(code)] = bpos
+    return char_to_byte
+
+
+def build_byte_to_unit(code: str, unit: str) -> List[int]:
+    """Map every byte offset of encode_source(code) to a 'utf16' or 'codepoints' index.
+
+    Bytes inside a character map to the character's own index; the list has
+    one entry per byte plus the end. Escaped raw bytes count as one unit.
+    """
+    if unit not in ('utf16', 'codepoints'):
+        raise ValueError(f"Unknown offset unit: {unit}")
+    if code.isascii():
+        return list(range(len(code) + 1))
+    index: List[int] = []
+    pos = 0
+    for ch in code:
+        index.extend([pos] * len(ch.encode('utf-8', 'surrogateescape')))
+        pos += 2 if unit == 'utf16' and ord(ch) > 0xFFFF else 1
+    index.append(pos)
+    return index
+
+
+def is_char_boundary(code_bytes: bytes, pos: int) -> bool:
+    """True if pos does not fall inside a UTF-8 sequence."""
+    if pos <= 0 or pos >= len(code_bytes):
+        return True
+    return (code_bytes[pos] & 0xC0) != 0x80
+
+
+def _byte_fallback_flags(tokenizer, ids: List[int]) -> List[bool]:
+    """Flag which token ids are byte-fallback pieces ('<0xNN>')."""
+    try:
+        pieces = tokenizer.convert_ids_to_tokens(ids)
+    except Exception:
+        return [False] * len(ids)
+    return [bool(p and BYTE_FALLBACK_PATTERN.match(str(p))) for p in pieces]
+
+
+@tracing.traced('encode',
+                before=lambda a: {'encoder': tracing.encoder_name(a['tokenizer'])},
+                after=lambda result, a: {'bytes': len(encode_source(a['code'])), 'tokens': len(result[0]),
+                                         'token_source': result[1]})
+def compute_token_spans(tokenizer, code: str, offset_unit: str = 'bytes') -> Tuple[List[Dict], str]:
+    """Tokenize code and return (spans, token_source).
+
+    Prefers the fast tokenizer offset_mapping; falls back to a heuristic
+    byte search over decoded tokens, and finally to single-byte spans.
+    Byte-fallback tokens report the byte they stand for inside their
+    character and are flagged partial. With offset_unit 'utf16' or
+    'codepoints' spans also carry start_/end_utf16 or start_/end_codepoint.
+    """
+    if offset_unit not in COLUMN_UNITS:
+        raise ValueError(f"Unknown offset unit: {offset_unit}")
+    code_bytes = encode_source(code)
+    # Tokenizers reject lone surrogates; U+FFFD keeps char offsets unchanged
+    tokenizer_text = ESCAPED_BYTE_PATTERN.sub('\ufffd', code)
+    spans: List[Dict] = []
+    token_source = 'offset_mapping'
+    try:
+        encoding = tokenizer(
+            tokenizer_text,
+            add_special_tokens=False,
+            return_offsets_mapping=True
+        )
+        offsets = encoding.get('offset_mapping')
+        if offsets is None:
+            raise ValueError('offset_mapping not available')
+        ids = list(encoding.get('input_ids') or [])
+        if len(ids) != len(offsets):
+            ids = [None] * len(offsets)
+        byte_fallback = _byte_fallback_flags(tokenizer, ids) if None not in ids else [False] * len(ids)
+
+        char_to_byte = build_char_to_byte(code)
+
+        prev_fallback_span = None
+        for token_id, pair, is_fallback in zip(ids, offsets, byte_fallback):
+            if not isinstance(pair, (list, tuple)) or len(pair) != 2:
+                continue
+            s, e = pair
+            if s is None or e is None:
+                continue
+            if e <= s:
+                # Some tokenizers give trailing byte tokens of a character an empty
+                # offset; they still belong to the character of the previous byte.
+                if is_fallback and prev_fallback_span is not None:
+                    s, e = prev_fallback_span
+                else:
+                    continue
+            s = max(0, min(s, len(code)))
+            e = max(0, min(e, len(code)))
+            sb, eb = char_to_byte[s], char_to_byte[e]
+            if eb <= sb:
+                continue
+
+            if is_fallback:
+                # Consecutive byte tokens of one character share its char span;
+                # hand them out one byte at a time.
+                if prev_fallback_span == (s, e) and spans and sb <= spans[-1]['end_byte'] < eb:
+                    sb = spans[-1]['end_byte']
+                byte_end = min(sb + 1, eb)
+                spans.append({
+                    'id': token_id,
+                    'start_byte': sb,
+                    'end_byte': byte_end,
+                    'partial': not (is_char_boundary(code_bytes, sb) and is_char_boundary(code_bytes, byte_end))
+                })
+                prev_fallback_span = (s, e)
+            else:
+                spans.append({'id': token_id, 'start_byte': sb, 'end_byte': eb, 'partial': False})
+                prev_fallback_span = None
+    except Exception:
+        # Fallback: heuristic byte-search per token id (less reliable across tokenizers)
+        tokens = tokenizer.encode(tokenizer_text, add_special_tokens=False)
+        token_texts = [tokenizer.decode([token], clean_up_tokenization_spaces=False) for token in tokens]
+        token_source = 'heuristic_decode'
+        spans = []
+        current_pos = 0
+        for token_id, token_text in zip(tokens, token_texts):
+            token_bytes = token_text.encode('utf-8')
+            token_start = -1
+            if token_bytes.strip():
+                token_start = code_bytes.find(token_bytes, current_pos)
+            if token_start != -1:
+                token_end = token_start + len(token_bytes)
+            else:
+                token_start = current_pos
+                token_end = min(current_pos + 1, len(code_bytes))
+            spans.append({
+                'id': token_id,
+                'start_byte': token_start,
+                'end_byte': token_end,
+                'partial': not (is_char_boundary(code_bytes, token_start) and is_char_boundary(code_bytes, token_end))
+            })
+            current_pos = token_end
+
+    # Safety fallback: if still empty, degrade to single-byte spans to avoid crashes
+    if not spans:
+        token_source = 'single_byte_fallback'
+        spans = [
+            {'id': None, 'start_byte': i, 'end_byte': i + 1,
+             'partial': not (is_char_boundary(code_bytes, i) and is_char_boundary(code_bytes, i + 1))}
+            for i in range(len(code_bytes))
+        ]
+
+    if offset_unit != 'bytes':
+        byte_to_unit = build_byte_to_unit(code, offset_unit)
+        key = UNIT_KEYS[offset_unit]
+        for span in spans:
+            span[f'start_{key}'] = byte_to_unit[span['start_byte']]
+            span[f'end_{key}'] = byte_to_unit[span['end_byte']]
+
+    return spans, token_source
+
+
+def coalesce_partial_spans(spans: List[Dict], code_bytes: bytes) -> List[Dict]:
+    """Merge runs of consecutive partial spans into whole-character spans.
+
+    Each output entry carries 'token_indices' listing the input spans it
+    covers. Complete spans pass through unchanged; a run that never reaches
+    a character boundary (truncated input) is emitted as-is and stays partial.
+    """
+    merged: List[Dict] = []
+    pending: Optional[Dict] = None
+
+    for idx, span in enumerate(spans):
+        if not span.get('partial'):
+            if pending is not None:
+                merged.append(pending)
+                pending = None
+            merged.append({
+                'start_byte': span['start_byte'],
+                'end_byte': span['end_byte'],
+                'token_indices': [idx],
+                'partial': False
+            })
+            continue
+
+        if pending is not None and span['start_byte'] != pending['end_byte']:
+            merged.append(pending)
+            pending = None
+        if pending is None:
+            pending = {
+                'start_byte': span['start_byte'],
+                'end_byte': span['end_byte'],
+                'token_indices': [idx],
+                'partial': True
+            }
+        else:
+            pending['end_byte'] = span['end_byte']
+            pending['token_indices'].append(idx)
+
+        if is_char_boundary(code_bytes, pending['start_byte']) and is_char_boundary(code_bytes, pending['end_byte']):
+            pending['partial'] = False
+            merged.append(pending)
+            pending = None
+
+    if pending is not None:
+        merged.append(pending)
+    return merged
@@ -0,0 +1,204 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Stream Format - Compact binary encoding of token spans
+
+Layout:
+  header   b'TOKS' + version (1 byte) + flags (1 byte; bit 0 = zstd payload)
+           + varint len(fingerprint) + encoder fingerprint (version 2; empty
+             when unknown)
+  payload  a sequence of documents, zstd-compressed as one frame when flagged:
+             varint len(name) + UTF-8 name
+             varint token count
+             per token: zigzag varint (id - previous id)      (None is -1)
+                        zigzag varint (start - previous end)
+                        varint ((end - start) << 1 | partial)
+
+Offsets are UTF-8 byte offsets as in token_spans. Consecutive tokens
+usually touch, so the start delta is 0 and most fields fit in one byte:
+roughly 3-4 bytes per token before compression versus ~60 in JSON.
+
+zstd needs the 'zstandard' package (imported only when used). Readers
+accept version 1 streams, which have no fingerprint. A reader given the
+expected fingerprint refuses a stream written by a different encoder.
+"""
+
+import io
+import json
+from typing import BinaryIO, Dict, Iterator, List, Optional, Tuple
+
+from encoder_registry import check_fingerprints
+
+MAGIC = b'TOKS'
+VERSION = 2
+SUPPORTED_VERSIONS = (1, 2)
+FLAG_ZSTD = 0x01
+
+
+class TokenStreamError(ValueError):
+    """Raised for malformed or unsupported token streams."""
+
+
+def _zstd():
+    try:
+        import zstandard
+    except ImportError:
+        raise TokenStreamError("zstd token streams need the 'zstandard' package (pip install zstandard)")
+    return zstandard
+
+
+def write_varint(out: bytearray, value: int):
+    """Append an unsigned LEB128 varint."""
+    while value > 0x7F:
+        out.append((value & 0x7F) | 0x80)
+        value >>= 7
+    out.append(value)
+
+
+def zigzag(value: int) -> int:
+    return -2 * value - 1 if value < 0 else 2 * value
+
+
+def unzigzag(value: int) -> int:
+    return (value >> 1) ^ -(value & 1)
+
+
+def read_varint(data: bytes, pos: int) -> Tuple[int, int]:
+    """Decode a varint at pos; returns (value, next position)."""
+    result = 0
+    shift = 0
+    while True:
+        if pos >= len(data):
+            raise TokenStreamError("Truncated varint")
+        b = data[pos]
+        pos += 1
+        result |= (b & 0x7F) << shift
+        if not b & 0x80:
+            return result, pos
+        shift += 7
+
+
+def encode_document(name: str, spans: List[Dict]) -> bytes:
+    """Encode one document's token spans (without the stream header)."""
+    out = bytearray()
+    name_bytes = name.encode('utf-8')
+    write_varint(out, len(name_bytes))
+    out += name_bytes
+    write_varint(out, len(spans))
+    prev_id = 0
+    prev_end = 0
+    for span in spans:
+        token_id = -1 if span['id'] is None else span['id']
+        write_varint(out, zigzag(token_id - prev_id))
+        write_varint(out, zigzag(span['start_byte'] - prev_end))
+        write_varint(out, ((span['end_byte'] - span['start_byte']) << 1) | (1 if span.get('partial') else 0))
+        prev_id = token_id
+        prev_end = span['end_byte']
+    return bytes(out)
+
+
+def decode_documents(payload: bytes) -> Iterator[Tuple[str, List[Dict]]]:
+    """Decode the documents of an uncompressed payload."""
+    pos = 0
+    while pos < len(payload):
+        name_len, pos = read_varint(payload, pos)
+        name = payload[pos:pos + name_len].decode('utf-8')
+        pos += name_len
+        count, pos = read_varint(payload, pos)
+        spans = []
+        prev_id = 0
+        prev_end = 0
+        for _ in range(count):
+            delta_id, pos = read_varint(payload, pos)
+            delta_start, pos = read_varint(payload, pos)
+            packed, pos = read_varint(payload, pos)
+            token_id = prev_id + unzigzag(delta_id)
+            start = prev_end + unzigzag(delta_start)
+            end = start + (packed >> 1)
+            spans.append({
+                'id': None if token_id == -1 else token_id,
+                'start_byte': start,
+                'end_byte': end,
+                'partial': bool(packed & 1),
+            })
+            prev_id = token_id
+            prev_end = end
+        yield name, spans
+
+
+class TokenStreamWriter:
+    """Write documents to a binary token stream."""
+
+    def __init__(self, stream: BinaryIO, compress: bool = False, level: int = 3,
+                 fingerprint: Optional[str] = None):
+        self.stream = stream
+        self.compress = compress
+        self.fingerprint = fingerprint
+        zstandard = _zstd() if compress else None
+        header = bytearray(MAGIC + bytes([VERSION, FLAG_ZSTD if compress else 0]))
+        fingerprint_bytes = (fingerprint or '').encode('utf-8')
+        write_varint(header, len(fingerprint_bytes))
+        stream.write(bytes(header + fingerprint_bytes))
+        self._out = stream
+        self._compressor = None
+        if zstandard is not None:
+            self._compressor = zstandard.ZstdCompressor(level=level).stream_writer(stream, closefd=False)
+            self._out = self._compressor
+        self.documents = 0
+        self.tokens = 0
+
+    def write_document(self, name: str, spans: List[Dict]):
+        self._out.write(encode_document(name, spans))
+        self.documents += 1
+        self.tokens += len(spans)
+
+    def close(self):
+        """Finish the stream (flushes the zstd frame); the underlying stream stays open."""
+        if self._compressor is not None:
+            self._compressor.close()
+            self._compressor = None
+        self.stream.flush()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.close()
+
+
+class TokenStreamReader:
+    """Iterate the (name, spans) documents of a binary token stream.
+
+    With fingerprint, a stream recorded by another encoder raises
+    encoder_registry.EncoderMismatchError.
+    """
+
+    def __init__(self, stream: BinaryIO, fingerprint: Optional[str] = None):
+        header = stream.read(len(MAGIC) + 2)
+        if len(header) < len(MAGIC) + 2 or header[:len(MAGIC)] != MAGIC:
+            raise TokenStreamError("Not a token stream")
+        self.version = header[len(MAGIC)]
+        if self.version not in SUPPORTED_VERSIONS:
+            raise TokenStreamError(f"Unsupported token stream version: {self.version}")
+        self.flags = header[len(MAGIC) + 1]
+        payload = stream.read()
+        self.fingerprint = None
+        if self.version >= 2:
+            length, pos = read_varint(payload, 0)
+            self.fingerprint = payload[pos:pos + length].decode('utf-8') or None
+            payload = payload[pos + length:]
+        check_fingerprints(self.fingerprint, fingerprint)
+        if self.flags & FLAG_ZSTD:
+            payload = _zstd().ZstdDecompressor().stream_reader(io.BytesIO(payload)).read()
+        self._payload = payload
+
+    def __iter__(self) -> Iterator[Tuple[str, List[Dict]]]:
+        return decode_documents(self._payload)
+
+    def documents(self) -> Dict[str, List[Dict]]:
+        return dict(iter(self))
+
+
+def json_size(documents: Dict[str, List[Dict]]) -> int:
+    """Size of the same documents as compact JSON, for comparison."""
+    return len(json.dumps(documents, separators=(',', ':')).encode('utf-8'))
@@ -0,0 +1,176 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Token Golden Files - Snapshot tests of tokens and offsets per sample and encoder
+
+A golden file records how one encoder tokenizes one sample input, one token
+per line, so a backend or tokenizer upgrade that shifts a single offset
+shows up as a one-line diff:
+
+  # tokoffset golden v1
+  # file: python/example.py
+  # model: gpt2
+  # encoder: sha256:...
+  # tokens: 1234
+  0	37811	0	3	"\\"\\"\\""
+  1	198	3	4	"\\n"
+
+Columns: token index, id, start byte, end byte, token text (JSON; bytes of
+partial tokens as \\xNN). Golden files live under
+<golden_dir>/<model>/<relative path>.tokens ('/' in model names becomes
+'__'). check_golden compares a sample against its golden file and returns
+a unified diff of the token lines; update_golden rewrites it. run_golden
+does either for every file under a corpus root (code_samples by default),
+or for some files and subdirectories of it, and also reports golden files
+whose sample is gone. Golden paths are always relative to the corpus root.
+"""
+
+import difflib
+import json
+from pathlib import Path
+from typing import Dict, Iterable, List, Optional, Union
+
+from manifest import encoder_fingerprint
+from repo_walker import walk_repository
+from source_text import read_source
+from token_spans import compute_token_spans, encode_source
+
+GOLDEN_HEADER = '# tokoffset golden v1'
+GOLDEN_SUFFIX = '.tokens'
+
+
+def golden_path(golden_dir: Union[str, Path], model: str, rel_path: str) -> Path:
+    return Path(golden_dir) / model.replace('/', '__') / (rel_path + GOLDEN_SUFFIX)
+
+
+def golden_lines(tokenizer, path: Union[str, Path], rel_path: str, model: str,
+                 encoding: str = 'auto', fingerprint: Optional[str] = None) -> List[str]:
+    """Canonical golden file lines for one sample."""
+    text, byte_map = read_source(path, encoding=encoding)
+    code_bytes = encode_source(text)
+    spans, _ = compute_token_spans(tokenizer, text)
+    lines = [
+        GOLDEN_HEADER,
+        f"# file: {rel_path}",
+        f"# model: {model}",
+        f"# encoder: {fingerprint or encoder_fingerprint(tokenizer)}",
+        f"# tokens: {len(spans)}",
+    ]
+    for i, span in enumerate(spans):
+        piece = code_bytes[span['start_byte']:span['end_byte']].decode('utf-8', errors='backslashreplace')
+        start, end = span['start_byte'], span['end_byte']
+        if byte_map is not None:
+            start, end = byte_map[start], byte_map[end]
+        lines.append(f"{i}\t{span['id']}\t{start}\t{end}\t{json.dumps(piece, ensure_ascii=False)}")
+    return lines
+
+
+def _first_difference(expected: List[str], actual: List[str]) -> Optional[str]:
+    for old, new in zip(expected, actual):
+        if old != new:
+            return f"expected {old!r}, got {new!r}"
+    if len(expected) != len(actual):
+        return f"expected {len(expected)} lines, got {len(actual)}"
+    return None
+
+
+def check_golden(tokenizer, path: Union[str, Path], rel_path: str, golden_dir: Union[str, Path],
+                 model: str, encoding: str = 'auto', fingerprint: Optional[str] = None,
+                 context: int = 2) -> Dict:
+    """Compare a sample with its golden file: status 'match', 'mismatch' or 'missing'."""
+    target = golden_path(golden_dir, model, rel_path)
+    result = {'file': rel_path, 'golden': str(target), 'diff': [], 'first_difference': None, 'encoder_changed': False}
+    if not target.exists():
+        return dict(result, status='missing')
+    expected = target.read_text(encoding='utf-8').splitlines()
+    actual = golden_lines(tokenizer, path, rel_path, model, encoding, fingerprint)
+    # The encoder fingerprint is reported separately: it changes with any vocab edit
+    result['encoder_changed'] = expected[3:4] != actual[3:4]
+    expected_body = expected[:3] + expected[4:]
+    actual_body = actual[:3] + actual[4:]
+    if expected_body == actual_body:
+        return dict(result, status='match')
+    result['diff'] = list(difflib.unified_diff(expected_body, actual_body, f"golden/{rel_path}", rel_path,
+                                               n=context, lineterm=''))
+    result['first_difference'] = _first_difference(expected_body, actual_body)
+    return dict(result, status='mismatch')
+
+
+def update_golden(tokenizer, path: Union[str, Path], rel_path: str, golden_dir: Union[str, Path],
+                  model: str, encoding: str = 'auto', fingerprint: Optional[str] = None) -> str:
+    """Write the golden file of a sample: 'written' (new), 'updated' or 'unchanged'."""
+    target = golden_path(golden_dir, model, rel_path)
+    content = '\n'.join(golden_lines(tokenizer, path, rel_path, model, encoding, fingerprint)) + '\n'
+    if not target.exists():
+        status = 'written'
+    elif target.read_text(encoding='utf-8') == content:
+        return 'unchanged'
+    else:
+        status = 'updated'
+    target.parent.mkdir(parents=True, exist_ok=True)
+    target.write_text(content, encoding='utf-8')
+    return status
+
+
+def run_golden(tokenizer, root: Union[str, Path], golden_dir: Union[str, Path], model: str,
+               update: bool = False, encoding: str = 'auto', ignore_patterns=None,
+               paths: Optional[Iterable[Union[str, Path]]] = None) -> List[Dict]:
+    """Check (or update) the golden files of every sample under root.
+
+    paths limits the run to files or subdirectories of the corpus root;
+    orphaned golden files are then only reported inside them.
+    """
+    root = Path(root)
+    base = root if root.is_dir() else root.parent
+    targets = [Path(p) for p in paths] if paths else [root]
+    prefixes = []
+    for target in targets:
+        try:
+            prefix = target.resolve().relative_to(base.resolve()).as_posix()
+        except ValueError:
+            raise ValueError(f"{target} is not inside the corpus {root}")
+        prefixes.append('' if prefix == '.' else prefix)
+    fingerprint = encoder_fingerprint(tokenizer)
+    results = []
+    seen = set()
+    for target, prefix in zip(targets, prefixes):
+        for path in walk_repository(target, ignore_patterns=ignore_patterns):
+            rel = path.relative_to(target).as_posix() if target.is_dir() else ''
+            rel = '/'.join(part for part in (prefix, rel) if part)
+            golden = golden_path(golden_dir, model, rel)
+            if golden in seen:
+                continue
+            seen.add(golden)
+            if update:
+                status = update_golden(tokenizer, path, rel, golden_dir, model, encoding, fingerprint)
+                results.append({'file': rel, 'status': status})
+            else:
+                results.append(check_golden(tokenizer, path, rel, golden_dir, model, encoding, fingerprint))
+    model_dir = Path(golden_dir) / model.replace('/', '__')
+    if model_dir.is_dir() and root.is_dir():
+        for golden in sorted(model_dir.rglob('*' + GOLDEN_SUFFIX)):
+            rel = golden.relative_to(model_dir).as_posix()[:-len(GOLDEN_SUFFIX)]
+            inside = any(not p or rel == p or rel.startswith(p + '/') for p in prefixes)
+            if inside and golden not in seen:
+                results.append({'file': rel, 'golden': str(golden), 'status': 'orphaned'})
+    return results
+
+
+def print_golden_results(results: List[Dict], max_diff_lines: int = 40):
+    """Print mismatches with their diffs, then a status summary."""
+    counts: Dict[str, int] = {}
+    encoder_changed = 0
+    for result in results:
+        counts[result['status']] = counts.get(result['status'], 0) + 1
+        if result['status'] == 'mismatch':
+            print(f"✗ {result['file']}: {result['first_difference']}")
+            for line in result['diff'][:max_diff_lines]:
+                print(f"    {line}")
+            if len(result['diff']) > max_diff_lines:
+                print(f"    ... {len(result['diff']) - max_diff_lines} more diff lines")
+        elif result['status'] in ('missing', 'orphaned'):
+            print(f"✗ {result['file']}: {result['status']} golden file")
+        encoder_changed += bool(result.get('encoder_changed'))
+    if encoder_changed:
+        print(f"Encoder fingerprint differs from {encoder_changed} golden file(s)")
+    print(', '.join(f"{n} {status}" for status, n in sorted(counts.items())))
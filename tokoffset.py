@@ -0,0 +1,1447 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+tokoffset - Token offset command-line tools
+
+Subcommands:
+  lsp-helper   JSON-RPC over stdio for editor extensions (live token counts/boundaries)
+  scan         Per-file and per-directory token summary of a repository
+  stats        Token distributions (per line, length, frequency, per language)
+  classes      Tokens per lexical class (identifier, keyword, string, comment, ...)
+  subwords     How tokens align to camelCase/snake_case identifier sub-words
+  chunk        Split files into token-budget chunks (JSON Lines)
+  resolve      Map chunk IDs back to path, byte/line/token ranges and excerpt
+  chunk-diff   Unchanged/modified/added/removed chunks of edited files vs a manifest
+  race-check   Verify concurrent tokenization matches sequential results
+  pack         Write token spans of files as a compact binary token stream
+  unpack       Read a binary token stream back as JSON Lines
+  export       Token tables (doc, index, id, offsets, class) as Parquet/Arrow
+  index        SQLite inventory of per-file token counts, chunks and spans
+  watch        Retokenize files as they change; stream token counts, keep a manifest live
+  check        Fail when prompt/template files exceed a token budget (pre-commit gate)
+  token-diff   Token-level insert/delete/equal runs between two versions of a file
+  dedup        Near-duplicate chunks via token shingles and MinHash
+  diagnostics  Anchor file:line:col diagnostics (go vet, tsc, ...) to token indices
+  coverage     Token coverage from a Go cover profile (covered/uncovered token ranges)
+  go-ast       Tag Go tokens with their go/ast node kind and declaration (FuncDecl:main)
+  notebook     Per-cell tokens of a Jupyter notebook (cell and raw JSON offsets)
+  markdown     Fenced code blocks of Markdown docs: language, byte span, token range
+  structure    Tokens per JSON/YAML path ($.scores.数学): which keys cost the most tokens
+  bias         Token IDs covering a byte/char span, as a logit_bias map or banned list
+  stop         Replay a file as a token stream and find where stop strings cut it
+  decode       Decode token IDs incrementally into display-safe pieces with byte offsets
+  redact       Mask secrets with fixed-length placeholders, keeping offsets to the original
+  mask         Replace or drop the tokens covering given PII byte ranges, with an audit report
+  golden       Snapshot-test tokens and offsets of a corpus against golden files
+  align        Translate token ranges of one tokenizer to the covering ranges of another
+  bench        Benchmark tokenization throughput over a corpus
+  explain      Show the BPE merge tree behind each token
+  show         Print a file with token boundaries highlighted in the terminal
+  whitespace   Tokens spent on indentation, blank lines and trailing whitespace
+  inject       Tokenize a file with added tokens inserted at byte positions
+  fim          Split a file at a cursor into a fill-in-the-middle prompt within a budget
+  count        Token counts per file for several models
+  report       Token audit of a repository (languages, largest files, offset checks) as JSON/Markdown
+  normalize    Tokenize normalized text (NFKC, lowercase, regex ...) with spans in the original file
+  config       Show the project config file and the defaults it sets
+
+Defaults come from the nearest .tokoffset.yaml / .tokoffset.toml (see
+config.py); flags override them. --config picks a file, --no_config skips it.
+--normalize STEP (repeatable) tokenizes normalized text in every command,
+with spans still in the original file.
+"""
+
+import sys
+import json
+import argparse
+from pathlib import Path
+from typing import Dict, List, Optional
+
+
+def load_tokenizer(model_name: str, normalize: Optional[List[str]] = None):
+    """Load a HuggingFace tokenizer once per process (imported lazily to keep --help fast).
+
+    With normalizer specs (--normalize) it tokenizes normalized text but
+    still reports spans into the original (normalizers.NormalizingEncoder).
+    """
+    from encoder_registry import get_encoder
+    tokenizer = get_encoder(model_name).tokenizer
+    if normalize:
+        from normalizers import NormalizerChain, NormalizingEncoder
+        tokenizer = NormalizingEncoder(tokenizer, NormalizerChain.from_spec(normalize))
+    return tokenizer
+
+
+def cmd_lsp_helper(args) -> int:
+    from limits import RequestLimits
+    from lsp_helper import run_stdio
+    limits = RequestLimits(args.max_request_bytes, args.max_concurrent, args.queue_timeout)
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    metrics = None
+    if args.metrics_port is not None:
+        from metrics import ServiceMetrics, serve_metrics
+        metrics = ServiceMetrics()
+        server = serve_metrics(metrics, args.metrics_port, args.metrics_host)
+        host, port = server.server_address[:2]
+        print(f"Metrics on http://{host}:{port}/metrics", file=sys.stderr)
+    return run_stdio(tokenizer, metrics, limits)
+
+
+def cmd_scan(args) -> int:
+    from repo_walker import print_summary, summarize_repository
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    summary = summarize_repository(tokenizer, args.root, batch_size=args.batch_size, encoding=args.encoding,
+                                   ignore_patterns=args.ignore_patterns)
+    print_summary(summary)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(summary, f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Summary saved to: {args.output}")
+    return 0
+
+
+def cmd_stats(args) -> int:
+    from stats import collect_corpus_stats, print_stats
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    result = collect_corpus_stats(tokenizer, args.paths, top_k=args.top_k, encoding=args.encoding,
+                                  ignore_patterns=args.ignore_patterns)
+    print_stats(result)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(result, f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Statistics saved to: {args.output}")
+    return 0
+
+
+def cmd_classes(args) -> int:
+    from lexical import classify_tokens, load_parser, print_class_summary, summarize_classes
+    from repo_walker import language_for_path
+    from source_text import read_source
+    language = args.language or language_for_path(args.file)
+    if not language:
+        print(f"✗ Cannot infer the language of {args.file}; pass --language")
+        return 2
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, _ = read_source(args.file, encoding=args.encoding)
+    tokens = classify_tokens(tokenizer, load_parser(language), text)
+    summary = summarize_classes(tokens)
+    print_class_summary(summary, args.file)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump({'file': args.file, 'language': language, 'summary': summary, 'tokens': tokens},
+                      f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Token classes saved to: {args.output}")
+    return 0
+
+
+def cmd_subwords(args) -> int:
+    from lexical import lexical_segments, load_parser
+    from repo_walker import language_for_path
+    from source_text import read_source
+    from subwords import align_subwords, print_subword_report
+    from token_spans import encode_source
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, _ = read_source(args.file, encoding=args.encoding)
+    segments = None
+    language = args.language or language_for_path(args.file)
+    if language:
+        try:
+            segments = lexical_segments(load_parser(language).parse(encode_source(text)))
+        except Exception as e:
+            print(f"✗ {language} parser unavailable ({e}); matching identifiers by regex")
+    result = align_subwords(tokenizer, text, segments)
+    print_subword_report(result, args.file)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(dict(result, file=args.file, model=args.model), f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Sub-word alignment saved to: {args.output}")
+    return 0
+
+
+def cmd_chunk(args) -> int:
+    from chunker import chunk_file
+    from encoder_registry import fingerprint_of
+    from manifest import build_manifest, write_manifest
+    from repo_walker import walk_repository
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    root = Path(args.root)
+    base = root if root.is_dir() else root.parent
+    all_chunks = []
+    out = open(args.output, 'w', encoding='utf-8') if args.output else (None if args.manifest else sys.stdout)
+    try:
+        for path in walk_repository(root, ignore_patterns=args.ignore_patterns):
+            for chunk in chunk_file(tokenizer, path, base, args.max_tokens, encoding=args.encoding,
+                                    redact=args.redact):
+                if out is not None:
+                    out.write(json.dumps(chunk, ensure_ascii=False) + '\n')
+                all_chunks.append(chunk)
+    finally:
+        if out is not None and out is not sys.stdout:
+            out.close()
+    if args.output:
+        print(f"📁 {len(all_chunks)} chunks saved to: {args.output}")
+    if args.manifest:
+        manifest = build_manifest(all_chunks, args.model, fingerprint_of(tokenizer), args.max_tokens,
+                                  args.encoding, args.redact)
+        write_manifest(manifest, args.manifest)
+        print(f"📁 Manifest saved to: {args.manifest}")
+    return 0
+
+
+def cmd_resolve(args) -> int:
+    from chunker import ChunkResolver, print_excerpt
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    resolver = ChunkResolver(tokenizer, args.root, args.max_tokens, encoding=args.encoding, redact=args.redact)
+    status = 0
+    for chunk_id in args.chunk_ids:
+        try:
+            location = resolver.resolve(chunk_id)
+        except (KeyError, ValueError) as e:
+            print(f"✗ {e.args[0] if e.args else e}")
+            status = 1
+            continue
+        if args.json:
+            print(json.dumps(location, ensure_ascii=False))
+        else:
+            print_excerpt(location)
+    return status
+
+
+def cmd_chunk_diff(args) -> int:
+    from chunk_diff import apply_file_diffs, diff_file, print_chunk_diff
+    from manifest import ManifestError, load_manifest, write_manifest
+    try:
+        manifest = load_manifest(args.manifest)
+    except (OSError, ManifestError) as e:
+        print(f"✗ Cannot read manifest {args.manifest}: {e}")
+        return 2
+    from encoder_registry import EncoderMismatchError
+    if args.allow_encoder_change and args.update:
+        print("✗ --update cannot mix encoders in one manifest; re-run chunk --manifest instead")
+        return 2
+    tokenizer = load_tokenizer(args.model or manifest['encoder'].get('model') or 'gpt2', args.normalize)
+    diffs = []
+    for path in args.files:
+        try:
+            diff = diff_file(tokenizer, manifest, path, args.root, allow_encoder_change=args.allow_encoder_change,
+                             encoding=args.encoding)
+        except EncoderMismatchError as e:
+            print(f"✗ {e}; pass --allow_encoder_change to diff anyway")
+            return 2
+        print_chunk_diff(diff)
+        diffs.append(diff)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump([{k: v for k, v in d.items() if k != 'chunks'} for d in diffs], f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Chunk diff saved to: {args.output}")
+    if args.update:
+        write_manifest(apply_file_diffs(manifest, diffs), args.update)
+        print(f"📁 Updated manifest saved to: {args.update}")
+    return 0
+
+
+def cmd_race_check(args) -> int:
+    from repo_walker import walk_repository
+    from shared_encoder import check_thread_safety
+    from source_text import read_source
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    texts = []
+    for root in args.paths:
+        for path in walk_repository(root, ignore_patterns=args.ignore_patterns):
+            text, _ = read_source(path, encoding='auto')
+            texts.append(text)
+    if not texts:
+        print("✗ No text files found")
+        return 2
+    result = check_thread_safety(tokenizer, texts, threads=args.threads, rounds=args.rounds, shared=args.raw)
+    mark = '✓' if result['mismatches'] == 0 else '✗'
+    print(f"{mark} {result['mode']}: {result['calls']} calls on {args.threads} threads, "
+          f"{result['mismatches']} mismatches (tokenizer clones: {result['clones']})")
+    return 0 if result['mismatches'] == 0 else 1
+
+
+def cmd_pack(args) -> int:
+    from repo_walker import walk_repository
+    from source_text import read_source
+    from token_spans import compute_token_spans
+    from token_stream import TokenStreamError, TokenStreamWriter, json_size
+    from encoder_registry import fingerprint_of
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    json_bytes = 0
+    try:
+        with open(args.output, 'wb') as f, \
+                TokenStreamWriter(f, compress=args.zstd, fingerprint=fingerprint_of(tokenizer)) as writer:
+            for root in args.paths:
+                root_path = Path(root)
+                base = root_path if root_path.is_dir() else root_path.parent
+                for path in walk_repository(root_path, ignore_patterns=args.ignore_patterns):
+                    text, byte_map = read_source(path, encoding=args.encoding)
+                    spans, _ = compute_token_spans(tokenizer, text)
+                    if byte_map is not None:
+                        for span in spans:
+                            span['start_byte'] = byte_map[span['start_byte']]
+                            span['end_byte'] = byte_map[span['end_byte']]
+                    name = path.relative_to(base).as_posix()
+                    writer.write_document(name, spans)
+                    json_bytes += json_size({name: spans})
+    except TokenStreamError as e:
+        print(f"✗ {e}")
+        Path(args.output).unlink(missing_ok=True)
+        return 2
+    size = Path(args.output).stat().st_size
+    print(f"📁 {writer.documents} documents, {writer.tokens} tokens saved to: {args.output}")
+    print(f"  Size: {size} bytes (JSON: {json_bytes} bytes, {json_bytes / size if size else 0:.1f}x smaller)")
+    return 0
+
+
+def cmd_unpack(args) -> int:
+    from token_stream import TokenStreamError, TokenStreamReader
+    try:
+        with open(args.stream, 'rb') as f:
+            reader = TokenStreamReader(f)
+            for name, spans in reader:
+                print(json.dumps({'document': name, 'encoder': reader.fingerprint, 'tokens': spans},
+                                 ensure_ascii=False))
+    except TokenStreamError as e:
+        print(f"✗ {e}")
+        return 2
+    return 0
+
+
+def cmd_export(args) -> int:
+    from arrow_export import iter_token_rows, write_token_table
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    rows = iter_token_rows(tokenizer, args.paths, with_classes=not args.no_classes, encoding=args.encoding,
+                           ignore_patterns=args.ignore_patterns)
+    try:
+        total = write_token_table(rows, args.output, args.format)
+    except RuntimeError as e:
+        print(f"✗ {e}")
+        return 2
+    print(f"📁 {total} token rows saved to: {args.output}")
+    return 0
+
+
+def cmd_index(args) -> int:
+    from sqlite_index import build_index
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    result = build_index(tokenizer, args.root, args.sqlite, args.model, max_tokens=args.max_tokens,
+                         spans=args.spans, encoding=args.encoding, ignore_patterns=args.ignore_patterns)
+    print(f"📁 Indexed {result['files']} files ({result['tokens']} tokens, {result['removed']} removed) into: {args.sqlite}")
+    return 0
+
+
+def cmd_watch(args) -> int:
+    from watcher import RepositoryWatcher, watch
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    watcher = RepositoryWatcher(tokenizer, args.root, args.model, args.max_tokens, args.encoding, args.manifest,
+                                args.ignore_patterns)
+
+    def _emit(events):
+        for event in events:
+            if args.json:
+                print(json.dumps(event, ensure_ascii=False), flush=True)
+                continue
+            where = event['path'] if 'path' in event else f"{event['files']} files"
+            line = f"{event['event']:<8} {where}  {event['tokens']} tokens"
+            if 'delta' in event:
+                line += f" ({event['delta']:+d}, {event['retokenized']} retokenized)"
+            if isinstance(event.get('chunks'), dict):
+                c = event['chunks']
+                line += f"  chunks: {c['modified']} modified, {c['added']} added, {c['removed']} removed"
+            print(line, flush=True)
+
+    initial = watcher.start()
+    _emit([initial])
+    if not args.json:
+        print(f"Watching {args.root} (Ctrl-C to stop)", file=sys.stderr)
+    try:
+        watch(watcher, _emit, interval=args.interval)
+    except KeyboardInterrupt:
+        pass
+    return 0
+
+
+def cmd_check(args) -> int:
+    from budget import check_files, print_budget_report, tracked_files
+    if args.budget is None:
+        print("✗ No budget: pass --max_tokens or set commands.check.budget in the project config")
+        return 2
+    if args.files:
+        paths = args.files
+    else:
+        try:
+            paths = tracked_files('.', args.include) if args.include else tracked_files('.')
+        except RuntimeError as e:
+            print(f"✗ {e}")
+            return 2
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    results = check_files(tokenizer, paths, args.budget, args.encoding)
+    if args.json:
+        print(json.dumps(results, ensure_ascii=False, indent=2))
+    else:
+        print_budget_report(results, args.verbose)
+    return 0 if all(r['ok'] for r in results) else 1
+
+
+def cmd_token_diff(args) -> int:
+    from token_diff import diff_files, print_token_diff
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    result = diff_files(tokenizer, args.old, args.new, encoding=args.encoding)
+    if args.json:
+        print(json.dumps(result, ensure_ascii=False, indent=2))
+    else:
+        print_token_diff(result, show_equal=args.all)
+    return 0
+
+
+def cmd_dedup(args) -> int:
+    from dedup import collect_chunks, find_near_duplicates, print_duplicates
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    chunks = collect_chunks(tokenizer, args.paths, args.max_tokens, args.shingle, args.encoding,
+                            args.ignore_patterns)
+    result = find_near_duplicates(chunks, args.threshold)
+    print_duplicates(result)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(result, f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Near-duplicate report saved to: {args.output}")
+    return 0
+
+
+def cmd_diagnostics(args) -> int:
+    from diagnostics import parse_diagnostics, print_anchors, resolve_diagnostics
+    if args.input and args.input != '-':
+        with open(args.input, 'r', encoding='utf-8', errors='replace') as f:
+            diagnostics = parse_diagnostics(f)
+    else:
+        diagnostics = parse_diagnostics(sys.stdin)
+    if not diagnostics:
+        print("✗ No diagnostics found in the input")
+        return 2
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    results = resolve_diagnostics(tokenizer, diagnostics, args.root, args.column_unit, args.encoding)
+    if args.json:
+        for result in results:
+            print(json.dumps(result, ensure_ascii=False))
+    else:
+        print_anchors(results)
+    return 0
+
+
+def cmd_coverage(args) -> int:
+    from go_coverage import CoverProfileError, parse_cover_profile, print_coverage, profile_coverage
+    try:
+        with open(args.profile, 'r', encoding='utf-8') as f:
+            profile = parse_cover_profile(f)
+    except (OSError, CoverProfileError) as e:
+        print(f"✗ Cannot read cover profile {args.profile}: {e}")
+        return 2
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    result = profile_coverage(tokenizer, profile, args.root, args.encoding)
+    print_coverage(result)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(result, f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Token coverage saved to: {args.output}")
+    return 0
+
+
+def cmd_go_ast(args) -> int:
+    from go_ast import go_ast_tokens, print_go_ast_summary, select_tokens, summarize_go_ast
+    from lexical import load_parser
+    from position_index import PositionIndex
+    from source_text import read_source
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    tokens = go_ast_tokens(tokenizer, load_parser('go'), text)
+    if byte_map is not None:
+        for token in tokens:
+            token['start_byte'], token['end_byte'] = byte_map[token['start_byte']], byte_map[token['end_byte']]
+    print_go_ast_summary(summarize_go_ast(tokens), args.file)
+    selected = tokens
+    if args.kind or args.decl:
+        with open(args.file, 'rb') as f:
+            data = f.read()
+        positions = PositionIndex(data)
+        indices = select_tokens(tokens, args.kind, args.decl)
+        print(f"{len(indices)} tokens match{' kind ' + args.kind if args.kind else ''}"
+              f"{' in ' + args.decl if args.decl else ''}:")
+        for i in indices:
+            token = tokens[i]
+            line, column = positions.position(token['start_byte'])
+            piece = data[token['start_byte']:token['end_byte']].decode('utf-8', errors='replace')
+            print(f"  L{line}:C{column}  token {i} {piece!r}  {token['ast_kind']}  {token['decl'] or '-'}")
+        selected = [dict(tokens[i], index=i) for i in indices]
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump({'file': args.file, 'tokens': selected}, f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Go AST tokens saved to: {args.output}")
+    return 0
+
+
+def cmd_notebook(args) -> int:
+    from notebook import NotebookError, print_notebook_report, tokenize_notebook
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    try:
+        result = tokenize_notebook(tokenizer, args.file, args.cells)
+    except (OSError, UnicodeDecodeError, NotebookError) as e:
+        print(f"✗ Cannot read notebook {args.file}: {e}")
+        return 2
+    print_notebook_report(result)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(result, f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Notebook tokens saved to: {args.output}")
+    return 0
+
+
+def cmd_markdown(args) -> int:
+    from markdown_blocks import markdown_blocks, print_markdown_blocks
+    from source_text import read_source
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    parsers: Dict[str, object] = {}
+    results = []
+    for path in args.files:
+        try:
+            text, byte_map = read_source(path, encoding=args.encoding)
+        except (OSError, UnicodeDecodeError) as e:
+            print(f"✗ Cannot read {path}: {e}")
+            continue
+        result = markdown_blocks(tokenizer, text, byte_map, parsers)
+        print_markdown_blocks(result, path)
+        results.append(dict(result, path=path))
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(results, f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Code blocks saved to: {args.output}")
+    return 0 if len(results) == len(args.files) else 1
+
+
+def cmd_structure(args) -> int:
+    from source_text import read_source
+    from structure_paths import (StructureError, detect_format, print_path_summary,
+                                 structure_tokens, summarize_paths)
+    fmt = detect_format(args.file, args.format)
+    if fmt is None:
+        print(f"✗ Cannot infer whether {args.file} is JSON or YAML; pass --format")
+        return 2
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    try:
+        tokens = structure_tokens(tokenizer, text, fmt)
+    except StructureError as e:
+        print(f"✗ {args.file}: {e}")
+        return 2
+    rows = summarize_paths(tokens)
+    print_path_summary(rows, len(tokens), args.file, args.top)
+    if args.output:
+        if byte_map is not None:
+            for token in tokens:
+                token['start_byte'], token['end_byte'] = byte_map[token['start_byte']], byte_map[token['end_byte']]
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump({'file': args.file, 'format': fmt, 'paths': rows,
+                       'tokens': [{k: v for k, v in t.items() if k != 'ancestors'} for t in tokens]},
+                      f, ensure_ascii=False, indent=2)
+        print(f"\n📁 Structural paths saved to: {args.output}")
+    return 0
+
+
+def cmd_bias(args) -> int:
+    from logit_bias import banned_token_ids, logit_bias_map, tokens_covering_span
+    from source_text import read_source
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    if byte_map is not None and args.unit == 'bytes':
+        print(f"✗ {args.file} is not plain UTF-8; pass character offsets with --unit chars")
+        return 2
+    try:
+        result = tokens_covering_span(tokenizer, text, args.start, args.end, args.unit)
+    except ValueError as e:
+        print(f"✗ {e}")
+        return 2
+    result['logit_bias'] = logit_bias_map(result['ids'], args.bias)
+    result['bad_words_ids'] = banned_token_ids(result['ids'])
+    if args.json:
+        print(json.dumps(result, ensure_ascii=False))
+        return 0
+    alignment = 'token-aligned' if result['aligned'] else 'not token-aligned'
+    print(f"Tokens [{result['tokens'][0]}, {result['tokens'][1]}) cover bytes "
+          f"[{result['bytes'][0]}, {result['bytes'][1]}) ({alignment})")
+    print(json.dumps(result['logit_bias']))
+    return 0
+
+
+def cmd_stop(args) -> int:
+    from source_text import read_source
+    from stop_sequences import find_stop
+    stops = [s.encode('latin-1', 'backslashreplace').decode('unicode_escape') for s in args.stop]
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, _ = read_source(args.file, encoding=args.encoding)
+    ids = tokenizer.encode(text, add_special_tokens=False)
+    result = find_stop(tokenizer, ids, stops)
+    if args.json:
+        print(json.dumps(dict(result, tokens=len(ids)), ensure_ascii=False))
+        return 0
+    match = result['stop']
+    if match is None:
+        print(f"No stop string in {len(ids)} tokens")
+        return 0
+    tokens = match['tokens']
+    print(f"✓ Stop {match['stop']!r} at bytes [{match['cut_byte']}, {match['end_byte']}) "
+          f"in tokens [{tokens[0]}, {tokens[1]})" + (" (split across tokens)" if match['split'] else ""))
+    print(f"  Cut output at byte {match['cut_byte']} after {result['tokens_consumed']} of {len(ids)} tokens")
+    return 0
+
+
+def cmd_decode(args) -> int:
+    from source_text import read_source
+    from stream_decoder import decode_stream
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    if args.ids:
+        try:
+            ids = [int(part) for part in args.ids.replace(',', ' ').split()]
+        except ValueError:
+            print(f"✗ --ids must be integers: {args.ids}")
+            return 2
+    elif args.file:
+        text, _ = read_source(args.file, encoding=args.encoding)
+        ids = tokenizer.encode(text, add_special_tokens=False)
+    else:
+        print("✗ Pass a file to replay or --ids")
+        return 2
+    for piece in decode_stream(tokenizer, ids):
+        print(json.dumps(piece, ensure_ascii=False))
+    return 0
+
+
+def cmd_redact(args) -> int:
+    from position_index import PositionIndex
+    from redact import DETECTORS, redact_text
+    from source_text import read_source
+    detectors = args.detectors.split(',') if args.detectors else None
+    if detectors and any(name not in DETECTORS for name in detectors):
+        print(f"✗ Unknown detector; available: {', '.join(DETECTORS)}")
+        return 2
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    result = redact_text(text, detectors, args.placeholder, byte_map)
+    with open(args.file, 'rb') as f:
+        positions = PositionIndex(f.read())
+    for match in result['matches']:
+        line, column = positions.position(match['start_byte'])
+        if args.json:
+            print(json.dumps(dict(match, line=line, column=column)))
+        else:
+            print(f"{args.file}:{line}:{column}  {match['detector']}  bytes [{match['start_byte']}, {match['end_byte']})")
+    if not args.json:
+        print(f"{len(result['matches'])} secret(s) found")
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8', errors='surrogateescape', newline='') as f:
+            f.write(result['text'])
+        if args.offset_map:
+            with open(args.offset_map, 'w', encoding='utf-8') as f:
+                json.dump({'file': args.file, 'byte_map': result['byte_map']}, f)
+        if not args.json:
+            print(f"📁 Redacted text saved to: {args.output}")
+    return 0
+
+
+def cmd_mask(args) -> int:
+    from pii_mask import mask_spans, print_mask_report
+    from source_text import read_source
+    spans = []
+    if args.spans:
+        with open(args.spans, 'r', encoding='utf-8') as f:
+            spans.extend(json.load(f))
+    for item in args.span or []:
+        parts = item.split(':', 2)
+        try:
+            spans.append([int(parts[0]), int(parts[1])] + parts[2:])
+        except (ValueError, IndexError):
+            print(f"✗ --span must be START:END[:LABEL]: {item}")
+            return 2
+    if not spans:
+        print("✗ Pass --spans FILE or --span START:END")
+        return 2
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    result = mask_spans(tokenizer, text, spans, args.mode, args.placeholder, byte_map)
+    print_mask_report(result, args.file)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8', errors='surrogateescape', newline='') as f:
+            f.write(result['text'])
+        print(f"📁 Masked text saved to: {args.output}")
+    if args.report:
+        report = {key: result[key] for key in ('mode', 'tokens', 'affected_tokens', 'removals', 'ids')}
+        with open(args.report, 'w', encoding='utf-8') as f:
+            json.dump(dict(report, file=args.file, model=args.model), f, ensure_ascii=False, indent=2)
+        print(f"📁 Masking report saved to: {args.report}")
+    return 0
+
+
+def cmd_golden(args) -> int:
+    from tokentest import print_golden_results, run_golden
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    try:
+        results = run_golden(tokenizer, args.corpus, args.golden_dir, args.model, args.update, args.encoding,
+                             args.ignore_patterns, args.paths)
+    except ValueError as e:
+        print(f"✗ {e}")
+        return 2
+    print_golden_results(results)
+    if args.update:
+        return 0
+    return 1 if any(r['status'] != 'match' for r in results) else 0
+
+
+def cmd_align(args) -> int:
+    from source_text import read_source
+    from span_align import align_tokenizers, print_alignment
+    ranges = []
+    for item in args.tokens or []:
+        try:
+            start, end = (int(part) for part in item.split(':'))
+        except ValueError:
+            print(f"✗ --tokens must be START:END: {item}")
+            return 2
+        ranges.append((start, end))
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    # Both sides see the same normalized text, or their boundaries cannot agree
+    aligner = align_tokenizers(load_tokenizer(args.model, args.normalize),
+                               load_tokenizer(args.target_model, args.normalize), text, byte_map)
+    direction = 'b_to_a' if args.reverse else 'a_to_b'
+    try:
+        translations = aligner.translate_many(ranges, direction)
+    except IndexError as e:
+        print(f"✗ {e}")
+        return 2
+    if args.json:
+        print(json.dumps([dict(r, source_tokens=list(rng)) for rng, r in zip(ranges, translations)], indent=2))
+    else:
+        print_alignment(aligner, translations, ranges, args.file)
+    return 0
+
+
+def cmd_bench(args) -> int:
+    from profiling import print_benchmark, run_benchmark
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    result = run_benchmark(tokenizer, args.root, args.repeat, args.encoding, args.ignore_patterns)
+    if args.json:
+        print(json.dumps(result, indent=2))
+    else:
+        print_benchmark(result)
+    return 0
+
+
+def cmd_explain(args) -> int:
+    from bpe_explain import ExplainError, explain, print_explanations
+    from source_text import read_source
+    if args.text is not None:
+        text, byte_map = args.text, None
+    elif args.file:
+        text, byte_map = read_source(args.file, encoding=args.encoding)
+    else:
+        print("✗ Pass a file or --text")
+        return 2
+    start, end = 0, None
+    if args.tokens:
+        try:
+            start, end = (int(part) for part in args.tokens.split(':'))
+        except ValueError:
+            print(f"✗ --tokens must be START:END: {args.tokens}")
+            return 2
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    try:
+        results = explain(tokenizer, text, byte_map, start, end)
+    except ExplainError as e:
+        print(f"✗ {e}")
+        return 1
+    if args.json:
+        print(json.dumps(results, ensure_ascii=False, indent=2))
+    else:
+        print_explanations(results, args.file or '')
+    return 0
+
+
+def cmd_show(args) -> int:
+    from source_text import read_source
+    from token_show import show
+    lines = None
+    if args.lines:
+        try:
+            lines = tuple(int(part) for part in args.lines.split(':'))
+        except ValueError:
+            lines = ()
+        if len(lines) != 2:
+            print(f"✗ --lines must be FIRST:LAST: {args.lines}")
+            return 2
+    text, _ = read_source(args.file, encoding=args.encoding)
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    color = None if args.color == 'auto' else args.color == 'always'
+    show(tokenizer, text, color=color, width=args.width, lines=lines, tab_size=args.tab_size,
+         show_whitespace=args.whitespace)
+    return 0
+
+
+def cmd_whitespace(args) -> int:
+    from repo_walker import walk_repository
+    from source_text import read_source
+    from whitespace_stats import estimate_savings, print_whitespace_report, whitespace_stats
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    paths = list(walk_repository(args.root, ignore_patterns=args.ignore_patterns))
+    if args.output and len(paths) != 1:
+        print("✗ --output needs a single file")
+        return 2
+    results = []
+    for path in paths:
+        text, byte_map = read_source(path, encoding=args.encoding)
+        result = {'file': str(path), 'stats': whitespace_stats(tokenizer, text, byte_map)}
+        if args.minimize or args.output:
+            savings = estimate_savings(tokenizer, text, byte_map, indent=args.indent,
+                                       max_blank_lines=args.max_blank_lines, tab_size=args.tab_size)
+            if args.output:
+                with open(args.output, 'w', encoding='utf-8', errors='surrogateescape', newline='') as f:
+                    f.write(savings['text'])
+            result['savings'] = {key: savings[key] for key in ('tokens_before', 'tokens_after', 'saved')}
+        results.append(result)
+    if args.json:
+        print(json.dumps(results, indent=2))
+    else:
+        print_whitespace_report(results)
+    if args.output:
+        print(f"📁 Minimized text saved to: {args.output}")
+    return 0
+
+
+def cmd_inject(args) -> int:
+    from added_tokens import AddedTokens
+    from source_text import read_source
+    injections = []
+    for item in args.at:
+        pos, sep, token = item.partition(':')
+        if not sep or not pos.isdigit() or not token:
+            print(f"✗ --at must be POS:TOKEN: {item}")
+            return 2
+        injections.append((int(pos), token))
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    if args.add:
+        # Shared tokenizers are read-only; add to a private copy
+        tokenizer = tokenizer.copy()
+    added = AddedTokens(tokenizer)
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    try:
+        for _, token in injections:
+            if token not in added:
+                added.register(token, add=args.add)
+        result = added.inject(text, injections, byte_map)
+    except ValueError as e:
+        print(f"✗ {e}")
+        return 1
+    if args.json:
+        print(json.dumps(result, ensure_ascii=False, indent=2))
+        return 0
+    print(f"{len(result['spans'])} tokens, {len(result['injections'])} injection(s)")
+    for injection in result['injections']:
+        ids = [result['ids'][i] for i in injection['indices']]
+        print(f"  byte {injection['start_byte']}: {injection['token']} -> tokens "
+              f"{injection['indices'][0]}..{injection['indices'][-1]} (ids {ids})")
+    return 0
+
+
+def cmd_fim(args) -> int:
+    from fim import print_fim, split_fim
+    from source_text import read_source
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    try:
+        result = split_fim(tokenizer, text, args.cursor, args.budget, args.middle_end, byte_map,
+                           args.suffix_share, args.sentinels, args.mode)
+    except ValueError as e:
+        print(f"✗ {e}")
+        return 1
+    if args.json:
+        print(json.dumps(result, ensure_ascii=False, indent=2))
+    else:
+        print_fim(result, args.file)
+    return 0
+
+
+def cmd_count(args) -> int:
+    from repo_walker import walk_repository
+    from session import Session
+    tokenizers = {model: load_tokenizer(model, args.normalize) for model in args.models}
+    rows = []
+    for path in walk_repository(args.root, ignore_patterns=args.ignore_patterns):
+        try:
+            session = Session.from_file(path, encoding=args.encoding)
+        except (OSError, UnicodeDecodeError) as e:
+            print(f"✗ Cannot read {path}: {e}", file=sys.stderr)
+            continue
+        rows.append({'file': str(path), 'bytes': len(session.data), 'counts': session.counts(tokenizers)})
+    if args.json:
+        print(json.dumps(rows, indent=2))
+        return 0
+    width = max([len(model) for model in args.models] + [8])
+    print(f"{'File':<40} {'Bytes':>8} " + ' '.join(f"{model[-width:]:>{width}}" for model in args.models))
+    for row in rows:
+        print(f"{row['file'][-40:]:<40} {row['bytes']:>8} "
+              + ' '.join(f"{row['counts'][model]:>{width}}" for model in args.models))
+    total_bytes = sum(row['bytes'] for row in rows)
+    print(f"{'Total':<40} {total_bytes:>8} "
+          + ' '.join(f"{sum(row['counts'][model] for row in rows):>{width}}" for model in args.models))
+    return 0
+
+
+def cmd_report(args) -> int:
+    from report import build_report, render_markdown
+    tokenizer = load_tokenizer(args.model, args.normalize)
+    report = build_report(tokenizer, args.root, args.model, args.sample, args.seed, args.top,
+                          args.context_window, args.encoding, args.ignore_patterns)
+    markdown = render_markdown(report)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8') as f:
+            json.dump(report, f, ensure_ascii=False, indent=2)
+        print(f"📁 Report saved to: {args.output}")
+    if args.markdown:
+        with open(args.markdown, 'w', encoding='utf-8') as f:
+            f.write(markdown)
+        print(f"📁 Markdown report saved to: {args.markdown}")
+    if not args.output and not args.markdown:
+        print(markdown)
+    return 0
+
+
+def cmd_normalize(args) -> int:
+    from normalizers import NormalizerChain, normalized_token_spans
+    from source_text import read_source
+    from token_spans import encode_source
+    try:
+        chain = NormalizerChain.from_spec(args.steps)
+    except ValueError as e:
+        print(f"✗ {e}")
+        return 2
+    # --steps is the chain here; a --normalize wrapper would apply on top of it
+    tokenizer = load_tokenizer(args.model)
+    text, byte_map = read_source(args.file, encoding=args.encoding)
+    spans, normalized, _ = normalized_token_spans(tokenizer, text, chain, byte_map)
+    if args.output:
+        with open(args.output, 'w', encoding='utf-8', errors='surrogateescape', newline='') as f:
+            f.write(normalized)
+        print(f"📁 Normalized text saved to: {args.output}")
+    if args.json:
+        print(json.dumps(spans, indent=2))
+        return 0
+    with open(args.file, 'rb') as f:
+        original = f.read()
+    norm_bytes = encode_source(normalized)
+    print(f"{len(spans)} tokens after {', '.join(args.steps)}")
+    for i, span in enumerate(spans[:args.top]):
+        piece = norm_bytes[span['norm_start']:span['norm_end']].decode('utf-8', errors='replace')
+        source = original[span['start_byte']:span['end_byte']].decode('utf-8', errors='replace')
+        print(f"  {i:>5}  {piece!r:<24} <- [{span['start_byte']}, {span['end_byte']}) {source!r}")
+    return 0
+
+
+def cmd_config(args) -> int:
+    from config import defaults_for
+    config = args.project_config
+    if not config:
+        print("No config file (.tokoffset.yaml / .tokoffset.toml) found")
+        return 0
+    print(f"Config: {config['_path']}")
+    for key, value in sorted(defaults_for(config).items()):
+        print(f"  {key} = {value!r}")
+    if config.get('ignore'):
+        print(f"  ignore = {config['ignore']!r}")
+    for command, settings in sorted(config.get('commands', {}).items()):
+        for key, value in sorted(settings.items()):
+            print(f"  {command}.{key} = {value!r}")
+    return 0
+
+
+def build_parser(config: Optional[Dict] = None) -> argparse.ArgumentParser:
+    parser = argparse.ArgumentParser(
+        prog='tokoffset',
+        description='Token offset tools',
+        formatter_class=argparse.RawDescriptionHelpFormatter,
+        epilog="""
+Usage examples:
+  python tokoffset.py lsp-helper --model gpt2   # Serve JSON-RPC on stdin/stdout
+  python tokoffset.py lsp-helper --metrics_port 9464   # ... with Prometheus /metrics
+  python tokoffset.py scan path/to/repo         # Token summary honoring .gitignore/.tokignore
+  python tokoffset.py stats code_samples        # Token distributions as tables (+ --output JSON)
+  python tokoffset.py classes prompt.py         # Fraction of tokens that are comments, strings, ...
+  python tokoffset.py subwords main.go          # Token vs identifier sub-word alignment
+  python tokoffset.py chunk src --manifest chunks.manifest.json
+  python tokoffset.py resolve 'pkg/util.go#Server.Run@3f9a0c1d2e4b' --root src
+  python tokoffset.py chunk-diff --manifest chunks.manifest.json --root src pkg/util.go
+  python tokoffset.py race-check code_samples --threads 16
+  python tokoffset.py pack code_samples --output tokens.toks --zstd
+  python tokoffset.py export code_samples --output tokens.parquet
+  python tokoffset.py index . --sqlite tokens.db --spans
+  python tokoffset.py watch src --manifest chunks.manifest.json   # Live counts + manifest
+  python tokoffset.py check --max-tokens 2000 prompts/system.txt  # Budget gate (exit 1 when over)
+  python tokoffset.py token-diff old/prompt.txt new/prompt.txt    # Token-level diff
+  python tokoffset.py dedup docs --threshold 0.8 --output dups.json
+  go vet ./... 2>&1 | python tokoffset.py diagnostics --json   # Diagnostics -> token indices
+  python tokoffset.py coverage cover.out --root . --output token_coverage.json
+  python tokoffset.py go-ast main.go --kind BasicLit --decl FuncDecl:main   # String literals in main
+  python tokoffset.py notebook analysis.ipynb --cells code --output cells.json
+  python tokoffset.py markdown README.md docs/guide.md --output blocks.json
+  python tokoffset.py structure config.yaml --top 10   # Keys consuming the most tokens
+  python tokoffset.py bias prompt.txt --start 120 --end 164 --bias -100   # logit_bias JSON
+  python tokoffset.py stop completion.txt --stop '\n\n###' --stop '</answer>'
+  python tokoffset.py decode --ids 1,2,3 --model meta-llama/Llama-2-7b-hf   # Streamed pieces
+  python tokoffset.py redact .env.example --output redacted.txt   # List and mask secrets
+  python tokoffset.py chunk src --redact --output chunks.jsonl    # Chunk redacted text
+  python tokoffset.py resolve 'config.py#settings@0b1c2d3e4f5a' --root src --redact
+  python tokoffset.py mask record.txt --spans pii.json --mode drop --report audit.json
+  python tokoffset.py golden code_samples --golden_dir golden --update   # Record snapshots
+  python tokoffset.py golden code_samples --golden_dir golden            # Exit 1 on any drift
+  python tokoffset.py align example.py --model gpt2 --target_model bigcode/starcoder --tokens 10:20
+  python tokoffset.py --cpuprofile cpu.prof --trace trace.json bench code_samples   # Profiles for a perf report
+  python tokoffset.py explain --text "def 解析数据():" --model Qwen/Qwen2.5-Coder-7B   # Why this split?
+  python tokoffset.py show example.go --lines 10:40 | less -R          # Token boundaries in color
+  python tokoffset.py whitespace src --minimize --indent tab          # What would reformatting save?
+  python tokoffset.py inject example.py --at "0:<|fim_prefix|>" --at "120:<|fim_suffix|>" --json
+  python tokoffset.py fim example.py --cursor 1200 --budget 2048 --sentinels starcoder
+  python tokoffset.py count src --models gpt2 bigcode/starcoder meta-llama/Llama-2-7b-hf
+  python tokoffset.py report . --sample 500 --seed 1 --output report.json --markdown report.md
+  python tokoffset.py normalize notes.txt --steps nfkc strip_accents lowercase --json
+  python tokoffset.py --config ci.tokoffset.yaml scan .   # Explicit config file
+        """
+    )
+    parser.add_argument('--config', help='Project config file (default: nearest .tokoffset.yaml/.toml)')
+    parser.add_argument('--no_config', action='store_true', help='Ignore project config files')
+    parser.add_argument('--normalize', action='append', metavar='STEP',
+                        help='Normalizer step applied before tokenizing in every command (repeatable, '
+                             'e.g. --normalize nfkc --normalize lowercase); spans still address the file')
+    parser.add_argument('--cpuprofile', help='Write a cProfile CPU profile of the command to this file')
+    parser.add_argument('--memprofile', help='Write a tracemalloc memory snapshot of the command to this file')
+    parser.add_argument('--trace', help='Write the tokenization spans of the command as a Chrome trace to this file')
+    subparsers = parser.add_subparsers(dest='command')
+
+    from limits import DEFAULT_MAX_CONCURRENT, DEFAULT_QUEUE_TIMEOUT
+    lsp = subparsers.add_parser('lsp-helper', help='Serve JSON-RPC over stdio for editor extensions')
+    lsp.add_argument('--model', default='gpt2', help='Tokenizer model')
+    lsp.add_argument('--metrics_port', type=int, help='Serve Prometheus metrics on this port (/metrics)')
+    lsp.add_argument('--metrics_host', default='127.0.0.1', help='Metrics listen address')
+    lsp.add_argument('--max_request_bytes', type=int, help='Refuse larger requests (error data status 413)')
+    lsp.add_argument('--max_concurrent', type=int, default=DEFAULT_MAX_CONCURRENT,
+                     help='Requests admitted at once; others queue (default: %(default)s)')
+    lsp.add_argument('--queue_timeout', type=float, default=DEFAULT_QUEUE_TIMEOUT,
+                     help='Seconds a request may queue before being refused (status 429, default: %(default)s)')
+    lsp.set_defaults(func=cmd_lsp_helper)
+
+    scan = subparsers.add_parser('scan', help='Summarize token counts per file and directory')
+    scan.add_argument('root', help='Repository root directory')
+    scan.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    scan.add_argument('--model', default='gpt2', help='Tokenizer model')
+    scan.add_argument('--batch_size', type=int, default=64, help='Files per tokenizer batch')
+    scan.add_argument('--output', help='Write the summary JSON to this file')
+    scan.set_defaults(func=cmd_scan)
+
+    stats = subparsers.add_parser('stats', help='Token distributions over a corpus')
+    stats.add_argument('paths', nargs='+', help='Files or directories')
+    stats.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    stats.add_argument('--model', default='gpt2', help='Tokenizer model')
+    stats.add_argument('--top_k', type=int, default=50, help='Number of most frequent tokens to report')
+    stats.add_argument('--output', help='Write the statistics JSON to this file')
+    stats.set_defaults(func=cmd_stats)
+
+    classes = subparsers.add_parser('classes', help='Tag tokens with their lexical class')
+    classes.add_argument('file', help='Source file')
+    classes.add_argument('--language', help='Language key (default: inferred from the extension)')
+    classes.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    classes.add_argument('--model', default='gpt2', help='Tokenizer model')
+    classes.add_argument('--output', help='Write the tagged tokens JSON to this file')
+    classes.set_defaults(func=cmd_classes)
+
+    subwords = subparsers.add_parser('subwords', help='Align tokens to identifier sub-words')
+    subwords.add_argument('file', help='Source file')
+    subwords.add_argument('--language', help='Language key (default: inferred from the extension)')
+    subwords.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    subwords.add_argument('--model', default='gpt2', help='Tokenizer model')
+    subwords.add_argument('--output', help='Write the per-identifier alignment JSON to this file')
+    subwords.set_defaults(func=cmd_subwords)
+
+    chunk = subparsers.add_parser('chunk', help='Split files into token-budget chunks')
+    chunk.add_argument('root', help='File or directory to chunk')
+    chunk.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    chunk.add_argument('--model', default='gpt2', help='Tokenizer model')
+    chunk.add_argument('--max_tokens', type=int, default=512, help='Token budget per chunk')
+    chunk.add_argument('--output', help='Write chunks as JSON Lines to this file (default: stdout)')
+    chunk.add_argument('--manifest', help='Write a versioned chunk manifest (JSON) to this file')
+    chunk.add_argument('--redact', action='store_true', help='Mask secrets before tokenizing (see the redact command)')
+    chunk.set_defaults(func=cmd_chunk)
+
+    resolve = subparsers.add_parser('resolve', help='Resolve chunk IDs to source locations')
+    resolve.add_argument('chunk_ids', nargs='+', help='Chunk IDs produced by chunk')
+    resolve.add_argument('--root', default='.', help='Directory the chunk paths are relative to')
+    resolve.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    resolve.add_argument('--model', default='gpt2', help='Tokenizer model (must match chunking)')
+    resolve.add_argument('--max_tokens', type=int, default=512, help='Token budget (must match chunking)')
+    resolve.add_argument('--redact', action='store_true', help='Resolve IDs from chunk --redact (must match chunking)')
+    resolve.add_argument('--json', action='store_true', help='Print locations as JSON Lines')
+    resolve.set_defaults(func=cmd_resolve)
+
+    chunk_diff = subparsers.add_parser('chunk-diff', help='Diff re-chunked files against a manifest')
+    chunk_diff.add_argument('files', nargs='+', help='Modified files (relative to --root)')
+    chunk_diff.add_argument('--manifest', required=True, help='Manifest written by chunk --manifest')
+    chunk_diff.add_argument('--root', default='.', help='Directory the manifest paths are relative to')
+    chunk_diff.add_argument('--model', help='Tokenizer model (default: the manifest encoder model)')
+    chunk_diff.add_argument('--encoding', help='Source encoding (default: the one the manifest was chunked with)')
+    chunk_diff.add_argument('--output', help='Write the diff JSON to this file')
+    chunk_diff.add_argument('--update', help='Write the manifest with these files re-chunked to this file')
+    chunk_diff.add_argument('--allow_encoder_change', action='store_true',
+                            help='Diff even if the tokenizer differs from the manifest encoder')
+    chunk_diff.set_defaults(func=cmd_chunk_diff)
+
+    race = subparsers.add_parser('race-check', help='Compare concurrent and sequential tokenization')
+    race.add_argument('paths', nargs='+', help='Files or directories to tokenize')
+    race.add_argument('--model', default='gpt2', help='Tokenizer model')
+    race.add_argument('--threads', type=int, default=8, help='Concurrent threads')
+    race.add_argument('--rounds', type=int, default=3, help='Passes over the texts')
+    race.add_argument('--raw', action='store_true', help='Share the raw tokenizer instead of a SharedEncoder')
+    race.set_defaults(func=cmd_race_check)
+
+    pack = subparsers.add_parser('pack', help='Write token spans as a binary token stream')
+    pack.add_argument('paths', nargs='+', help='Files or directories')
+    pack.add_argument('--output', required=True, help='Token stream file to write')
+    pack.add_argument('--zstd', action='store_true', help='Compress the stream with zstd (needs zstandard)')
+    pack.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    pack.add_argument('--model', default='gpt2', help='Tokenizer model')
+    pack.set_defaults(func=cmd_pack)
+
+    unpack = subparsers.add_parser('unpack', help='Print a binary token stream as JSON Lines')
+    unpack.add_argument('stream', help='Token stream file')
+    unpack.set_defaults(func=cmd_unpack)
+
+    export = subparsers.add_parser('export', help='Write token tables as Parquet or Arrow IPC')
+    export.add_argument('paths', nargs='+', help='Files or directories')
+    export.add_argument('--output', required=True, help='Output file (.parquet or .arrow)')
+    export.add_argument('--format', choices=['parquet', 'arrow'], help='Output format (default: from the extension)')
+    export.add_argument('--no_classes', action='store_true', help='Skip lexical classes (no parsing)')
+    export.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    export.add_argument('--model', default='gpt2', help='Tokenizer model')
+    export.set_defaults(func=cmd_export)
+
+    index = subparsers.add_parser('index', help='Store a token inventory in SQLite')
+    index.add_argument('root', help='Repository root directory')
+    index.add_argument('--sqlite', required=True, help='SQLite database to create or update')
+    index.add_argument('--spans', action='store_true', help='Also store every token span')
+    index.add_argument('--max_tokens', type=int, default=512, help='Token budget per chunk')
+    index.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    index.add_argument('--model', default='gpt2', help='Tokenizer model')
+    index.set_defaults(func=cmd_index)
+
+    watch_cmd = subparsers.add_parser('watch', help='Retokenize changed files and stream token counts')
+    watch_cmd.add_argument('root', help='Directory to watch')
+    watch_cmd.add_argument('--manifest', help='Keep this chunk manifest in sync')
+    watch_cmd.add_argument('--max_tokens', type=int, default=512, help='Token budget per chunk')
+    watch_cmd.add_argument('--interval', type=float, default=1.0,
+                           help='Poll interval, or settle time with watchdog (seconds)')
+    watch_cmd.add_argument('--json', action='store_true', help='Print events as JSON Lines')
+    watch_cmd.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    watch_cmd.add_argument('--model', default='gpt2', help='Tokenizer model')
+    watch_cmd.set_defaults(func=cmd_watch)
+
+    check = subparsers.add_parser('check', help='Fail when files exceed a token budget')
+    check.add_argument('files', nargs='*', help='Files to check (default: tracked prompt/template files)')
+    # Own dest: the project config's max_tokens is the chunk budget
+    check.add_argument('--max_tokens', '--max-tokens', type=int, dest='budget', help='Token budget per file')
+    check.add_argument('--include', nargs='+',
+                       help='Patterns selecting tracked files when no files are given '
+                            '(default: *.prompt, *.tmpl, *.j2, *.jinja, prompts/*, ...)')
+    check.add_argument('--json', action='store_true', help='Print the per-file results as JSON')
+    check.add_argument('--verbose', action='store_true', help='Also list files within budget')
+    check.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    check.add_argument('--model', default='gpt2', help='Tokenizer model')
+    check.set_defaults(func=cmd_check)
+
+    token_diff = subparsers.add_parser('token-diff', help='Token-level diff between two file versions')
+    token_diff.add_argument('old', help='Old version')
+    token_diff.add_argument('new', help='New version')
+    token_diff.add_argument('--json', action='store_true', help='Print all runs as JSON')
+    token_diff.add_argument('--all', action='store_true', help='Also print equal runs')
+    token_diff.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    token_diff.add_argument('--model', default='gpt2', help='Tokenizer model')
+    token_diff.set_defaults(func=cmd_token_diff)
+
+    dedup = subparsers.add_parser('dedup', help='Report near-duplicate chunks')
+    dedup.add_argument('paths', nargs='+', help='Files or directories')
+    dedup.add_argument('--threshold', type=float, default=0.8, help='Minimum shingle Jaccard similarity')
+    dedup.add_argument('--shingle', type=int, default=5, help='Tokens per shingle')
+    dedup.add_argument('--max_tokens', type=int, default=512, help='Token budget per chunk')
+    dedup.add_argument('--output', help='Write pairs, clusters and redundant chunk IDs as JSON')
+    dedup.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    dedup.add_argument('--model', default='gpt2', help='Tokenizer model')
+    dedup.set_defaults(func=cmd_dedup)
+
+    diag = subparsers.add_parser('diagnostics', help='Anchor compiler diagnostics to tokens')
+    diag.add_argument('input', nargs='?', help='Tool output to read (default: stdin)')
+    diag.add_argument('--root', default='.', help='Directory relative diagnostic paths refer to')
+    diag.add_argument('--column_unit', choices=['bytes', 'utf16', 'codepoints'],
+                      help='What columns count (default: utf16 for tsc and JS/TS files, codepoints for .py, else bytes)')
+    diag.add_argument('--json', action='store_true', help='Print anchors as JSON Lines')
+    diag.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    diag.add_argument('--model', default='gpt2', help='Tokenizer model')
+    diag.set_defaults(func=cmd_diagnostics)
+
+    cover = subparsers.add_parser('coverage', help='Project a Go cover profile onto tokens')
+    cover.add_argument('profile', help='Cover profile (go test -coverprofile=...)')
+    cover.add_argument('--root', default='.', help='Module root the profile paths refer to')
+    cover.add_argument('--output', help='Write per-file token runs and blocks as JSON')
+    cover.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    cover.add_argument('--model', default='gpt2', help='Tokenizer model')
+    cover.set_defaults(func=cmd_coverage)
+
+    go_ast = subparsers.add_parser('go-ast', help='Tag Go tokens with go/ast node kinds and declarations')
+    go_ast.add_argument('file', help='Go source file')
+    go_ast.add_argument('--kind', help='Only list tokens of this go/ast kind (e.g. BasicLit, Ident, CallExpr)')
+    go_ast.add_argument('--decl', help="Only list tokens of this declaration (e.g. 'FuncDecl:main')")
+    go_ast.add_argument('--output', help='Write the annotated (or selected) tokens as JSON')
+    go_ast.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    go_ast.add_argument('--model', default='gpt2', help='Tokenizer model')
+    go_ast.set_defaults(func=cmd_go_ast)
+
+    nb = subparsers.add_parser('notebook', help='Tokenize the cells of a Jupyter notebook')
+    nb.add_argument('file', help='Notebook (.ipynb, nbformat 4)')
+    nb.add_argument('--cells', nargs='+', choices=['code', 'markdown', 'raw'],
+                    help='Cell types to tokenize (default: all)')
+    nb.add_argument('--output', help='Write per-cell token spans (cell and file offsets) as JSON')
+    nb.add_argument('--model', default='gpt2', help='Tokenizer model')
+    nb.set_defaults(func=cmd_notebook)
+
+    md = subparsers.add_parser('markdown', help='Fenced code blocks of Markdown files as token ranges')
+    md.add_argument('files', nargs='+', help='Markdown files')
+    md.add_argument('--output', help='Write the blocks (spans, token ranges, classes) as JSON')
+    md.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    md.add_argument('--model', default='gpt2', help='Tokenizer model')
+    md.set_defaults(func=cmd_markdown)
+
+    structure = subparsers.add_parser('structure', help='Map JSON/YAML tokens to the paths of their values')
+    structure.add_argument('file', help='JSON or YAML document')
+    structure.add_argument('--format', choices=['json', 'yaml'], help='Document format (default: from the extension)')
+    structure.add_argument('--top', type=int, default=20, help='Paths to list (default: 20)')
+    structure.add_argument('--output', help='Write per-path totals and per-token paths as JSON')
+    structure.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    structure.add_argument('--model', default='gpt2', help='Tokenizer model')
+    structure.set_defaults(func=cmd_structure)
+
+    bias = subparsers.add_parser('bias', help='Token IDs covering a span of a file (logit_bias helper)')
+    bias.add_argument('file', help='Text file')
+    bias.add_argument('--start', type=int, required=True, help='Span start offset')
+    bias.add_argument('--end', type=int, required=True, help='Span end offset (exclusive)')
+    bias.add_argument('--unit', choices=['bytes', 'chars'], default='bytes', help='What offsets count (default: bytes)')
+    bias.add_argument('--bias', type=float, default=-100, help='Bias value for the logit_bias map (default: -100)')
+    bias.add_argument('--json', action='store_true', help='Print IDs, token/byte range, logit_bias and bad_words_ids as JSON')
+    bias.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    bias.add_argument('--model', default='gpt2', help='Tokenizer model')
+    bias.set_defaults(func=cmd_bias)
+
+    stop = subparsers.add_parser('stop', help='Find where stop strings cut a token stream')
+    stop.add_argument('file', help='Generated text to replay token by token')
+    stop.add_argument('--stop', action='append', required=True,
+                      help='Stop string (repeatable; backslash escapes like \\n are decoded)')
+    stop.add_argument('--json', action='store_true', help='Print the match as JSON')
+    stop.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    stop.add_argument('--model', default='gpt2', help='Tokenizer model')
+    stop.set_defaults(func=cmd_stop)
+
+    decode = subparsers.add_parser('decode', help='Decode token IDs incrementally into display-safe pieces')
+    decode.add_argument('file', nargs='?', help='Text to encode and replay token by token')
+    decode.add_argument('--ids', help='Token IDs to decode (comma or space separated) instead of a file')
+    decode.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    decode.add_argument('--model', default='gpt2', help='Tokenizer model')
+    decode.set_defaults(func=cmd_decode)
+
+    redact = subparsers.add_parser('redact', help='Mask secrets, keeping a byte map to the original')
+    redact.add_argument('file', help='File to scan')
+    redact.add_argument('--detectors', help='Comma-separated detector names (default: all)')
+    redact.add_argument('--placeholder', default='[REDACTED]',
+                        help="Replacement text; {name} expands to the detector (default: [REDACTED])")
+    redact.add_argument('--output', help='Write the redacted text to this file')
+    redact.add_argument('--offset_map', help='With --output, also write the redacted -> original byte map as JSON')
+    redact.add_argument('--json', action='store_true', help='Print matches as JSON Lines')
+    redact.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    redact.set_defaults(func=cmd_redact)
+
+    mask = subparsers.add_parser('mask', help='Mask the tokens covering sensitive byte ranges')
+    mask.add_argument('file', help='Text file')
+    mask.add_argument('--spans', help='JSON list of {start_byte, end_byte, label} or [start, end] ranges')
+    mask.add_argument('--span', action='append', help='A range as START:END[:LABEL] (repeatable)')
+    mask.add_argument('--mode', choices=['replace', 'drop'], default='replace',
+                      help='Replace covering tokens with the placeholder or drop them (default: replace)')
+    mask.add_argument('--placeholder', default='[PII]', help='Placeholder text for --mode replace')
+    mask.add_argument('--output', help='Write the masked text to this file')
+    mask.add_argument('--report', help='Write removals (token ranges, bytes, SHA-256) and masked IDs as JSON')
+    mask.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    mask.add_argument('--model', default='gpt2', help='Tokenizer model')
+    mask.set_defaults(func=cmd_mask)
+
+    golden = subparsers.add_parser('golden', help='Compare tokens/offsets of a corpus with golden files')
+    golden.add_argument('paths', nargs='*', help='Files or directories of the corpus to check (default: all of it)')
+    golden.add_argument('--corpus', default='code_samples',
+                        help='Corpus root golden paths are relative to (default: code_samples)')
+    golden.add_argument('--golden_dir', default='golden', help='Golden file directory (default: golden)')
+    golden.add_argument('--update', action='store_true', help='Write or refresh the golden files instead of checking')
+    golden.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    golden.add_argument('--model', default='gpt2', help='Tokenizer model')
+    golden.set_defaults(func=cmd_golden)
+
+    align = subparsers.add_parser('align', help='Translate token ranges between two tokenizers')
+    align.add_argument('file', help='Source file')
+    align.add_argument('--tokens', action='append', help='Token range START:END of --model (repeatable)')
+    align.add_argument('--target_model', required=True, help='Tokenizer to translate the ranges to')
+    align.add_argument('--reverse', action='store_true', help='Translate ranges of --target_model to --model instead')
+    align.add_argument('--json', action='store_true', help='Print the translations as JSON')
+    align.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    align.add_argument('--model', default='gpt2', help='Tokenizer model')
+    align.set_defaults(func=cmd_align)
+
+    bench = subparsers.add_parser('bench', help='Benchmark tokenization throughput over a corpus')
+    bench.add_argument('root', nargs='?', default='code_samples', help='File or directory (default: code_samples)')
+    bench.add_argument('--repeat', type=int, default=3, help='Timed rounds over the corpus (default: 3)')
+    bench.add_argument('--json', action='store_true', help='Print the results as JSON')
+    bench.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    bench.add_argument('--model', default='gpt2', help='Tokenizer model')
+    bench.set_defaults(func=cmd_bench)
+
+    explain_cmd = subparsers.add_parser('explain', help='Show the BPE merge tree behind each token')
+    explain_cmd.add_argument('file', nargs='?', help='Source file')
+    explain_cmd.add_argument('--text', help='Explain this text instead of a file')
+    explain_cmd.add_argument('--tokens', help='Only tokens START:END')
+    explain_cmd.add_argument('--json', action='store_true', help='Print the merge trees as JSON')
+    explain_cmd.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    explain_cmd.add_argument('--model', default='gpt2', help='Tokenizer model (fast BPE)')
+    explain_cmd.set_defaults(func=cmd_explain)
+
+    show_cmd = subparsers.add_parser('show', help='Print a file with token boundaries highlighted')
+    show_cmd.add_argument('file', help='Source file')
+    show_cmd.add_argument('--lines', help='Only lines FIRST:LAST (1-based, inclusive)')
+    show_cmd.add_argument('--color', choices=['auto', 'always', 'never'], default='auto',
+                          help="Background colors per token; 'never' marks boundaries with '¦' (default: auto)")
+    show_cmd.add_argument('--width', type=int, help='Wrap width (default: terminal width)')
+    show_cmd.add_argument('--tab_size', type=int, default=4, help='Tab stop width (default: 4)')
+    show_cmd.add_argument('--whitespace', action='store_true', help='Show spaces, tabs and newlines as · → ↵')
+    show_cmd.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    show_cmd.add_argument('--model', default='gpt2', help='Tokenizer model')
+    show_cmd.set_defaults(func=cmd_show)
+
+    whitespace = subparsers.add_parser('whitespace', help='Tokens spent on indentation, blank lines and trailing whitespace')
+    whitespace.add_argument('root', help='File or directory')
+    whitespace.add_argument('--minimize', action='store_true', help='Also count tokens after minimizing whitespace')
+    whitespace.add_argument('--indent', default='tab', help="Minimized indentation: 'tab', 'keep' or spaces per level (default: tab)")
+    whitespace.add_argument('--max_blank_lines', type=int, default=1, help='Blank lines kept in a row when minimizing (default: 1)')
+    whitespace.add_argument('--tab_size', type=int, default=4, help='Tab stop width (default: 4)')
+    whitespace.add_argument('--output', help='Write the minimized text of a single file here')
+    whitespace.add_argument('--json', action='store_true', help='Print per-file results with region byte spans as JSON')
+    whitespace.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    whitespace.add_argument('--model', default='gpt2', help='Tokenizer model')
+    whitespace.set_defaults(func=cmd_whitespace)
+
+    inject = subparsers.add_parser('inject', help='Tokenize with added tokens inserted at byte positions')
+    inject.add_argument('file', help='Source file')
+    inject.add_argument('--at', action='append', required=True, help='Injection POS:TOKEN, a file byte offset (repeatable)')
+    inject.add_argument('--add', action='store_true', help='Add tokens missing from the vocabulary as special tokens')
+    inject.add_argument('--json', action='store_true', help='Print IDs, spans (added tokens zero-width) and injections as JSON')
+    inject.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    inject.add_argument('--model', default='gpt2', help='Tokenizer model')
+    inject.set_defaults(func=cmd_inject)
+
+    fim = subparsers.add_parser('fim', help='Split a file at a cursor into a fill-in-the-middle prompt')
+    fim.add_argument('file', help='Source file')
+    fim.add_argument('--cursor', type=int, required=True, help='Cursor file byte offset')
+    fim.add_argument('--middle_end', type=int, help='End of a selection the completion replaces (default: the cursor)')
+    fim.add_argument('--budget', type=int, default=2048, help='Total prompt tokens, sentinels included (default: 2048)')
+    fim.add_argument('--suffix_share', type=float, default=0.25, help='Share of the budget for the suffix (default: 0.25)')
+    fim.add_argument('--sentinels', choices=['default', 'starcoder', 'codellama'], default='default',
+                     help='FIM sentinel tokens of the model family (default: <|fim_prefix|> ...)')
+    fim.add_argument('--mode', choices=['psm', 'spm'], default='psm', help='Segment order (default: psm)')
+    fim.add_argument('--json', action='store_true', help='Print segments, byte ranges and prompt IDs as JSON')
+    fim.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    fim.add_argument('--model', default='gpt2', help='Tokenizer model')
+    fim.set_defaults(func=cmd_fim)
+
+    count = subparsers.add_parser('count', help='Token counts per file for several models')
+    count.add_argument('root', help='File or directory')
+    count.add_argument('--models', nargs='+', default=['gpt2'], help='Tokenizer models (default: gpt2)')
+    count.add_argument('--json', action='store_true', help='Print per-file counts as JSON')
+    count.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    count.set_defaults(func=cmd_count)
+
+    report = subparsers.add_parser('report', help='Token audit of a repository as JSON and Markdown')
+    report.add_argument('root', nargs='?', default='.', help='Repository root (default: .)')
+    report.add_argument('--sample', type=float, help='Process only N files (or a fraction < 1), chosen by --seed')
+    report.add_argument('--seed', type=int, default=0, help='Sampling seed (default: 0)')
+    report.add_argument('--top', type=int, default=20, help='Largest files to list (default: 20)')
+    report.add_argument('--context_window', type=int, help='Also report files over this many tokens')
+    report.add_argument('--output', help='Write the JSON report to this file')
+    report.add_argument('--markdown', help='Write the Markdown report to this file (printed when no output is given)')
+    report.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    report.add_argument('--model', default='gpt2', help='Tokenizer model')
+    report.set_defaults(func=cmd_report)
+
+    normalize = subparsers.add_parser('normalize', help='Tokenize normalized text with spans in the original file')
+    normalize.add_argument('file', help='Source file')
+    normalize.add_argument('--steps', nargs='+', required=True,
+                           help="Normalizers in order: lowercase, strip_accents, nfc, nfd, nfkc, nfkd, 'regex:PATTERN=>REPLACEMENT'")
+    normalize.add_argument('--output', help='Write the normalized text to this file')
+    normalize.add_argument('--top', type=int, default=50, help='Tokens to print (default: 50)')
+    normalize.add_argument('--json', action='store_true', help='Print all spans (file and normalized offsets) as JSON')
+    normalize.add_argument('--encoding', default='auto', help="Source encoding, or 'auto' to detect it")
+    normalize.add_argument('--model', default='gpt2', help='Tokenizer model')
+    normalize.set_defaults(func=cmd_normalize)
+
+    config_cmd = subparsers.add_parser('config', help='Show the project config and the defaults it sets')
+    config_cmd.set_defaults(func=cmd_config)
+
+    if config:
+        from config import apply_config
+        apply_config(parser, config)
+        for name, subparser in subparsers.choices.items():
+            apply_config(subparser, config, name)
+        for name in sorted(set(config.get('commands', {})) - set(subparsers.choices) - {'analyzer'}):
+            print(f"⚠️  {config['_path']}: commands.{name} is not a tokoffset command; ignored", file=sys.stderr)
+
+    return parser
+
+
+def main(argv=None) -> int:
+    from config import ConfigError, ignore_patterns, load_project_config
+
+    # The config file sets parser defaults, so find it before the full parse
+    pre = argparse.ArgumentParser(add_help=False, allow_abbrev=False)
+    pre.add_argument('--config')
+    pre.add_argument('--no_config', action='store_true')
+    known, _ = pre.parse_known_args(argv)
+    try:
+        config = {} if known.no_config else load_project_config(known.config)
+    except ConfigError as e:
+        print(f"✗ {e}", file=sys.stderr)
+        return 2
+
+    parser = build_parser(config)
+    args = parser.parse_args(argv)
+    args.project_config = config
+    args.ignore_patterns = ignore_patterns(config)
+    if args.normalize:
+        from normalizers import NormalizerChain
+        try:
+            NormalizerChain.from_spec(args.normalize)
+        except ValueError as e:
+            print(f"✗ {e}", file=sys.stderr)
+            return 2
+    if not getattr(args, 'func', None):
+        parser.print_help()
+        return 0
+    if args.cpuprofile or args.memprofile or args.trace:
+        from profiling import profiled
+        with profiled(args.cpuprofile, args.memprofile, args.trace):
+            return args.func(args)
+    return args.func(args)
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,155 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Tracing Hooks - Optional OpenTelemetry spans around tokenization work
+
+Spans (all attributes prefixed 'tokoffset.'):
+- tokoffset.encode   token_spans.compute_token_spans
+                     encoder, bytes, tokens, token_source
+- tokoffset.chunk    chunker.chunk_text
+                     encoder, path, structural, bytes, tokens, chunks
+- tokoffset.align    analyzer rule alignment (kind=rules: language, rules, score)
+                     and subwords.align_subwords (kind=subwords: identifiers,
+                     tokens); both with encoder and bytes
+- tokoffset.cache    chunker.ChunkResolver lookups
+                     cache, path, hit
+
+Spans are emitted only when the 'opentelemetry-api' package is installed;
+they join the caller's current trace, and export wherever the application
+configured its OpenTelemetry SDK. Set TOKOFFSET_TRACING=0 to turn them off.
+Without OpenTelemetry every hook is a no-op costing one function call.
+Functions get their span with the traced decorator.
+
+start_recording() additionally keeps every span in memory as a Chrome
+trace event (independent of OpenTelemetry); profiling.py writes them out
+for the CLI's --trace flag.
+"""
+
+import functools
+import inspect
+import os
+import threading
+import time
+from contextlib import contextmanager, nullcontext
+from typing import Any, Callable, Dict, Iterator, List, Optional
+
+_UNSET = object()
+_tracer = _UNSET
+_recorder: Optional[List[Dict]] = None
+
+
+class _NoopSpan:
+    def set_attribute(self, key: str, value):
+        pass
+
+
+_NOOP_SPAN = _NoopSpan()
+
+
+def get_tracer():
+    """The OpenTelemetry tracer, or None when tracing is unavailable or disabled."""
+    global _tracer
+    if _tracer is _UNSET:
+        if os.environ.get('TOKOFFSET_TRACING', '1').lower() in ('0', 'false', 'off'):
+            _tracer = None
+        else:
+            try:
+                from opentelemetry import trace
+                _tracer = trace.get_tracer('tokoffset')
+            except ImportError:
+                _tracer = None
+    return _tracer
+
+
+def tracing_enabled() -> bool:
+    return _recorder is not None or get_tracer() is not None
+
+
+def start_recording() -> List[Dict]:
+    """Also record spans as Chrome trace events into the returned list."""
+    global _recorder
+    _recorder = []
+    return _recorder
+
+
+def stop_recording() -> List[Dict]:
+    """Stop recording; returns the recorded events."""
+    global _recorder
+    events, _recorder = _recorder, None
+    return events or []
+
+
+def encoder_name(tokenizer) -> str:
+    return str(getattr(tokenizer, 'name_or_path', None) or type(tokenizer).__name__)
+
+
+class _Span:
+    """Wraps an OpenTelemetry span (or a recorded event's args) so attribute names get the tokoffset prefix."""
+
+    def __init__(self, span, args: Optional[Dict] = None):
+        self._span = span
+        self._args = args
+
+    def set_attribute(self, key: str, value):
+        if value is None:
+            return
+        if self._span is not None:
+            self._span.set_attribute(f'tokoffset.{key}', value)
+        if self._args is not None:
+            self._args[key] = value
+
+
+@contextmanager
+def span(name: str, **attributes) -> Iterator[object]:
+    """Run a block inside a 'tokoffset.<name>' span.
+
+    Yields an object with set_attribute(key, value) for results known only
+    at the end of the block; None values are skipped.
+    """
+    tracer = get_tracer()
+    recorder = _recorder
+    if tracer is None and recorder is None:
+        yield _NOOP_SPAN
+        return
+    args = {} if recorder is not None else None
+    start = time.perf_counter()
+    with tracer.start_as_current_span(f'tokoffset.{name}') if tracer is not None else nullcontext() as otel_span:
+        wrapped = _Span(otel_span, args)
+        for key, value in attributes.items():
+            wrapped.set_attribute(key, value)
+        try:
+            yield wrapped
+        finally:
+            if recorder is not None:
+                recorder.append({
+                    'name': f'tokoffset.{name}', 'ph': 'X', 'pid': os.getpid(), 'tid': threading.get_ident(),
+                    'ts': start * 1e6, 'dur': (time.perf_counter() - start) * 1e6, 'args': args,
+                })
+
+
+def traced(name: str, before: Optional[Callable[[Dict], Dict]] = None,
+           after: Optional[Callable[[Any, Dict], Dict]] = None, **attributes):
+    """Decorator running a function inside a 'tokoffset.<name>' span.
+
+    before(arguments) returns attributes known from the call and
+    after(result, arguments) those known from its result; arguments maps
+    parameter names to values (defaults included). With tracing disabled
+    the function is called directly.
+    """
+    def decorate(func):
+        signature = inspect.signature(func)
+
+        @functools.wraps(func)
+        def wrapper(*args, **kwargs):
+            if not tracing_enabled():
+                return func(*args, **kwargs)
+            bound = signature.bind(*args, **kwargs)
+            bound.apply_defaults()
+            arguments = bound.arguments
+            with span(name, **attributes, **(before(arguments) if before else {})) as s:
+                result = func(*args, **kwargs)
+                for key, value in (after(result, arguments) if after else {}).items():
+                    s.set_attribute(key, value)
+            return result
+        return wrapper
+    return decorate
@@ -0,0 +1,220 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Repository Watcher - Keep token counts and a chunk manifest in sync with edits
+
+RepositoryWatcher holds a TextBuffer per text file. When a file changes on
+disk, the changed byte region (common prefix/suffix of old and new content)
+is applied as one edit, so only the tokens around it are retokenized.
+With a manifest path, the file is also re-chunked and merged into the
+manifest (chunk_diff), which is rewritten atomically.
+
+Each refresh returns events:
+  {'event': 'added' | 'modified' | 'removed', 'path', 'tokens', 'delta',
+   'retokenized', 'chunks': {'unchanged', 'modified', 'added', 'removed'}}
+
+watch() uses the 'watchdog' package to wake up on file system events when
+it is installed, and polls modification times otherwise.
+"""
+
+import threading
+import time
+from pathlib import Path
+from typing import Callable, Dict, List, Optional, Tuple, Union
+
+from chunk_diff import apply_file_diffs, diff_file
+from chunker import DEFAULT_MAX_TOKENS, chunk_file
+from encoder_registry import fingerprint_of
+from manifest import build_manifest, write_manifest
+from repo_walker import walk_repository
+from source_text import read_source
+from textbuf import TextBuffer
+from token_spans import encode_source
+
+DEFAULT_INTERVAL = 1.0
+
+
+def _is_boundary(data: bytes, pos: int) -> bool:
+    return pos >= len(data) or data[pos] & 0xC0 != 0x80
+
+
+def changed_region(old: bytes, new: bytes) -> Tuple[int, int, int]:
+    """(start, old_end, new_end): the smallest edit turning old into new.
+
+    Offsets are moved outwards to UTF-8 character boundaries.
+    """
+    limit = min(len(old), len(new))
+    start = 0
+    while start < limit and old[start] == new[start]:
+        start += 1
+    while start > 0 and not (_is_boundary(old, start) and _is_boundary(new, start)):
+        start -= 1
+    suffix = 0
+    while suffix < limit - start and old[len(old) - 1 - suffix] == new[len(new) - 1 - suffix]:
+        suffix += 1
+    # The suffixes are equal, so a boundary in old is one in new
+    while suffix > 0 and not _is_boundary(old, len(old) - suffix):
+        suffix -= 1
+    return start, len(old) - suffix, len(new) - suffix
+
+
+def snapshot(root: Path, exclude: Tuple[Path, ...] = (), ignore_patterns=None) -> Dict[str, Tuple[int, int]]:
+    """rel path -> (mtime_ns, size) for the text files under root."""
+    base = root if root.is_dir() else root.parent
+    state = {}
+    for path in walk_repository(root, ignore_patterns=ignore_patterns):
+        if path.resolve() in exclude:
+            continue
+        try:
+            stat = path.stat()
+        except OSError:
+            continue
+        state[path.relative_to(base).as_posix()] = (stat.st_mtime_ns, stat.st_size)
+    return state
+
+
+class RepositoryWatcher:
+    """Incrementally maintained token counts (and chunk manifest) for a tree."""
+
+    def __init__(self, tokenizer, root: Union[str, Path], model: str = '',
+                 max_tokens: int = DEFAULT_MAX_TOKENS, encoding: str = 'auto',
+                 manifest_path: Union[str, Path, None] = None, ignore_patterns=None):
+        self.tokenizer = tokenizer
+        self.root = Path(root)
+        self.base = self.root if self.root.is_dir() else self.root.parent
+        self.model = model
+        self.max_tokens = max_tokens
+        self.encoding = encoding
+        self.manifest_path = Path(manifest_path) if manifest_path else None
+        self.ignore_patterns = ignore_patterns
+        self.manifest: Optional[Dict] = None
+        self.buffers: Dict[str, TextBuffer] = {}
+        self._state: Dict[str, Tuple[int, int]] = {}
+        self._exclude: Tuple[Path, ...] = ()
+        if self.manifest_path is not None:
+            resolved = self.manifest_path.resolve()
+            self._exclude = (resolved, resolved.with_name(resolved.name + '.tmp'))
+
+    @property
+    def total_tokens(self) -> int:
+        return sum(buffer.token_count() for buffer in self.buffers.values())
+
+    def _read(self, rel: str) -> str:
+        text, _ = read_source(self.base / rel, encoding=self.encoding)
+        return text
+
+    def start(self) -> Dict:
+        """Tokenize every file (and write the initial manifest); returns a summary."""
+        self._state = snapshot(self.root, self._exclude, self.ignore_patterns)
+        chunks = []
+        for rel in sorted(self._state):
+            try:
+                self.buffers[rel] = TextBuffer(self.tokenizer, self._read(rel))
+                if self.manifest_path is not None:
+                    chunks.extend(chunk_file(self.tokenizer, self.base / rel, self.base,
+                                             self.max_tokens, encoding=self.encoding))
+            except (OSError, UnicodeDecodeError):
+                continue
+        if self.manifest_path is not None:
+            self.manifest = build_manifest(chunks, self.model, fingerprint_of(self.tokenizer),
+                                           self.max_tokens, self.encoding)
+            write_manifest(self.manifest, self.manifest_path)
+        return {'event': 'initial', 'files': len(self.buffers), 'tokens': self.total_tokens,
+                'chunks': len(chunks) if self.manifest_path is not None else None}
+
+    def _update(self, rel: str, present: bool, diffs: List[Dict]) -> Optional[Dict]:
+        old_buffer = self.buffers.get(rel)
+        old_tokens = old_buffer.token_count() if old_buffer is not None else 0
+        text = None
+        if present:
+            try:
+                text = self._read(rel)
+            except FileNotFoundError:
+                pass
+            except (OSError, UnicodeDecodeError):
+                return None
+
+        if text is None:
+            self.buffers.pop(rel, None)
+            event = {'event': 'removed', 'path': rel, 'tokens': 0, 'delta': -old_tokens, 'retokenized': 0}
+        elif old_buffer is None:
+            buffer = self.buffers[rel] = TextBuffer(self.tokenizer, text)
+            event = {'event': 'added', 'path': rel, 'tokens': buffer.token_count(),
+                     'delta': buffer.token_count(), 'retokenized': buffer.token_count()}
+        else:
+            new_bytes = encode_source(text)
+            start, old_end, new_end = changed_region(old_buffer.get_bytes(), new_bytes)
+            if start == old_end == new_end:
+                return None
+            change = old_buffer.replace(start, old_end,
+                                        new_bytes[start:new_end].decode('utf-8', errors='surrogateescape'))
+            event = {'event': 'modified', 'path': rel, 'tokens': old_buffer.token_count(),
+                     'delta': old_buffer.token_count() - old_tokens,
+                     'retokenized': change['new_end_token'] - change['start_token']}
+
+        if self.manifest is not None:
+            diff = diff_file(self.tokenizer, self.manifest, rel, self.base, encoding=self.encoding)
+            diffs.append(diff)
+            event['chunks'] = {key: len(diff[key]) for key in ('unchanged', 'modified', 'added', 'removed')}
+        return event
+
+    def refresh(self) -> List[Dict]:
+        """Pick up files changed since the last refresh; returns their events."""
+        state = snapshot(self.root, self._exclude, self.ignore_patterns)
+        changed = sorted(rel for rel in set(state) | set(self._state) if state.get(rel) != self._state.get(rel))
+        self._state = state
+        diffs: List[Dict] = []
+        events = [event for event in (self._update(rel, rel in state, diffs) for rel in changed) if event is not None]
+        if diffs:
+            self.manifest = apply_file_diffs(self.manifest, diffs)
+            write_manifest(self.manifest, self.manifest_path)
+        return events
+
+
+def _watchdog_trigger(root: Path, trigger: threading.Event):
+    """Start a watchdog observer setting trigger on any change; None without watchdog."""
+    try:
+        from watchdog.events import FileSystemEventHandler
+        from watchdog.observers import Observer
+    except ImportError:
+        return None
+
+    class _Handler(FileSystemEventHandler):
+        def on_any_event(self, event):
+            trigger.set()
+
+    observer = Observer()
+    observer.schedule(_Handler(), str(root), recursive=True)
+    observer.start()
+    return observer
+
+
+def watch(watcher: RepositoryWatcher, on_events: Callable[[List[Dict]], None],
+          interval: float = DEFAULT_INTERVAL, stop: Optional[threading.Event] = None) -> str:
+    """Refresh watcher on every change until stop is set; returns the backend used.
+
+    With watchdog, refreshes run once events have settled for `interval`
+    seconds; otherwise the tree is polled every `interval` seconds.
+    """
+    stop = stop or threading.Event()
+    trigger = threading.Event()
+    observer = _watchdog_trigger(watcher.base, trigger)
+    try:
+        while not stop.is_set():
+            if observer is None:
+                stop.wait(interval)
+            else:
+                if not trigger.wait(0.2):
+                    continue
+                # Debounce: editors write files in several steps
+                while trigger.is_set() and not stop.is_set():
+                    trigger.clear()
+                    time.sleep(interval)
+            events = watcher.refresh()
+            if events:
+                on_events(events)
+    finally:
+        if observer is not None:
+            observer.stop()
+            observer.join()
+    return 'watchdog' if observer is not None else 'polling'
@@ -0,0 +1,189 @@
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+"""
+Whitespace Analytics - Tokens spent on indentation, blank lines and trailing whitespace
+
+Whitespace regions of a text (byte spans):
+- indent     leading spaces/tabs of a line with content
+- blank      a line holding only whitespace, its line break included
+- trailing   spaces/tabs between the content of a line and its line break
+
+A token is charged to a category in proportion to its bytes inside that
+category's regions, so a token '\\n    ' ending one line and indenting the
+next counts 4/5 as indentation. Summed per file this is how many tokens
+the formatting costs.
+
+minimize_whitespace rewrites a text with less of it (indentation as one
+tab per level or at a smaller width, runs of blank lines collapsed,
+trailing whitespace stripped) and returns a byte map back to the original
+(offset_map.apply_edits), so results on the minimized text still point
+into the file. estimate_savings tokenizes both to show what reformatting
+before prompting would save.
+"""
+
+import re
+from collections import Counter
+from typing import Dict, List, Optional, Tuple
+
+from offset_map import apply_edits, compose_byte_maps
+from token_spans import build_char_to_byte, compute_token_spans
+
+CATEGORIES = ('indent', 'blank', 'trailing')
+INDENT_MODES = ('tab', 'keep') + tuple(str(n) for n in range(1, 9))
+
+LINE_PATTERN = re.compile(r'([ \t]*)(.*?)([ \t]*)(\r?\n|$)')
+
+
+def _lines(text: str):
+    """(line start, indent end, content end, line end, break end) char offsets per line."""
+    for match in LINE_PATTERN.finditer(text):
+        if match.start() == len(text) and match.start() > 0 and not match.group(0):
+            break
+        yield match.start(), match.end(1), match.end(2), match.start(4), match.end(4)
+        if match.end() == len(text):
+            break
+
+
+def whitespace_regions(text: str) -> List[Tuple[int, int, str]]:
+    """(start_byte, end_byte, category) whitespace regions in text order."""
+    char_to_byte = build_char_to_byte(text)
+    regions = []
+    for start, indent_end, content_end, line_end, break_end in _lines(text):
+        if content_end == indent_end:
+            if break_end > start:
+                regions.append((start, break_end, 'blank'))
+            continue
+        if indent_end > start:
+            regions.append((start, indent_end, 'indent'))
+        if line_end > content_end:
+            regions.append((content_end, line_end, 'trailing'))
+    return [(char_to_byte[s], char_to_byte[e], category) for s, e, category in regions]
+
+
+def whitespace_stats(tokenizer, text: str, byte_map: Optional[List[int]] = None) -> Dict:
+    """Tokens and bytes per whitespace category, with the region byte spans (file offsets with byte_map)."""
+    spans, _ = compute_token_spans(tokenizer, text)
+    regions = whitespace_regions(text)
+    categories = {c: {'tokens': 0.0, 'bytes': 0, 'spans': []} for c in CATEGORIES}
+    for start, end, category in regions:
+        categories[category]['bytes'] += end - start
+        categories[category]['spans'].append([byte_map[start], byte_map[end]] if byte_map is not None else [start, end])
+
+    # Both lists are sorted and regions do not overlap: sweep them together
+    r = 0
+    whole = 0
+    for span in spans:
+        start, end = span['start_byte'], span['end_byte']
+        if end <= start:
+            continue
+        while r < len(regions) and regions[r][1] <= start:
+            r += 1
+        inside = 0
+        k = r
+        while k < len(regions) and regions[k][0] < end:
+            overlap = min(end, regions[k][1]) - max(start, regions[k][0])
+            if overlap > 0:
+                categories[regions[k][2]]['tokens'] += overlap / (end - start)
+                inside += overlap
+            k += 1
+        whole += inside == end - start
+    total = sum(categories[c]['tokens'] for c in CATEGORIES)
+    return {
+        'tokens': len(spans),
+        'whitespace_tokens': total,
+        'whitespace_only_tokens': whole,
+        'share': total / len(spans) if spans else 0.0,
+        'categories': categories,
+    }
+
+
+def detect_indent_width(text: str) -> int:
+    """Indentation step in spaces: the widest of 8/4/3/2 dividing 90% of space indents (4 without any)."""
+    widths = Counter()
+    for start, indent_end, content_end, _, _ in _lines(text):
+        indent = text[start:indent_end]
+        if content_end > indent_end and indent and '\t' not in indent:
+            widths[len(indent)] += 1
+    if not widths:
+        return 4
+    total = sum(widths.values())
+    for step in (8, 4, 3, 2):
+        # Odd widths from aligned continuation lines should not force a step of 1
+        if sum(n for width, n in widths.items() if width % step == 0) >= 0.9 * total:
+            return step
+    return min(widths)
+
+
+def minimize_whitespace(text: str, indent: str = 'tab', max_blank_lines: int = 1,
+                        strip_trailing: bool = True, tab_size: int = 4) -> Tuple[str, List[int]]:
+    """Rewrite text with less whitespace; returns (new_text, byte_map to text).
+
+    indent: 'tab' (one tab per level), 'keep', or a width in spaces per level.
+    Levels come from detect_indent_width; tabs count tab_size columns.
+    """
+    if indent not in INDENT_MODES:
+        raise ValueError(f"Unknown indent mode: {indent}")
+    char_to_byte = build_char_to_byte(text)
+    step = detect_indent_width(text)
+    edits = []
+    blank_run = 0
+    for start, indent_end, content_end, line_end, break_end in _lines(text):
+        if content_end == indent_end:
+            blank_run += 1
+            if blank_run > max_blank_lines and break_end > start:
+                edits.append((start, break_end, ''))
+            elif strip_trailing and line_end > start:
+                edits.append((start, line_end, ''))
+            continue
+        blank_run = 0
+        if indent != 'keep' and indent_end > start:
+            columns = len(text[start:indent_end].expandtabs(tab_size))
+            level, rest = divmod(columns, step)
+            new_indent = ('\t' * level if indent == 'tab' else ' ' * (int(indent) * level)) + ' ' * rest
+            if new_indent != text[start:indent_end]:
+                edits.append((start, indent_end, new_indent))
+        if strip_trailing and line_end > content_end:
+            edits.append((content_end, line_end, ''))
+    edits = [(char_to_byte[s], char_to_byte[e], new) for s, e, new in edits]
+    if not edits:
+        return text, list(range(char_to_byte[-1] + 1))
+    return apply_edits(text, edits)
+
+
+def estimate_savings(tokenizer, text: str, byte_map: Optional[List[int]] = None, **options) -> Dict:
+    """Token counts before and after minimize_whitespace, with the minimized text and its byte map to the file."""
+    minimized, minimize_map = minimize_whitespace(text, **options)
+    before = len(compute_token_spans(tokenizer, text)[0])
+    after = len(compute_token_spans(tokenizer, minimized)[0])
+    return {
+        'tokens_before': before,
+        'tokens_after': after,
+        'saved': before - after,
+        'text': minimized,
+        'byte_map': compose_byte_maps(minimize_map, byte_map),
+    }
+
+
+def print_whitespace_report(results: List[Dict]):
+    """One row per file, then totals; results carry 'file', 'stats' and optionally 'savings'."""
+    print(f"\n{'='*60}")
+    print("Whitespace Tokens")
+    print(f"{'='*60}")
+    print(f"{'File':<32} {'Tokens':>7} {'Indent':>7} {'Blank':>6} {'Trail':>6} {'Share':>6}"
+          + (f" {'Saved':>6}" if any('savings' in r for r in results) else ''))
+    totals = Counter()
+    for result in results:
+        stats = result['stats']
+        cats = stats['categories']
+        row = (f"{result['file'][-32:]:<32} {stats['tokens']:>7} {cats['indent']['tokens']:>7.1f} "
+               f"{cats['blank']['tokens']:>6.1f} {cats['trailing']['tokens']:>6.1f} {stats['share']:>6.1%}")
+        if 'savings' in result:
+            row += f" {result['savings']['saved']:>6}"
+            totals['saved'] += result['savings']['saved']
+        print(row)
+        totals['tokens'] += stats['tokens']
+        totals['whitespace'] += stats['whitespace_tokens']
+    if totals['tokens']:
+        print(f"Total: {totals['whitespace']:.1f} of {totals['tokens']} tokens on whitespace "
+              f"({totals['whitespace'] / totals['tokens']:.1%})"
+              + (f", {totals['saved']} saved by minimizing" if 'saved' in totals else ''))